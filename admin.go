@@ -0,0 +1,109 @@
+package discover
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/omecodes/common/errors"
+	"github.com/omecodes/common/utils/log"
+	"github.com/omecodes/libome"
+	"github.com/omecodes/zebou"
+)
+
+// msgAdminDeRegister deregisters a service whoever registered it. Its value holds the ids of the nodes to deregister
+// joined with '|', or nothing to deregister the whole service. Only peers whose certificate identity is one of the
+// server admin identities may send it
+const msgAdminDeRegister = "AdminDeRegister"
+
+// errorForbidden is the code of the protocol error reported to peers that are not allowed to send a message
+const errorForbidden = "forbidden"
+
+// rejectionAdmin is the reason counted by MetricServerRejections for admin messages of peers that are not admins
+const rejectionAdmin = "admin"
+
+// isManagedOwner reports whether owner registers services on behalf of the server configuration: the server itself,
+// the static services directory and the import sources. Their services are only changed through the configuration
+func (s *Server) isManagedOwner(owner string) bool {
+	return owner == s.name || owner == StaticServicesPeer || strings.HasPrefix(owner, SourcePeerPrefix)
+}
+
+// isAdmin reports whether the peer of ctx authenticated with one of the admin identities
+func (s *Server) isAdmin(ctx context.Context) bool {
+	identity := s.peerIdentity(zebou.Peer(ctx))
+	return identity != "" && containsString(s.adminIdentities, identity)
+}
+
+// handleAdminDeRegister deregisters the service, or the nodes, of msg from all the peers that registered it
+func (s *Server) handleAdminDeRegister(ctx context.Context, msg *zebou.ZeMsg) {
+	peer := zebou.Peer(ctx)
+	if !s.isAdmin(ctx) {
+		s.rejectMutation(ctx, msg, errorForbidden, rejectionAdmin, fmt.Errorf("%w: peer is not an admin", errors.Forbidden))
+		return
+	}
+
+	var nodeIDs []string
+	if len(msg.Encoded) > 0 {
+		nodeIDs = strings.Split(string(msg.Encoded), "|")
+	}
+
+	var removedOwner string
+	var removed *ome.ServiceInfo
+	for _, owner := range s.index.peersOf(msg.Id) {
+		if s.isManagedOwner(owner) {
+			continue
+		}
+		removedOwner = owner
+
+		if len(nodeIDs) > 0 {
+			s.deregisterNodes(ctx, peer, owner, msg.Id, nodeIDs)
+			continue
+		}
+
+		before := s.index.lookup(owner, msg.Id)
+		removed = before
+		done := s.storeOperation(ctx, "delete")
+		err := s.store.Delete(owner, msg.Id)
+		done(err)
+		if err != nil {
+			log.Error("registry server • could not delete service info", log.Err(err), log.Field("service", msg.Id))
+			return
+		}
+		s.audit(peer, AuditDeregister, msg.Id, before, nil)
+	}
+
+	if removedOwner == "" {
+		return
+	}
+
+	log.Info("registry server • admin deregistration", log.Field("peer", peer.ID), log.Field("identity", s.peerIdentity(peer)),
+		log.Field("service", msg.Id), log.Field("nodes", nodeIDs))
+
+	if len(nodeIDs) > 0 {
+		s.announceNodesRemoval(ctx, &zebou.ZeMsg{
+			Type:    ome.RegistryEventType_DeRegisterNode.String(),
+			Id:      msg.Id,
+			Encoded: msg.Encoded,
+		})
+		return
+	}
+	s.announceRemoval(ctx, removedOwner, &zebou.ZeMsg{
+		Type: ome.RegistryEventType_DeRegister.String(),
+		Id:   msg.Id,
+	}, removed)
+}
+
+// AdminDeregisterService deregisters the service id, or its nodes, whoever registered it. The client must be
+// authenticated with one of the server admin identities. Services registered by the server configuration are kept
+func (m *MsgClient) AdminDeregisterService(id string, nodes ...string) error {
+	if !m.ServerSupports(CapabilityAdmin) {
+		return fmt.Errorf("%w: server does not support admin messages", errors.NotSupported)
+	}
+
+	msg := &zebou.ZeMsg{
+		Type:    msgAdminDeRegister,
+		Id:      id,
+		Encoded: []byte(strings.Join(nodes, "|")),
+	}
+	return m.getMessenger().SendMsg(msg)
+}
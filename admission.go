@@ -0,0 +1,287 @@
+package discover
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/omecodes/common/errors"
+	"github.com/omecodes/common/utils/log"
+	"github.com/omecodes/libome"
+	"github.com/omecodes/zebou"
+	"google.golang.org/protobuf/proto"
+)
+
+// errorAdmissionDenied is the code of the protocol error reported to peers whose registration is denied by a hook
+const errorAdmissionDenied = "admission_denied"
+
+// rejectionAdmission is the reason counted by MetricServerRejections for registrations denied by a hook
+const rejectionAdmission = "admission"
+
+// defaultAdmissionTimeout is how long a hook may take when its timeout is not set
+const defaultAdmissionTimeout = time.Second * 5
+
+// AdmissionRequest is a registration submitted to the admission hooks
+type AdmissionRequest struct {
+	// Operation is the registry event type of the registration: Register or Update
+	Operation string           `json:"operation"`
+	Peer      string           `json:"peer"`
+	Address   string           `json:"address,omitempty"`
+	Identity  string           `json:"identity,omitempty"`
+	Service   *ome.ServiceInfo `json:"service"`
+}
+
+// MutatingHook returns the service to register in place of the one of a registration, e.g. to add meta or rewrite
+// addresses. Returning the request service unchanged admits it as is
+type MutatingHook interface {
+	Mutate(ctx context.Context, req *AdmissionRequest) (*ome.ServiceInfo, error)
+}
+
+// MutatingHookFunc is a function that implements MutatingHook
+type MutatingHookFunc func(ctx context.Context, req *AdmissionRequest) (*ome.ServiceInfo, error)
+
+func (f MutatingHookFunc) Mutate(ctx context.Context, req *AdmissionRequest) (*ome.ServiceInfo, error) {
+	return f(ctx, req)
+}
+
+// ValidatingHook admits or denies a registration once mutated. Denials are returned with Deny
+type ValidatingHook interface {
+	Admit(ctx context.Context, req *AdmissionRequest) error
+}
+
+// ValidatingHookFunc is a function that implements ValidatingHook
+type ValidatingHookFunc func(ctx context.Context, req *AdmissionRequest) error
+
+func (f ValidatingHookFunc) Admit(ctx context.Context, req *AdmissionRequest) error {
+	return f(ctx, req)
+}
+
+// AdmissionDenial is the error hooks return to deny a registration. Other errors are hook failures, handled
+// according to the hook failure policy
+type AdmissionDenial struct {
+	Reason string
+}
+
+func (d *AdmissionDenial) Error() string {
+	return "admission denied: " + d.Reason
+}
+
+// Deny returns the error that denies a registration for reason
+func Deny(reason string) error {
+	return &AdmissionDenial{Reason: reason}
+}
+
+// FailurePolicy tells what happens to a registration when a hook fails or times out
+type FailurePolicy string
+
+const (
+	// FailClosed denies the registration
+	FailClosed FailurePolicy = "fail"
+	// FailOpen admits the registration as if the hook did not exist
+	FailOpen FailurePolicy = "ignore"
+)
+
+// AdmissionHook is a hook of the admission chain. Exactly one of Mutating and Validating is expected. Mutating hooks
+// run first, in order, then the service is validated and the validating hooks run, in order
+type AdmissionHook struct {
+	// Name identifies the hook in logs and metrics
+	Name       string
+	Mutating   MutatingHook
+	Validating ValidatingHook
+	// FailurePolicy defaults to FailClosed
+	FailurePolicy FailurePolicy
+	// Timeout defaults to 5 seconds
+	Timeout time.Duration
+}
+
+func (h *AdmissionHook) timeout() time.Duration {
+	if h.Timeout <= 0 {
+		return defaultAdmissionTimeout
+	}
+	return h.Timeout
+}
+
+// failed applies the hook failure policy to err. It returns the error that denies the registration, if any
+func (h *AdmissionHook) failed(metrics Metrics, err error) error {
+	if denial, ok := err.(*AdmissionDenial); ok {
+		return denial
+	}
+
+	policy := h.FailurePolicy
+	if policy == "" {
+		policy = FailClosed
+	}
+	metrics.Add(MetricServerAdmissionFailures, 1, map[string]string{"hook": h.Name, "policy": string(policy)})
+	log.Error("registry server • admission hook failed", log.Err(err), log.Field("hook", h.Name), log.Field("policy", policy))
+
+	if policy == FailOpen {
+		return nil
+	}
+	return fmt.Errorf("%w: admission hook %s failed: %s", errors.Unavailable, h.Name, err)
+}
+
+// callHook calls hook until it returns or timeout expires, whether hook honours its context or not
+func callHook(ctx context.Context, timeout time.Duration, hook func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- hook(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// admit runs the mutating hooks on the registration msg of info by the peer of ctx, validates their result and runs
+// the validating hooks. It returns the service to register, or reports the rejection to the peer and returns false
+func (s *Server) admit(ctx context.Context, msg *zebou.ZeMsg, operation string, info *ome.ServiceInfo) (*ome.ServiceInfo, bool) {
+	peer := zebou.Peer(ctx)
+	req := &AdmissionRequest{
+		Operation: operation,
+		Peer:      peer.ID,
+		Address:   peer.Address,
+		Identity:  s.peerIdentity(peer),
+		Service:   info,
+	}
+
+	for i := range s.admissionHooks {
+		hook := &s.admissionHooks[i]
+		if hook.Mutating == nil {
+			continue
+		}
+
+		hookReq := &AdmissionRequest{
+			Operation: req.Operation,
+			Peer:      req.Peer,
+			Address:   req.Address,
+			Identity:  req.Identity,
+			// hooks may change the service they get
+			Service: proto.Clone(req.Service).(*ome.ServiceInfo),
+		}
+		var mutated *ome.ServiceInfo
+		err := callHook(ctx, hook.timeout(), func(ctx context.Context) (err error) {
+			mutated, err = hook.Mutating.Mutate(ctx, hookReq)
+			return
+		})
+
+		if err == nil && mutated == nil {
+			err = fmt.Errorf("%w: no service returned", errors.Internal)
+		}
+		if err != nil {
+			if err = hook.failed(s.metrics, err); err != nil {
+				s.rejectMutation(ctx, msg, errorAdmissionDenied, rejectionAdmission, err)
+				return nil, false
+			}
+			continue
+		}
+		req.Service = mutated
+	}
+
+	if err := validateService(req.Service, s.validators); err != nil {
+		s.rejectMutation(ctx, msg, errorInvalidService, rejectionInvalid, err)
+		return nil, false
+	}
+
+	for i := range s.admissionHooks {
+		hook := &s.admissionHooks[i]
+		if hook.Validating == nil {
+			continue
+		}
+
+		err := callHook(ctx, hook.timeout(), func(ctx context.Context) error {
+			return hook.Validating.Admit(ctx, req)
+		})
+
+		if err != nil {
+			if err = hook.failed(s.metrics, err); err != nil {
+				s.rejectMutation(ctx, msg, errorAdmissionDenied, rejectionAdmission, err)
+				return nil, false
+			}
+		}
+	}
+	return req.Service, true
+}
+
+// AdmissionResponse is the response of an admission webhook
+type AdmissionResponse struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+	// Service is the mutated service. The request service is kept if it is nil
+	Service *ome.ServiceInfo `json:"service,omitempty"`
+}
+
+// AdmissionWebhook is an out-of-process hook. The admission request is POSTed as JSON to URL, which responds with
+// a JSON AdmissionResponse. It can be used as a mutating or as a validating hook
+type AdmissionWebhook struct {
+	URL string
+	// Client defaults to http.DefaultClient
+	Client *http.Client
+}
+
+func (w *AdmissionWebhook) call(ctx context.Context, req *AdmissionRequest) (*AdmissionResponse, error) {
+	encoded, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(encoded))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	rsp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rsp.Body.Close()
+	}()
+
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: webhook responded %s", errors.Unavailable, rsp.Status)
+	}
+
+	response := new(AdmissionResponse)
+	if err := json.Unmarshal(body, response); err != nil {
+		return nil, err
+	}
+	if !response.Allowed {
+		return nil, Deny(response.Reason)
+	}
+	return response, nil
+}
+
+func (w *AdmissionWebhook) Mutate(ctx context.Context, req *AdmissionRequest) (*ome.ServiceInfo, error) {
+	response, err := w.call(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if response.Service == nil {
+		return req.Service, nil
+	}
+	return response.Service, nil
+}
+
+func (w *AdmissionWebhook) Admit(ctx context.Context, req *AdmissionRequest) error {
+	_, err := w.call(ctx, req)
+	return err
+}
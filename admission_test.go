@@ -0,0 +1,298 @@
+package discover
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/omecodes/common/errors"
+	"github.com/omecodes/libome"
+)
+
+// admitTestRegistration registers info from a client of a server running hooks. It returns the stored service, nil
+// if the registration was rejected, and the server metrics
+func admitTestRegistration(t *testing.T, hooks []AdmissionHook, info *ome.ServiceInfo) (*ome.ServiceInfo, *PrometheusMetrics) {
+	metrics := NewPrometheusMetrics()
+	s := startTestServer(t, &ServerConfig{Metrics: metrics, AdmissionHooks: hooks})
+	defer s.Stop()
+
+	client := connectTestClient(t, s, nil)
+	defer client.Stop()
+	if err := client.RegisterService(info); err != nil {
+		t.Fatal(err)
+	}
+	waitHandled(t, s, metrics, "Register", 1)
+
+	stored, err := s.GetService(info.Id)
+	if err != nil {
+		return nil, metrics
+	}
+	return stored, metrics
+}
+
+func TestAdmissionFailurePolicy(t *testing.T) {
+	failure := errors.New("hook is down")
+	failingMutation := MutatingHookFunc(func(context.Context, *AdmissionRequest) (*ome.ServiceInfo, error) {
+		return nil, failure
+	})
+	failingValidation := ValidatingHookFunc(func(context.Context, *AdmissionRequest) error {
+		return failure
+	})
+	denyingValidation := ValidatingHookFunc(func(context.Context, *AdmissionRequest) error {
+		return Deny("not allowed")
+	})
+
+	tests := []struct {
+		name     string
+		hook     AdmissionHook
+		admitted bool
+		failures string
+	}{
+		{
+			name:     "failing mutation with default policy",
+			hook:     AdmissionHook{Name: "hook", Mutating: failingMutation},
+			failures: "fail",
+		},
+		{
+			name:     "failing mutation fails open",
+			hook:     AdmissionHook{Name: "hook", Mutating: failingMutation, FailurePolicy: FailOpen},
+			admitted: true,
+			failures: "ignore",
+		},
+		{
+			name: "mutation without service",
+			hook: AdmissionHook{Name: "hook", FailurePolicy: FailClosed, Mutating: MutatingHookFunc(func(context.Context, *AdmissionRequest) (*ome.ServiceInfo, error) {
+				return nil, nil
+			})},
+			failures: "fail",
+		},
+		{
+			name:     "failing validation fails closed",
+			hook:     AdmissionHook{Name: "hook", Validating: failingValidation, FailurePolicy: FailClosed},
+			failures: "fail",
+		},
+		{
+			name:     "failing validation fails open",
+			hook:     AdmissionHook{Name: "hook", Validating: failingValidation, FailurePolicy: FailOpen},
+			admitted: true,
+			failures: "ignore",
+		},
+		{
+			name: "denial fails open",
+			hook: AdmissionHook{Name: "hook", Validating: denyingValidation, FailurePolicy: FailOpen},
+		},
+		{
+			name:     "admission",
+			hook:     AdmissionHook{Name: "hook", Validating: ValidatingHookFunc(func(context.Context, *AdmissionRequest) error { return nil })},
+			admitted: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stored, metrics := admitTestRegistration(t, []AdmissionHook{test.hook}, testService("api", "10.0.0.1:80"))
+			if admitted := stored != nil; admitted != test.admitted {
+				t.Errorf("admitted: %t, expected %t", admitted, test.admitted)
+			}
+
+			rejections := metricValue(metrics, MetricServerRejections, map[string]string{"reason": rejectionAdmission})
+			if expected := map[bool]float64{true: 0, false: 1}[test.admitted]; rejections != expected {
+				t.Errorf("counted %v admission rejections, expected %v", rejections, expected)
+			}
+			for _, policy := range []string{"fail", "ignore"} {
+				failures := metricValue(metrics, MetricServerAdmissionFailures, map[string]string{"hook": "hook", "policy": policy})
+				if expected := map[bool]float64{true: 1, false: 0}[policy == test.failures]; failures != expected {
+					t.Errorf("counted %v %s failures, expected %v", failures, policy, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestAdmissionTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	// the hook ignores its context, the server must not wait for it
+	blocking := ValidatingHookFunc(func(context.Context, *AdmissionRequest) error {
+		<-release
+		return nil
+	})
+
+	for _, policy := range []FailurePolicy{FailClosed, FailOpen} {
+		start := time.Now()
+		stored, metrics := admitTestRegistration(t, []AdmissionHook{
+			{Name: "slow", Validating: blocking, FailurePolicy: policy, Timeout: 50 * time.Millisecond},
+		}, testService("api", "10.0.0.1:80"))
+
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("%s registration took %s", policy, elapsed)
+		}
+		if admitted := stored != nil; admitted != (policy == FailOpen) {
+			t.Errorf("%s admitted: %t", policy, admitted)
+		}
+		if failures := metricValue(metrics, MetricServerAdmissionFailures, map[string]string{"hook": "slow", "policy": string(policy)}); failures != 1 {
+			t.Errorf("counted %v %s failures instead of 1", failures, policy)
+		}
+	}
+}
+
+func TestAdmissionMutationChain(t *testing.T) {
+	addMeta := func(key string, value string) MutatingHookFunc {
+		return func(_ context.Context, req *AdmissionRequest) (*ome.ServiceInfo, error) {
+			if req.Service.Meta == nil {
+				req.Service.Meta = map[string]string{}
+			}
+			req.Service.Meta[key] = value
+			return req.Service, nil
+		}
+	}
+
+	var validated *ome.ServiceInfo
+	var operation string
+	stored, _ := admitTestRegistration(t, []AdmissionHook{
+		{Name: "validate", Validating: ValidatingHookFunc(func(_ context.Context, req *AdmissionRequest) error {
+			validated = req.Service
+			operation = req.Operation
+			if req.Peer == "" {
+				return Deny("no peer")
+			}
+			return nil
+		})},
+		{Name: "zone", Mutating: addMeta("zone", "eu")},
+		{Name: "failing", FailurePolicy: FailOpen, Mutating: MutatingHookFunc(func(_ context.Context, req *AdmissionRequest) (*ome.ServiceInfo, error) {
+			// changes to the request service of a failed hook are dropped
+			req.Service.Meta["zone"] = "us"
+			return nil, errors.New("failed")
+		})},
+		{Name: "tier", Mutating: MutatingHookFunc(func(_ context.Context, req *AdmissionRequest) (*ome.ServiceInfo, error) {
+			if req.Service.Meta["zone"] != "eu" {
+				return nil, Deny("mutations are not chained")
+			}
+			return addMeta("tier", "gold")(context.Background(), req)
+		})},
+	}, testService("api", "10.0.0.1:80"))
+
+	if stored == nil {
+		t.Fatal("the registration was rejected")
+	}
+	if stored.Meta["zone"] != "eu" || stored.Meta["tier"] != "gold" {
+		t.Errorf("stored meta %v", stored.Meta)
+	}
+	if validated == nil || validated.Meta["tier"] != "gold" {
+		t.Errorf("validating hook got %v instead of the mutated service", validated)
+	}
+	if operation != ome.RegistryEventType_Register.String() {
+		t.Errorf("got operation %q", operation)
+	}
+}
+
+func TestAdmissionRejectsInvalidMutation(t *testing.T) {
+	stored, metrics := admitTestRegistration(t, []AdmissionHook{
+		{Name: "break", Mutating: MutatingHookFunc(func(_ context.Context, req *AdmissionRequest) (*ome.ServiceInfo, error) {
+			req.Service.Nodes[0].Address = "not an address"
+			return req.Service, nil
+		})},
+	}, testService("api", "10.0.0.1:80"))
+
+	if stored != nil {
+		t.Error("stored an invalid mutated service")
+	}
+	if rejections := metricValue(metrics, MetricServerRejections, map[string]string{"reason": rejectionInvalid}); rejections != 1 {
+		t.Errorf("counted %v invalid rejections instead of 1", rejections)
+	}
+}
+
+func TestAdmissionWebhook(t *testing.T) {
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := new(AdmissionRequest)
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil || r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/mutate":
+			req.Service.Label = "mutated"
+			_ = json.NewEncoder(w).Encode(&AdmissionResponse{Allowed: true, Service: req.Service})
+		case "/keep":
+			_ = json.NewEncoder(w).Encode(&AdmissionResponse{Allowed: true})
+		case "/deny":
+			_ = json.NewEncoder(w).Encode(&AdmissionResponse{Allowed: req.Service.Label != "mutated", Reason: "mutated services are denied"})
+		case "/malformed":
+			_, _ = w.Write([]byte("{"))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer endpoint.Close()
+
+	webhook := func(path string) *AdmissionWebhook {
+		return &AdmissionWebhook{URL: endpoint.URL + path}
+	}
+
+	tests := []struct {
+		name     string
+		hooks    []AdmissionHook
+		label    string
+		admitted bool
+		failures float64
+	}{
+		{
+			name:     "mutating webhook",
+			hooks:    []AdmissionHook{{Name: "webhook", Mutating: webhook("/mutate")}},
+			label:    "mutated",
+			admitted: true,
+		},
+		{
+			name:     "mutating webhook without service",
+			hooks:    []AdmissionHook{{Name: "webhook", Mutating: webhook("/keep")}},
+			admitted: true,
+		},
+		{
+			name:     "validating webhook admits",
+			hooks:    []AdmissionHook{{Name: "webhook", Validating: webhook("/deny")}},
+			admitted: true,
+		},
+		{
+			name: "validating webhook denies",
+			hooks: []AdmissionHook{
+				{Name: "mutate", Mutating: webhook("/mutate")},
+				{Name: "webhook", Validating: webhook("/deny")},
+			},
+		},
+		{
+			name:     "webhook error",
+			hooks:    []AdmissionHook{{Name: "webhook", Validating: webhook("/error")}},
+			failures: 1,
+		},
+		{
+			name:     "malformed response",
+			hooks:    []AdmissionHook{{Name: "webhook", Validating: webhook("/malformed"), FailurePolicy: FailOpen}},
+			admitted: true,
+			failures: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stored, metrics := admitTestRegistration(t, test.hooks, testService("api", "10.0.0.1:80"))
+			if admitted := stored != nil; admitted != test.admitted {
+				t.Fatalf("admitted: %t, expected %t", admitted, test.admitted)
+			}
+			if stored != nil && stored.Label != test.label {
+				t.Errorf("stored label %q, expected %q", stored.Label, test.label)
+			}
+
+			var failures float64
+			for _, policy := range []string{"fail", "ignore"} {
+				failures += metricValue(metrics, MetricServerAdmissionFailures, map[string]string{"hook": "webhook", "policy": policy})
+			}
+			if failures != test.failures {
+				t.Errorf("counted %v failures, expected %v", failures, test.failures)
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package discover
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/omecodes/common/utils/log"
+	"github.com/omecodes/libome"
+	"github.com/omecodes/zebou"
+)
+
+// AuditAction is the kind of registry mutation an audit record describes
+type AuditAction string
+
+const (
+	AuditRegister       AuditAction = "register"
+	AuditUpdate         AuditAction = "update"
+	AuditDeregister     AuditAction = "deregister"
+	AuditDeregisterNode AuditAction = "deregister_node"
+	AuditClientQuit     AuditAction = "client_quit"
+	AuditRestore        AuditAction = "restore"
+)
+
+const auditDefaultMaxBackups = 5
+
+// AuditRecord describes a registry mutation
+type AuditRecord struct {
+	Time        time.Time        `json:"time"`
+	Action      AuditAction      `json:"action"`
+	ServiceID   string           `json:"service_id"`
+	PeerID      string           `json:"peer_id,omitempty"`
+	PeerAddress string           `json:"peer_address,omitempty"`
+	Identity    string           `json:"identity,omitempty"`
+	Nodes       []string         `json:"nodes,omitempty"`
+	Before      *ome.ServiceInfo `json:"before,omitempty"`
+	After       *ome.ServiceInfo `json:"after,omitempty"`
+}
+
+// AuditSink is the interface audit records destinations implement
+type AuditSink interface {
+	Write(record *AuditRecord) error
+	Close() error
+}
+
+// AuditFile is an append-only JSON lines audit sink. When the file reaches its maximum size it is renamed
+// with a ".1" suffix, previous backups being shifted up to the configured maximum count
+type AuditFile struct {
+	mutex      sync.Mutex
+	filename   string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// OpenAuditFile opens or creates the audit log at filename. The file is rotated when it exceeds maxSize bytes,
+// never if maxSize is zero. maxBackups defaults to 5
+func OpenAuditFile(filename string, maxSize int64, maxBackups int) (*AuditFile, error) {
+	if maxBackups <= 0 {
+		maxBackups = auditDefaultMaxBackups
+	}
+
+	a := &AuditFile{
+		filename:   filename,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	return a, a.open()
+}
+
+func (a *AuditFile) open() error {
+	file, err := os.OpenFile(a.filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	a.file = file
+	a.size = stat.Size()
+	return nil
+}
+
+func (a *AuditFile) Write(record *AuditRecord) error {
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	encoded = append(encoded, '\n')
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(encoded)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := a.file.Write(encoded)
+	a.size += int64(n)
+	return err
+}
+
+func (a *AuditFile) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+
+	for i := a.maxBackups - 1; i > 0; i-- {
+		err := os.Rename(auditBackupName(a.filename, i), auditBackupName(a.filename, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if err := os.Rename(a.filename, auditBackupName(a.filename, 1)); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+// Sync commits the written records to stable storage
+func (a *AuditFile) Sync() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.file.Sync()
+}
+
+func (a *AuditFile) Close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.file.Close()
+}
+
+func auditBackupName(filename string, index int) string {
+	return fmt.Sprintf("%s.%d", filename, index)
+}
+
+// ReplayAudit calls fn, from the oldest to the most recent, with every record of the audit log at filename
+// and its backups that concerns serviceID. All records are replayed if serviceID is empty. Replay stops when fn returns false
+func ReplayAudit(filename string, serviceID string, fn func(record *AuditRecord) bool) error {
+	var filenames []string
+	for i := 1; ; i++ {
+		name := auditBackupName(filename, i)
+		if _, err := os.Stat(name); err != nil {
+			break
+		}
+		filenames = append([]string{name}, filenames...)
+	}
+	filenames = append(filenames, filename)
+
+	for _, name := range filenames {
+		proceed, err := replayAuditFile(name, serviceID, fn)
+		if err != nil {
+			return err
+		}
+		if !proceed {
+			return nil
+		}
+	}
+	return nil
+}
+
+func replayAuditFile(filename string, serviceID string, fn func(record *AuditRecord) bool) (bool, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, err
+	}
+
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Error("audit • failed to close file", log.Err(err))
+		}
+	}()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		record := new(AuditRecord)
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			return false, err
+		}
+
+		if serviceID != "" && record.ServiceID != serviceID {
+			continue
+		}
+
+		if !fn(record) {
+			return false, nil
+		}
+	}
+	return true, scanner.Err()
+}
+
+// audit writes a record of the mutation made by peer, or by the server itself if peer is nil
+func (s *Server) audit(peer *zebou.PeerInfo, action AuditAction, serviceID string, before, after *ome.ServiceInfo, nodes ...string) {
+	if s.auditSink == nil {
+		return
+	}
+
+	record := &AuditRecord{
+		Time:      time.Now(),
+		Action:    action,
+		ServiceID: serviceID,
+		Nodes:     nodes,
+		Before:    before,
+		After:     after,
+	}
+
+	if peer != nil {
+		record.PeerID = peer.ID
+		record.PeerAddress = peer.Address
+		record.Identity = s.peerIdentity(peer)
+	} else {
+		record.PeerID = s.name
+	}
+
+	if err := s.auditSink.Write(record); err != nil {
+		log.Error("registry server • could not write audit record", log.Err(err), log.Field("service", serviceID))
+	}
+}
+
+// auditEnabled reports whether mutations are audited. It is used to skip reading previous states otherwise
+func (s *Server) auditEnabled() bool {
+	return s.auditSink != nil
+}
+
+// storedService returns the service info stored for peer and id, or nil if there is none
+func (s *Server) storedService(peer string, id string) *ome.ServiceInfo {
+	return s.index.lookup(peer, id)
+}
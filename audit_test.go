@@ -0,0 +1,255 @@
+package discover
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// auditTestRecord returns the record of the registration of id, numbered i
+func auditTestRecord(i int, id string) *AuditRecord {
+	return &AuditRecord{
+		Time:      time.Unix(int64(i), 0).UTC(),
+		Action:    AuditRegister,
+		ServiceID: id,
+		PeerID:    fmt.Sprintf("peer-%d", i),
+	}
+}
+
+// replayedPeers returns the peer ids of the records replayed from filename for serviceID
+func replayedPeers(t *testing.T, filename string, serviceID string) []string {
+	var peers []string
+	err := ReplayAudit(filename, serviceID, func(record *AuditRecord) bool {
+		peers = append(peers, record.PeerID)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return peers
+}
+
+func TestAuditFileRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discover-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "audit.jsonl")
+
+	encoded, err := json.Marshal(auditTestRecord(0, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordSize := int64(len(encoded) + 1)
+
+	// each file holds two records
+	a, err := OpenAuditFile(filename, 2*recordSize, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7; i++ {
+		if err := a.Write(auditTestRecord(i, "a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{filename, filename + ".1", filename + ".2"} {
+		stat, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.Size() > 2*recordSize {
+			t.Errorf("%s is %d bytes long, above the %d bytes maximum", filepath.Base(name), stat.Size(), 2*recordSize)
+		}
+	}
+	if _, err := os.Stat(filename + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 backups, got %v", err)
+	}
+
+	// the oldest records are dropped with the backups beyond the maximum count
+	want := []string{"peer-2", "peer-3", "peer-4", "peer-5", "peer-6"}
+	if peers := replayedPeers(t, filename, ""); !reflect.DeepEqual(peers, want) {
+		t.Errorf("replayed %v, want %v", peers, want)
+	}
+
+	// a reopened file keeps its size so that it is rotated on time
+	a, err = OpenAuditFile(filename, 2*recordSize, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 7; i < 9; i++ {
+		if err := a.Write(auditTestRecord(i, "a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"peer-4", "peer-5", "peer-6", "peer-7", "peer-8"}
+	if peers := replayedPeers(t, filename, ""); !reflect.DeepEqual(peers, want) {
+		t.Errorf("replayed %v after reopening, want %v", peers, want)
+	}
+}
+
+func TestAuditFileWithoutRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discover-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "audit.jsonl")
+
+	a, err := OpenAuditFile(filename, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := a.Write(auditTestRecord(i, "a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filename + ".1"); !os.IsNotExist(err) {
+		t.Errorf("expected no backup, got %v", err)
+	}
+	if peers := replayedPeers(t, filename, ""); len(peers) != 10 {
+		t.Errorf("replayed %d records, want 10", len(peers))
+	}
+}
+
+func TestReplayAuditFilters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discover-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "audit.jsonl")
+
+	encoded, err := json.Marshal(auditTestRecord(0, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the records of a and b are spread over the file and its backups
+	a, err := OpenAuditFile(filename, int64(3*(len(encoded)+1)), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		id := "a"
+		if i%3 == 1 {
+			id = "b"
+		}
+		if err := a.Write(auditTestRecord(i, id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		serviceID string
+		want      []string
+	}{
+		{serviceID: "a", want: []string{"peer-0", "peer-2", "peer-3", "peer-5", "peer-6"}},
+		{serviceID: "b", want: []string{"peer-1", "peer-4", "peer-7"}},
+		{serviceID: "c"},
+		{serviceID: "", want: []string{"peer-0", "peer-1", "peer-2", "peer-3", "peer-4", "peer-5", "peer-6", "peer-7"}},
+	}
+	for _, test := range tests {
+		if peers := replayedPeers(t, filename, test.serviceID); !reflect.DeepEqual(peers, test.want) {
+			t.Errorf("replayed %v for %q, want %v", peers, test.serviceID, test.want)
+		}
+	}
+
+	// replay stops as soon as fn returns false, in any file
+	var peers []string
+	err = ReplayAudit(filename, "b", func(record *AuditRecord) bool {
+		peers = append(peers, record.PeerID)
+		return len(peers) < 2
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"peer-1", "peer-4"}; !reflect.DeepEqual(peers, want) {
+		t.Errorf("replayed %v, want %v", peers, want)
+	}
+}
+
+func TestReplayAuditErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discover-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "audit.jsonl")
+
+	if peers := replayedPeers(t, filename, ""); len(peers) > 0 {
+		t.Errorf("replayed %v from a missing file", peers)
+	}
+
+	if err := ioutil.WriteFile(filename, []byte("{\"service_id\":\"a\"}\nnot json\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReplayAudit(filename, "", func(*AuditRecord) bool { return true }); err == nil {
+		t.Error("expected the invalid record to fail the replay")
+	}
+}
+
+func TestServerAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discover-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "audit.jsonl")
+
+	s := startTestServer(t, &ServerConfig{AuditLogFilename: filename})
+	c := connectTestClient(t, s, nil)
+	if err := c.RegisterService(testService("a", "10.0.0.1:80")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "registration", func() bool { return hasService(s, "a") })
+	if err := c.DeregisterService("a"); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "deregistration", func() bool { return !hasService(s, "a") })
+	_ = c.Stop()
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	var records []*AuditRecord
+	err = ReplayAudit(filename, "a", func(record *AuditRecord) bool {
+		records = append(records, record)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Action != AuditRegister || records[1].Action != AuditDeregister {
+		t.Fatalf("got %d records", len(records))
+	}
+	if records[0].After == nil || records[0].After.Id != "a" || records[0].PeerID == "" || records[0].PeerAddress == "" {
+		t.Errorf("got register record %+v", records[0])
+	}
+	if records[1].Before == nil || records[1].Before.Id != "a" || records[1].After != nil {
+		t.Errorf("got deregister record %+v", records[1])
+	}
+}
@@ -0,0 +1,195 @@
+package discover
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/omecodes/common/errors"
+	"github.com/omecodes/zebou"
+	"google.golang.org/protobuf/proto"
+)
+
+// msgBatch holds several messages sent in one frame. Its encoded value is the sequence of the protobuf encoded
+// messages, each prefixed by its varint encoded length
+const msgBatch = "Batch"
+
+// Limits of the batches sent to peers, kept well below the default gRPC message size limit
+const (
+	maxBatchMessages = 512
+	maxBatchBytes    = 1 << 20
+)
+
+// CompressionGzip is the gzip compression of the frames sent to peers
+const CompressionGzip = "gzip"
+
+// headerCompression is the message header naming the compression of the message value
+const headerCompression = "compression"
+
+// compressionThreshold is the size under which frames are sent uncompressed, compression not being worth it
+const compressionThreshold = 1024
+
+// compressor compresses the value of the frames sent to peers
+type compressor interface {
+	compress(data []byte) ([]byte, error)
+	decompress(data []byte) ([]byte, error)
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	return ioutil.ReadAll(r)
+}
+
+var compressors = map[string]compressor{
+	CompressionGzip: gzipCompressor{},
+}
+
+// defaultCompressions are the compressions offered by clients and accepted by servers, in order of preference
+var defaultCompressions = []string{CompressionGzip}
+
+// negotiateCompression returns the first of the offered compressions that is accepted, or an empty string for none
+func negotiateCompression(offered []string, accepted []string) string {
+	for _, name := range offered {
+		if _, found := compressors[name]; found && containsString(accepted, name) {
+			return name
+		}
+	}
+	return ""
+}
+
+// packBatches returns the batches that hold msgs, in order
+func packBatches(msgs []*zebou.ZeMsg) ([]*zebou.ZeMsg, error) {
+	var batches []*zebou.ZeMsg
+	var buf bytes.Buffer
+	count := 0
+
+	flush := func() {
+		if count > 0 {
+			batches = append(batches, &zebou.ZeMsg{Type: msgBatch, Encoded: append([]byte(nil), buf.Bytes()...)})
+		}
+		buf.Reset()
+		count = 0
+	}
+
+	length := make([]byte, binary.MaxVarintLen64)
+	for _, msg := range msgs {
+		encoded, err := proto.Marshal(msg)
+		if err != nil {
+			return nil, err
+		}
+		if count == maxBatchMessages || (count > 0 && buf.Len()+len(encoded) > maxBatchBytes) {
+			flush()
+		}
+
+		n := binary.PutUvarint(length, uint64(len(encoded)))
+		buf.Write(length[:n])
+		buf.Write(encoded)
+		count++
+	}
+	flush()
+	return batches, nil
+}
+
+// unpackBatch returns the messages held by the batch msg
+func unpackBatch(msg *zebou.ZeMsg) ([]*zebou.ZeMsg, error) {
+	var msgs []*zebou.ZeMsg
+	data := msg.Encoded
+	for len(data) > 0 {
+		size, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < size {
+			return nil, fmt.Errorf("%w: truncated batch", errors.BadInput)
+		}
+		data = data[n:]
+
+		inner := new(zebou.ZeMsg)
+		if err := proto.Unmarshal(data[:size], inner); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, inner)
+		data = data[size:]
+	}
+	return msgs, nil
+}
+
+// compressMessage returns a copy of msg whose value is compressed with the compression name. msg is returned as is
+// if its value is too small to be worth compressing
+func compressMessage(msg *zebou.ZeMsg, name string) (*zebou.ZeMsg, error) {
+	c, found := compressors[name]
+	if !found {
+		return nil, fmt.Errorf("%w: unknown compression %q", errors.NotSupported, name)
+	}
+	if len(msg.Encoded) < compressionThreshold {
+		return msg, nil
+	}
+
+	compressed, err := c.compress(msg.Encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &zebou.ZeMsg{Type: msg.Type, Id: msg.Id, Encoded: compressed}
+	msgCarrier{msg: out}.Set(headerCompression, name)
+	return out, nil
+}
+
+// decompressMessage returns a copy of msg whose value is decompressed, msg itself if it is not compressed
+func decompressMessage(msg *zebou.ZeMsg) (*zebou.ZeMsg, error) {
+	headers := messageHeaders(msg)
+	name := headers.Get(headerCompression)
+	if name == "" {
+		return msg, nil
+	}
+
+	c, found := compressors[name]
+	if !found {
+		return nil, fmt.Errorf("%w: unknown compression %q", errors.NotSupported, name)
+	}
+
+	decompressed, err := c.decompress(msg.Encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &zebou.ZeMsg{Id: msg.Id, Encoded: decompressed}
+	headers.Del(headerCompression)
+	out.Type = messageType(msg)
+	if len(headers) > 0 {
+		out.Type += "?" + headers.Encode()
+	}
+	return out, nil
+}
+
+// readFrame returns the messages of a frame received from the other end: the frame itself, or the messages it
+// holds if it is a batch
+func readFrame(frame *zebou.ZeMsg) ([]*zebou.ZeMsg, error) {
+	msg, err := decompressMessage(frame)
+	if err != nil {
+		return nil, err
+	}
+	if messageType(msg) != msgBatch {
+		return []*zebou.ZeMsg{msg}, nil
+	}
+	return unpackBatch(msg)
+}
@@ -0,0 +1,295 @@
+package discover
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omecodes/common/errors"
+	"github.com/omecodes/libome"
+	"github.com/omecodes/zebou"
+	"google.golang.org/protobuf/proto"
+)
+
+// batchTestMessages returns count messages whose values are size bytes long
+func batchTestMessages(count int, size int) []*zebou.ZeMsg {
+	var msgs []*zebou.ZeMsg
+	for i := 0; i < count; i++ {
+		msgs = append(msgs, &zebou.ZeMsg{
+			Type:    ome.RegistryEventType_Register.String(),
+			Id:      fmt.Sprintf("s%d", i),
+			Encoded: bytes.Repeat([]byte{byte(i)}, size),
+		})
+	}
+	return msgs
+}
+
+// unpackBatches returns the messages held by batches, failing t if one is not a batch
+func unpackBatches(t *testing.T, batches []*zebou.ZeMsg) []*zebou.ZeMsg {
+	var msgs []*zebou.ZeMsg
+	for _, batch := range batches {
+		if batch.Type != msgBatch {
+			t.Fatalf("got a %s frame", batch.Type)
+		}
+		unpacked, err := unpackBatch(batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, unpacked...)
+	}
+	return msgs
+}
+
+func TestBatchRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		msgs []*zebou.ZeMsg
+	}{
+		{name: "one message", msgs: batchTestMessages(1, 10)},
+		{name: "several messages", msgs: batchTestMessages(10, 100)},
+		{name: "empty values", msgs: batchTestMessages(3, 0)},
+		{name: "headers", msgs: []*zebou.ZeMsg{
+			{Type: ome.RegistryEventType_Register.String() + "?codec=proto&traceparent=00-1-2-01", Id: "a", Encoded: []byte("a")},
+			{Type: ome.RegistryEventType_DeRegisterNode.String(), Id: "b", Encoded: []byte("n1|n2")},
+			{Type: msgSynced},
+		}},
+	}
+
+	for _, test := range tests {
+		batches, err := packBatches(test.msgs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(batches) != 1 {
+			t.Errorf("%s: got %d batches, want 1", test.name, len(batches))
+		}
+
+		msgs := unpackBatches(t, batches)
+		if len(msgs) != len(test.msgs) {
+			t.Errorf("%s: got %d messages, want %d", test.name, len(msgs), len(test.msgs))
+			continue
+		}
+		for i, msg := range msgs {
+			if !proto.Equal(msg, test.msgs[i]) {
+				t.Errorf("%s: got message %v, want %v", test.name, msg, test.msgs[i])
+			}
+		}
+	}
+}
+
+func TestPackBatchesLimits(t *testing.T) {
+	tests := []struct {
+		name  string
+		msgs  []*zebou.ZeMsg
+		sizes []int
+	}{
+		{name: "count", msgs: batchTestMessages(maxBatchMessages*2+1, 1), sizes: []int{maxBatchMessages, maxBatchMessages, 1}},
+		{name: "bytes", msgs: batchTestMessages(5, maxBatchBytes/2), sizes: []int{1, 1, 1, 1, 1}},
+		{name: "bytes and count", msgs: batchTestMessages(7, maxBatchBytes/3-100), sizes: []int{3, 3, 1}},
+		{name: "oversized message", msgs: batchTestMessages(2, maxBatchBytes+1), sizes: []int{1, 1}},
+		{name: "no message", sizes: nil},
+	}
+
+	for _, test := range tests {
+		batches, err := packBatches(test.msgs)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var sizes []int
+		for _, batch := range batches {
+			msgs, err := unpackBatch(batch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sizes = append(sizes, len(msgs))
+			if len(msgs) > 1 && len(batch.Encoded) > maxBatchBytes {
+				t.Errorf("%s: batch of %d messages is %d bytes long", test.name, len(msgs), len(batch.Encoded))
+			}
+		}
+		if fmt.Sprint(sizes) != fmt.Sprint(test.sizes) {
+			t.Errorf("%s: got batches of %v messages, want %v", test.name, sizes, test.sizes)
+		}
+
+		msgs := unpackBatches(t, batches)
+		for i, msg := range msgs {
+			if msg.Id != test.msgs[i].Id {
+				t.Errorf("%s: got message %s at %d, want %s", test.name, msg.Id, i, test.msgs[i].Id)
+				break
+			}
+		}
+	}
+}
+
+func TestUnpackTruncatedBatch(t *testing.T) {
+	batches, err := packBatches(batchTestMessages(2, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	truncated := &zebou.ZeMsg{Type: msgBatch, Encoded: batches[0].Encoded[:len(batches[0].Encoded)-10]}
+	if _, err := unpackBatch(truncated); err == nil || !strings.HasPrefix(err.Error(), errors.BadInput.Error()) {
+		t.Errorf("expected a bad input error, got %v", err)
+	}
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	small := &zebou.ZeMsg{Type: msgBatch, Encoded: bytes.Repeat([]byte("a"), compressionThreshold-1)}
+	compressed, err := compressMessage(small, CompressionGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compressed != small {
+		t.Error("small message compressed")
+	}
+
+	large := &zebou.ZeMsg{Type: msgBatch + "?traceparent=00-1-2-01", Id: "a", Encoded: bytes.Repeat([]byte("a"), 10*compressionThreshold)}
+	compressed, err = compressMessage(large, CompressionGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messageHeaders(compressed).Get(headerCompression) != CompressionGzip || messageType(compressed) != msgBatch {
+		t.Errorf("got compressed message type %q", compressed.Type)
+	}
+	if len(compressed.Encoded) >= len(large.Encoded) {
+		t.Errorf("compressed value is %d bytes long", len(compressed.Encoded))
+	}
+
+	decompressed, err := decompressMessage(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(decompressed, large) {
+		t.Errorf("got %q %q, want %q", decompressed.Type, decompressed.Id, large.Type)
+	}
+
+	if plain, err := decompressMessage(large); err != nil || plain != large {
+		t.Errorf("uncompressed message changed: %v", err)
+	}
+
+	if _, err := compressMessage(large, "lz4"); err == nil || !strings.HasPrefix(err.Error(), errors.NotSupported.Error()) {
+		t.Errorf("expected a not supported error, got %v", err)
+	}
+	unknown := &zebou.ZeMsg{Type: msgBatch + "?compression=lz4", Encoded: compressed.Encoded}
+	if _, err := decompressMessage(unknown); err == nil || !strings.HasPrefix(err.Error(), errors.NotSupported.Error()) {
+		t.Errorf("expected a not supported error, got %v", err)
+	}
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	tests := []struct {
+		offered  []string
+		accepted []string
+		want     string
+	}{
+		{offered: []string{CompressionGzip}, accepted: []string{CompressionGzip}, want: CompressionGzip},
+		{offered: []string{"lz4", CompressionGzip}, accepted: []string{"lz4", CompressionGzip}, want: CompressionGzip},
+		{offered: []string{CompressionGzip}},
+		{accepted: []string{CompressionGzip}},
+	}
+
+	for _, test := range tests {
+		if got := negotiateCompression(test.offered, test.accepted); got != test.want {
+			t.Errorf("negotiateCompression(%v, %v) = %q, want %q", test.offered, test.accepted, got, test.want)
+		}
+	}
+}
+
+// receiveRegistry returns the frames received until the one holding msgSynced, and the ids of the services they
+// register
+func receiveRegistry(t *testing.T, frames <-chan *zebou.ZeMsg) ([]*zebou.ZeMsg, map[string]bool) {
+	var received []*zebou.ZeMsg
+	ids := map[string]bool{}
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case frame := <-frames:
+			received = append(received, frame)
+			msgs, err := readFrame(frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, msg := range msgs {
+				switch messageType(msg) {
+				case ome.RegistryEventType_Register.String():
+					ids[msg.Id] = true
+				case msgSynced:
+					return received, ids
+				}
+			}
+		case <-deadline:
+			t.Fatalf("timed out waiting for the registry content, got %d services", len(ids))
+		}
+	}
+}
+
+func TestCompressionIsNegotiatedPerPeer(t *testing.T) {
+	s := startTestServer(t, &ServerConfig{})
+	defer s.Stop()
+
+	owner := connectTestClient(t, s, nil)
+	defer owner.Stop()
+	for i := 0; i < 20; i++ {
+		info := testService(fmt.Sprintf("s%d", i), "10.0.0.1:80")
+		info.Meta = map[string]string{"description": strings.Repeat("registered service ", 20)}
+		if err := owner.RegisterService(info); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eventually(t, "registrations", func() bool { return hasService(s, "s19") })
+
+	tests := []struct {
+		name         string
+		compressions []string
+		compressed   bool
+	}{
+		{name: "gzip", compressions: []string{CompressionGzip}, compressed: true},
+		{name: "no compression", compressed: false},
+	}
+
+	for _, test := range tests {
+		peer, frames := connectRawFrames(s)
+		sendHello(t, peer, &hello{Version: ProtocolVersion, Codecs: []string{CodecJSON}, Compressions: test.compressions,
+			Capabilities: []Capability{CapabilityBatch, CapabilityCompression}})
+
+		received, ids := receiveRegistry(t, frames)
+		if len(ids) != 20 {
+			t.Errorf("%s: got %d services, want 20", test.name, len(ids))
+		}
+
+		var batches, compressed int
+		for _, frame := range received {
+			if messageType(frame) == msgBatch {
+				batches++
+			}
+			if messageHeaders(frame).Get(headerCompression) != "" {
+				compressed++
+			}
+		}
+		if batches == 0 {
+			t.Errorf("%s: registry content not batched", test.name)
+		}
+		if test.compressed && compressed == 0 {
+			t.Errorf("%s: no compressed frame", test.name)
+		}
+		if !test.compressed && compressed > 0 {
+			t.Errorf("%s: got %d compressed frames", test.name, compressed)
+		}
+	}
+
+	// a client decompresses the frames sent by the server
+	c := connectTestClient(t, s, nil)
+	defer c.Stop()
+	if !c.ServerSupports(CapabilityCompression) {
+		t.Error("compression is not negotiated with the client")
+	}
+	services, err := c.Query(&Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 20 {
+		t.Errorf("client got %d services, want 20", len(services))
+	}
+}
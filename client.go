@@ -1,16 +1,22 @@
 package discover
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/google/uuid"
 	"github.com/omecodes/common/errors"
 	"github.com/omecodes/common/utils/log"
 	"github.com/omecodes/libome"
 	"github.com/omecodes/zebou"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ConnectionStateChangesHandler interface {
@@ -25,39 +31,159 @@ func (f HandleConnectionStateFunc) HandleConnectionState(connected bool) {
 
 // MsgClient is a zebou messaging based client client
 type MsgClient struct {
-	messenger *zebou.Client
-	store     *sync.Map
-	handlers  *sync.Map
+	messenger  atomic.Value
+	tlsConfig  *tls.Config
+	store      *serviceIndex
+	registered *serviceIndex
+	handlers   *sync.Map
 
 	connectionStateHandleMutex sync.Mutex
 	connectionChangesHandlers  map[string]ConnectionStateChangesHandler
 
 	bufferMutex    sync.Mutex
 	messagesBuffer []*zebou.ZeMsg
+
+	metrics      atomic.Value
+	tracer       atomic.Value
+	propagator   atomic.Value
+	codec        atomic.Value
+	offered      atomic.Value
+	compressions atomic.Value
+	validators   atomic.Value
+	server       atomic.Value
+	connections  int64
+
+	synced          chan struct{}
+	syncedOnce      sync.Once
+	rejected        chan struct{}
+	rejectOnce      sync.Once
+	rejectErr       error
+	pendingRequests sync.Map
+}
+
+type clientMetrics struct {
+	Metrics
+}
+
+type clientTracer struct {
+	trace.Tracer
+}
+
+type clientPropagator struct {
+	propagation.TextMapPropagator
+}
+
+type clientCodec struct {
+	Codec
+}
+
+type clientValidators struct {
+	validators []Validator
+}
+
+// SetTracerProvider sets the provider of the tracer used to trace registrations and events delivery
+func (m *MsgClient) SetTracerProvider(provider trace.TracerProvider) {
+	m.tracer.Store(clientTracer{tracerFrom(provider)})
+}
+
+func (m *MsgClient) getTracer() trace.Tracer {
+	return m.tracer.Load().(clientTracer).Tracer
+}
+
+// SetPropagator sets the propagator of the trace context to and from the server. Defaults to the W3C trace context
+// propagator. The trace context is only sent to servers that support tracing
+func (m *MsgClient) SetPropagator(propagator propagation.TextMapPropagator) {
+	if propagator == nil {
+		propagator = defaultPropagator
+	}
+	m.propagator.Store(clientPropagator{propagator})
+}
+
+func (m *MsgClient) getPropagator() propagation.TextMapPropagator {
+	return m.propagator.Load().(clientPropagator).TextMapPropagator
+}
+
+// sentPropagator returns the propagator of the trace context sent to the server, nil if the server does not
+// support tracing
+func (m *MsgClient) sentPropagator() propagation.TextMapPropagator {
+	if !m.ServerSupports(CapabilityTracing) {
+		return nil
+	}
+	return m.getPropagator()
+}
+
+// SetMetrics sets the backend the client reports its metrics to
+func (m *MsgClient) SetMetrics(metrics Metrics) {
+	m.metrics.Store(clientMetrics{metrics})
+}
+
+func (m *MsgClient) getMetrics() Metrics {
+	return m.metrics.Load().(clientMetrics).Metrics
+}
+
+// SetCodecs sets the codecs offered to the server, in order of preference. JSON is used if the server accepts none of
+// them. It applies from the next connection
+func (m *MsgClient) SetCodecs(names ...string) {
+	m.offered.Store(names)
+}
+
+func (m *MsgClient) offeredCodecs() []string {
+	return m.offered.Load().([]string)
+}
+
+// SetCompressions sets the compressions offered to the server for the frames it sends, in order of preference.
+// Frames are not compressed if names is empty. It applies from the next connection
+func (m *MsgClient) SetCompressions(names ...string) {
+	m.compressions.Store(names)
+}
+
+func (m *MsgClient) offeredCompressions() []string {
+	return m.compressions.Load().([]string)
+}
+
+// SetValidators sets the validators applied to the services registered through the client, after the built-in rules
+// of ValidateService. The server applies its own
+func (m *MsgClient) SetValidators(validators ...Validator) {
+	m.validators.Store(clientValidators{validators})
+}
+
+// getCodec returns the codec negotiated with the server
+func (m *MsgClient) getCodec() Codec {
+	return m.codec.Load().(clientCodec).Codec
 }
 
 // RegisterService sends register message to the discovery server
-func (m *MsgClient) RegisterService(info *ome.ServiceInfo) error {
+func (m *MsgClient) RegisterService(info *ome.ServiceInfo) (err error) {
+	ctx, span := m.getTracer().Start(context.Background(), "discover.client.RegisterService",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("discover.service.id", info.Id)),
+	)
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	if err = validateService(info, m.validators.Load().(clientValidators).validators); err != nil {
+		log.Error("could not register invalid service", log.Err(err), log.Field("id", info.Id))
+		return err
+	}
 
-	m.store.Store(info.Id, info)
+	previous := m.registered.lookup("", info.Id)
+	m.store.put("", info.Id, info)
+	m.registered.put("", info.Id, info)
 
-	encoded, err := json.Marshal(info)
+	msg, err := m.registrationMessage(ctx, previous, info)
 	if err != nil {
 		log.Info("could not encode service info", log.Err(err))
 		return err
 	}
 
-	err = m.messenger.SendMsg(&zebou.ZeMsg{
-		Type:    ome.RegistryEventType_Register.String(),
-		Id:      info.Id,
-		Encoded: encoded,
-	})
+	err = m.getMessenger().SendMsg(msg)
 	if err != nil {
 		log.Error("could not send message to server", log.Err(err))
 		return err
 	}
 
-	m.notifyEvent(&ome.RegistryEvent{
+	m.notifyEvent(ctx, &ome.RegistryEvent{
 		Type:      ome.RegistryEventType_Register,
 		ServiceId: info.Id,
 		Info:      info,
@@ -67,6 +193,36 @@ func (m *MsgClient) RegisterService(info *ome.ServiceInfo) error {
 	return nil
 }
 
+// registrationMessage returns the message that registers info. It is a patch of previous, the info registered
+// before, if the server supports patches and only nodes or meta changed
+func (m *MsgClient) registrationMessage(ctx context.Context, previous *ome.ServiceInfo, info *ome.ServiceInfo) (*zebou.ZeMsg, error) {
+	if previous != nil && m.ServerSupports(CapabilityPatch) {
+		msg, err := patchMessage(previous, info)
+		if err != nil {
+			return nil, err
+		}
+		if msg != nil {
+			return injectTrace(ctx, m.sentPropagator(), msg), nil
+		}
+	}
+
+	codec := m.getCodec()
+	encoded, err := codec.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := injectTrace(ctx, m.sentPropagator(), &zebou.ZeMsg{
+		Type:    ome.RegistryEventType_Register.String(),
+		Id:      info.Id,
+		Encoded: encoded,
+	})
+	if codec.Name() != CodecJSON {
+		msgCarrier{msg: msg}.Set(headerCodec, codec.Name())
+	}
+	return msg, nil
+}
+
 // DeregisterService sends a deregister message to the discovery server
 func (m *MsgClient) DeregisterService(id string, nodes ...string) error {
 	var encoded []byte
@@ -82,10 +238,30 @@ func (m *MsgClient) DeregisterService(id string, nodes ...string) error {
 		msg.Type = ome.RegistryEventType_DeRegister.String()
 	}
 
-	err := m.messenger.SendMsg(msg)
-	if err != nil {
-		log.Error("could not send message to server", log.Err(err))
-		return err
+	// servers without the node list capability read the message value as a single node id
+	for _, out := range adaptMessage(msg, m.server.Load().(serverInfo).capabilities) {
+		err := m.getMessenger().SendMsg(out)
+		if err != nil {
+			log.Error("could not send message to server", log.Err(err))
+			return err
+		}
+	}
+
+	if len(nodes) == 0 {
+		m.registered.remove("", id)
+	} else if registered := m.registered.lookup("", id); registered != nil {
+		info := &ome.ServiceInfo{
+			Id:    registered.Id,
+			Type:  registered.Type,
+			Label: registered.Label,
+			Meta:  registered.Meta,
+		}
+		for _, node := range registered.Nodes {
+			if !containsString(nodes, node.Id) {
+				info.Nodes = append(info.Nodes, node)
+			}
+		}
+		m.registered.put("", id, info)
 	}
 
 	if len(nodes) > 0 {
@@ -98,14 +274,7 @@ func (m *MsgClient) DeregisterService(id string, nodes ...string) error {
 
 // GetService returns service info from local store that matches id
 func (m *MsgClient) GetService(id string) (*ome.ServiceInfo, error) {
-	var info *ome.ServiceInfo
-	m.store.Range(func(key, value interface{}) bool {
-		if key == id {
-			info = value.(*ome.ServiceInfo)
-			return false
-		}
-		return true
-	})
+	info := m.store.get(id)
 	if info == nil {
 		return nil, errors.NotFound
 	}
@@ -177,14 +346,7 @@ func (m *MsgClient) DeregisterEventHandler(id string) {
 
 // GetOfType gets all the service of type t
 func (m *MsgClient) GetOfType(t uint32) ([]*ome.ServiceInfo, error) {
-	var result []*ome.ServiceInfo
-	m.store.Range(func(key, value interface{}) bool {
-		info := value.(*ome.ServiceInfo)
-		if info.Type == t {
-			result = append(result, info)
-		}
-		return true
-	})
+	result := m.store.ofType(t)
 	if len(result) == 0 {
 		return nil, errors.NotFound
 	}
@@ -194,93 +356,211 @@ func (m *MsgClient) GetOfType(t uint32) ([]*ome.ServiceInfo, error) {
 
 // FirstOfType returns the first service from local store of type t
 func (m *MsgClient) FirstOfType(t uint32) (*ome.ServiceInfo, error) {
-	var info *ome.ServiceInfo
-	m.store.Range(func(key, value interface{}) bool {
-		info = value.(*ome.ServiceInfo)
-		return info.Type != t
-	})
+	info := m.store.firstOfType(t)
 	if info == nil {
 		return nil, errors.NotFound
 	}
 	return info, nil
 }
 
+// Query returns the services from local store that q selects, in registration order
+func (m *MsgClient) Query(q *Query) ([]*ome.ServiceInfo, error) {
+	return m.store.query(q), nil
+}
+
+// WaitSynced blocks until the server has sent the registry content, or ctx is done. It fails if the server protocol
+// version is not compatible with the client one
+func (m *MsgClient) WaitSynced(ctx context.Context) error {
+	select {
+	case <-m.synced:
+		return nil
+	case <-m.rejected:
+		return m.rejectErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Peers requests the list of the peers connected to the server
+func (m *MsgClient) Peers(ctx context.Context) ([]*PeerInfo, error) {
+	if m.serverGreeted() && !m.ServerSupports(CapabilityPeers) {
+		return nil, fmt.Errorf("%w: server does not list its peers", errors.NotSupported)
+	}
+
+	requestID := uuid.New().String()
+	response := make(chan []byte, 1)
+	m.pendingRequests.Store(requestID, response)
+	defer m.pendingRequests.Delete(requestID)
+
+	err := m.getMessenger().SendMsg(&zebou.ZeMsg{
+		Type: msgListPeers,
+		Id:   requestID,
+	})
+	if err != nil {
+		log.Error("could not send message to server", log.Err(err))
+		return nil, err
+	}
+
+	select {
+	case encoded := <-response:
+		var peers []*PeerInfo
+		err = json.Unmarshal(encoded, &peers)
+		return peers, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 // Stop closes the messaging connection
 func (m *MsgClient) Stop() error {
 	return nil
 }
 
-func (m *MsgClient) handleInbound() {
-	for {
-		msg, err := m.messenger.GetMessage()
+func (m *MsgClient) getMessenger() *zebou.Client {
+	return m.messenger.Load().(*zebou.Client)
+}
+
+// handleInbound handles the messages received by messenger until it is replaced
+func (m *MsgClient) handleInbound(messenger *zebou.Client) {
+	for m.getMessenger() == messenger {
+		frame, err := messenger.GetMessage()
 		if err != nil {
 			log.Error("failed to get next message", log.Err(err))
+			return
+		}
+
+		msgs, err := readFrame(frame)
+		if err != nil {
+			m.getMetrics().Add(MetricClientDecodeFailures, 1, nil)
+			log.Error("failed to read message frame", log.Err(err), log.Field("type", messageType(frame)))
 			continue
 		}
+		for _, msg := range msgs {
+			m.handleMessage(msg)
+		}
+	}
+}
+
+func (m *MsgClient) handleMessage(msg *zebou.ZeMsg) {
+	msgType := messageType(msg)
+	ctx, span := m.getTracer().Start(extractTrace(context.Background(), m.getPropagator(), msg), "discover.client.handleInbound",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("discover.message.type", msgType),
+			attribute.String("discover.service.id", msg.Id),
+		),
+	)
+	defer span.End()
+
+	log.Info("registry • received event", log.Field("type", msgType))
+	m.getMetrics().Add(MetricClientMessages, 1, map[string]string{"type": msgType})
+
+	switch msgType {
+	case ome.RegistryEventType_Update.String(), ome.RegistryEventType_Register.String():
+		info := new(ome.ServiceInfo)
+		codec, err := messageCodec(msg)
+		if err == nil {
+			err = codec.Unmarshal(msg.Encoded, info)
+		}
+		if err != nil {
+			m.getMetrics().Add(MetricClientDecodeFailures, 1, nil)
+			log.Error("failed to decode service info from message payload", log.Err(err))
+			span.RecordError(err)
+			return
+		}
 
-		log.Info("registry • received event", log.Field("type", msg.Type))
+		log.Info("registry • register service event", log.Field("id", info.Id))
+		m.store.put("", info.Id, info)
 
-		switch msg.Type {
-		case ome.RegistryEventType_Update.String(), ome.RegistryEventType_Register.String():
-			info := new(ome.ServiceInfo)
-			err := json.Unmarshal(msg.Encoded, info)
-			if err != nil {
-				log.Error("failed to decode service info from message payload", log.Err(err))
-				return
+		event := &ome.RegistryEvent{
+			ServiceId: info.Id,
+			Info:      info,
+		}
+		event.Type = ome.RegistryEventType(ome.RegistryEventType_value[msgType])
+		m.notifyEvent(ctx, event)
+
+	case ome.RegistryEventType_DeRegister.String():
+		log.Info("registry • delete service event", log.Field("id", msg.Id))
+		m.store.remove("", msg.Id)
+		m.notifyEvent(ctx, &ome.RegistryEvent{
+			Type:      ome.RegistryEventType_DeRegister,
+			ServiceId: msg.Id,
+		})
+
+	case ome.RegistryEventType_DeRegisterNode.String():
+		if stored := m.store.lookup("", msg.Id); stored != nil {
+			info := &ome.ServiceInfo{
+				Id:    stored.Id,
+				Type:  stored.Type,
+				Label: stored.Label,
+				Meta:  stored.Meta,
 			}
+			log.Info("registry • register nodes event", log.Field("for", info.Id))
 
-			log.Info("registry • register service event", log.Field("id", info.Id))
-			m.store.Store(info.Id, info)
+			nodeIDs := strings.Split(string(msg.Encoded), "|")
+			var newNodes []*ome.Node
+			for _, node := range stored.Nodes {
+				if !containsString(nodeIDs, node.Id) {
+					newNodes = append(newNodes, node)
+				}
+			}
 
-			event := &ome.RegistryEvent{
+			info.Nodes = newNodes
+			m.store.put("", info.Id, info)
+
+			m.notifyEvent(ctx, &ome.RegistryEvent{
+				Type:      ome.RegistryEventType_DeRegisterNode,
 				ServiceId: info.Id,
-				Info:      info,
-			}
-			event.Type = ome.RegistryEventType(ome.RegistryEventType_value[msg.Type])
-			m.notifyEvent(event)
-
-		case ome.RegistryEventType_DeRegister.String():
-			log.Info("registry • delete service event", log.Field("id", msg.Id))
-			m.store.Delete(msg.Id)
-			m.notifyEvent(&ome.RegistryEvent{
-				Type:      ome.RegistryEventType_DeRegister,
-				ServiceId: msg.Id,
 			})
+		}
 
-		case ome.RegistryEventType_DeRegisterNode.String():
-			o, ok := m.store.Load(msg.Id)
-			if ok {
-				info := o.(*ome.ServiceInfo)
-				log.Info("registry • register nodes event", log.Field("for", info.Id))
-
-				nodeId := string(msg.Encoded)
-				var newNodes []*ome.Node
-				for _, node := range info.Nodes {
-					if node.Id != nodeId {
-						log.Info("registry • new node", log.Field("node", nodeId))
-						newNodes = append(newNodes, node)
-					}
-				}
+	case msgWelcome:
+		m.handleWelcome(msg)
 
-				info.Nodes = newNodes
-				m.store.Store(info.Id, info)
+	case msgError:
+		m.handleError(msg)
 
-				m.notifyEvent(&ome.RegistryEvent{
-					Type:      ome.RegistryEventType_DeRegisterNode,
-					ServiceId: info.Id,
-				})
-			}
+	case msgPatch:
+		m.handlePatch(ctx, msg)
+
+	case msgResync:
+		m.handleResync(msg)
 
-		default:
-			log.Info("received unsupported msg type", log.Field("type", msg.Type))
+	case msgDrain:
+		redirect := string(msg.Encoded)
+		log.Info("registry • server is draining", log.Field("redirect", redirect))
+		if redirect != "" {
+			m.migrate(redirect)
 		}
+
+	case msgSynced:
+		m.syncedOnce.Do(func() {
+			close(m.synced)
+		})
+
+	case msgPeers:
+		if o, found := m.pendingRequests.Load(msg.Id); found {
+			o.(chan []byte) <- msg.Encoded
+		}
+
+	default:
+		log.Info("received unsupported msg type", log.Field("type", msgType))
 	}
 }
 
-func (m *MsgClient) notifyEvent(e *ome.RegistryEvent) {
+// notifyEvent calls every handler in its own goroutine, within a span that is a child of ctx
+func (m *MsgClient) notifyEvent(ctx context.Context, e *ome.RegistryEvent) {
+	tracer := m.getTracer()
 	m.handlers.Range(func(key, value interface{}) bool {
 		h := value.(ome.EventHandler)
-		go h.Handle(e)
+		go func() {
+			_, span := tracer.Start(ctx, "discover.client.handler", trace.WithAttributes(
+				attribute.String("discover.event.type", e.Type.String()),
+				attribute.String("discover.service.id", e.ServiceId),
+			))
+			defer span.End()
+			h.Handle(e)
+		}()
 		return true
 	})
 }
@@ -303,7 +583,7 @@ func (m *MsgClient) sendBufferedMessages() {
 	m.bufferMutex.Lock()
 	defer m.bufferMutex.Unlock()
 	for _, msg := range m.messagesBuffer {
-		err := m.messenger.SendMsg(msg)
+		err := m.getMessenger().SendMsg(msg)
 		if err != nil {
 			log.Error("")
 		}
@@ -313,38 +593,91 @@ func (m *MsgClient) sendBufferedMessages() {
 // NewZebouClient creates and initialize a zebou based registry client
 func NewZebouClient(server string, tlsConfig *tls.Config) *MsgClient {
 	c := new(MsgClient)
-	c.store = new(sync.Map)
+	c.store = newServiceIndex()
+	c.registered = newServiceIndex()
+	c.synced = make(chan struct{})
+	c.rejected = make(chan struct{})
 	c.handlers = new(sync.Map)
+	c.metrics.Store(clientMetrics{noopMetrics{}})
+	c.tracer.Store(clientTracer{tracerFrom(nil)})
+	c.propagator.Store(clientPropagator{defaultPropagator})
+	c.codec.Store(clientCodec{jsonCodec{}})
+	c.offered.Store(defaultCodecs)
+	c.compressions.Store(defaultCompressions)
+	c.validators.Store(clientValidators{})
+	c.server.Store(serverInfo{})
 
 	c.connectionChangesHandlers = map[string]ConnectionStateChangesHandler{}
 
-	c.messenger = zebou.NewClient(server, tlsConfig)
-	c.messenger.SetConnectionSateHandler(zebou.ConnectionStateHandlerFunc(func(active bool) {
+	c.tlsConfig = tlsConfig
+	c.connect(server)
+	return c
+}
+
+// connect starts a messenger connected to server. The services registered through the client are registered again
+// each time the messenger connects
+func (m *MsgClient) connect(server string) {
+	messenger := zebou.NewClient(server, m.tlsConfig)
+	messenger.SetConnectionSateHandler(zebou.ConnectionStateHandlerFunc(func(active bool) {
+		if !active && m.getMessenger() != messenger {
+			// the connection of a replaced messenger is closed once the client migrated. It is stopped from the
+			// goroutine that syncs it, as zebou clients cannot be stopped from another one without a data race
+			if err := messenger.Stop(); err != nil {
+				log.Error("registry • failed to stop previous connection", log.Err(err))
+			}
+			return
+		}
+
 		if active {
-			go c.handleInbound()
-			c.store.Range(func(key, value interface{}) bool {
-				i := value.(*ome.ServiceInfo)
-				err := c.messenger.Send(
+			m.getMetrics().Set(MetricClientConnected, 1, nil)
+			if atomic.AddInt64(&m.connections, 1) > 1 {
+				m.getMetrics().Add(MetricClientReconnects, 1, nil)
+			}
+		} else {
+			m.getMetrics().Set(MetricClientConnected, 0, nil)
+		}
+
+		if active {
+			// the codec is negotiated again with the server of the new connection
+			m.codec.Store(clientCodec{jsonCodec{}})
+			m.server.Store(serverInfo{})
+			if err := m.sendHello(messenger); err != nil {
+				log.Error("Registry • failed to send hello", log.Err(err))
+			}
+
+			for _, i := range m.registered.all() {
+				err := messenger.Send(
 					ome.RegistryEventType_Register.String(),
 					i.Id,
 					i,
 				)
 				if err != nil {
 					log.Error("Registry • failed to send message", log.Err(err))
-					return false
+					break
 				}
 
 				log.Error("Registry • registered", log.Field("id", i.Id))
 
-				c.notifyEvent(&ome.RegistryEvent{
+				m.notifyEvent(context.Background(), &ome.RegistryEvent{
 					Type:      ome.RegistryEventType_Register,
 					ServiceId: i.Id,
 					Info:      i,
 				})
-				return true
-			})
+			}
 		}
 	}))
-	c.messenger.Connect()
-	return c
+
+	m.messenger.Store(messenger)
+	go m.handleInbound(messenger)
+	messenger.Connect()
+}
+
+// migrate replaces the messenger with one connected to server, then tells the draining server it can close the
+// previous connection
+func (m *MsgClient) migrate(server string) {
+	previous := m.getMessenger()
+	m.connect(server)
+	if err := previous.SendMsg(&zebou.ZeMsg{Type: msgDrain, Encoded: []byte(server)}); err != nil {
+		log.Error("registry • failed to send message", log.Err(err))
+	}
 }
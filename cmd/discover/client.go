@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/omecodes/discover"
+	"github.com/omecodes/libome"
+)
+
+// clientFlags are the flags shared by the commands that talk to a running server
+type clientFlags struct {
+	server  string
+	ca      string
+	cert    string
+	key     string
+	timeout time.Duration
+	output  string
+}
+
+func newClientFlags(fs *flag.FlagSet) *clientFlags {
+	c := new(clientFlags)
+	fs.StringVar(&c.server, "server", defaultAddress, "address of the discovery server")
+	fs.StringVar(&c.ca, "ca", "", "CA certificate file the server certificate is verified with. Plain text connection if neither ca nor cert is set")
+	fs.StringVar(&c.cert, "cert", "", "client certificate file for mutual TLS")
+	fs.StringVar(&c.key, "key", "", "client key file for mutual TLS")
+	fs.DurationVar(&c.timeout, "timeout", 10*time.Second, "time allowed to connect to the server and get its answer")
+	fs.StringVar(&c.output, "o", "table", "output format: table or json")
+	return c
+}
+
+// tlsConfig returns the client TLS configuration. Certificates are reloaded when their files change,
+// so that long running commands like watch and register survive a rotation
+func (c *clientFlags) tlsConfig() (*tls.Config, error) {
+	if c.ca == "" && c.cert == "" {
+		return nil, nil
+	}
+
+	certificates, err := discover.NewCertificateReloader(c.cert, c.key, c.ca)
+	if err != nil {
+		return nil, err
+	}
+	go certificates.Watch(time.Minute)
+
+	host, _, err := net.SplitHostPort(c.server)
+	if err != nil {
+		host = c.server
+	}
+	return certificates.ClientConfig(host), nil
+}
+
+func (c *clientFlags) checkOutput() error {
+	if c.output != outputTable && c.output != outputJSON {
+		return fmt.Errorf("unsupported output format %q", c.output)
+	}
+	return nil
+}
+
+// connect returns a client that has received the registry content from the server
+func (c *clientFlags) connect() (*discover.MsgClient, error) {
+	if err := c.checkOutput(); err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	client := discover.NewZebouClient(c.server, tlsConfig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	if err := client.WaitSynced(ctx); err != nil {
+		return nil, fmt.Errorf("could not sync with %s: %v", c.server, err)
+	}
+	return client, nil
+}
+
+func runList(args []string) error {
+	fs := flag.NewFlagSet("ls", flag.ExitOnError)
+	cf := newClientFlags(fs)
+	query := fs.String("query", "", `service query, e.g. "type=2,meta.region=eu,protocol=grpc"`)
+	fs.Usage = flagsUsage(fs, "ls [flags]")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	q, err := discover.ParseQuery(*query)
+	if err != nil {
+		return err
+	}
+
+	client, err := cf.connect()
+	if err != nil {
+		return err
+	}
+
+	services, err := client.Query(q)
+	if err != nil {
+		return err
+	}
+	return printServices(cf.output, services)
+}
+
+func runGet(args []string) error {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	cf := newClientFlags(fs)
+	fs.Usage = flagsUsage(fs, "get [flags] <service-id>")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	client, err := cf.connect()
+	if err != nil {
+		return err
+	}
+
+	info, err := client.GetService(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("%s: %v", fs.Arg(0), err)
+	}
+	return printService(cf.output, info)
+}
+
+func runWatch(args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	cf := newClientFlags(fs)
+	query := fs.String("query", "", "only print the events of the services the query selects")
+	fs.Usage = flagsUsage(fs, "watch [flags]")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	q, err := discover.ParseQuery(*query)
+	if err != nil {
+		return err
+	}
+
+	if err := cf.checkOutput(); err != nil {
+		return err
+	}
+
+	tlsConfig, err := cf.tlsConfig()
+	if err != nil {
+		return err
+	}
+
+	events := make(chan *ome.RegistryEvent, 64)
+	client := discover.NewZebouClient(cf.server, tlsConfig)
+	client.RegisterEventHandler(ome.EventHandlerFunc(func(e *ome.RegistryEvent) {
+		events <- e
+	}))
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	// deregistration events carry no service info: they are printed for the services that were selected
+	selected := map[string]bool{}
+	for {
+		select {
+		case <-signals:
+			return nil
+
+		case e := <-events:
+			var info *ome.ServiceInfo
+			switch e.Type {
+			case ome.RegistryEventType_DeRegister:
+				if !selected[e.ServiceId] {
+					continue
+				}
+				delete(selected, e.ServiceId)
+
+			default:
+				info = e.Info
+				if info == nil {
+					info, _ = client.GetService(e.ServiceId)
+				}
+				if info == nil || !q.Match(info) {
+					continue
+				}
+				selected[info.Id] = true
+			}
+
+			if err := printEvent(cf.output, e, info); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func runRegister(args []string) error {
+	fs := flag.NewFlagSet("register", flag.ExitOnError)
+	cf := newClientFlags(fs)
+	filename := fs.String("f", "", "JSON or YAML file holding a service or a list of services")
+	fs.Usage = flagsUsage(fs, "register [flags] -f <file>")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *filename == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	services, err := discover.ReadServicesFile(*filename)
+	if err != nil {
+		return err
+	}
+
+	client, err := cf.connect()
+	if err != nil {
+		return err
+	}
+
+	for _, info := range services {
+		if err := client.RegisterService(info); err != nil {
+			return fmt.Errorf("%s: %v", info.Id, err)
+		}
+		fmt.Fprintf(stdout, "registered %s\n", info.Id)
+	}
+
+	// services are registered for as long as the client is connected
+	fmt.Fprintln(stdout, "press Ctrl-C to deregister")
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	for _, info := range services {
+		if err := client.DeregisterService(info.Id); err != nil {
+			return fmt.Errorf("%s: %v", info.Id, err)
+		}
+		fmt.Fprintf(stdout, "deregistered %s\n", info.Id)
+	}
+	return nil
+}
+
+func runDeregister(args []string) error {
+	fs := flag.NewFlagSet("deregister", flag.ExitOnError)
+	cf := newClientFlags(fs)
+	var nodes stringList
+	fs.Var(&nodes, "node", "id of a node to deregister instead of the whole service. Can be repeated")
+	fs.Usage = flagsUsage(fs, "deregister [flags] <service-id>")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	id := fs.Arg(0)
+
+	client, err := cf.connect()
+	if err != nil {
+		return err
+	}
+
+	if _, err := client.GetService(id); err != nil {
+		return fmt.Errorf("%s: %v", id, err)
+	}
+
+	// the server echoes the deregistration to all the clients once it is applied
+	applied := make(chan struct{}, 1)
+	client.RegisterEventHandler(ome.EventHandlerFunc(func(e *ome.RegistryEvent) {
+		// the remaining registration is sent if other peers registered the service under the same id
+		if e.ServiceId == id && e.Type != ome.RegistryEventType_Register {
+			select {
+			case applied <- struct{}{}:
+			default:
+			}
+		}
+	}))
+
+	// the client registered nothing: the service of other peers is deregistered as an admin
+	if err := client.AdminDeregisterService(id, nodes...); err != nil {
+		return err
+	}
+
+	select {
+	case <-applied:
+		fmt.Fprintf(stdout, "deregistered %s\n", id)
+		return nil
+	case <-time.After(cf.timeout):
+		return errors.New("the server did not confirm the deregistration, check that the client certificate identity is one of the server admin identities")
+	}
+}
+
+func runPeers(args []string) error {
+	fs := flag.NewFlagSet("peers", flag.ExitOnError)
+	cf := newClientFlags(fs)
+	fs.Usage = flagsUsage(fs, "peers [flags]")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	client, err := cf.connect()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cf.timeout)
+	defer cancel()
+
+	peers, err := client.Peers(ctx)
+	if err != nil {
+		return err
+	}
+	return printPeers(cf.output, peers)
+}
+
+// stringList is a repeatable string flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
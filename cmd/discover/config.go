@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	envPrefix  = "DISCOVER_"
+	configFlag = "config"
+)
+
+// envName returns the environment variable that holds the value of the flag name, e.g. DISCOVER_BIND_ADDRESS for bind-address
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// parseFlags parses args into fs. The flags that are not set on the command line are read from their environment
+// variable, then from the configuration file named by the config flag if fs defines one. Configuration files are
+// YAML or JSON objects whose keys are flag names. Flags may follow the positional arguments, up to a "--" argument
+// after which all the arguments are positional
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		remaining := fs.Args()
+		if parsed := len(args) - len(remaining); parsed > 0 && args[parsed-1] == "--" {
+			positional = append(positional, remaining...)
+			break
+		}
+		if len(remaining) == 0 {
+			break
+		}
+		positional = append(positional, remaining[0])
+		args = remaining[1:]
+	}
+	// leaves the positional arguments in fs.Args()
+	_ = fs.Parse(append([]string{"--"}, positional...))
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	var config map[string]string
+	if f := fs.Lookup(configFlag); f != nil {
+		filename := f.Value.String()
+		if !set[configFlag] {
+			filename = os.Getenv(envName(configFlag))
+		}
+
+		if filename != "" {
+			var err error
+			config, err = readConfigFile(filename)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+
+		if value, found := os.LookupEnv(envName(f.Name)); found {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %v", value, envName(f.Name), setErr)
+			}
+			return
+		}
+
+		if value, found := config[f.Name]; found {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %s in configuration file: %v", value, f.Name, setErr)
+			}
+		}
+	})
+	return err
+}
+
+// readConfigFile reads the YAML or JSON configuration file at filename. Keys are normalized to flag names:
+// "bind_address" and "bind-address" both set the bind-address flag
+func readConfigFile(filename string) (map[string]string, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(content, &values); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", filename, err)
+	}
+
+	config := map[string]string{}
+	for key, value := range values {
+		switch value.(type) {
+		case map[interface{}]interface{}, []interface{}:
+			return nil, fmt.Errorf("%s: %s must be a scalar value", filename, key)
+		}
+		config[strings.ToLower(strings.Replace(key, "_", "-", -1))] = fmt.Sprint(value)
+	}
+	return config, nil
+}
@@ -0,0 +1,74 @@
+// Command discover runs a discovery server and inspects or modifies the registry of a running one.
+//
+// Usage:
+//
+//	discover <command> [flags] [arguments]
+//
+// Run "discover <command> -h" for the flags of a command.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []*command{
+	{name: "serve", usage: "serve [flags]", summary: "run a discovery server", run: runServe},
+	{name: "ls", usage: "ls [flags]", summary: "list the registered services", run: runList},
+	{name: "get", usage: "get [flags] <service-id>", summary: "show a registered service", run: runGet},
+	{name: "watch", usage: "watch [flags]", summary: "print registry events as they happen", run: runWatch},
+	{name: "register", usage: "register [flags] -f <file>", summary: "register the services described in a JSON or YAML file until interrupted", run: runRegister},
+	{name: "deregister", usage: "deregister [flags] <service-id>", summary: "deregister a service or some of its nodes as an admin", run: runDeregister},
+	{name: "peers", usage: "peers [flags]", summary: "list the peers connected to the server", run: runPeers},
+}
+
+// stdout is the command output. The library logs are left as they are, on the process standard output
+var stdout io.Writer = os.Stdout
+
+func main() {
+	if len(os.Args) < 2 {
+		usage(os.Stderr)
+		os.Exit(2)
+	}
+
+	name := os.Args[1]
+	if name == "help" || name == "-h" || name == "--help" {
+		usage(os.Stdout)
+		return
+	}
+
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+
+		if err := cmd.run(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "discover %s: %v\n", name, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "discover: unknown command %q\n\n", name)
+	usage(os.Stderr)
+	os.Exit(2)
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: discover <command> [flags] [arguments]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-12s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, `Run "discover <command> -h" for the flags of a command.`)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/omecodes/discover"
+	"github.com/omecodes/libome"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+// flagsUsage returns a usage function that prints the command line of a command and the flags of fs
+func flagsUsage(fs *flag.FlagSet, usage string) func() {
+	return func() {
+		w := fs.Output()
+		fmt.Fprintf(w, "Usage: discover %s\n\n", usage)
+		fmt.Fprintf(w, "Flags can also be set with %s<FLAG> environment variables, e.g. %s.\n\n", envPrefix, envName("server"))
+		fs.PrintDefaults()
+	}
+}
+
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func printServices(output string, services []*ome.ServiceInfo) error {
+	if output == outputJSON {
+		if services == nil {
+			services = []*ome.ServiceInfo{}
+		}
+		return printJSON(services)
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTYPE\tLABEL\tNODES")
+	for _, info := range services {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", info.Id, info.Type, info.Label, nodesSummary(info.Nodes))
+	}
+	return w.Flush()
+}
+
+func printService(output string, info *ome.ServiceInfo) error {
+	if output == outputJSON {
+		return printJSON(info)
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", info.Id)
+	fmt.Fprintf(w, "Type:\t%d\n", info.Type)
+	fmt.Fprintf(w, "Label:\t%s\n", info.Label)
+	fmt.Fprintf(w, "Meta:\t%s\n", metaSummary(info.Meta))
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if len(info.Nodes) == 0 {
+		return nil
+	}
+
+	fmt.Fprintln(stdout)
+	w = tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tPROTOCOL\tADDRESS\tSECURITY\tTTL\tMETA")
+	for _, node := range info.Nodes {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n", node.Id, node.Protocol, node.Address, node.Security, node.Ttl, metaSummary(node.Meta))
+	}
+	return w.Flush()
+}
+
+func printPeers(output string, peers []*discover.PeerInfo) error {
+	if output == outputJSON {
+		if peers == nil {
+			peers = []*discover.PeerInfo{}
+		}
+		return printJSON(peers)
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tADDRESS\tIDENTITY\tSERVICES\tCONNECTED")
+	for _, peer := range peers {
+		identity := peer.Identity
+		if identity == "" {
+			identity = "-"
+		}
+		connected := time.Since(peer.ConnectedAt).Round(time.Second)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s ago\n", peer.ID, peer.Address, identity, peer.Services, connected)
+	}
+	return w.Flush()
+}
+
+// printEvent prints e as a line of text, or as a JSON line. info is the service the event is about, if known
+func printEvent(output string, e *ome.RegistryEvent, info *ome.ServiceInfo) error {
+	if output == outputJSON {
+		return json.NewEncoder(stdout).Encode(e)
+	}
+
+	nodes := ""
+	if info != nil {
+		nodes = nodesSummary(info.Nodes)
+	}
+	_, err := fmt.Fprintf(stdout, "%s  %-16s  %-24s  %s\n", time.Now().Format("15:04:05"), e.Type, e.ServiceId, nodes)
+	return err
+}
+
+func nodesSummary(nodes []*ome.Node) string {
+	var parts []string
+	for _, node := range nodes {
+		parts = append(parts, fmt.Sprintf("%s=%s://%s", node.Id, strings.ToLower(node.Protocol.String()), node.Address))
+	}
+	return strings.Join(parts, " ")
+}
+
+func metaSummary(meta map[string]string) string {
+	var keys []string
+	for key := range meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		parts = append(parts, key+"="+meta[key])
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/omecodes/discover"
+	"github.com/omecodes/libome"
+)
+
+const defaultAddress = "localhost:9780"
+
+func runServe(args []string) error {
+	config := new(discover.ServerConfig)
+
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.String(configFlag, "", "YAML or JSON configuration file whose keys are flag names")
+	fs.StringVar(&config.Name, "name", "discover", "server name, the peer id of the services registered by the server")
+	fs.StringVar(&config.BindAddress, "bind-address", defaultAddress, "address of the client protocol endpoint")
+	fs.StringVar(&config.CertFilename, "cert", "", "TLS certificate file")
+	fs.StringVar(&config.KeyFilename, "key", "", "TLS key file")
+	fs.StringVar(&config.ClientCACertFilename, "client-ca", "", "CA certificate file client certificates are verified with")
+	fs.DurationVar(&config.TLSReloadInterval, "tls-reload-interval", 0, "period at which the certificate files are checked for changes (default 1m). Reloaded on SIGHUP only if negative")
+	fs.Var((*stringList)(&config.Codecs), "codec", "codec peers may negotiate to encode service infos besides json, e.g. proto. Can be repeated (default proto)")
+	fs.Var((*stringList)(&config.Compressions), "compression", "compression peers may negotiate for the frames sent to them. Can be repeated (default gzip)")
+	fs.BoolVar(&config.DisableCompression, "no-compression", false, "send frames uncompressed whatever the peers offer")
+	fs.Float64Var(&config.RateLimit, "rate-limit", 0, "registry mutations per second a peer may send. Unlimited if zero")
+	fs.IntVar(&config.RateBurst, "rate-burst", 0, "registry mutations a peer may send at once (default rate-limit)")
+	fs.Float64Var(&config.IdentityRateLimit, "identity-rate-limit", 0, "registry mutations per second the peers of a client certificate identity may send together. Unlimited if zero")
+	fs.IntVar(&config.IdentityRateBurst, "identity-rate-burst", 0, "registry mutations the peers of an identity may send at once (default identity-rate-limit)")
+	fs.IntVar(&config.MaxServicesPerPeer, "max-services-per-peer", 0, "services a peer may register. Unlimited if zero")
+	fs.IntVar(&config.MaxNodesPerPeer, "max-nodes-per-peer", 0, "nodes the services of a peer may have in total. Unlimited if zero")
+	fs.IntVar(&config.MaxServiceInfoSize, "max-service-size", 0, "size in bytes of a registered service info. Unlimited if zero")
+	fs.StringVar(&config.StoreDir, "store-dir", "", "directory of the SQLite registry database")
+	fs.StringVar((*string)(&config.StoreBackend), "store-backend", "", "registry storage: memory, sqlite or mysql. Defaults to sqlite if store-dir is set, memory otherwise")
+	fs.StringVar(&config.StoreDSN, "store-dsn", "", "MySQL data source name")
+	fs.StringVar(&config.DNSBindAddress, "dns-address", "", "UDP/TCP address of the DNS server. Disabled if empty")
+	fs.StringVar(&config.DNSZone, "dns-zone", "", `zone the DNS server is authoritative for (default "discover.")`)
+	fs.StringVar(&config.PrometheusSDBindAddress, "prometheus-sd-address", "", "address of the Prometheus HTTP service discovery endpoint. Disabled if empty")
+	fs.StringVar(&config.XDSBindAddress, "xds-address", "", "address of the Envoy REST xDS endpoints. Disabled if empty")
+	fs.StringVar(&config.XDSClusterName, "xds-cluster", "", `name of the Envoy cluster pointing at the xDS endpoints (default "discover")`)
+	fs.StringVar(&config.MetricsBindAddress, "metrics-address", "", "address of the Prometheus metrics endpoint. Disabled if empty")
+	fs.StringVar(&config.AuditLogFilename, "audit-log", "", "JSON lines file registry mutations are audited to. Disabled if empty")
+	fs.Int64Var(&config.AuditLogMaxSize, "audit-log-max-size", 0, "size in bytes from which the audit log is rotated. Never rotated if zero")
+	fs.IntVar(&config.AuditLogMaxBackups, "audit-log-max-backups", 0, "number of rotated audit logs kept (default 5)")
+	fs.StringVar(&config.SnapshotFilename, "snapshot-file", "", "file a registry snapshot is periodically written to. Disabled if empty")
+	fs.DurationVar(&config.SnapshotInterval, "snapshot-interval", 0, "period of the registry snapshots (default 5m)")
+	fs.StringVar(&config.StaticServicesDir, "static-dir", "", "directory of JSON or YAML files defining static services. Disabled if empty")
+	fs.DurationVar(&config.StaticServicesInterval, "static-interval", 0, "period at which the static services directory is checked for changes (default 5s)")
+	redirect := fs.String("redirect", "", "address of the server clients are told to migrate to when this one shuts down")
+	drainTimeout := fs.Duration("drain-timeout", 10*time.Second, "time allowed to in-flight messages when shutting down")
+	restore := fs.String("restore", "", "snapshot file the registry is restored from at startup")
+	fs.DurationVar(&config.RestoreGracePeriod, "restore-grace-period", 0, "time restored services of peers that are not connected are kept (default 1m)")
+	fs.Var((*stringList)(&config.AdminIdentities), "admin-identity", "client certificate identity allowed to deregister the services of other peers. Can be repeated")
+	var mutatingWebhooks, validatingWebhooks stringList
+	fs.Var(&mutatingWebhooks, "mutating-webhook", "URL of an admission webhook that may change registrations. Can be repeated")
+	fs.Var(&validatingWebhooks, "validating-webhook", "URL of an admission webhook that may deny registrations. Can be repeated")
+	webhookTimeout := fs.Duration("webhook-timeout", 0, "time allowed to admission webhooks (default 5s)")
+	webhookPolicy := fs.String("webhook-failure-policy", string(discover.FailClosed), "what happens to registrations when an admission webhook fails: fail or ignore")
+	var eventWebhooks stringList
+	fs.Var(&eventWebhooks, "webhook", "URL registry events are POSTed to. Can be repeated")
+	webhookSecret := fs.String("webhook-secret", "", "key of the HMAC-SHA256 signature of the events sent to webhooks. Unsigned if empty")
+	webhookEvents := fs.String("webhook-events", "", "comma separated registry event types sent to webhooks, e.g. Register,DeRegister. All if empty")
+	fs.StringVar(&config.WebhookDeadLetterFilename, "webhook-dead-letter", "", "JSON lines file the events that could not be delivered to webhooks are appended to. Only logged if empty")
+	mirrorDir := fs.String("mirror-dir", "", "directory the registry services are mirrored to, as one JSON file per service. Disabled if empty")
+	fs.DurationVar(&config.SinksResyncInterval, "mirror-resync-interval", 0, "period of the full reconciliations of the mirror directory. Only reconciled at startup if zero")
+	importHosts := fs.String("import-hosts", "", "hosts-style file services are imported from. Disabled if empty")
+	importHostsPort := fs.Int("import-hosts-port", 0, "port of the imported hosts file addresses that have none")
+	importDir := fs.String("import-dir", "", "directory of JSON service files services are imported from. Disabled if empty")
+	importConsul := fs.String("import-consul", "", "URL of the Consul agent whose catalog services are imported from, e.g. http://localhost:8500. Disabled if empty")
+	importInterval := fs.Duration("import-interval", 0, "period at which the import sources are read (default 30s)")
+	fs.Usage = flagsUsage(fs, "serve [flags]")
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	policy := discover.FailurePolicy(*webhookPolicy)
+	if policy != discover.FailClosed && policy != discover.FailOpen {
+		return fmt.Errorf("unknown webhook failure policy %q", *webhookPolicy)
+	}
+	for _, url := range mutatingWebhooks {
+		config.AdmissionHooks = append(config.AdmissionHooks, discover.AdmissionHook{
+			Name:          url,
+			Mutating:      &discover.AdmissionWebhook{URL: url},
+			FailurePolicy: policy,
+			Timeout:       *webhookTimeout,
+		})
+	}
+	for _, url := range validatingWebhooks {
+		config.AdmissionHooks = append(config.AdmissionHooks, discover.AdmissionHook{
+			Name:          url,
+			Validating:    &discover.AdmissionWebhook{URL: url},
+			FailurePolicy: policy,
+			Timeout:       *webhookTimeout,
+		})
+	}
+
+	var eventTypes []ome.RegistryEventType
+	for _, name := range strings.Split(*webhookEvents, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		t, found := ome.RegistryEventType_value[name]
+		if !found {
+			return fmt.Errorf("unknown registry event type %q", name)
+		}
+		eventTypes = append(eventTypes, ome.RegistryEventType(t))
+	}
+	for _, url := range eventWebhooks {
+		config.Webhooks = append(config.Webhooks, discover.WebhookConfig{
+			URL:        url,
+			Secret:     *webhookSecret,
+			EventTypes: eventTypes,
+		})
+	}
+
+	if *mirrorDir != "" {
+		sink, err := discover.NewFileSink(*mirrorDir)
+		if err != nil {
+			return err
+		}
+		config.Sinks = append(config.Sinks, sink)
+	}
+
+	if *importHosts != "" {
+		config.Sources = append(config.Sources, discover.SourceConfig{
+			Name:     "hosts",
+			Source:   &discover.HostsFileSource{Filename: *importHosts, Port: *importHostsPort},
+			Interval: *importInterval,
+		})
+	}
+	if *importDir != "" {
+		config.Sources = append(config.Sources, discover.SourceConfig{
+			Name:     "dir",
+			Source:   &discover.DirectorySource{Dir: *importDir},
+			Interval: *importInterval,
+		})
+	}
+	if *importConsul != "" {
+		config.Sources = append(config.Sources, discover.SourceConfig{
+			Name:     "consul",
+			Source:   &discover.ConsulSource{Address: *importConsul},
+			Interval: *importInterval,
+		})
+	}
+
+	server, err := discover.Serve(config)
+	if err != nil {
+		return err
+	}
+
+	if *restore != "" {
+		if err := restoreSnapshot(server, *restore); err != nil {
+			_ = server.Stop()
+			return err
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if err := server.ReloadTLS(); err != nil {
+			fmt.Fprintf(os.Stderr, "discover serve: could not reload certificates: %v\n", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+	defer cancel()
+	return server.Shutdown(ctx, *redirect)
+}
+
+func restoreSnapshot(server *discover.Server, filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return server.Restore(file)
+}
@@ -0,0 +1,150 @@
+package discover
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/omecodes/common/errors"
+	"github.com/omecodes/libome"
+	"github.com/omecodes/zebou"
+	"google.golang.org/protobuf/proto"
+)
+
+// Names of the built-in codecs
+const (
+	CodecJSON  = "json"
+	CodecProto = "proto"
+)
+
+// headerCodec is the message header naming the codec of the service info a message holds. Messages without it are JSON encoded
+const headerCodec = "codec"
+
+// Codec encodes the service infos carried by registry messages
+type Codec interface {
+	Name() string
+	Marshal(info *ome.ServiceInfo) ([]byte, error)
+	Unmarshal(data []byte, info *ome.ServiceInfo) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return CodecJSON
+}
+
+func (jsonCodec) Marshal(info *ome.ServiceInfo) ([]byte, error) {
+	return json.Marshal(info)
+}
+
+func (jsonCodec) Unmarshal(data []byte, info *ome.ServiceInfo) error {
+	return json.Unmarshal(data, info)
+}
+
+// protoCodec uses the protobuf binary encoding, much more compact than JSON for infos holding PEM certificates
+type protoCodec struct{}
+
+func (protoCodec) Name() string {
+	return CodecProto
+}
+
+func (protoCodec) Marshal(info *ome.ServiceInfo) ([]byte, error) {
+	return proto.Marshal(info)
+}
+
+func (protoCodec) Unmarshal(data []byte, info *ome.ServiceInfo) error {
+	return proto.Unmarshal(data, info)
+}
+
+var codecs = map[string]Codec{
+	CodecJSON:  jsonCodec{},
+	CodecProto: protoCodec{},
+}
+
+// defaultCodecs are the codecs offered by clients and accepted by servers, in order of preference
+var defaultCodecs = []string{CodecProto, CodecJSON}
+
+// negotiateCodec returns the first of the offered codecs that is accepted. JSON is the fallback every peer supports
+func negotiateCodec(offered []string, accepted []string) Codec {
+	for _, name := range offered {
+		if codec, found := codecs[name]; found && containsString(accepted, name) {
+			return codec
+		}
+	}
+	return jsonCodec{}
+}
+
+// messageCodec returns the codec of the service info msg holds
+func messageCodec(msg *zebou.ZeMsg) (Codec, error) {
+	name := messageHeaders(msg).Get(headerCodec)
+	if name == "" {
+		return jsonCodec{}, nil
+	}
+
+	codec, found := codecs[name]
+	if !found {
+		return nil, fmt.Errorf("%w: unknown codec %q", errors.NotSupported, name)
+	}
+	return codec, nil
+}
+
+// carriesServiceInfo reports whether messages of type msgType hold an encoded service info
+func carriesServiceInfo(msgType string) bool {
+	return msgType == ome.RegistryEventType_Register.String() ||
+		msgType == ome.RegistryEventType_Update.String() ||
+		msgType == ome.RegistryEventType_DeRegister.String()
+}
+
+// encodeMessage returns a copy of msg whose JSON encoded service info is re-encoded with codec. msg is returned as is
+// if codec is JSON, msg is already encoded with codec or holds no service info
+func encodeMessage(msg *zebou.ZeMsg, codec Codec) (*zebou.ZeMsg, error) {
+	if codec.Name() == CodecJSON || len(msg.Encoded) == 0 || !carriesServiceInfo(messageType(msg)) {
+		return msg, nil
+	}
+	if messageHeaders(msg).Get(headerCodec) == codec.Name() {
+		return msg, nil
+	}
+
+	info := new(ome.ServiceInfo)
+	if err := json.Unmarshal(msg.Encoded, info); err != nil {
+		return nil, err
+	}
+
+	encoded, err := codec.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &zebou.ZeMsg{Type: msg.Type, Id: msg.Id, Encoded: encoded}
+	msgCarrier{msg: out}.Set(headerCodec, codec.Name())
+	return out, nil
+}
+
+// decodeMessage returns a copy of msg whose service info is JSON encoded, whatever codec it was encoded with
+func decodeMessage(msg *zebou.ZeMsg) (*zebou.ZeMsg, error) {
+	codec, err := messageCodec(msg)
+	if err != nil {
+		return nil, err
+	}
+	if codec.Name() == CodecJSON || len(msg.Encoded) == 0 || !carriesServiceInfo(messageType(msg)) {
+		return msg, nil
+	}
+
+	info := new(ome.ServiceInfo)
+	if err := codec.Unmarshal(msg.Encoded, info); err != nil {
+		return nil, err
+	}
+
+	encoded, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &zebou.ZeMsg{Id: msg.Id, Encoded: encoded}
+	headers := messageHeaders(msg)
+	headers.Del(headerCodec)
+	out.Type = messageType(msg)
+	if len(headers) > 0 {
+		out.Type += "?" + headers.Encode()
+	}
+	return out, nil
+}
@@ -0,0 +1,141 @@
+package discover
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/omecodes/libome"
+	"github.com/omecodes/zebou"
+	"google.golang.org/protobuf/proto"
+)
+
+// benchmarkCertifiedService returns a service whose meta holds a PEM encoded certificate, as services secured with TLS do
+func benchmarkCertifiedService(b *testing.B) *ome.ServiceInfo {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "service-1"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"service-1.discover"},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	info := benchmarkService(1)
+	info.Meta[ome.MetaServiceCertificate] = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}))
+	return info
+}
+
+func TestMessageCodecRoundTrip(t *testing.T) {
+	info := benchmarkService(1)
+	encoded, err := jsonCodec{}.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &zebou.ZeMsg{Type: ome.RegistryEventType_Register.String(), Id: info.Id, Encoded: encoded}
+
+	for _, codec := range []Codec{jsonCodec{}, protoCodec{}} {
+		out, err := encodeMessage(msg, codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decodedCodec, err := messageCodec(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decodedCodec.Name() != codec.Name() {
+			t.Fatalf("message encoded with %s is read as %s", codec.Name(), decodedCodec.Name())
+		}
+
+		in, err := decodeMessage(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if messageType(in) != messageType(msg) || messageHeaders(in).Get(headerCodec) != "" {
+			t.Fatalf("unexpected decoded message type %q", in.Type)
+		}
+
+		decoded := new(ome.ServiceInfo)
+		if err := (jsonCodec{}).Unmarshal(in.Encoded, decoded); err != nil {
+			t.Fatal(err)
+		}
+		if !proto.Equal(decoded, info) {
+			t.Fatalf("%s: decoded %v, expected %v", codec.Name(), decoded, info)
+		}
+	}
+}
+
+func BenchmarkCodecMarshal(b *testing.B) {
+	info := benchmarkCertifiedService(b)
+
+	for _, codec := range []Codec{jsonCodec{}, protoCodec{}} {
+		b.Run(codec.Name(), func(b *testing.B) {
+			var encoded []byte
+			var err error
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				encoded, err = codec.Marshal(info)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(encoded)), "bytes/msg")
+		})
+	}
+}
+
+func BenchmarkCodecUnmarshal(b *testing.B) {
+	info := benchmarkCertifiedService(b)
+
+	for _, codec := range []Codec{jsonCodec{}, protoCodec{}} {
+		encoded, err := codec.Marshal(info)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(codec.Name(), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := codec.Unmarshal(encoded, new(ome.ServiceInfo)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(encoded)), "bytes/msg")
+		})
+	}
+}
+
+// BenchmarkCodecBroadcast measures the re-encoding of the JSON stored service info done for peers that negotiated a codec
+func BenchmarkCodecBroadcast(b *testing.B) {
+	info := benchmarkCertifiedService(b)
+	encoded, err := jsonCodec{}.Marshal(info)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	msg := &zebou.ZeMsg{Type: ome.RegistryEventType_Update.String(), Id: info.Id, Encoded: encoded}
+	for _, codec := range []Codec{jsonCodec{}, protoCodec{}} {
+		b.Run(codec.Name(), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := encodeMessage(msg, codec); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
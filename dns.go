@@ -0,0 +1,700 @@
+package discover
+
+import (
+	"encoding/binary"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/omecodes/common/errors"
+	"github.com/omecodes/common/utils/log"
+	"github.com/omecodes/libome"
+)
+
+const (
+	dnsTypeA    uint16 = 1
+	dnsTypeNS   uint16 = 2
+	dnsTypeSOA  uint16 = 6
+	dnsTypePTR  uint16 = 12
+	dnsTypeTXT  uint16 = 16
+	dnsTypeAAAA uint16 = 28
+	dnsTypeSRV  uint16 = 33
+	dnsTypeOPT  uint16 = 41
+	dnsTypeANY  uint16 = 255
+
+	dnsClassINET uint16 = 1
+
+	dnsFlagResponse      uint16 = 1 << 15
+	dnsFlagAuthoritative uint16 = 1 << 10
+	dnsFlagTruncated     uint16 = 1 << 9
+	dnsFlagRecursion     uint16 = 1 << 8
+
+	dnsRCodeFormat   uint16 = 1
+	dnsRCodeNXDomain uint16 = 3
+	dnsRCodeNotImpl  uint16 = 4
+	dnsRCodeRefused  uint16 = 5
+
+	dnsDefaultZone  = "discover."
+	dnsDefaultTTL   = 5
+	dnsMaxUDPSize   = 512
+	dnsMaxEDNSSize  = 4096
+	dnsMaxTXTString = 255
+	dnsMaxNameJumps = 64
+
+	// dnsTCPTimeout is how long a TCP connection may stay idle, and the time allowed to send a response
+	dnsTCPTimeout = time.Second * 10
+)
+
+type dnsQuestion struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+type dnsRR struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+}
+
+// dnsMsg is a minimal DNS message representation. Names are kept in presentation
+// format with a trailing dot, and names embedded in PTR, SRV, NS and SOA data are
+// stored uncompressed so that records can be copied from one message to another
+type dnsMsg struct {
+	ID         uint16
+	Flags      uint16
+	Questions  []dnsQuestion
+	Answers    []dnsRR
+	Authority  []dnsRR
+	Additional []dnsRR
+}
+
+func (m *dnsMsg) pack() []byte {
+	buf := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(buf[0:], m.ID)
+	binary.BigEndian.PutUint16(buf[2:], m.Flags)
+	binary.BigEndian.PutUint16(buf[4:], uint16(len(m.Questions)))
+	binary.BigEndian.PutUint16(buf[6:], uint16(len(m.Answers)))
+	binary.BigEndian.PutUint16(buf[8:], uint16(len(m.Authority)))
+	binary.BigEndian.PutUint16(buf[10:], uint16(len(m.Additional)))
+
+	for _, q := range m.Questions {
+		buf = appendDNSName(buf, q.Name)
+		buf = appendUint16(buf, q.Type)
+		buf = appendUint16(buf, q.Class)
+	}
+
+	for _, section := range [][]dnsRR{m.Answers, m.Authority, m.Additional} {
+		for _, rr := range section {
+			buf = appendDNSName(buf, rr.Name)
+			buf = appendUint16(buf, rr.Type)
+			buf = appendUint16(buf, rr.Class)
+			buf = append(buf, byte(rr.TTL>>24), byte(rr.TTL>>16), byte(rr.TTL>>8), byte(rr.TTL))
+			buf = appendUint16(buf, uint16(len(rr.Data)))
+			buf = append(buf, rr.Data...)
+		}
+	}
+	return buf
+}
+
+func unpackDNSMsg(b []byte) (*dnsMsg, error) {
+	if len(b) < 12 {
+		return nil, errors.BadInput
+	}
+
+	m := &dnsMsg{
+		ID:    binary.BigEndian.Uint16(b[0:]),
+		Flags: binary.BigEndian.Uint16(b[2:]),
+	}
+	qdCount := int(binary.BigEndian.Uint16(b[4:]))
+	anCount := int(binary.BigEndian.Uint16(b[6:]))
+	nsCount := int(binary.BigEndian.Uint16(b[8:]))
+	arCount := int(binary.BigEndian.Uint16(b[10:]))
+
+	offset := 12
+	for i := 0; i < qdCount; i++ {
+		name, next, err := readDNSName(b, offset)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(b) {
+			return nil, errors.BadInput
+		}
+		m.Questions = append(m.Questions, dnsQuestion{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(b[next:]),
+			Class: binary.BigEndian.Uint16(b[next+2:]),
+		})
+		offset = next + 4
+	}
+
+	var err error
+	sections := []*[]dnsRR{&m.Answers, &m.Authority, &m.Additional}
+	for si, count := range []int{anCount, nsCount, arCount} {
+		for i := 0; i < count; i++ {
+			var rr dnsRR
+			rr, offset, err = readDNSRR(b, offset)
+			if err != nil {
+				return nil, err
+			}
+			*sections[si] = append(*sections[si], rr)
+		}
+	}
+	return m, nil
+}
+
+func readDNSRR(b []byte, offset int) (dnsRR, int, error) {
+	var rr dnsRR
+	name, next, err := readDNSName(b, offset)
+	if err != nil {
+		return rr, 0, err
+	}
+	if next+10 > len(b) {
+		return rr, 0, errors.BadInput
+	}
+
+	rr.Name = name
+	rr.Type = binary.BigEndian.Uint16(b[next:])
+	rr.Class = binary.BigEndian.Uint16(b[next+2:])
+	rr.TTL = binary.BigEndian.Uint32(b[next+4:])
+	length := int(binary.BigEndian.Uint16(b[next+8:]))
+	start := next + 10
+	end := start + length
+	if end > len(b) {
+		return rr, 0, errors.BadInput
+	}
+
+	switch rr.Type {
+	case dnsTypePTR, dnsTypeNS:
+		target, _, err := readDNSName(b, start)
+		if err != nil {
+			return rr, 0, err
+		}
+		rr.Data = appendDNSName(nil, target)
+
+	case dnsTypeSRV:
+		if length < 7 {
+			return rr, 0, errors.BadInput
+		}
+		target, _, err := readDNSName(b, start+6)
+		if err != nil {
+			return rr, 0, err
+		}
+		rr.Data = appendDNSName(append([]byte{}, b[start:start+6]...), target)
+
+	case dnsTypeSOA:
+		mname, next, err := readDNSName(b, start)
+		if err != nil {
+			return rr, 0, err
+		}
+		rname, next, err := readDNSName(b, next)
+		if err != nil {
+			return rr, 0, err
+		}
+		if next+20 > end {
+			return rr, 0, errors.BadInput
+		}
+		rr.Data = appendDNSName(nil, mname)
+		rr.Data = appendDNSName(rr.Data, rname)
+		rr.Data = append(rr.Data, b[next:next+20]...)
+
+	default:
+		rr.Data = append([]byte{}, b[start:end]...)
+	}
+	return rr, end, nil
+}
+
+// readDNSName reads the possibly compressed name at offset and returns it with the offset that follows it
+func readDNSName(b []byte, offset int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if offset >= len(b) {
+			return "", 0, errors.BadInput
+		}
+
+		length := int(b[offset])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = offset + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+
+		case length&0xC0 == 0xC0:
+			if offset+1 >= len(b) {
+				return "", 0, errors.BadInput
+			}
+			jumps++
+			if jumps > dnsMaxNameJumps {
+				return "", 0, errors.BadInput
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(b[offset:]) & 0x3FFF)
+
+		default:
+			if offset+1+length > len(b) {
+				return "", 0, errors.BadInput
+			}
+			labels = append(labels, string(b[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
+
+func appendDNSName(b []byte, name string) []byte {
+	name = strings.TrimSuffix(name, ".")
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) > 63 {
+				label = label[:63]
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func dnsAddressRecord(name string, ip net.IP, ttl uint32) (dnsRR, bool) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return dnsRR{Name: name, Type: dnsTypeA, Class: dnsClassINET, TTL: ttl, Data: []byte(ip4)}, true
+	}
+	if ip16 := ip.To16(); ip16 != nil {
+		return dnsRR{Name: name, Type: dnsTypeAAAA, Class: dnsClassINET, TTL: ttl, Data: []byte(ip16)}, true
+	}
+	return dnsRR{}, false
+}
+
+func dnsSRVRecord(name string, port uint16, target string, ttl uint32) dnsRR {
+	data := []byte{0, 0, 0, 0}
+	data = appendUint16(data, port)
+	return dnsRR{Name: name, Type: dnsTypeSRV, Class: dnsClassINET, TTL: ttl, Data: appendDNSName(data, target)}
+}
+
+// dnsTXTRecord packs strings as TXT character-strings. Strings longer than 255 bytes are
+// split across consecutive character-strings
+func dnsTXTRecord(name string, strs []string, ttl uint32) dnsRR {
+	var data []byte
+	for _, s := range strs {
+		for {
+			chunk := s
+			if len(chunk) > dnsMaxTXTString {
+				chunk = chunk[:dnsMaxTXTString]
+			}
+			data = append(data, byte(len(chunk)))
+			data = append(data, chunk...)
+			s = s[len(chunk):]
+			if s == "" {
+				break
+			}
+		}
+	}
+	if len(data) == 0 {
+		data = []byte{0}
+	}
+	return dnsRR{Name: name, Type: dnsTypeTXT, Class: dnsClassINET, TTL: ttl, Data: data}
+}
+
+func dnsSOARecord(zone string, ttl uint32) dnsRR {
+	data := appendDNSName(nil, "ns."+zone)
+	data = appendDNSName(data, "hostmaster."+zone)
+	for _, v := range []uint32{1, 3600, 600, 86400, ttl} {
+		data = append(data, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+	return dnsRR{Name: zone, Type: dnsTypeSOA, Class: dnsClassINET, TTL: ttl, Data: data}
+}
+
+// dnsNodeHostPort splits node address into host and port. Port is 0 if address has none
+func dnsNodeHostPort(node *ome.Node) (string, uint16) {
+	host, strPort, err := net.SplitHostPort(node.Address)
+	if err != nil {
+		return node.Address, 0
+	}
+	port, _ := strconv.ParseUint(strPort, 10, 16)
+	return host, uint16(port)
+}
+
+// dnsProtocolLabel returns the SRV service label of the protocol, e.g. "_grpc"
+func dnsProtocolLabel(protocol ome.Protocol) string {
+	return "_" + strings.ToLower(protocol.String())
+}
+
+// dnsRegistry is the registry a DNS server answers from
+type dnsRegistry interface {
+	// lookupService returns the service whose id matches name case-insensitively, nil if there is none. The returned
+	// info must not be modified
+	lookupService(name string) *ome.ServiceInfo
+}
+
+// dnsServer is an authoritative DNS server that answers queries under zone from the registry content. Names are
+// matched case-insensitively, and service and node ids may contain dots
+type dnsServer struct {
+	zone     string
+	registry dnsRegistry
+	udp      net.PacketConn
+	tcp      net.Listener
+	wg       sync.WaitGroup
+
+	connsMutex sync.Mutex
+	conns      map[net.Conn]bool
+	stopped    bool
+}
+
+func (d *dnsServer) serveUDP() {
+	defer d.wg.Done()
+	buf := make([]byte, dnsMaxEDNSSize)
+	for {
+		n, addr, err := d.udp.ReadFrom(buf)
+		if err != nil {
+			if !isClosedConnError(err) {
+				log.Error("registry dns • failed to read UDP packet", log.Err(err))
+			}
+			return
+		}
+
+		query, err := unpackDNSMsg(buf[:n])
+		if err != nil {
+			log.Info("registry dns • received malformed query", log.Field("from", addr.String()))
+			continue
+		}
+
+		response := d.answer(query)
+		packed := response.pack()
+		if len(packed) > dnsUDPSize(query) {
+			response.Answers, response.Authority, response.Additional = nil, nil, nil
+			response.Flags |= dnsFlagTruncated
+			packed = response.pack()
+		}
+
+		_, err = d.udp.WriteTo(packed, addr)
+		if err != nil {
+			log.Error("registry dns • failed to send response", log.Err(err), log.Field("to", addr.String()))
+		}
+	}
+}
+
+func (d *dnsServer) serveTCP() {
+	defer d.wg.Done()
+	for {
+		conn, err := d.tcp.Accept()
+		if err != nil {
+			if !isClosedConnError(err) {
+				log.Error("registry dns • failed to accept TCP connection", log.Err(err))
+			}
+			return
+		}
+
+		if !d.trackConn(conn) {
+			_ = conn.Close()
+			return
+		}
+		d.wg.Add(1)
+		go d.handleTCPConn(conn)
+	}
+}
+
+// trackConn adds conn to the connections closed by Stop. It returns false if the server is stopped
+func (d *dnsServer) trackConn(conn net.Conn) bool {
+	d.connsMutex.Lock()
+	defer d.connsMutex.Unlock()
+	if d.stopped {
+		return false
+	}
+	d.conns[conn] = true
+	return true
+}
+
+func (d *dnsServer) handleTCPConn(conn net.Conn) {
+	defer d.wg.Done()
+	defer func() {
+		d.connsMutex.Lock()
+		delete(d.conns, conn)
+		d.connsMutex.Unlock()
+
+		if err := conn.Close(); err != nil && !isClosedConnError(err) {
+			log.Error("registry dns • failed to close TCP connection", log.Err(err))
+		}
+	}()
+
+	header := make([]byte, 2)
+	for {
+		if err := conn.SetDeadline(time.Now().Add(dnsTCPTimeout)); err != nil {
+			return
+		}
+		if _, err := readFull(conn, header); err != nil {
+			return
+		}
+
+		buf := make([]byte, binary.BigEndian.Uint16(header))
+		if _, err := readFull(conn, buf); err != nil {
+			return
+		}
+
+		query, err := unpackDNSMsg(buf)
+		if err != nil {
+			log.Info("registry dns • received malformed query", log.Field("from", conn.RemoteAddr().String()))
+			return
+		}
+
+		packed := d.answer(query).pack()
+		if _, err := conn.Write(append(appendUint16(nil, uint16(len(packed))), packed...)); err != nil {
+			log.Error("registry dns • failed to send response", log.Err(err))
+			return
+		}
+	}
+}
+
+// answer builds the response to query
+func (d *dnsServer) answer(query *dnsMsg) *dnsMsg {
+	response := &dnsMsg{
+		ID:        query.ID,
+		Flags:     dnsFlagResponse | (query.Flags & dnsFlagRecursion),
+		Questions: query.Questions,
+	}
+
+	for _, rr := range query.Additional {
+		if rr.Type == dnsTypeOPT {
+			response.Additional = append(response.Additional, dnsRR{Name: ".", Type: dnsTypeOPT, Class: dnsMaxEDNSSize})
+			break
+		}
+	}
+
+	if query.Flags&dnsFlagResponse != 0 || len(query.Questions) != 1 {
+		response.Flags |= dnsRCodeFormat
+		return response
+	}
+
+	if opcode := (query.Flags >> 11) & 0xF; opcode != 0 {
+		response.Flags |= dnsRCodeNotImpl
+		return response
+	}
+
+	q := query.Questions[0]
+	labels, inZone := d.relativeLabels(q.Name)
+	if !inZone {
+		response.Flags |= dnsRCodeRefused
+		return response
+	}
+	response.Flags |= dnsFlagAuthoritative
+
+	answers, additional, exists := d.resolve(q, labels)
+	if !exists {
+		response.Flags |= dnsRCodeNXDomain
+		response.Authority = []dnsRR{dnsSOARecord(d.zone, dnsDefaultTTL)}
+		return response
+	}
+
+	response.Answers = answers
+	response.Additional = append(additional, response.Additional...)
+	if len(answers) == 0 {
+		response.Authority = []dnsRR{dnsSOARecord(d.zone, dnsDefaultTTL)}
+	}
+	return response
+}
+
+// relativeLabels returns the labels of name that precede the zone
+func (d *dnsServer) relativeLabels(name string) ([]string, bool) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+
+	lower := strings.ToLower(name)
+	if lower == d.zone {
+		return nil, true
+	}
+
+	if !strings.HasSuffix(lower, "."+d.zone) {
+		return nil, false
+	}
+	return strings.Split(name[:len(name)-len(d.zone)-1], "."), true
+}
+
+// resolve returns answers and additional records for q. exists is false if the queried name does not exist.
+// Names are "<service>", "<node>.<service>" or "_<protocol>._tcp.<service>". As ids may contain dots, a name is
+// first looked up as a service, then as the node of the service named by each of its suffixes
+func (d *dnsServer) resolve(q dnsQuestion, labels []string) (answers []dnsRR, additional []dnsRR, exists bool) {
+	wants := func(t uint16) bool {
+		return q.Type == t || q.Type == dnsTypeANY
+	}
+
+	if len(labels) == 0 {
+		if wants(dnsTypeSOA) {
+			answers = append(answers, dnsSOARecord(d.zone, dnsDefaultTTL))
+		}
+		return answers, nil, true
+	}
+
+	if len(labels) > 2 && strings.HasPrefix(labels[0], "_") && strings.EqualFold(labels[1], "_tcp") {
+		if info := d.registry.lookupService(strings.Join(labels[2:], ".")); info != nil {
+			return d.resolveSRV(q, labels[0], info, wants)
+		}
+	}
+
+	if info := d.registry.lookupService(strings.Join(labels, ".")); info != nil {
+		for _, node := range info.Nodes {
+			host, _ := dnsNodeHostPort(node)
+			if rr, ok := dnsAddressRecord(q.Name, net.ParseIP(host), dnsDefaultTTL); ok && wants(rr.Type) {
+				answers = append(answers, rr)
+			}
+		}
+
+		if wants(dnsTypeTXT) {
+			var strs []string
+			for key, value := range info.Meta {
+				strs = append(strs, key+"="+value)
+			}
+			sort.Strings(strs)
+			answers = append(answers, dnsTXTRecord(q.Name, strs, dnsDefaultTTL))
+		}
+		return answers, nil, true
+	}
+
+	for i := 1; i < len(labels); i++ {
+		info := d.registry.lookupService(strings.Join(labels[i:], "."))
+		if info == nil {
+			continue
+		}
+
+		nodeID := strings.Join(labels[:i], ".")
+		for _, node := range info.Nodes {
+			if !strings.EqualFold(node.Id, nodeID) {
+				continue
+			}
+
+			host, _ := dnsNodeHostPort(node)
+			if rr, ok := dnsAddressRecord(q.Name, net.ParseIP(host), dnsDefaultTTL); ok && wants(rr.Type) {
+				answers = append(answers, rr)
+			}
+			return answers, nil, true
+		}
+	}
+	return nil, nil, false
+}
+
+// resolveSRV returns the SRV records of the nodes of info whose protocol label is protocol, e.g. "_grpc"
+func (d *dnsServer) resolveSRV(q dnsQuestion, protocol string, info *ome.ServiceInfo, wants func(uint16) bool) (answers []dnsRR, additional []dnsRR, exists bool) {
+	serviceName := info.Id + "." + d.zone
+	for _, node := range info.Nodes {
+		if !strings.EqualFold(dnsProtocolLabel(node.Protocol), protocol) {
+			continue
+		}
+		exists = true
+
+		if !wants(dnsTypeSRV) {
+			continue
+		}
+
+		host, port := dnsNodeHostPort(node)
+		ip := net.ParseIP(host)
+		if ip == nil {
+			answers = append(answers, dnsSRVRecord(q.Name, port, host, dnsDefaultTTL))
+			continue
+		}
+
+		target := node.Id + "." + serviceName
+		answers = append(answers, dnsSRVRecord(q.Name, port, target, dnsDefaultTTL))
+		if rr, ok := dnsAddressRecord(target, ip, dnsDefaultTTL); ok {
+			additional = append(additional, rr)
+		}
+	}
+	return answers, additional, exists
+}
+
+func (d *dnsServer) Stop() error {
+	err := d.udp.Close()
+	if tcpErr := d.tcp.Close(); err == nil {
+		err = tcpErr
+	}
+
+	d.connsMutex.Lock()
+	d.stopped = true
+	for conn := range d.conns {
+		_ = conn.Close()
+	}
+	d.connsMutex.Unlock()
+
+	d.wg.Wait()
+	return err
+}
+
+// dnsUDPSize returns the maximum UDP response size advertised by query
+func dnsUDPSize(query *dnsMsg) int {
+	for _, rr := range query.Additional {
+		if rr.Type == dnsTypeOPT && int(rr.Class) > dnsMaxUDPSize {
+			if rr.Class > dnsMaxEDNSSize {
+				return dnsMaxEDNSSize
+			}
+			return int(rr.Class)
+		}
+	}
+	return dnsMaxUDPSize
+}
+
+func readFull(conn net.Conn, buf []byte) (int, error) {
+	read := 0
+	for read < len(buf) {
+		n, err := conn.Read(buf[read:])
+		read += n
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+func isClosedConnError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "use of closed network connection")
+}
+
+// lookupService returns the earliest registered info whose id matches name case-insensitively from the index
+func (s *Server) lookupService(name string) *ome.ServiceInfo {
+	return s.index.getFold(name)
+}
+
+// serveDNS starts an authoritative DNS server for zone on UDP and TCP address
+func serveDNS(address string, zone string, registry dnsRegistry) (*dnsServer, error) {
+	if zone == "" {
+		zone = dnsDefaultZone
+	}
+	zone = strings.ToLower(strings.TrimPrefix(zone, "."))
+	if !strings.HasSuffix(zone, ".") {
+		zone += "."
+	}
+
+	d := &dnsServer{
+		zone:     zone,
+		registry: registry,
+		conns:    map[net.Conn]bool{},
+	}
+
+	var err error
+	d.udp, err = net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	d.tcp, err = net.Listen("tcp", d.udp.LocalAddr().String())
+	if err != nil {
+		_ = d.udp.Close()
+		return nil, err
+	}
+
+	d.wg.Add(2)
+	go d.serveUDP()
+	go d.serveTCP()
+
+	log.Info("[discovery] starting DNS server", log.Field("at", d.udp.LocalAddr()), log.Field("zone", zone))
+	return d, nil
+}
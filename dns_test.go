@@ -0,0 +1,360 @@
+package discover
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omecodes/libome"
+)
+
+// mapRegistry is a dnsRegistry holding services by id
+type mapRegistry map[string]*ome.ServiceInfo
+
+func (r mapRegistry) lookupService(name string) *ome.ServiceInfo {
+	if info, found := r[name]; found {
+		return info
+	}
+	for id, info := range r {
+		if strings.EqualFold(id, name) {
+			return info
+		}
+	}
+	return nil
+}
+
+func TestDNSMessageRoundTrip(t *testing.T) {
+	a, _ := dnsAddressRecord("api.discover.", net.ParseIP("10.0.0.1"), 5)
+	aaaa, _ := dnsAddressRecord("api.discover.", net.ParseIP("fd00::1"), 5)
+	msg := &dnsMsg{
+		ID:        42,
+		Flags:     dnsFlagResponse | dnsFlagAuthoritative,
+		Questions: []dnsQuestion{{Name: "api.discover.", Type: dnsTypeANY, Class: dnsClassINET}},
+		Answers: []dnsRR{
+			a,
+			aaaa,
+			dnsSRVRecord("_http._tcp.api.discover.", 8080, "a.api.discover.", 5),
+			dnsTXTRecord("api.discover.", []string{"version=1", string(make([]byte, 300))}, 5),
+		},
+		Authority:  []dnsRR{dnsSOARecord("discover.", 5)},
+		Additional: []dnsRR{{Name: ".", Type: dnsTypeOPT, Class: dnsMaxEDNSSize, Data: []byte{}}},
+	}
+
+	unpacked, err := unpackDNSMsg(msg.pack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(unpacked, msg) {
+		t.Errorf("got %+v, expected %+v", unpacked, msg)
+	}
+
+	if _, err := unpackDNSMsg(msg.pack()[:30]); err == nil {
+		t.Error("unpacked a truncated message")
+	}
+}
+
+func TestDNSCompressedNames(t *testing.T) {
+	// a question for api.discover. followed by an answer whose name points to it
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint16(b[4:], 1)
+	binary.BigEndian.PutUint16(b[6:], 1)
+	b = appendDNSName(b, "api.discover.")
+	b = appendUint16(b, dnsTypeA)
+	b = appendUint16(b, dnsClassINET)
+	b = append(b, 0xC0, 12)
+	b = appendUint16(b, dnsTypeA)
+	b = appendUint16(b, dnsClassINET)
+	b = append(b, 0, 0, 0, 5, 0, 4, 10, 0, 0, 1)
+
+	msg, err := unpackDNSMsg(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Answers[0].Name != "api.discover." {
+		t.Errorf("compressed name read as %q", msg.Answers[0].Name)
+	}
+
+	// a pointer to itself
+	loop := append(make([]byte, 12), 0xC0, 12)
+	binary.BigEndian.PutUint16(loop[4:], 1)
+	if _, err := unpackDNSMsg(loop); err == nil {
+		t.Error("unpacked a name that points to itself")
+	}
+}
+
+func testDNSRegistry() mapRegistry {
+	return mapRegistry{
+		"api": {
+			Id: "api",
+			Nodes: []*ome.Node{
+				{Id: "a", Address: "10.0.0.1:8080", Protocol: ome.Protocol_Http},
+				{Id: "b", Address: "[fd00::2]:9090", Protocol: ome.Protocol_Grpc},
+				{Id: "c", Address: "api.example.com:8080", Protocol: ome.Protocol_Http},
+			},
+			Meta: map[string]string{"version": "1", "env": "prod"},
+		},
+		"web.v2": {
+			Id:    "web.v2",
+			Nodes: []*ome.Node{{Id: "10.0.0.3:80", Address: "10.0.0.3:80", Protocol: ome.Protocol_Http}},
+		},
+		"Mixed": {
+			Id:    "Mixed",
+			Nodes: []*ome.Node{{Id: "Node", Address: "10.0.0.4:80"}},
+		},
+	}
+}
+
+func TestDNSQueries(t *testing.T) {
+	d := &dnsServer{zone: dnsDefaultZone, registry: testDNSRegistry()}
+
+	tests := []struct {
+		name       string
+		qtype      uint16
+		rcode      uint16
+		answers    []string
+		additional int
+	}{
+		{name: "api.discover.", qtype: dnsTypeA, answers: []string{"A 10.0.0.1"}},
+		{name: "api.discover.", qtype: dnsTypeAAAA, answers: []string{"AAAA fd00::2"}},
+		{name: "API.Discover.", qtype: dnsTypeA, answers: []string{"A 10.0.0.1"}},
+		{name: "api.discover.", qtype: dnsTypeTXT, answers: []string{"TXT env=prod,version=1"}},
+		{name: "b.api.discover.", qtype: dnsTypeAAAA, answers: []string{"AAAA fd00::2"}},
+		{name: "B.API.discover.", qtype: dnsTypeAAAA, answers: []string{"AAAA fd00::2"}},
+		{name: "b.api.discover.", qtype: dnsTypeA},
+		{
+			name:       "_http._tcp.api.discover.",
+			qtype:      dnsTypeSRV,
+			answers:    []string{"SRV 8080 a.api.discover.", "SRV 8080 api.example.com."},
+			additional: 1,
+		},
+		{name: "_GRPC._TCP.api.discover.", qtype: dnsTypeSRV, answers: []string{"SRV 9090 b.api.discover."}, additional: 1},
+		{name: "web.v2.discover.", qtype: dnsTypeA, answers: []string{"A 10.0.0.3"}},
+		{name: "10.0.0.3:80.web.v2.discover.", qtype: dnsTypeA, answers: []string{"A 10.0.0.3"}},
+		{name: "_http._tcp.web.v2.discover.", qtype: dnsTypeSRV, answers: []string{"SRV 80 10.0.0.3:80.web.v2.discover."}, additional: 1},
+		{name: "mixed.discover.", qtype: dnsTypeA, answers: []string{"A 10.0.0.4"}},
+		{name: "node.mixed.discover.", qtype: dnsTypeA, answers: []string{"A 10.0.0.4"}},
+		{name: "discover.", qtype: dnsTypeSOA, answers: []string{"SOA"}},
+		{name: "missing.discover.", qtype: dnsTypeA, rcode: dnsRCodeNXDomain},
+		{name: "z.api.discover.", qtype: dnsTypeA, rcode: dnsRCodeNXDomain},
+		{name: "_ftp._tcp.api.discover.", qtype: dnsTypeSRV, rcode: dnsRCodeNXDomain},
+		{name: "api.example.com.", qtype: dnsTypeA, rcode: dnsRCodeRefused},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s %d", test.name, test.qtype), func(t *testing.T) {
+			query := &dnsMsg{ID: 7, Questions: []dnsQuestion{{Name: test.name, Type: test.qtype, Class: dnsClassINET}}}
+			response, err := unpackDNSMsg(d.answer(query).pack())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if rcode := response.Flags & 0xF; rcode != test.rcode {
+				t.Fatalf("got rcode %d, expected %d", rcode, test.rcode)
+			}
+			if response.ID != query.ID || response.Flags&dnsFlagResponse == 0 {
+				t.Errorf("response has id %d and flags %x", response.ID, response.Flags)
+			}
+
+			var answers []string
+			for _, rr := range response.Answers {
+				answers = append(answers, dnsRRString(t, rr))
+			}
+			if !reflect.DeepEqual(answers, test.answers) {
+				t.Errorf("got answers %q, expected %q", answers, test.answers)
+			}
+			if len(response.Additional) != test.additional {
+				t.Errorf("got %d additional records, expected %d", len(response.Additional), test.additional)
+			}
+		})
+	}
+}
+
+// dnsRRString returns a short description of rr data
+func dnsRRString(t *testing.T, rr dnsRR) string {
+	switch rr.Type {
+	case dnsTypeA:
+		return "A " + net.IP(rr.Data).String()
+	case dnsTypeAAAA:
+		return "AAAA " + net.IP(rr.Data).String()
+	case dnsTypeSRV:
+		target, _, err := readDNSName(rr.Data, 6)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprintf("SRV %d %s", binary.BigEndian.Uint16(rr.Data[4:]), target)
+	case dnsTypeTXT:
+		var strs []byte
+		for i := 0; i < len(rr.Data); i += 1 + int(rr.Data[i]) {
+			if len(strs) > 0 {
+				strs = append(strs, ',')
+			}
+			strs = append(strs, rr.Data[i+1:i+1+int(rr.Data[i])]...)
+		}
+		return "TXT " + string(strs)
+	case dnsTypeSOA:
+		return "SOA"
+	default:
+		return fmt.Sprintf("type %d", rr.Type)
+	}
+}
+
+// exchangeDNS sends query to the DNS server at address with network, and returns the response
+func exchangeDNS(t *testing.T, network string, address string, query *dnsMsg) *dnsMsg {
+	conn, err := net.DialTimeout(network, address, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	packed := query.pack()
+	if network == "tcp" {
+		packed = append(appendUint16(nil, uint16(len(packed))), packed...)
+	}
+	if _, err := conn.Write(packed); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 65536)
+	if network == "tcp" {
+		if _, err := readFull(conn, buf[:2]); err != nil {
+			t.Fatal(err)
+		}
+		buf = buf[:binary.BigEndian.Uint16(buf)]
+		if _, err := readFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf = buf[:n]
+	}
+
+	response, err := unpackDNSMsg(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestDNSTruncation(t *testing.T) {
+	info := &ome.ServiceInfo{Id: "large"}
+	for i := 0; i < 100; i++ {
+		info.Nodes = append(info.Nodes, &ome.Node{Id: fmt.Sprint(i), Address: fmt.Sprintf("10.0.1.%d:80", i)})
+	}
+	d, err := serveDNS("127.0.0.1:0", "", mapRegistry{"large": info})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+	address := d.udp.LocalAddr().String()
+
+	query := &dnsMsg{ID: 1, Questions: []dnsQuestion{{Name: "large.discover.", Type: dnsTypeA, Class: dnsClassINET}}}
+	response := exchangeDNS(t, "udp", address, query)
+	if response.Flags&dnsFlagTruncated == 0 || len(response.Answers) != 0 {
+		t.Errorf("UDP response has %d answers and flags %x", len(response.Answers), response.Flags)
+	}
+
+	// EDNS clients get large enough responses over UDP
+	query.Additional = []dnsRR{{Name: ".", Type: dnsTypeOPT, Class: dnsMaxEDNSSize}}
+	if response := exchangeDNS(t, "udp", address, query); len(response.Answers) != 100 {
+		t.Errorf("EDNS response has %d answers", len(response.Answers))
+	}
+
+	query.Additional = nil
+	if response := exchangeDNS(t, "tcp", address, query); response.Flags&dnsFlagTruncated != 0 || len(response.Answers) != 100 {
+		t.Errorf("TCP response has %d answers and flags %x", len(response.Answers), response.Flags)
+	}
+}
+
+func TestDNSStopClosesTCPConnections(t *testing.T) {
+	d, err := serveDNS("127.0.0.1:0", "", mapRegistry{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", d.tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	eventually(t, "tracked connection", func() bool {
+		d.connsMutex.Lock()
+		defer d.connsMutex.Unlock()
+		return len(d.conns) == 1
+	})
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- d.Stop()
+	}()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(dnsTCPTimeout / 2):
+		t.Fatal("Stop waits for idle TCP connections")
+	}
+}
+
+func TestDNSServerRegistry(t *testing.T) {
+	s := startTestServer(t, &ServerConfig{DNSBindAddress: "127.0.0.1:0"})
+	defer s.Stop()
+	address := s.dns.udp.LocalAddr().String()
+
+	for _, info := range []*ome.ServiceInfo{
+		testService("Billing.API", "10.0.0.1:80"),
+		testService("web", "10.0.0.2:80"),
+		testService("WEB", "10.0.0.3:80"),
+	} {
+		if err := s.RegisterService(info); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		rcode   uint16
+		answers []string
+	}{
+		{name: "billing.api.discover.", answers: []string{"A 10.0.0.1"}},
+		{name: "BILLING.Api.discover.", answers: []string{"A 10.0.0.1"}},
+		{name: "Node.billing.api.discover.", answers: []string{"A 10.0.0.1"}},
+		{name: "web.discover.", answers: []string{"A 10.0.0.2"}},
+		{name: "WEB.discover.", answers: []string{"A 10.0.0.3"}},
+		{name: "Web.discover.", answers: []string{"A 10.0.0.2"}},
+		{name: "other.node.billing.api.discover.", rcode: dnsRCodeNXDomain},
+	}
+
+	for _, test := range tests {
+		query := &dnsMsg{ID: 3, Questions: []dnsQuestion{{Name: test.name, Type: dnsTypeA, Class: dnsClassINET}}}
+		response := exchangeDNS(t, "udp", address, query)
+		if rcode := response.Flags & 0xF; rcode != test.rcode {
+			t.Errorf("%s: got rcode %d, expected %d", test.name, rcode, test.rcode)
+			continue
+		}
+
+		var answers []string
+		for _, rr := range response.Answers {
+			answers = append(answers, dnsRRString(t, rr))
+		}
+		if !reflect.DeepEqual(answers, test.answers) {
+			t.Errorf("%s: got answers %q, expected %q", test.name, answers, test.answers)
+		}
+	}
+
+	if err := s.DeregisterService("Billing.API"); err != nil {
+		t.Fatal(err)
+	}
+	query := &dnsMsg{ID: 4, Questions: []dnsQuestion{{Name: "billing.api.discover.", Type: dnsTypeA, Class: dnsClassINET}}}
+	if response := exchangeDNS(t, "udp", address, query); response.Flags&0xF != dnsRCodeNXDomain {
+		t.Errorf("deregistered service resolved with flags %x", response.Flags)
+	}
+}
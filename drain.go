@@ -0,0 +1,121 @@
+package discover
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/omecodes/common/utils/log"
+	"github.com/omecodes/zebou"
+)
+
+// msgDrain tells clients the server is shutting down. Its encoded value is the address of the server
+// clients must connect to instead, if any. Clients send it back once they are connected to that server
+const msgDrain = "Drain"
+
+const drainCheckInterval = time.Millisecond * 50
+
+// Drain puts the server in drain mode: registrations and updates are rejected, connected clients are told to migrate
+// to redirect if it is not empty, and in-flight messages are waited for until ctx is done. With a redirect, Drain also
+// waits for the clients to disconnect and their services to be removed from the store until ctx is done. The queued
+// webhook events are then delivered or dead-lettered until ctx is done. From then on, the peers that disconnect are
+// removed from the registry without broadcasting their deregistrations, as their owners register them again on the
+// new server
+func (s *Server) Drain(ctx context.Context, redirect string) error {
+	if !atomic.CompareAndSwapInt32(&s.draining, 0, 1) {
+		return nil
+	}
+	s.drainRedirect.Store(redirect)
+	log.Info("registry server • draining", log.Field("redirect", redirect))
+
+	s.broadcast(ctx, &zebou.ZeMsg{
+		Type:    msgDrain,
+		Encoded: []byte(redirect),
+	})
+
+	if err := s.waitHandled(ctx); err != nil {
+		return err
+	}
+
+	if redirect != "" {
+		s.waitPeersMigrated(ctx)
+	}
+
+	if s.webhooks != nil {
+		if err := s.webhooks.flush(ctx); err != nil {
+			return err
+		}
+	}
+
+	if syncer, ok := s.auditSink.(interface{ Sync() error }); ok {
+		if err := syncer.Sync(); err != nil {
+			log.Error("registry server • failed to flush audit sink", log.Err(err))
+			return err
+		}
+	}
+	return nil
+}
+
+// Shutdown drains the server then stops it. The server is stopped even if draining failed
+func (s *Server) Shutdown(ctx context.Context, redirect string) error {
+	err := s.Drain(ctx, redirect)
+	if stopErr := s.Stop(); err == nil {
+		err = stopErr
+	}
+	return err
+}
+
+// waitHandled waits until the in-flight messages are handled, or ctx is done
+func (s *Server) waitHandled(ctx context.Context) error {
+	handled := make(chan struct{})
+	go func() {
+		// taking the write lock waits for the handlers that hold the read lock
+		s.handling.Lock()
+		s.handling.Unlock()
+		close(handled)
+	}()
+
+	select {
+	case <-handled:
+		return nil
+	case <-ctx.Done():
+		log.Error("registry server • in-flight messages not handled before drain deadline", log.Err(ctx.Err()))
+		return ctx.Err()
+	}
+}
+
+// waitPeersMigrated waits until all the peers have disconnected to migrate and their services are removed from the
+// store, or ctx is done
+func (s *Server) waitPeersMigrated(ctx context.Context) {
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+
+	// sessions are deleted once ClientQuit has removed the peer services
+	for s.sessionCount() > 0 {
+		select {
+		case <-ctx.Done():
+			log.Info("registry server • peers still connected at drain deadline", log.Field("count", s.sessionCount()))
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handlePeerMigrated closes the connection of peer, which is connected to the redirect server, so that it leaves
+func (s *Server) handlePeerMigrated(peer *zebou.PeerInfo) {
+	log.Info("registry server • peer migrated", log.Field("peer", peer.ID), log.Field("addr", peer.Address))
+	s.identities.closeConn(peer.Address)
+}
+
+func (s *Server) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// rejectWhileDraining tells the peer of ctx the server is draining, in answer to a registration
+func (s *Server) rejectWhileDraining(ctx context.Context, msg *zebou.ZeMsg) {
+	log.Info("registry server • rejected registration while draining", log.Field("service", msg.Id))
+	redirect, _ := s.drainRedirect.Load().(string)
+	if err := s.reply(ctx, &zebou.ZeMsg{Type: msgDrain, Encoded: []byte(redirect)}); err != nil {
+		log.Error("registry server • could not send message", log.Err(err))
+	}
+}
@@ -0,0 +1,174 @@
+package discover
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/omecodes/libome"
+)
+
+// auditRecorder is an audit sink that keeps the records in memory
+type auditRecorder struct {
+	mutex   sync.Mutex
+	records []*AuditRecord
+}
+
+func (r *auditRecorder) Write(record *AuditRecord) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.records = append(r.records, record)
+	return nil
+}
+
+func (r *auditRecorder) Close() error {
+	return nil
+}
+
+// actions returns the actions of the records of service id
+func (r *auditRecorder) actions(id string) []AuditAction {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var actions []AuditAction
+	for _, record := range r.records {
+		if record.ServiceID == id {
+			actions = append(actions, record.Action)
+		}
+	}
+	return actions
+}
+
+func TestDrainRejectsRegistrations(t *testing.T) {
+	metrics := NewPrometheusMetrics()
+	s := startTestServer(t, &ServerConfig{Metrics: metrics})
+	defer s.Stop()
+
+	c := connectTestClient(t, s, nil)
+	defer c.Stop()
+	if err := c.RegisterService(testService("a", "10.0.0.1:80")); err != nil {
+		t.Fatal(err)
+	}
+	waitHandled(t, s, metrics, "Register", 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Drain(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Drain(ctx, ""); err != nil {
+		t.Errorf("draining again failed: %s", err)
+	}
+
+	if err := c.RegisterService(testService("b", "10.0.0.2:80")); err != nil {
+		t.Fatal(err)
+	}
+	waitHandled(t, s, metrics, "Register", 2)
+	if hasService(s, "b") {
+		t.Error("registration accepted while draining")
+	}
+	if !hasService(s, "a") {
+		t.Error("service removed while its owner is still connected")
+	}
+}
+
+func TestDrainWaitsForMigratedPeers(t *testing.T) {
+	sink := new(auditRecorder)
+	s := startTestServer(t, &ServerConfig{AuditSink: sink})
+	defer s.Stop()
+	target := startTestServer(t, &ServerConfig{Name: "target"})
+	defer target.Stop()
+
+	c := connectTestClient(t, s, nil)
+	defer c.Stop()
+	if err := c.RegisterService(testService("a", "10.0.0.1:80")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "registration", func() bool { return hasService(s, "a") })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Drain(ctx, target.listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the peer has migrated and its services are removed by the time Drain returns
+	if entries, err := s.store.GetForService("a"); err != nil || len(entries) > 0 {
+		t.Errorf("got %d stored entries after drain: %v", len(entries), err)
+	}
+	if hasService(s, "a") {
+		t.Error("migrated service still registered after drain")
+	}
+	actions := sink.actions("a")
+	if len(actions) != 2 || actions[1] != AuditClientQuit {
+		t.Errorf("got audit actions %v", actions)
+	}
+
+	eventually(t, "registration on the target", func() bool { return hasService(target, "a") })
+}
+
+func TestDrainDoesNotBroadcastDeregistrations(t *testing.T) {
+	s := startTestServer(t, &ServerConfig{})
+	defer s.Stop()
+	target := startTestServer(t, &ServerConfig{Name: "target"})
+	defer target.Stop()
+
+	owner := connectTestClient(t, s, nil)
+	defer owner.Stop()
+	if err := owner.RegisterService(testService("a", "10.0.0.1:80")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "registration", func() bool { return hasService(s, "a") })
+
+	// the observer ignores the drain message and stays connected
+	peer, msgs := connectRawPeer(t, s)
+	sendHello(t, peer, &hello{Version: ProtocolVersion, Codecs: []string{CodecJSON}, Capabilities: []Capability{CapabilityDrain}})
+	if types := receiveTypes(t, msgs, msgSynced, 5*time.Second); len(types) == 0 || types[len(types)-1] != msgSynced {
+		t.Fatalf("got %v", types)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if err := s.Drain(ctx, target.listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "migration", func() bool { return !hasService(s, "a") && hasService(target, "a") })
+
+	types := receiveTypes(t, msgs, "", 200*time.Millisecond)
+	if len(types) != 1 || types[0] != msgDrain {
+		t.Errorf("observer received %v, want only %s", types, msgDrain)
+	}
+	for _, msgType := range types {
+		if msgType == ome.RegistryEventType_DeRegister.String() {
+			t.Error("deregistration broadcast while draining")
+		}
+	}
+}
+
+func TestShutdownStopsAfterDrainDeadline(t *testing.T) {
+	s := startTestServer(t, &ServerConfig{})
+	address := s.listener.Addr().String()
+
+	// a message being handled holds the read lock until the drain deadline
+	s.handling.RLock()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := s.Shutdown(ctx, "")
+	s.handling.RUnlock()
+
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected the drain deadline error, got %v", err)
+	}
+	if !s.isDraining() {
+		t.Error("server is not draining")
+	}
+
+	c := NewZebouClient(address, nil)
+	defer c.Stop()
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer waitCancel()
+	if err := c.WaitSynced(waitCtx); err == nil {
+		t.Error("client synced with a stopped server")
+	}
+}
@@ -0,0 +1,496 @@
+package discover
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/omecodes/common/errors"
+	"github.com/omecodes/common/utils/log"
+	"github.com/omecodes/libome"
+	"github.com/omecodes/zebou"
+)
+
+// ProtocolVersion is the version of the registry protocol implemented by this package
+const ProtocolVersion = 1
+
+// MinProtocolVersion is the oldest protocol version of a peer this package can talk to
+const MinProtocolVersion = 1
+
+const (
+	// msgHello is sent by clients when they connect. It holds a JSON encoded hello
+	msgHello = "Hello"
+	// msgWelcome answers msgHello. It holds a JSON encoded welcome
+	msgWelcome = "Welcome"
+	// msgError reports a protocol error to the peer. It holds a JSON encoded protocolError
+	msgError = "Error"
+)
+
+// Capability names an optional protocol feature. A feature is only used with a peer if both ends advertised it in
+// the handshake, which lets new features be rolled out to a fleet of mixed versions
+type Capability string
+
+const (
+	// CapabilityCodec is the negotiation of the codec of service infos
+	CapabilityCodec Capability = "codec"
+	// CapabilityNodeList is the deregistration of several nodes in one message, their ids being joined with '|'.
+	// Peers without it get one message per node
+	CapabilityNodeList Capability = "node-list"
+	// CapabilityPeers is the listing of the peers connected to the server
+	CapabilityPeers Capability = "peers"
+	// CapabilityDrain is the redirection of clients when the server drains
+	CapabilityDrain Capability = "drain"
+	// CapabilityPatch is the update of services by patches of their nodes and meta instead of their full info
+	CapabilityPatch Capability = "patch"
+	// CapabilityBatch is the sending of several messages in one frame
+	CapabilityBatch Capability = "batch"
+	// CapabilityCompression is the compression of the frames sent by the server
+	CapabilityCompression Capability = "compression"
+	// CapabilityAdmin is the deregistration of the services of other peers by admins
+	CapabilityAdmin Capability = "admin"
+	// CapabilityTracing is the propagation of the trace context in the message headers. Peers without it would read
+	// the headers as part of the message type
+	CapabilityTracing Capability = "tracing"
+)
+
+// capabilities are the capabilities implemented by this package
+var capabilities = []Capability{CapabilityCodec, CapabilityNodeList, CapabilityPeers, CapabilityDrain, CapabilityPatch,
+	CapabilityBatch, CapabilityCompression, CapabilityAdmin, CapabilityTracing}
+
+// Codes of the protocol errors
+const (
+	errorIncompatibleVersion = "incompatible_version"
+	errorUnsupportedMessage  = "unsupported_message"
+)
+
+// protocolError is sent to peers whose version or messages are not supported
+type protocolError struct {
+	Code    string `json:"code"`
+	Type    string `json:"type,omitempty"`
+	Service string `json:"service,omitempty"`
+	Message string `json:"message"`
+}
+
+// helloTimeout is how long the server waits for the hello of a new peer before sending it the registry content.
+// Clients that predate the handshake never send one, they are served JSON once it expires
+const helloTimeout = time.Second
+
+// hello is the handshake request of a client
+type hello struct {
+	Version      int          `json:"version"`
+	MinVersion   int          `json:"min_version,omitempty"`
+	Codecs       []string     `json:"codecs"`
+	Compressions []string     `json:"compressions,omitempty"`
+	Capabilities []Capability `json:"capabilities,omitempty"`
+}
+
+// welcome is the handshake response of the server. Its capabilities are the ones both ends support
+type welcome struct {
+	Version      int          `json:"version"`
+	Codec        string       `json:"codec"`
+	Compression  string       `json:"compression,omitempty"`
+	Capabilities []Capability `json:"capabilities,omitempty"`
+}
+
+// compatibleVersion reports whether a peer of version, that cannot talk to peers older than minVersion, can talk to this package
+func compatibleVersion(version int, minVersion int) bool {
+	return version >= MinProtocolVersion && minVersion <= ProtocolVersion
+}
+
+// commonCapabilities returns the capabilities of offered that this package implements
+func commonCapabilities(offered []Capability) []Capability {
+	var common []Capability
+	for _, c := range offered {
+		if hasCapability(capabilities, c) {
+			common = append(common, c)
+		}
+	}
+	return common
+}
+
+func hasCapability(list []Capability, c Capability) bool {
+	for _, item := range list {
+		if item == c {
+			return true
+		}
+	}
+	return false
+}
+
+// adaptMessage returns the messages to send to a peer with the given capabilities in place of msg
+func adaptMessage(msg *zebou.ZeMsg, peerCapabilities []Capability) []*zebou.ZeMsg {
+	if messageType(msg) != ome.RegistryEventType_DeRegisterNode.String() || hasCapability(peerCapabilities, CapabilityNodeList) {
+		return []*zebou.ZeMsg{msg}
+	}
+
+	var messages []*zebou.ZeMsg
+	for _, node := range strings.Split(string(msg.Encoded), "|") {
+		messages = append(messages, &zebou.ZeMsg{Type: msg.Type, Id: msg.Id, Encoded: []byte(node)})
+	}
+	return messages
+}
+
+// peerSession is the server side state of a connected peer. Messages sent to the peer go through its session so that
+// they are encoded with the negotiated codec and never written concurrently to the stream
+type peerSession struct {
+	ctx     context.Context
+	info    *PeerInfo
+	limiter *tokenBucket
+
+	mutex        sync.Mutex
+	codec        Codec
+	compression  string
+	capabilities []Capability
+	rejected     bool
+	synced       bool
+	closed       bool
+	flushing     bool
+	pending      []*zebou.ZeMsg
+
+	// writeMutex serializes the writes to the peer stream
+	writeMutex sync.Mutex
+	// mutations serializes the registrations of the peer
+	mutations sync.Mutex
+
+	greeted   chan struct{}
+	greetOnce sync.Once
+}
+
+func newPeerSession(ctx context.Context, info *PeerInfo) *peerSession {
+	return &peerSession{
+		ctx:     ctx,
+		info:    info,
+		codec:   jsonCodec{},
+		greeted: make(chan struct{}),
+	}
+}
+
+// send writes msgs, encoded with the session codec, to the peer. They are sent in batches if the peer supports it
+func (p *peerSession) send(msgs ...*zebou.ZeMsg) error {
+	p.writeMutex.Lock()
+	defer p.writeMutex.Unlock()
+
+	p.mutex.Lock()
+	closed, codec, compression := p.closed, p.codec, p.compression
+	batch := hasCapability(p.capabilities, CapabilityBatch)
+	p.mutex.Unlock()
+
+	if closed {
+		return nil
+	}
+
+	frames := make([]*zebou.ZeMsg, 0, len(msgs))
+	for _, msg := range msgs {
+		encoded, err := encodeMessage(msg, codec)
+		if err != nil {
+			return err
+		}
+		frames = append(frames, encoded)
+	}
+
+	if batch && len(frames) > 1 {
+		var err error
+		frames, err = packBatches(frames)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, frame := range frames {
+		if compression != "" {
+			var err error
+			frame, err = compressMessage(frame, compression)
+			if err != nil {
+				return err
+			}
+		}
+		if err := zebou.Send(p.ctx, frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliver sends msg to the peer once it has received the registry content, adapted to the peer capabilities.
+// The messages delivered while previous ones are being written are sent together
+func (p *peerSession) deliver(msg *zebou.ZeMsg) error {
+	p.mutex.Lock()
+	if p.rejected || p.closed {
+		p.mutex.Unlock()
+		return nil
+	}
+
+	p.pending = append(p.pending, adaptMessage(msg, p.capabilities)...)
+	if !p.synced || p.flushing {
+		p.mutex.Unlock()
+		return nil
+	}
+	p.flushing = true
+	p.mutex.Unlock()
+
+	return p.flush()
+}
+
+// flush writes the pending messages until there are none left. The caller must have set flushing
+func (p *peerSession) flush() error {
+	for {
+		p.mutex.Lock()
+		pending := p.pending
+		p.pending = nil
+		if len(pending) == 0 || p.closed {
+			p.flushing = false
+			p.mutex.Unlock()
+			return nil
+		}
+		p.mutex.Unlock()
+
+		if err := p.send(pending...); err != nil {
+			p.mutex.Lock()
+			p.flushing = false
+			p.mutex.Unlock()
+			return err
+		}
+	}
+}
+
+// close drops the messages sent to the peer from now on
+func (p *peerSession) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closed = true
+	p.pending = nil
+}
+
+func (p *peerSession) currentCodec() Codec {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.codec
+}
+
+// markSynced sends the messages delivered during the initial sync
+func (p *peerSession) markSynced() error {
+	p.mutex.Lock()
+	p.synced = true
+	if p.flushing {
+		p.mutex.Unlock()
+		return nil
+	}
+	p.flushing = true
+	p.mutex.Unlock()
+
+	return p.flush()
+}
+
+// supports reports whether the peer negotiated capability c
+func (p *peerSession) supports(c Capability) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return hasCapability(p.capabilities, c)
+}
+
+func (p *peerSession) isRejected() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.rejected
+}
+
+// greet negotiates the codec, protocol version and capabilities offered by the peer hello. It returns an error
+// if the peer version is not compatible, in which case the peer gets no registry content. The registry content is
+// only sent once markGreeted is called
+func (p *peerSession) greet(h *hello, codecs []string, compressions []string) (*welcome, error) {
+	p.mutex.Lock()
+	p.info.Version = h.Version
+	if compatibleVersion(h.Version, h.MinVersion) {
+		p.codec = negotiateCodec(h.Codecs, codecs)
+		p.capabilities = commonCapabilities(h.Capabilities)
+		if hasCapability(p.capabilities, CapabilityCompression) {
+			p.compression = negotiateCompression(h.Compressions, compressions)
+		}
+		p.info.Codec = p.codec.Name()
+		p.info.Compression = p.compression
+		p.info.Capabilities = capabilityNames(p.capabilities)
+	} else {
+		p.rejected = true
+	}
+	rejected := p.rejected
+	p.mutex.Unlock()
+
+	if rejected {
+		return nil, fmt.Errorf("%w: protocol version %d (min %d) is not compatible with version %d (min %d)",
+			errors.NotSupported, h.Version, h.MinVersion, ProtocolVersion, MinProtocolVersion)
+	}
+	return &welcome{Version: ProtocolVersion, Codec: p.codec.Name(), Compression: p.compression, Capabilities: p.capabilities}, nil
+}
+
+// markGreeted lets syncPeer send the registry content
+func (p *peerSession) markGreeted() {
+	p.greetOnce.Do(func() {
+		close(p.greeted)
+	})
+}
+
+func capabilityNames(list []Capability) []string {
+	var names []string
+	for _, c := range list {
+		names = append(names, string(c))
+	}
+	return names
+}
+
+// waitGreeted waits for the peer hello until timeout
+func (p *peerSession) waitGreeted(timeout time.Duration) {
+	select {
+	case <-p.greeted:
+	case <-time.After(timeout):
+		log.Info("registry server • no hello received, using JSON", log.Field("peer", p.info.ID))
+	}
+}
+
+// session returns the session of the peer id, or nil if it is not connected
+func (s *Server) session(id string) *peerSession {
+	if o, found := s.peers.Load(id); found {
+		return o.(*peerSession)
+	}
+	return nil
+}
+
+// handleHello answers the hello of the peer of ctx
+func (s *Server) handleHello(ctx context.Context, msg *zebou.ZeMsg) {
+	peer := zebou.Peer(ctx)
+	session := s.session(peer.ID)
+	if session == nil {
+		return
+	}
+
+	h := new(hello)
+	if err := json.Unmarshal(msg.Encoded, h); err != nil {
+		log.Error("registry server • failed to decode hello", log.Err(err), log.Field("peer", peer.ID))
+		return
+	}
+
+	// the welcome, or the rejection, is sent before the registry content so that the peer knows the negotiated
+	// capabilities once it is synced
+	defer session.markGreeted()
+
+	w, err := session.greet(h, s.codecs, s.compressions)
+	if err != nil {
+		log.Error("registry server • rejected incompatible peer", log.Err(err), log.Field("peer", peer.ID))
+		s.replyError(ctx, &protocolError{Code: errorIncompatibleVersion, Type: msgHello, Message: err.Error()})
+		return
+	}
+
+	encoded, err := json.Marshal(w)
+	if err != nil {
+		log.Error("registry server • failed to encode welcome", log.Err(err))
+		return
+	}
+
+	if err := session.send(&zebou.ZeMsg{Type: msgWelcome, Encoded: encoded}); err != nil {
+		log.Error("registry server • could not send message", log.Err(err))
+		return
+	}
+	log.Info("registry server • peer greeted", log.Field("peer", peer.ID), log.Field("version", h.Version),
+		log.Field("codec", w.Codec), log.Field("compression", w.Compression), log.Field("capabilities", w.Capabilities))
+}
+
+// replyError sends e to the peer of ctx
+func (s *Server) replyError(ctx context.Context, e *protocolError) {
+	encoded, err := json.Marshal(e)
+	if err != nil {
+		log.Error("registry server • failed to encode protocol error", log.Err(err))
+		return
+	}
+	if err := s.reply(ctx, &zebou.ZeMsg{Type: msgError, Encoded: encoded}); err != nil {
+		log.Error("registry server • could not send message", log.Err(err))
+	}
+}
+
+// sendHello starts the handshake on a new connection of messenger
+func (m *MsgClient) sendHello(messenger *zebou.Client) error {
+	encoded, err := json.Marshal(&hello{
+		Version:      ProtocolVersion,
+		MinVersion:   MinProtocolVersion,
+		Codecs:       m.offeredCodecs(),
+		Compressions: m.offeredCompressions(),
+		Capabilities: capabilities,
+	})
+	if err != nil {
+		return err
+	}
+	return messenger.SendMsg(&zebou.ZeMsg{Type: msgHello, Encoded: encoded})
+}
+
+// handleWelcome switches to the codec and capabilities negotiated by the server
+func (m *MsgClient) handleWelcome(msg *zebou.ZeMsg) {
+	w := new(welcome)
+	if err := json.Unmarshal(msg.Encoded, w); err != nil {
+		log.Error("registry • failed to decode welcome", log.Err(err))
+		return
+	}
+
+	if !compatibleVersion(w.Version, 0) {
+		m.reject(fmt.Errorf("%w: server protocol version %d is older than %d", errors.NotSupported, w.Version, MinProtocolVersion))
+		return
+	}
+
+	codec, found := codecs[w.Codec]
+	if !found {
+		log.Error("registry • server selected an unknown codec", log.Field("codec", w.Codec))
+		return
+	}
+	m.codec.Store(clientCodec{codec})
+	m.server.Store(serverInfo{version: w.Version, capabilities: commonCapabilities(w.Capabilities)})
+	log.Info("registry • connected to server", log.Field("version", w.Version), log.Field("codec", w.Codec),
+		log.Field("compression", w.Compression), log.Field("capabilities", w.Capabilities))
+}
+
+// handleError handles a protocol error reported by the server
+func (m *MsgClient) handleError(msg *zebou.ZeMsg) {
+	e := new(protocolError)
+	if err := json.Unmarshal(msg.Encoded, e); err != nil {
+		log.Error("registry • failed to decode protocol error", log.Err(err))
+		return
+	}
+
+	switch e.Code {
+	case errorIncompatibleVersion:
+		m.reject(fmt.Errorf("%w: %s", errors.NotSupported, e.Message))
+
+	case errorRateLimited, errorQuotaExceeded, errorInvalidService, errorAdmissionDenied, errorForbidden:
+		m.getMetrics().Add(MetricClientRejections, 1, map[string]string{"code": e.Code})
+		log.Error("registry • server rejected mutation", log.Field("code", e.Code), log.Field("type", e.Type),
+			log.Field("service", e.Service), log.Field("message", e.Message))
+
+	default:
+		log.Error("registry • server reported a protocol error", log.Field("code", e.Code), log.Field("type", e.Type), log.Field("message", e.Message))
+	}
+}
+
+// reject records that the server cannot be talked to. WaitSynced returns err from then on
+func (m *MsgClient) reject(err error) {
+	log.Error("registry • incompatible server", log.Err(err))
+	m.rejectOnce.Do(func() {
+		m.rejectErr = err
+		close(m.rejected)
+	})
+}
+
+// serverInfo is what the client knows of the server it is connected to
+type serverInfo struct {
+	version      int
+	capabilities []Capability
+}
+
+// ServerSupports reports whether the server the client is connected to negotiated capability c. It is false until
+// the server answered the handshake, and with servers that predate it
+func (m *MsgClient) ServerSupports(c Capability) bool {
+	return hasCapability(m.server.Load().(serverInfo).capabilities, c)
+}
+
+// serverGreeted reports whether the server answered the handshake
+func (m *MsgClient) serverGreeted() bool {
+	return m.server.Load().(serverInfo).version > 0
+}
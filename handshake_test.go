@@ -0,0 +1,340 @@
+package discover
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omecodes/common/errors"
+	"github.com/omecodes/libome"
+	"github.com/omecodes/zebou"
+)
+
+// connectRawFrames connects a zebou client to s and returns the frames it receives.
+// The client is disconnected when s stops: zebou clients cannot be stopped while connected without a data race
+func connectRawFrames(s *Server) (*zebou.Client, <-chan *zebou.ZeMsg) {
+	peer := zebou.NewClient(s.listener.Addr().String(), nil)
+	peer.Connect()
+
+	frames := make(chan *zebou.ZeMsg, 64)
+	go func() {
+		defer close(frames)
+		for {
+			frame, err := peer.GetMessage()
+			if err != nil {
+				return
+			}
+			frames <- frame
+		}
+	}()
+	return peer, frames
+}
+
+// connectRawPeer connects a zebou client to s and returns the messages it receives, unbatched and decompressed
+func connectRawPeer(t *testing.T, s *Server) (*zebou.Client, <-chan *zebou.ZeMsg) {
+	peer, frames := connectRawFrames(s)
+
+	msgs := make(chan *zebou.ZeMsg, 64)
+	go func() {
+		defer close(msgs)
+		for frame := range frames {
+			read, err := readFrame(frame)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for _, msg := range read {
+				msgs <- msg
+			}
+		}
+	}()
+	return peer, msgs
+}
+
+// sendHello sends h on behalf of peer
+func sendHello(t *testing.T, peer *zebou.Client, h *hello) {
+	encoded, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.SendMsg(&zebou.ZeMsg{Type: msgHello, Encoded: encoded}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// receiveTypes returns the types of the messages received until one of type last, or until timeout
+func receiveTypes(t *testing.T, msgs <-chan *zebou.ZeMsg, last string, timeout time.Duration) []string {
+	var types []string
+	deadline := time.After(timeout)
+	for {
+		select {
+		case msg, ok := <-msgs:
+			if !ok {
+				return types
+			}
+			types = append(types, messageType(msg))
+			if messageType(msg) == last {
+				return types
+			}
+		case <-deadline:
+			return types
+		}
+	}
+}
+
+func TestCompatibleVersion(t *testing.T) {
+	tests := []struct {
+		version    int
+		minVersion int
+		compatible bool
+	}{
+		{version: ProtocolVersion, minVersion: MinProtocolVersion, compatible: true},
+		{version: ProtocolVersion, compatible: true},
+		{version: ProtocolVersion + 1, minVersion: ProtocolVersion, compatible: true},
+		{version: ProtocolVersion + 2, minVersion: ProtocolVersion + 1, compatible: false},
+		{version: MinProtocolVersion - 1, compatible: false},
+		{version: 0, compatible: false},
+	}
+
+	for _, test := range tests {
+		if compatible := compatibleVersion(test.version, test.minVersion); compatible != test.compatible {
+			t.Errorf("compatibleVersion(%d, %d) = %v, want %v", test.version, test.minVersion, compatible, test.compatible)
+		}
+	}
+}
+
+func TestAdaptMessage(t *testing.T) {
+	tests := []struct {
+		name         string
+		msg          *zebou.ZeMsg
+		capabilities []Capability
+		want         []string
+	}{
+		{
+			name:         "node list",
+			msg:          &zebou.ZeMsg{Type: ome.RegistryEventType_DeRegisterNode.String(), Id: "a", Encoded: []byte("n1|n2")},
+			capabilities: []Capability{CapabilityNodeList},
+			want:         []string{"n1|n2"},
+		},
+		{
+			name: "one message per node",
+			msg:  &zebou.ZeMsg{Type: ome.RegistryEventType_DeRegisterNode.String(), Id: "a", Encoded: []byte("n1|n2")},
+			want: []string{"n1", "n2"},
+		},
+		{
+			name: "other type",
+			msg:  &zebou.ZeMsg{Type: ome.RegistryEventType_DeRegister.String(), Id: "a", Encoded: []byte("n1|n2")},
+			want: []string{"n1|n2"},
+		},
+	}
+
+	for _, test := range tests {
+		var encoded []string
+		for _, msg := range adaptMessage(test.msg, test.capabilities) {
+			if msg.Type != test.msg.Type || msg.Id != test.msg.Id {
+				t.Errorf("%s: got message %s %s", test.name, msg.Type, msg.Id)
+			}
+			encoded = append(encoded, string(msg.Encoded))
+		}
+		if !reflect.DeepEqual(encoded, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, encoded, test.want)
+		}
+	}
+}
+
+func TestGreet(t *testing.T) {
+	tests := []struct {
+		name         string
+		hello        *hello
+		welcome      *welcome
+		compressions []string
+	}{
+		{
+			name: "negotiated",
+			hello: &hello{Version: ProtocolVersion, MinVersion: MinProtocolVersion, Codecs: []string{CodecProto, CodecJSON},
+				Compressions: []string{CompressionGzip}, Capabilities: []Capability{CapabilityCompression, "unknown", CapabilityAdmin}},
+			welcome: &welcome{Version: ProtocolVersion, Codec: CodecProto, Compression: CompressionGzip,
+				Capabilities: []Capability{CapabilityCompression, CapabilityAdmin}},
+			compressions: []string{CompressionGzip},
+		},
+		{
+			name: "compression without capability",
+			hello: &hello{Version: ProtocolVersion, Codecs: []string{CodecJSON}, Compressions: []string{CompressionGzip},
+				Capabilities: []Capability{CapabilityAdmin}},
+			welcome:      &welcome{Version: ProtocolVersion, Codec: CodecJSON, Capabilities: []Capability{CapabilityAdmin}},
+			compressions: []string{CompressionGzip},
+		},
+		{
+			name: "compression not accepted",
+			hello: &hello{Version: ProtocolVersion, Codecs: []string{CodecProto}, Compressions: []string{CompressionGzip},
+				Capabilities: []Capability{CapabilityCompression}},
+			welcome: &welcome{Version: ProtocolVersion, Codec: CodecJSON, Capabilities: []Capability{CapabilityCompression}},
+		},
+	}
+
+	for _, test := range tests {
+		session := newPeerSession(context.Background(), &PeerInfo{ID: "peer"})
+		codecs := []string{CodecJSON}
+		if test.welcome.Codec != CodecJSON {
+			codecs = append(codecs, test.welcome.Codec)
+		}
+
+		w, err := session.greet(test.hello, codecs, test.compressions)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(w, test.welcome) {
+			t.Errorf("%s: got welcome %+v, want %+v", test.name, w, test.welcome)
+		}
+		if session.currentCodec().Name() != test.welcome.Codec || session.info.Codec != test.welcome.Codec {
+			t.Errorf("%s: session codec is %s", test.name, session.currentCodec().Name())
+		}
+		if session.info.Version != test.hello.Version || session.info.Compression != test.welcome.Compression {
+			t.Errorf("%s: got peer info %+v", test.name, session.info)
+		}
+
+		select {
+		case <-session.greeted:
+			t.Errorf("%s: registry content unblocked before the welcome was sent", test.name)
+		default:
+		}
+		session.markGreeted()
+		session.markGreeted()
+		session.waitGreeted(time.Second)
+	}
+}
+
+func TestGreetRejectsIncompatibleVersion(t *testing.T) {
+	session := newPeerSession(context.Background(), &PeerInfo{ID: "peer"})
+	_, err := session.greet(&hello{Version: ProtocolVersion + 2, MinVersion: ProtocolVersion + 1, Codecs: []string{CodecProto},
+		Capabilities: capabilities}, []string{CodecJSON, CodecProto}, nil)
+	if err == nil || !strings.HasPrefix(err.Error(), errors.NotSupported.Error()) {
+		t.Fatalf("expected a not supported error, got %v", err)
+	}
+	if !session.isRejected() {
+		t.Error("session is not rejected")
+	}
+	if session.supports(CapabilityAdmin) || session.currentCodec().Name() != CodecJSON {
+		t.Error("rejected session negotiated capabilities")
+	}
+}
+
+func TestIncompatiblePeerGetsNoRegistryContent(t *testing.T) {
+	s := startTestServer(t, &ServerConfig{})
+	defer s.Stop()
+
+	owner := connectTestClient(t, s, nil)
+	defer owner.Stop()
+	if err := owner.RegisterService(testService("a", "10.0.0.1:80")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "registration", func() bool { return hasService(s, "a") })
+
+	peer, msgs := connectRawPeer(t, s)
+	sendHello(t, peer, &hello{Version: ProtocolVersion + 2, MinVersion: ProtocolVersion + 1, Codecs: []string{CodecJSON}})
+
+	select {
+	case msg := <-msgs:
+		if messageType(msg) != msgError {
+			t.Fatalf("expected an error, got %s", msg.Type)
+		}
+		e := new(protocolError)
+		if err := json.Unmarshal(msg.Encoded, e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Code != errorIncompatibleVersion || e.Type != msgHello {
+			t.Errorf("got error %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the rejection")
+	}
+
+	if types := receiveTypes(t, msgs, msgSynced, 2*helloTimeout); len(types) > 0 {
+		t.Errorf("rejected peer received %v", types)
+	}
+}
+
+func TestLegacyPeerWithoutHello(t *testing.T) {
+	s := startTestServer(t, &ServerConfig{})
+	defer s.Stop()
+
+	owner := connectTestClient(t, s, nil)
+	defer owner.Stop()
+	if err := owner.RegisterService(testService("a", "10.0.0.1:80")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "registration", func() bool { return hasService(s, "a") })
+
+	_, msgs := connectRawPeer(t, s)
+
+	var types []string
+	var info *ome.ServiceInfo
+	deadline := time.After(5 * time.Second)
+	for len(types) == 0 || types[len(types)-1] != msgSynced {
+		select {
+		case msg := <-msgs:
+			types = append(types, messageType(msg))
+			if messageType(msg) == ome.RegistryEventType_Register.String() {
+				if messageHeaders(msg).Get(headerCodec) != "" {
+					t.Errorf("legacy peer got a message encoded with %s", messageHeaders(msg).Get(headerCodec))
+				}
+				info = new(ome.ServiceInfo)
+				if err := json.Unmarshal(msg.Encoded, info); err != nil {
+					t.Fatal(err)
+				}
+			}
+		case <-deadline:
+			t.Fatalf("timed out waiting for the registry content, got %v", types)
+		}
+	}
+
+	want := []string{ome.RegistryEventType_Register.String(), msgSynced}
+	if !reflect.DeepEqual(types, want) {
+		t.Errorf("got %v, want %v", types, want)
+	}
+	if info == nil || info.Id != "a" || len(info.Nodes) != 1 {
+		t.Errorf("got service %v", info)
+	}
+
+	peers := s.Peers()
+	session := s.session(peers[len(peers)-1].ID)
+	if session == nil || session.isRejected() || session.currentCodec().Name() != CodecJSON {
+		t.Error("legacy peer session is not served JSON")
+	}
+}
+
+func TestWelcomeIsSentBeforeRegistryContent(t *testing.T) {
+	s := startTestServer(t, &ServerConfig{})
+	defer s.Stop()
+
+	owner := connectTestClient(t, s, nil)
+	defer owner.Stop()
+	for _, id := range []string{"a", "b", "c"} {
+		if err := owner.RegisterService(testService(id, "10.0.0.1:80")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eventually(t, "registrations", func() bool { return hasService(s, "c") })
+
+	for i := 0; i < 10; i++ {
+		peer, msgs := connectRawPeer(t, s)
+		sendHello(t, peer, &hello{Version: ProtocolVersion, MinVersion: MinProtocolVersion, Codecs: []string{CodecProto},
+			Compressions: []string{CompressionGzip}, Capabilities: capabilities})
+
+		types := receiveTypes(t, msgs, msgSynced, 5*time.Second)
+		if len(types) != 5 || types[0] != msgWelcome || types[4] != msgSynced {
+			t.Fatalf("got %v", types)
+		}
+
+		c := connectTestClient(t, s, nil)
+		supported := c.ServerSupports(CapabilityAdmin)
+		_ = c.Stop()
+		if !supported {
+			t.Fatal("client is synced before it is welcomed")
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package discover
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/omecodes/common/errors"
+	"github.com/omecodes/common/utils/log"
+	"github.com/omecodes/libome"
+)
+
+// SourcePeerPrefix prefixes the source names to get the owners of the services imported from them
+const SourcePeerPrefix = "source:"
+
+const defaultSourceInterval = time.Second * 30
+
+// sourceTimeout is how long reading a source may take
+const sourceTimeout = time.Second * 30
+
+// Source is an external registry services are imported from
+type Source interface {
+	// Services returns all the services the source holds
+	Services(ctx context.Context) ([]*ome.ServiceInfo, error)
+}
+
+// SourceConfig is a source the server imports services from. The services are registered under the
+// SourcePeerPrefix + Name owner, and deregistered when they disappear from the source
+type SourceConfig struct {
+	// Name identifies the source in logs and service owners
+	Name   string
+	Source Source
+	// Interval is the period at which the source is read. Defaults to 30 seconds
+	Interval time.Duration
+}
+
+// startSources imports the services of sources every interval until Stop is called
+func (s *Server) startSources(sources []SourceConfig) error {
+	names := map[string]bool{}
+	for _, source := range sources {
+		if source.Name == "" || source.Source == nil {
+			return fmt.Errorf("%w: source without name or implementation", errors.BadInput)
+		}
+		if names[source.Name] {
+			return fmt.Errorf("%w: several sources are named %q", errors.BadInput, source.Name)
+		}
+		names[source.Name] = true
+	}
+
+	s.stopSources = make(chan struct{})
+	for _, source := range sources {
+		go s.importPeriodically(source)
+	}
+	return nil
+}
+
+func (s *Server) importPeriodically(source SourceConfig) {
+	interval := source.Interval
+	if interval <= 0 {
+		interval = defaultSourceInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.importSource(source); err != nil {
+			log.Error("registry server • could not import services", log.Err(err), log.Field("source", source.Name))
+		}
+
+		select {
+		case <-s.stopSources:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// importSource reconciles the services registered under the owner of source with its content. Services are left as
+// they are while the source cannot be read. Invalid services are skipped
+func (s *Server) importSource(source SourceConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sourceTimeout)
+	defer cancel()
+
+	infos, err := source.Source.Services(ctx)
+	if err != nil {
+		return err
+	}
+
+	var services []*ome.ServiceInfo
+	for _, info := range infos {
+		if err := validateService(info, s.validators); err != nil {
+			log.Error("registry server • skipped invalid imported service", log.Err(err), log.Field("source", source.Name))
+			continue
+		}
+		services = append(services, info)
+	}
+	return s.reconcileOwnedServices(SourcePeerPrefix+source.Name, services)
+}
+
+// HostsFileSource reads services from a hosts-style file. Each line holds an address followed by the names of the
+// services it is a node of. Text after # is ignored:
+//
+//	10.0.0.1        api cache
+//	10.0.0.2:9090   api
+//
+// Addresses without port get Port
+type HostsFileSource struct {
+	Filename string
+	Port     int
+	// Protocol is the protocol of the nodes
+	Protocol ome.Protocol
+}
+
+func (h *HostsFileSource) Services(ctx context.Context) ([]*ome.ServiceInfo, error) {
+	file, err := os.Open(h.Filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	services := map[string]*ome.ServiceInfo{}
+	var names []string
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%w: %s:%d: address without service name", errors.BadInput, h.Filename, line)
+		}
+
+		address := fields[0]
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			if h.Port <= 0 {
+				return nil, fmt.Errorf("%w: %s:%d: address %q has no port", errors.BadInput, h.Filename, line, address)
+			}
+			address = net.JoinHostPort(address, strconv.Itoa(h.Port))
+		}
+
+		for _, name := range fields[1:] {
+			info, found := services[name]
+			if !found {
+				info = &ome.ServiceInfo{Id: name, Label: name}
+				services[name] = info
+				names = append(names, name)
+			}
+			if findNode(info.Nodes, address) != nil {
+				continue
+			}
+			info.Nodes = append(info.Nodes, &ome.Node{
+				Id:       address,
+				Address:  address,
+				Protocol: h.Protocol,
+			})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make([]*ome.ServiceInfo, len(names))
+	for i, name := range names {
+		result[i] = services[name]
+	}
+	return result, nil
+}
+
+// DirectorySource reads services from the JSON or YAML files of a directory, as the static services directory
+type DirectorySource struct {
+	Dir string
+}
+
+func (d *DirectorySource) Services(ctx context.Context) ([]*ome.ServiceInfo, error) {
+	services, _, err := readStaticServices(d.Dir)
+	return services, err
+}
+
+// consulCatalogService is an entry of the Consul catalog service endpoint response
+type consulCatalogService struct {
+	ID             string
+	Node           string
+	Address        string
+	ServiceID      string
+	ServiceName    string
+	ServiceTags    []string
+	ServiceAddress string
+	ServicePort    int
+	ServiceMeta    map[string]string
+}
+
+// MetaConsulTags is the node meta key of the comma separated tags of the services imported from Consul
+const MetaConsulTags = "consul-tags"
+
+// ConsulSource reads services from the catalog HTTP API of a Consul agent. Every Consul service becomes a service
+// whose nodes are its instances
+type ConsulSource struct {
+	// Address is the base URL of the agent, e.g. http://localhost:8500
+	Address string
+	// Datacenter defaults to the datacenter of the agent
+	Datacenter string
+	// Token is the ACL token sent to the agent, if any
+	Token string
+	// Client defaults to http.DefaultClient
+	Client *http.Client
+}
+
+func (c *ConsulSource) get(ctx context.Context, path string, result interface{}) error {
+	endpoint := strings.TrimSuffix(c.Address, "/") + path
+	if c.Datacenter != "" {
+		endpoint += "?dc=" + url.QueryEscape(c.Datacenter)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	if c.Token != "" {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = rsp.Body.Close()
+	}()
+
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: consul responded %s", errors.Unavailable, rsp.Status)
+	}
+	return json.Unmarshal(body, result)
+}
+
+func (c *ConsulSource) Services(ctx context.Context) ([]*ome.ServiceInfo, error) {
+	var catalog map[string][]string
+	if err := c.get(ctx, "/v1/catalog/services", &catalog); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(catalog))
+	for name := range catalog {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var services []*ome.ServiceInfo
+	for _, name := range names {
+		var instances []*consulCatalogService
+		if err := c.get(ctx, "/v1/catalog/service/"+url.PathEscape(name), &instances); err != nil {
+			return nil, err
+		}
+		if len(instances) == 0 {
+			continue
+		}
+
+		info := &ome.ServiceInfo{Id: name, Label: name}
+		for _, instance := range instances {
+			host := instance.ServiceAddress
+			if host == "" {
+				host = instance.Address
+			}
+
+			node := &ome.Node{
+				Id:      instance.Node + "/" + instance.ServiceID,
+				Address: net.JoinHostPort(host, strconv.Itoa(instance.ServicePort)),
+			}
+			if len(instance.ServiceMeta) > 0 || len(instance.ServiceTags) > 0 {
+				node.Meta = map[string]string{}
+				for key, value := range instance.ServiceMeta {
+					node.Meta[key] = value
+				}
+				if len(instance.ServiceTags) > 0 {
+					node.Meta[MetaConsulTags] = strings.Join(instance.ServiceTags, ",")
+				}
+			}
+			info.Nodes = append(info.Nodes, node)
+		}
+		services = append(services, info)
+	}
+	return services, nil
+}
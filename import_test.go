@@ -0,0 +1,233 @@
+package discover
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/omecodes/libome"
+)
+
+// servicesString describes services as "id=address,address;id=address"
+func servicesString(services []*ome.ServiceInfo) string {
+	var descriptions []string
+	for _, info := range services {
+		var addresses []string
+		for _, node := range info.Nodes {
+			addresses = append(addresses, node.Address)
+		}
+		descriptions = append(descriptions, info.Id+"="+strings.Join(addresses, ","))
+	}
+	return strings.Join(descriptions, ";")
+}
+
+func TestHostsFileSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discover-hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name     string
+		content  string
+		port     int
+		services string
+		err      string
+	}{
+		{
+			name:     "addresses with ports",
+			content:  "10.0.0.1:80 api\n10.0.0.2:81 api db\n",
+			services: "api=10.0.0.1:80,10.0.0.2:81;db=10.0.0.2:81",
+		},
+		{
+			name:     "default port",
+			content:  "10.0.0.1 api\n10.0.0.2:9090 api\n::1 db\n",
+			port:     8080,
+			services: "api=10.0.0.1:8080,10.0.0.2:9090;db=[::1]:8080",
+		},
+		{
+			name:     "comments and blank lines",
+			content:  "# services\n\n10.0.0.1:80 api # main node\n   \n#10.0.0.2:80 api\n",
+			services: "api=10.0.0.1:80",
+		},
+		{
+			name:     "duplicate nodes",
+			content:  "10.0.0.1:80 api api\n10.0.0.1:80 api\n",
+			services: "api=10.0.0.1:80",
+		},
+		{
+			name: "empty file",
+		},
+		{
+			name:    "address without service",
+			content: "10.0.0.1:80 api\n10.0.0.2:80\n",
+			err:     ":2: address without service name",
+		},
+		{
+			name:    "address without port",
+			content: "10.0.0.1 api\n",
+			err:     `address "10.0.0.1" has no port`,
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filename := filepath.Join(dir, "hosts"+string(rune('a'+i)))
+			if err := ioutil.WriteFile(filename, []byte(test.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			source := &HostsFileSource{Filename: filename, Port: test.port, Protocol: ome.Protocol_Http}
+			services, err := source.Services(context.Background())
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if described := servicesString(services); described != test.services {
+				t.Errorf("got services %q, expected %q", described, test.services)
+			}
+			for _, info := range services {
+				if info.Label != info.Id || info.Nodes[0].Protocol != ome.Protocol_Http {
+					t.Errorf("%s has label %q and protocol %s", info.Id, info.Label, info.Nodes[0].Protocol)
+				}
+			}
+		})
+	}
+
+	source := &HostsFileSource{Filename: filepath.Join(dir, "missing")}
+	if _, err := source.Services(context.Background()); err == nil {
+		t.Error("read a missing hosts file")
+	}
+}
+
+func TestConsulSource(t *testing.T) {
+	catalog := map[string][]*consulCatalogService{
+		"api": {
+			{Node: "n1", Address: "10.0.0.1", ServiceID: "api-1", ServicePort: 80, ServiceTags: []string{"v1", "primary"}},
+			{Node: "n2", Address: "10.0.0.2", ServiceID: "api-2", ServiceAddress: "10.1.0.2", ServicePort: 81, ServiceMeta: map[string]string{"zone": "eu"}},
+		},
+		"web app": {
+			{Node: "n1", Address: "10.0.0.1", ServiceID: "web", ServicePort: 8080},
+		},
+		"gone": {},
+	}
+
+	var mutex sync.Mutex
+	var requests []string
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requests = append(requests, r.URL.RequestURI())
+		mutex.Unlock()
+		if r.Header.Get("X-Consul-Token") != "token" || r.URL.Query().Get("dc") != "dc1" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if r.URL.Path == "/v1/catalog/services" {
+			names := map[string][]string{}
+			for name := range catalog {
+				names[name] = nil
+			}
+			_ = json.NewEncoder(w).Encode(names)
+			return
+		}
+
+		instances, found := catalog[strings.TrimPrefix(r.URL.Path, "/v1/catalog/service/")]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(instances)
+	}))
+	defer consul.Close()
+
+	source := &ConsulSource{Address: consul.URL + "/", Datacenter: "dc1", Token: "token"}
+	services, err := source.Services(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if described := servicesString(services); described != "api=10.0.0.1:80,10.1.0.2:81;web app=10.0.0.1:8080" {
+		t.Fatalf("got services %q", described)
+	}
+	api := services[0]
+	if api.Label != "api" || api.Nodes[0].Id != "n1/api-1" {
+		t.Errorf("api has label %q and node %q", api.Label, api.Nodes[0].Id)
+	}
+	if tags := api.Nodes[0].Meta[MetaConsulTags]; tags != "v1,primary" {
+		t.Errorf("api-1 has tags %q", tags)
+	}
+	if meta := api.Nodes[1].Meta; meta["zone"] != "eu" || meta[MetaConsulTags] != "" {
+		t.Errorf("api-2 has meta %v", meta)
+	}
+	if services[1].Nodes[0].Meta != nil {
+		t.Errorf("web app has meta %v", services[1].Nodes[0].Meta)
+	}
+	mutex.Lock()
+	if !containsString(requests, "/v1/catalog/service/web%20app?dc=dc1") {
+		t.Errorf("service names are not escaped: %v", requests)
+	}
+	mutex.Unlock()
+
+	source.Token = "wrong"
+	if _, err := source.Services(context.Background()); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("got error %v when consul denies access", err)
+	}
+}
+
+func TestImportSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discover-hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "hosts")
+
+	s := startTestServer(t, &ServerConfig{})
+	defer s.Stop()
+	source := SourceConfig{Name: "hosts", Source: &HostsFileSource{Filename: filename}}
+	owner := SourcePeerPrefix + "hosts"
+
+	if err := ioutil.WriteFile(filename, []byte("10.0.0.1:80 api db\n10.0.0.2:99999 cache\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.importSource(source); err != nil {
+		t.Fatal(err)
+	}
+	if described := servicesString(s.index.forPeer(owner)); described != "api=10.0.0.1:80;db=10.0.0.1:80" {
+		t.Errorf("imported %q", described)
+	}
+
+	if err := ioutil.WriteFile(filename, []byte("10.0.0.2:80 api\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.importSource(source); err != nil {
+		t.Fatal(err)
+	}
+	if described := servicesString(s.index.forPeer(owner)); described != "api=10.0.0.2:80" {
+		t.Errorf("imported %q after the source changed", described)
+	}
+
+	if err := os.Remove(filename); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.importSource(source); err == nil {
+		t.Error("imported an unreadable source")
+	}
+	if !hasService(s, "api") {
+		t.Error("services were removed while the source could not be read")
+	}
+}
@@ -0,0 +1,377 @@
+package discover
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/omecodes/libome"
+)
+
+type indexKey struct {
+	peer string
+	id   string
+}
+
+type indexEntry struct {
+	key  indexKey
+	seq  uint64
+	info *ome.ServiceInfo
+}
+
+type indexSet map[indexKey]*indexEntry
+
+// indexMap maps indexed values to the entries that hold them
+type indexMap map[interface{}]indexSet
+
+func (m indexMap) add(value interface{}, entry *indexEntry) {
+	set, found := m[value]
+	if !found {
+		set = indexSet{}
+		m[value] = set
+	}
+	set[entry.key] = entry
+}
+
+func (m indexMap) remove(value interface{}, key indexKey) {
+	set, found := m[value]
+	if !found {
+		return
+	}
+
+	delete(set, key)
+	if len(set) == 0 {
+		delete(m, value)
+	}
+}
+
+// serviceIndex is an in-memory view of the registered services indexed by id, case folded id, type, label, meta keys
+// and node protocols.
+// The same service id can be registered by several peers. Returned infos are shared with the index and must not be
+// modified, the public getters return copies of them
+type serviceIndex struct {
+	sync.RWMutex
+	seq        uint64
+	entries    indexSet
+	byPeer     indexMap
+	byID       indexMap
+	byFoldedID indexMap
+	byType     indexMap
+	byLabel    indexMap
+	byMetaKey  indexMap
+	byProtocol indexMap
+}
+
+func newServiceIndex() *serviceIndex {
+	x := new(serviceIndex)
+	x.reset()
+	return x
+}
+
+func (x *serviceIndex) reset() {
+	x.entries = indexSet{}
+	x.byPeer = indexMap{}
+	x.byID = indexMap{}
+	x.byFoldedID = indexMap{}
+	x.byType = indexMap{}
+	x.byLabel = indexMap{}
+	x.byMetaKey = indexMap{}
+	x.byProtocol = indexMap{}
+}
+
+// put indexes info as registered by peer under id, replacing the info peer previously registered with the same id
+func (x *serviceIndex) put(peer string, id string, info *ome.ServiceInfo) {
+	x.Lock()
+	defer x.Unlock()
+
+	key := indexKey{peer: peer, id: id}
+	seq := x.seq
+	if previous, found := x.entries[key]; found {
+		seq = previous.seq
+		x.unlink(previous)
+	} else {
+		x.seq++
+	}
+
+	entry := &indexEntry{key: key, seq: seq, info: info}
+	x.entries[key] = entry
+	x.link(entry)
+}
+
+// remove removes the info registered by peer with id and returns it. It returns nil if there is none
+func (x *serviceIndex) remove(peer string, id string) *ome.ServiceInfo {
+	x.Lock()
+	defer x.Unlock()
+
+	entry, found := x.entries[indexKey{peer: peer, id: id}]
+	if !found {
+		return nil
+	}
+	x.unlink(entry)
+	return entry.info
+}
+
+// removePeer removes all the infos registered by peer
+func (x *serviceIndex) removePeer(peer string) {
+	x.Lock()
+	defer x.Unlock()
+
+	for _, entry := range x.byPeer[peer] {
+		x.unlink(entry)
+	}
+}
+
+func (x *serviceIndex) clear() {
+	x.Lock()
+	defer x.Unlock()
+	x.reset()
+}
+
+func (x *serviceIndex) link(entry *indexEntry) {
+	info := entry.info
+	x.byPeer.add(entry.key.peer, entry)
+	x.byID.add(entry.key.id, entry)
+	x.byFoldedID.add(strings.ToLower(entry.key.id), entry)
+	x.byType.add(info.Type, entry)
+	if info.Label != "" {
+		x.byLabel.add(info.Label, entry)
+	}
+	for key := range info.Meta {
+		x.byMetaKey.add(key, entry)
+	}
+	for _, node := range info.Nodes {
+		x.byProtocol.add(node.Protocol, entry)
+		for key := range node.Meta {
+			x.byMetaKey.add(key, entry)
+		}
+	}
+}
+
+func (x *serviceIndex) unlink(entry *indexEntry) {
+	info := entry.info
+	delete(x.entries, entry.key)
+	x.byPeer.remove(entry.key.peer, entry.key)
+	x.byID.remove(entry.key.id, entry.key)
+	x.byFoldedID.remove(strings.ToLower(entry.key.id), entry.key)
+	x.byType.remove(info.Type, entry.key)
+	x.byLabel.remove(info.Label, entry.key)
+	for key := range info.Meta {
+		x.byMetaKey.remove(key, entry.key)
+	}
+	for _, node := range info.Nodes {
+		x.byProtocol.remove(node.Protocol, entry.key)
+		for key := range node.Meta {
+			x.byMetaKey.remove(key, entry.key)
+		}
+	}
+}
+
+// lookup returns the info registered by peer with id, or nil if there is none
+func (x *serviceIndex) lookup(peer string, id string) *ome.ServiceInfo {
+	x.RLock()
+	defer x.RUnlock()
+
+	if entry, found := x.entries[indexKey{peer: peer, id: id}]; found {
+		return entry.info
+	}
+	return nil
+}
+
+// get returns the earliest registered info with id, or nil if there is none
+func (x *serviceIndex) get(id string) *ome.ServiceInfo {
+	_, info := x.earliest(id)
+	return info
+}
+
+// earliest returns the earliest registered info with id and the peer that registered it, or nil if there is none
+func (x *serviceIndex) earliest(id string) (string, *ome.ServiceInfo) {
+	x.RLock()
+	defer x.RUnlock()
+
+	entry := first(x.byID[id])
+	if entry == nil {
+		return "", nil
+	}
+	return entry.key.peer, entry.info
+}
+
+// getFold returns the earliest registered info whose id matches id case-insensitively, or nil if there is none.
+// Infos registered with id exactly are preferred
+func (x *serviceIndex) getFold(id string) *ome.ServiceInfo {
+	x.RLock()
+	defer x.RUnlock()
+
+	entry := first(x.byID[id])
+	if entry == nil {
+		entry = first(x.byFoldedID[strings.ToLower(id)])
+	}
+	if entry == nil {
+		return nil
+	}
+	return entry.info
+}
+
+// firstOfType returns the earliest registered info of type t, or nil if there is none
+func (x *serviceIndex) firstOfType(t uint32) *ome.ServiceInfo {
+	x.RLock()
+	defer x.RUnlock()
+
+	if entry := first(x.byType[t]); entry != nil {
+		return entry.info
+	}
+	return nil
+}
+
+// ofType returns the infos of type t in registration order
+func (x *serviceIndex) ofType(t uint32) []*ome.ServiceInfo {
+	x.RLock()
+	defer x.RUnlock()
+	return sorted(x.byType[t])
+}
+
+// withLabel returns the infos labelled label in registration order
+func (x *serviceIndex) withLabel(label string) []*ome.ServiceInfo {
+	x.RLock()
+	defer x.RUnlock()
+	return sorted(x.byLabel[label])
+}
+
+// withMetaKey returns the infos whose service or node meta contains key, in registration order
+func (x *serviceIndex) withMetaKey(key string) []*ome.ServiceInfo {
+	x.RLock()
+	defer x.RUnlock()
+	return sorted(x.byMetaKey[key])
+}
+
+// withProtocol returns the infos that have a node implementing protocol, in registration order
+func (x *serviceIndex) withProtocol(protocol ome.Protocol) []*ome.ServiceInfo {
+	x.RLock()
+	defer x.RUnlock()
+	return sorted(x.byProtocol[protocol])
+}
+
+// forPeer returns the infos registered by peer in registration order
+func (x *serviceIndex) forPeer(peer string) []*ome.ServiceInfo {
+	x.RLock()
+	defer x.RUnlock()
+	return sorted(x.byPeer[peer])
+}
+
+// peersOf returns the peers that registered id
+func (x *serviceIndex) peersOf(id string) []string {
+	x.RLock()
+	defer x.RUnlock()
+
+	var peers []string
+	for key := range x.byID[id] {
+		peers = append(peers, key.peer)
+	}
+	return peers
+}
+
+// each calls f with every info and the peer that registered it
+func (x *serviceIndex) each(f func(peer string, info *ome.ServiceInfo)) {
+	x.RLock()
+	defer x.RUnlock()
+
+	for key, entry := range x.entries {
+		f(key.peer, entry.info)
+	}
+}
+
+// all returns all the infos in registration order
+func (x *serviceIndex) all() []*ome.ServiceInfo {
+	x.RLock()
+	defer x.RUnlock()
+	return sorted(x.entries)
+}
+
+func (x *serviceIndex) size() int {
+	x.RLock()
+	defer x.RUnlock()
+	return len(x.entries)
+}
+
+func first(set indexSet) *indexEntry {
+	var result *indexEntry
+	for _, entry := range set {
+		if result == nil || entry.seq < result.seq {
+			result = entry
+		}
+	}
+	return result
+}
+
+func sorted(set indexSet) []*ome.ServiceInfo {
+	entries := make([]*indexEntry, 0, len(set))
+	for _, entry := range set {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seq < entries[j].seq
+	})
+
+	result := make([]*ome.ServiceInfo, len(entries))
+	for i, entry := range entries {
+		result[i] = entry.info
+	}
+	return result
+}
+
+// indexedStore is a Store that keeps an index up to date with the mutations it applies
+type indexedStore struct {
+	Store
+	mutex sync.Mutex
+	index *serviceIndex
+}
+
+func (s *indexedStore) Upsert(entry *StoreEntry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.Store.Upsert(entry); err != nil {
+		return err
+	}
+
+	info := new(ome.ServiceInfo)
+	if err := json.Unmarshal([]byte(entry.Value), info); err != nil {
+		s.index.remove(entry.Peer, entry.Service)
+		return nil
+	}
+	s.index.put(entry.Peer, entry.Service, info)
+	return nil
+}
+
+func (s *indexedStore) Delete(peer string, service string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.Store.Delete(peer, service); err != nil {
+		return err
+	}
+	s.index.remove(peer, service)
+	return nil
+}
+
+func (s *indexedStore) DeleteForPeer(peer string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.Store.DeleteForPeer(peer); err != nil {
+		return err
+	}
+	s.index.removePeer(peer)
+	return nil
+}
+
+func (s *indexedStore) Clear() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.Store.Clear(); err != nil {
+		return err
+	}
+	s.index.clear()
+	return nil
+}
@@ -0,0 +1,408 @@
+package discover
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/omecodes/libome"
+)
+
+var benchmarkSizes = []int{1000, 10000, 100000}
+
+const benchmarkTypes = 100
+
+func benchmarkService(i int) *ome.ServiceInfo {
+	return &ome.ServiceInfo{
+		Id:    fmt.Sprintf("service-%d", i),
+		Type:  uint32(i % benchmarkTypes),
+		Label: fmt.Sprintf("label-%d", i%10),
+		Nodes: []*ome.Node{
+			{Id: "grpc", Protocol: ome.Protocol_Grpc, Address: fmt.Sprintf("10.0.%d.%d:9000", i/256%256, i%256)},
+			{Id: "http", Protocol: ome.Protocol_Http, Address: fmt.Sprintf("10.0.%d.%d:8080", i/256%256, i%256)},
+		},
+		Meta: map[string]string{
+			"zone":                   fmt.Sprintf("zone-%d", i%3),
+			fmt.Sprintf("k%d", i%50): "v",
+		},
+	}
+}
+
+var benchmarkServers = map[int]*Server{}
+
+// benchmarkServer returns a server whose registry holds size services, spread over peers.
+// Servers are shared by benchmarks that do not modify the registry
+func benchmarkServer(b *testing.B, size int) *Server {
+	if s, found := benchmarkServers[size]; found {
+		return s
+	}
+
+	s := &Server{index: newServiceIndex(), metrics: noopMetrics{}, tracer: tracerFrom(nil)}
+	s.store = &indexedStore{Store: NewMemoryStore(), index: s.index}
+
+	for i := 0; i < size; i++ {
+		info := benchmarkService(i)
+		encoded, err := json.Marshal(info)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		err = s.store.Upsert(&StoreEntry{Peer: fmt.Sprintf("peer-%d", i%20), Service: info.Id, Value: string(encoded)})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	benchmarkServers[size] = s
+	return s
+}
+
+// scanOfType is the full scan GetOfType used to run before the index
+func scanOfType(store Store, t uint32) ([]*ome.ServiceInfo, error) {
+	var (
+		result    []*ome.ServiceInfo
+		decodeErr error
+	)
+	err := store.Range(func(entry *StoreEntry) bool {
+		info := new(ome.ServiceInfo)
+		if decodeErr = json.Unmarshal([]byte(entry.Value), info); decodeErr != nil {
+			return false
+		}
+		if info.Type == t {
+			result = append(result, info)
+		}
+		return true
+	})
+	if err == nil {
+		err = decodeErr
+	}
+	return result, err
+}
+
+func BenchmarkServerGetService(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("services=%d", size), func(b *testing.B) {
+			s := benchmarkServer(b, size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := s.GetService(fmt.Sprintf("service-%d", i%size)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkServerGetOfType(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("services=%d", size), func(b *testing.B) {
+			s := benchmarkServer(b, size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := s.GetOfType(uint32(i % benchmarkTypes)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkServerGetOfTypeFullScan(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("services=%d", size), func(b *testing.B) {
+			s := benchmarkServer(b, size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := scanOfType(s.store, uint32(i%benchmarkTypes)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkServerFirstOfType(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("services=%d", size), func(b *testing.B) {
+			s := benchmarkServer(b, size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := s.FirstOfType(uint32(i % benchmarkTypes)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkServiceIndexWithMetaKey(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("services=%d", size), func(b *testing.B) {
+			s := benchmarkServer(b, size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if len(s.index.withMetaKey(fmt.Sprintf("k%d", i%50))) == 0 {
+					b.Fatal("no match")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkServiceIndexPut(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("services=%d", size), func(b *testing.B) {
+			s := benchmarkServer(b, size)
+			index := newServiceIndex()
+			for _, info := range s.index.all() {
+				index.put("peer", info.Id, info)
+			}
+			services := make([]*ome.ServiceInfo, size)
+			for i := range services {
+				services[i] = benchmarkService(i)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				info := services[i%size]
+				index.put("peer", info.Id, info)
+			}
+		})
+	}
+}
+
+func BenchmarkMsgClientGetService(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("services=%d", size), func(b *testing.B) {
+			m := &MsgClient{store: newServiceIndex()}
+			for i := 0; i < size; i++ {
+				info := benchmarkService(i)
+				m.store.put("", info.Id, info)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := m.GetService(fmt.Sprintf("service-%d", i%size)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func indexIDs(infos []*ome.ServiceInfo) string {
+	var ids []string
+	for _, info := range infos {
+		ids = append(ids, info.Id)
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestServiceIndexPut(t *testing.T) {
+	x := newServiceIndex()
+	x.put("p1", "api", &ome.ServiceInfo{Id: "api", Type: 1, Label: "old", Meta: map[string]string{"zone": "a"}})
+	x.put("p1", "db", &ome.ServiceInfo{Id: "db", Type: 2})
+	x.put("p2", "api", &ome.ServiceInfo{Id: "api", Type: 1, Label: "other"})
+
+	x.put("p1", "api", &ome.ServiceInfo{Id: "api", Type: 3, Label: "new", Nodes: []*ome.Node{
+		{Id: "a", Protocol: ome.Protocol_Grpc, Meta: map[string]string{"health": "healthy"}},
+	}})
+
+	if ids := indexIDs(x.all()); ids != "api,db,api" {
+		t.Errorf("replacing an info changed the registration order: %s", ids)
+	}
+	if info := x.get("api"); info.Type != 3 {
+		t.Errorf("get returned an info of type %d instead of the earliest registration", info.Type)
+	}
+	if info := x.lookup("p2", "api"); info == nil || info.Label != "other" {
+		t.Errorf("lookup returned %v", info)
+	}
+	if x.size() != 3 {
+		t.Errorf("index holds %d entries instead of 3", x.size())
+	}
+
+	if infos := x.ofType(1); indexIDs(infos) != "api" || infos[0].Label != "other" {
+		t.Errorf("type 1 holds %s", indexIDs(infos))
+	}
+	if infos := x.withLabel("old"); len(infos) != 0 {
+		t.Error("the replaced label is still indexed")
+	}
+	if infos := x.withMetaKey("zone"); len(infos) != 0 {
+		t.Error("the replaced meta key is still indexed")
+	}
+	if ids := indexIDs(x.withMetaKey("health")); ids != "api" {
+		t.Errorf("node meta key is indexed for %s", ids)
+	}
+	if ids := indexIDs(x.withProtocol(ome.Protocol_Grpc)); ids != "api" {
+		t.Errorf("grpc is indexed for %s", ids)
+	}
+	if ids := indexIDs(x.forPeer("p1")); ids != "api,db" {
+		t.Errorf("p1 registered %s", ids)
+	}
+}
+
+func TestServiceIndexRemove(t *testing.T) {
+	x := newServiceIndex()
+	x.put("p1", "api", &ome.ServiceInfo{Id: "api", Type: 1, Label: "api", Meta: map[string]string{"zone": "a"}, Nodes: []*ome.Node{
+		{Id: "a", Protocol: ome.Protocol_Http, Meta: map[string]string{"health": "healthy"}},
+	}})
+	x.put("p2", "api", &ome.ServiceInfo{Id: "api", Type: 2})
+	x.put("p2", "db", &ome.ServiceInfo{Id: "db", Type: 2})
+
+	if info := x.remove("p3", "api"); info != nil {
+		t.Error("removed an info that was not registered")
+	}
+	if info := x.remove("p1", "api"); info == nil || info.Label != "api" {
+		t.Fatalf("remove returned %v", info)
+	}
+	if info := x.remove("p1", "api"); info != nil {
+		t.Error("removed the same info twice")
+	}
+	if info := x.get("api"); info == nil || info.Type != 2 {
+		t.Errorf("the registration of p2 was not kept: %v", info)
+	}
+
+	for name, m := range map[string]indexMap{"label": x.byLabel, "meta key": x.byMetaKey, "protocol": x.byProtocol} {
+		if len(m) != 0 {
+			t.Errorf("%s index holds %d values after their entries were removed", name, len(m))
+		}
+	}
+	if _, found := x.byPeer["p1"]; found {
+		t.Error("peer index keeps an empty set")
+	}
+	if len(x.byType[uint32(1)]) != 0 {
+		t.Error("type index keeps the removed entry")
+	}
+
+	x.removePeer("p2")
+	if x.size() != 0 || len(x.byID) != 0 || len(x.byType) != 0 || len(x.byPeer) != 0 {
+		t.Errorf("index is not empty after the removal of all peers: %d entries", x.size())
+	}
+}
+
+func TestServiceIndexGetFold(t *testing.T) {
+	x := newServiceIndex()
+	x.put("p1", "Api", &ome.ServiceInfo{Id: "Api", Type: 1})
+	x.put("p1", "API", &ome.ServiceInfo{Id: "API", Type: 2})
+	x.put("p2", "Api", &ome.ServiceInfo{Id: "Api", Type: 3})
+
+	tests := []struct {
+		id   string
+		want uint32
+	}{
+		{id: "api", want: 1},
+		{id: "API", want: 2},
+		{id: "Api", want: 1},
+		{id: "aPI", want: 1},
+	}
+	for _, test := range tests {
+		if info := x.getFold(test.id); info == nil || info.Type != test.want {
+			t.Errorf("getFold(%q) returned %v, want type %d", test.id, info, test.want)
+		}
+	}
+	if info := x.getFold("db"); info != nil {
+		t.Errorf("getFold returned %v for a missing id", info)
+	}
+
+	x.remove("p1", "Api")
+	if info := x.getFold("api"); info == nil || info.Type == 1 {
+		t.Errorf("getFold returned the removed info: %v", info)
+	}
+	x.removePeer("p1")
+	x.removePeer("p2")
+	if len(x.byFoldedID) != 0 {
+		t.Errorf("folded id index holds %d values after their entries were removed", len(x.byFoldedID))
+	}
+}
+
+func TestServiceIndexPeersOf(t *testing.T) {
+	x := newServiceIndex()
+	x.put("p1", "api", &ome.ServiceInfo{Id: "api"})
+	x.put("p2", "api", &ome.ServiceInfo{Id: "api"})
+	x.put("p2", "db", &ome.ServiceInfo{Id: "db"})
+
+	peers := x.peersOf("api")
+	sort.Strings(peers)
+	if strings.Join(peers, ",") != "p1,p2" {
+		t.Errorf("api is registered by %v", peers)
+	}
+	if peers := x.peersOf("missing"); len(peers) != 0 {
+		t.Errorf("missing is registered by %v", peers)
+	}
+
+	x.remove("p1", "api")
+	if peers := x.peersOf("api"); len(peers) != 1 || peers[0] != "p2" {
+		t.Errorf("api is registered by %v after the removal", peers)
+	}
+}
+
+func TestServiceIndexQuery(t *testing.T) {
+	x := newServiceIndex()
+	for i := 0; i < 30; i++ {
+		info := benchmarkService(i)
+		x.put(fmt.Sprintf("peer-%d", i%3), info.Id, info)
+	}
+	services := x.all()
+
+	queries := []string{
+		"",
+		"type=3",
+		"type in (1,2,3)",
+		"label=label-4",
+		"label=label-*",
+		"meta.zone=zone-1",
+		"meta.zone in (zone-0,zone-2), type in (0,1,2,3,4,5)",
+		"meta.k7",
+		"!meta.k7",
+		"meta.zone!=zone-1",
+		"meta.zone notin (zone-1)",
+		"protocol=grpc, nodes=2",
+		"protocol=http, type=200",
+		"nodes>2",
+	}
+	for _, query := range queries {
+		q, err := ParseQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := indexIDs(q.Filter(services))
+		if ids := indexIDs(x.query(q)); ids != expected {
+			t.Errorf("%q selected %s, expected %s", query, ids, expected)
+		}
+	}
+}
+
+func TestServerGettersReturnCopies(t *testing.T) {
+	s := startTestServer(t, &ServerConfig{})
+	defer s.Stop()
+	if err := s.RegisterService(testService("api", "10.0.0.1:80")); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := s.GetService("api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info.Nodes[0].Address = "changed"
+	node, err := s.GetNode("api", info.Nodes[0].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.Address = "changed"
+	infos, err := s.Query(&Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos[0].Id = "changed"
+	first, err := s.FirstOfType(info.Type)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.Label = "changed"
+
+	indexed := s.index.get("api")
+	if indexed == nil || indexed.Id != "api" || indexed.Label == "changed" || indexed.Nodes[0].Address != "10.0.0.1:80" {
+		t.Errorf("a getter exposed the indexed info: %v", indexed)
+	}
+}
@@ -0,0 +1,133 @@
+package discover
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+
+	"github.com/omecodes/zebou"
+)
+
+// identityListener keeps track of the TLS connections it accepts so that peers can be identified
+// by their certificate from the address zebou reports for them. It also keeps track of all the connections it
+// accepts so that they can be closed before the hub is stopped
+type identityListener struct {
+	net.Listener
+	conns sync.Map
+
+	mutex   sync.Mutex
+	open    map[net.Conn]struct{}
+	closing bool
+}
+
+func (l *identityListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		address := conn.RemoteAddr().String()
+		tlsConn, isTLS := conn.(*tls.Conn)
+		tracked := &trackedConn{Conn: conn}
+		tracked.onClose = func() {
+			if isTLS {
+				l.conns.Delete(address)
+			}
+			l.mutex.Lock()
+			delete(l.open, tracked)
+			l.mutex.Unlock()
+		}
+
+		l.mutex.Lock()
+		if l.closing {
+			l.mutex.Unlock()
+			_ = conn.Close()
+			continue
+		}
+		if l.open == nil {
+			l.open = map[net.Conn]struct{}{}
+		}
+		l.open[tracked] = struct{}{}
+		l.mutex.Unlock()
+
+		if isTLS {
+			l.conns.Store(address, tlsConn)
+		}
+		return tracked, nil
+	}
+}
+
+// closeConns closes the accepted connections. The connections accepted from then on are closed right away
+func (l *identityListener) closeConns() {
+	l.mutex.Lock()
+	l.closing = true
+	open := l.open
+	l.open = nil
+	l.mutex.Unlock()
+
+	for conn := range open {
+		_ = conn.Close()
+	}
+}
+
+// closeConn closes the accepted connection of the peer connected from address
+func (l *identityListener) closeConn(address string) {
+	l.mutex.Lock()
+	var conn net.Conn
+	for open := range l.open {
+		if open.RemoteAddr().String() == address {
+			conn = open
+			break
+		}
+	}
+	l.mutex.Unlock()
+
+	if conn != nil {
+		_ = conn.Close()
+	}
+}
+
+// identity returns the subject common name of the certificate presented by the peer connected from address.
+// It returns an empty string if the peer is not connected over TLS or did not present a certificate
+func (l *identityListener) identity(address string) string {
+	o, found := l.conns.Load(address)
+	if !found {
+		return ""
+	}
+
+	state := o.(*tls.Conn).ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+
+	subject := state.PeerCertificates[0].Subject
+	if subject.CommonName != "" {
+		return subject.CommonName
+	}
+	return subject.String()
+}
+
+type trackedConn struct {
+	net.Conn
+	once    sync.Once
+	onClose func()
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.onClose)
+	return c.Conn.Close()
+}
+
+// peerIdentity returns the certificate identity of peer. Identities are remembered when peers connect
+// so that they remain available once the underlying connection is closed
+func (s *Server) peerIdentity(peer *zebou.PeerInfo) string {
+	if session := s.session(peer.ID); session != nil {
+		return session.info.Identity
+	}
+
+	if s.identities == nil {
+		return ""
+	}
+	return s.identities.identity(peer.Address)
+}
@@ -0,0 +1,773 @@
+package discover
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/omecodes/common/errors"
+	"github.com/omecodes/common/utils/log"
+	"github.com/omecodes/libome"
+	"golang.org/x/net/ipv4"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	mdnsDefaultServiceType    = "_ome-discover._tcp"
+	mdnsDefaultDomain         = "local."
+	mdnsDefaultTTL            = 120
+	mdnsDefaultBrowseInterval = time.Second * 20
+	mdnsMaxPacketSize         = 9000
+	mdnsInfoChunkSize         = 200
+
+	mdnsClassCacheFlush uint16 = 1 << 15
+)
+
+var mdnsGroupAddress = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// MDNSConfig holds multicast DNS-SD discovery parameters
+type MDNSConfig struct {
+	// Interface is the network interface used to join the multicast group and to send packets. The system default
+	// is used if nil
+	Interface *net.Interface
+	// ServiceType is the DNS-SD service type services are announced under. Defaults to "_ome-discover._tcp"
+	ServiceType string
+	// Domain defaults to "local."
+	Domain string
+	// TTL is the announced records time to live in seconds. Defaults to 120
+	TTL uint32
+	// BrowseInterval is the delay between two browse queries. Defaults to 20 seconds
+	BrowseInterval time.Duration
+}
+
+// ClientConfig selects the registry client implementation
+type ClientConfig struct {
+	// ServerAddress is the discovery server address. Serverless mDNS discovery is used if empty
+	ServerAddress string
+	TLSConfig     *tls.Config
+	MDNS          *MDNSConfig
+}
+
+// NewClient creates a zebou registry client if a server address is configured, an mDNS registry client otherwise.
+// A nil config creates an mDNS registry client with the default parameters
+func NewClient(config *ClientConfig) (ome.Registry, error) {
+	if config == nil {
+		config = new(ClientConfig)
+	}
+	if config.ServerAddress != "" {
+		return NewZebouClient(config.ServerAddress, config.TLSConfig), nil
+	}
+	return NewMDNSClient(config.MDNS)
+}
+
+type mdnsEntry struct {
+	info      *ome.ServiceInfo
+	expiresAt time.Time
+}
+
+// MDNSClient is a serverless registry client that announces and browses services over multicast DNS-SD
+type MDNSClient struct {
+	conn     *net.UDPConn
+	sender   *net.UDPConn
+	handlers *sync.Map
+
+	serviceType string
+	hostname    string
+	ttl         uint32
+	interval    time.Duration
+
+	mutex  sync.Mutex
+	local  map[string]*ome.ServiceInfo
+	remote map[string]*mdnsEntry
+
+	stop chan bool
+	wg   sync.WaitGroup
+}
+
+// RegisterService stores a copy of info locally and announces it on the network
+func (m *MDNSClient) RegisterService(info *ome.ServiceInfo) error {
+	stored := proto.Clone(info).(*ome.ServiceInfo)
+	m.mutex.Lock()
+	_, exists := m.local[info.Id]
+	m.local[info.Id] = stored
+	m.mutex.Unlock()
+
+	err := m.announce(stored, m.ttl)
+	if err != nil {
+		log.Error("mdns registry • could not announce service", log.Err(err), log.Field("id", info.Id))
+		return err
+	}
+
+	event := &ome.RegistryEvent{
+		Type:      ome.RegistryEventType_Register,
+		ServiceId: info.Id,
+		Info:      info,
+	}
+	if exists {
+		event.Type = ome.RegistryEventType_Update
+	}
+	m.notifyEvent(event)
+
+	log.Info("mdns registry • registered", log.Field("id", info.Id))
+	return nil
+}
+
+// DeregisterService withdraws the service announcement. If nodes are given only these are removed from the service
+func (m *MDNSClient) DeregisterService(id string, nodes ...string) error {
+	m.mutex.Lock()
+	info, found := m.local[id]
+	if !found {
+		m.mutex.Unlock()
+		return errors.NotFound
+	}
+
+	if len(nodes) == 0 {
+		delete(m.local, id)
+		m.mutex.Unlock()
+
+		err := m.announce(info, 0)
+		if err != nil {
+			log.Error("mdns registry • could not send goodbye", log.Err(err), log.Field("id", id))
+			return err
+		}
+
+		m.notifyEvent(&ome.RegistryEvent{
+			Type:      ome.RegistryEventType_DeRegister,
+			ServiceId: id,
+		})
+		log.Info("mdns registry • deregistered", log.Field("id", id))
+		return nil
+	}
+
+	// the stored info is replaced rather than modified, as it may be being announced
+	updated := proto.Clone(info).(*ome.ServiceInfo)
+	var newNodes []*ome.Node
+	for _, node := range updated.Nodes {
+		removed := false
+		for _, nodeID := range nodes {
+			if node.Id == nodeID {
+				removed = true
+				break
+			}
+		}
+		if !removed {
+			newNodes = append(newNodes, node)
+		}
+	}
+	updated.Nodes = newNodes
+	m.local[id] = updated
+	m.mutex.Unlock()
+
+	err := m.announce(updated, m.ttl)
+	if err != nil {
+		log.Error("mdns registry • could not announce service", log.Err(err), log.Field("id", id))
+		return err
+	}
+
+	m.notifyEvent(&ome.RegistryEvent{
+		Type:      ome.RegistryEventType_DeRegisterNode,
+		ServiceId: id,
+		Info:      proto.Clone(updated).(*ome.ServiceInfo),
+	})
+	log.Info("mdns registry • deregistered nodes", log.Field("id", id), log.Field("nodes", nodes))
+	return nil
+}
+
+// GetService returns a copy of the local or discovered service that matches id
+func (m *MDNSClient) GetService(id string) (*ome.ServiceInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if info, found := m.local[id]; found {
+		return proto.Clone(info).(*ome.ServiceInfo), nil
+	}
+
+	if entry, found := m.remote[id]; found {
+		return proto.Clone(entry.info).(*ome.ServiceInfo), nil
+	}
+	return nil, errors.NotFound
+}
+
+// GetNode returns the node of the service that matches id
+func (m *MDNSClient) GetNode(id string, nodeID string) (*ome.Node, error) {
+	info, err := m.GetService(id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, n := range info.Nodes {
+		if n.Id == nodeID {
+			return n, nil
+		}
+	}
+	return nil, errors.NotFound
+}
+
+// Certificate returns the PEM encoded certificate of the service that matches id
+func (m *MDNSClient) Certificate(id string) ([]byte, error) {
+	info, err := m.GetService(id)
+	if err != nil {
+		return nil, err
+	}
+	strCert, found := info.Meta[ome.MetaServiceCertificate]
+	if !found {
+		return nil, errors.NotFound
+	}
+	return []byte(strCert), nil
+}
+
+// ConnectionInfo returns the connection info of the node of the service that implements the given transport protocol
+func (m *MDNSClient) ConnectionInfo(id string, protocol ome.Protocol) (*ome.ConnectionInfo, error) {
+	info, err := m.GetService(id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, n := range info.Nodes {
+		if protocol == n.Protocol {
+			ci := new(ome.ConnectionInfo)
+			ci.Address = n.Address
+			strCert, found := info.Meta[ome.MetaServiceCertificate]
+			if !found {
+				return ci, nil
+			}
+			ci.Certificate = []byte(strCert)
+			return ci, nil
+		}
+	}
+	return nil, errors.NotFound
+}
+
+// RegisterEventHandler adds an event handler. Returns an id that is used to deregister h
+func (m *MDNSClient) RegisterEventHandler(h ome.EventHandler) string {
+	hid := uuid.New().String()
+	m.handlers.Store(hid, h)
+	return hid
+}
+
+// DeregisterEventHandler removes the event handler that match id
+func (m *MDNSClient) DeregisterEventHandler(id string) {
+	m.handlers.Delete(id)
+}
+
+// GetOfType gets all the local and discovered services of type t
+func (m *MDNSClient) GetOfType(t uint32) ([]*ome.ServiceInfo, error) {
+	var result []*ome.ServiceInfo
+	for _, info := range m.all() {
+		if info.Type == t {
+			result = append(result, info)
+		}
+	}
+	if len(result) == 0 {
+		return nil, errors.NotFound
+	}
+	return result, nil
+}
+
+// FirstOfType returns the first local or discovered service of type t
+func (m *MDNSClient) FirstOfType(t uint32) (*ome.ServiceInfo, error) {
+	for _, info := range m.all() {
+		if info.Type == t {
+			return info, nil
+		}
+	}
+	return nil, errors.NotFound
+}
+
+// Query returns the local and discovered services that q selects
+func (m *MDNSClient) Query(q *Query) ([]*ome.ServiceInfo, error) {
+	return q.Filter(m.all()), nil
+}
+
+// Stop sends goodbye packets for the local services and leaves the multicast group
+func (m *MDNSClient) Stop() error {
+	m.mutex.Lock()
+	var services []*ome.ServiceInfo
+	for _, info := range m.local {
+		services = append(services, info)
+	}
+	m.mutex.Unlock()
+
+	for _, info := range services {
+		if err := m.announce(info, 0); err != nil {
+			log.Error("mdns registry • could not send goodbye", log.Err(err), log.Field("id", info.Id))
+		}
+	}
+
+	close(m.stop)
+	err := m.conn.Close()
+	if senderErr := m.sender.Close(); err == nil {
+		err = senderErr
+	}
+	m.wg.Wait()
+	return err
+}
+
+// all returns copies of the local and discovered services
+func (m *MDNSClient) all() []*ome.ServiceInfo {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var result []*ome.ServiceInfo
+	for _, info := range m.local {
+		result = append(result, proto.Clone(info).(*ome.ServiceInfo))
+	}
+	for _, entry := range m.remote {
+		result = append(result, proto.Clone(entry.info).(*ome.ServiceInfo))
+	}
+	return result
+}
+
+func (m *MDNSClient) instanceName(id string) string {
+	return id + "." + m.serviceType
+}
+
+// records returns the DNS-SD records describing info: a PTR answer, followed by the TXT record and the SRV and address
+// records of every node
+func (m *MDNSClient) records(info *ome.ServiceInfo, ttl uint32) ([]dnsRR, []dnsRR, error) {
+	txt, err := m.txtRecord(info, ttl, true)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	instance := m.instanceName(info.Id)
+	answers := []dnsRR{{
+		Name:  m.serviceType,
+		Type:  dnsTypePTR,
+		Class: dnsClassINET,
+		TTL:   ttl,
+		Data:  appendDNSName(nil, instance),
+	}}
+	additional := []dnsRR{txt}
+
+	for _, node := range info.Nodes {
+		host, port := dnsNodeHostPort(node)
+		ip := net.ParseIP(host)
+		target := host
+		if ip != nil {
+			target = m.nodeHostname(node)
+		}
+
+		srv := dnsSRVRecord(instance, port, target, ttl)
+		srv.Class |= mdnsClassCacheFlush
+		additional = append(additional, srv)
+
+		if rr, ok := dnsAddressRecord(target, ip, ttl); ok {
+			rr.Class |= mdnsClassCacheFlush
+			additional = append(additional, rr)
+		}
+	}
+	return answers, additional, nil
+}
+
+// txtRecord returns the TXT record of info. It holds the id and type of info, and its JSON encoding split in
+// "info.N" chunks if withInfo is true
+func (m *MDNSClient) txtRecord(info *ome.ServiceInfo, ttl uint32, withInfo bool) (dnsRR, error) {
+	strs := []string{
+		"id=" + info.Id,
+		"type=" + strconv.FormatUint(uint64(info.Type), 10),
+	}
+
+	if withInfo {
+		encoded, err := json.Marshal(info)
+		if err != nil {
+			return dnsRR{}, err
+		}
+		for i := 0; len(encoded) > 0; i++ {
+			chunk := encoded
+			if len(chunk) > mdnsInfoChunkSize {
+				chunk = chunk[:mdnsInfoChunkSize]
+			}
+			strs = append(strs, fmt.Sprintf("info.%d=%s", i, chunk))
+			encoded = encoded[len(chunk):]
+		}
+	}
+
+	txt := dnsTXTRecord(m.instanceName(info.Id), strs, ttl)
+	txt.Class |= mdnsClassCacheFlush
+	return txt, nil
+}
+
+// nodeHostname returns the host name the SRV record of node, whose address is an IP, targets. Each node gets its own
+// name so that the address records tell the address of every node
+func (m *MDNSClient) nodeHostname(node *ome.Node) string {
+	label := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return '-'
+	}, node.Id)
+	if len(label) > 63 {
+		label = label[:63]
+	}
+	if label == "" {
+		label = "node"
+	}
+	return label + "." + m.hostname
+}
+
+// announce multicasts info records. A zero ttl announces the service removal
+func (m *MDNSClient) announce(info *ome.ServiceInfo, ttl uint32) error {
+	msgs, err := m.announcements(info, ttl)
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		if err := m.send(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// announcements returns the packets announcing info. Records that do not fit in one packet are split across several,
+// and the service info is left out of the TXT record if it cannot fit in a packet: the service is then only
+// advertised, peers cannot register it
+func (m *MDNSClient) announcements(info *ome.ServiceInfo, ttl uint32) ([]*dnsMsg, error) {
+	answers, additional, err := m.records(info, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	first := &dnsMsg{Flags: dnsFlagResponse | dnsFlagAuthoritative, Answers: answers, Additional: additional[:1]}
+	if len(first.pack()) > mdnsMaxPacketSize {
+		log.Info("mdns registry • service info is too large to be announced", log.Field("id", info.Id))
+		additional[0], err = m.txtRecord(info, ttl, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var msgs []*dnsMsg
+	msg := &dnsMsg{Flags: dnsFlagResponse | dnsFlagAuthoritative, Answers: answers}
+	for _, rr := range additional {
+		msg.Additional = append(msg.Additional, rr)
+		if len(msg.Additional) == 1 || len(msg.pack()) <= mdnsMaxPacketSize {
+			continue
+		}
+
+		msg.Additional = msg.Additional[:len(msg.Additional)-1]
+		msgs = append(msgs, msg)
+		msg = &dnsMsg{Flags: dnsFlagResponse | dnsFlagAuthoritative, Answers: answers, Additional: []dnsRR{rr}}
+	}
+	return append(msgs, msg), nil
+}
+
+func (m *MDNSClient) browse() error {
+	return m.send(&dnsMsg{
+		Questions: []dnsQuestion{{
+			Name:  m.serviceType,
+			Type:  dnsTypePTR,
+			Class: dnsClassINET,
+		}},
+	})
+}
+
+func (m *MDNSClient) send(msg *dnsMsg) error {
+	packed := msg.pack()
+	if len(packed) > mdnsMaxPacketSize {
+		return errors.BadInput
+	}
+	_, err := m.sender.WriteToUDP(packed, mdnsGroupAddress)
+	return err
+}
+
+func (m *MDNSClient) receive(conn *net.UDPConn) {
+	defer m.wg.Done()
+
+	buf := make([]byte, mdnsMaxPacketSize)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if !isClosedConnError(err) {
+				log.Error("mdns registry • failed to read packet", log.Err(err))
+			}
+			return
+		}
+
+		msg, err := unpackDNSMsg(buf[:n])
+		if err != nil {
+			log.Info("mdns registry • received malformed packet", log.Field("from", addr.String()))
+			continue
+		}
+
+		if msg.Flags&dnsFlagResponse == 0 {
+			m.handleQuery(msg)
+		} else {
+			m.handleResponse(msg)
+		}
+	}
+}
+
+func (m *MDNSClient) handleQuery(msg *dnsMsg) {
+	m.mutex.Lock()
+	var services []*ome.ServiceInfo
+	for _, q := range msg.Questions {
+		name := strings.ToLower(q.Name)
+		for id, info := range m.local {
+			if name == strings.ToLower(m.serviceType) || name == strings.ToLower(m.instanceName(id)) {
+				services = append(services, info)
+			}
+		}
+	}
+	m.mutex.Unlock()
+
+	for _, info := range services {
+		if err := m.announce(info, m.ttl); err != nil {
+			log.Error("mdns registry • could not answer query", log.Err(err), log.Field("id", info.Id))
+		}
+	}
+}
+
+func (m *MDNSClient) handleResponse(msg *dnsMsg) {
+	records := append(append([]dnsRR{}, msg.Answers...), msg.Additional...)
+	suffix := "." + strings.ToLower(m.serviceType)
+
+	for _, rr := range records {
+		if rr.Type != dnsTypeTXT || !strings.HasSuffix(strings.ToLower(rr.Name), suffix) {
+			continue
+		}
+
+		info, err := mdnsDecodeTXT(rr.Data)
+		if err != nil {
+			log.Info("mdns registry • could not decode service info", log.Err(err), log.Field("name", rr.Name))
+			continue
+		}
+
+		m.mutex.Lock()
+		_, isLocal := m.local[info.Id]
+		m.mutex.Unlock()
+		if isLocal {
+			continue
+		}
+
+		if rr.TTL == 0 {
+			m.remove(info.Id)
+		} else {
+			m.save(info, time.Duration(rr.TTL)*time.Second)
+		}
+	}
+}
+
+func (m *MDNSClient) save(info *ome.ServiceInfo, ttl time.Duration) {
+	m.mutex.Lock()
+	previous, exists := m.remote[info.Id]
+	m.remote[info.Id] = &mdnsEntry{
+		info:      info,
+		expiresAt: time.Now().Add(ttl),
+	}
+	m.mutex.Unlock()
+
+	if !exists {
+		log.Info("mdns registry • discovered service", log.Field("id", info.Id))
+		m.notifyEvent(&ome.RegistryEvent{
+			Type:      ome.RegistryEventType_Register,
+			ServiceId: info.Id,
+			Info:      proto.Clone(info).(*ome.ServiceInfo),
+		})
+		return
+	}
+
+	before, _ := json.Marshal(previous.info)
+	after, _ := json.Marshal(info)
+	if string(before) != string(after) {
+		m.notifyEvent(&ome.RegistryEvent{
+			Type:      ome.RegistryEventType_Update,
+			ServiceId: info.Id,
+			Info:      proto.Clone(info).(*ome.ServiceInfo),
+		})
+	}
+}
+
+func (m *MDNSClient) remove(id string) {
+	m.mutex.Lock()
+	_, exists := m.remote[id]
+	delete(m.remote, id)
+	m.mutex.Unlock()
+
+	if exists {
+		log.Info("mdns registry • service left", log.Field("id", id))
+		m.notifyEvent(&ome.RegistryEvent{
+			Type:      ome.RegistryEventType_DeRegister,
+			ServiceId: id,
+		})
+	}
+}
+
+// maintain periodically browses the network and evicts expired services
+func (m *MDNSClient) maintain() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := m.browse(); err != nil && !isClosedConnError(err) {
+			log.Error("mdns registry • could not send browse query", log.Err(err))
+		}
+
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		var expired []string
+		m.mutex.Lock()
+		for id, entry := range m.remote {
+			if now.After(entry.expiresAt) {
+				expired = append(expired, id)
+			}
+		}
+		m.mutex.Unlock()
+
+		for _, id := range expired {
+			m.remove(id)
+		}
+	}
+}
+
+func (m *MDNSClient) notifyEvent(e *ome.RegistryEvent) {
+	m.handlers.Range(func(key, value interface{}) bool {
+		h := value.(ome.EventHandler)
+		go h.Handle(e)
+		return true
+	})
+}
+
+// mdnsDecodeTXT rebuilds a service info from the "info.N" chunks of a TXT record data
+func mdnsDecodeTXT(data []byte) (*ome.ServiceInfo, error) {
+	chunks := map[int]string{}
+	for len(data) > 0 {
+		length := int(data[0])
+		if 1+length > len(data) {
+			return nil, errors.BadInput
+		}
+		str := string(data[1 : 1+length])
+		data = data[1+length:]
+
+		if !strings.HasPrefix(str, "info.") {
+			continue
+		}
+
+		parts := strings.SplitN(str[len("info."):], "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.BadInput
+		}
+
+		index, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, errors.BadInput
+		}
+		chunks[index] = parts[1]
+	}
+
+	if len(chunks) == 0 {
+		return nil, errors.NotFound
+	}
+
+	var indexes []int
+	for index := range chunks {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	var encoded strings.Builder
+	for i, index := range indexes {
+		if i != index {
+			return nil, errors.BadInput
+		}
+		encoded.WriteString(chunks[index])
+	}
+
+	info := new(ome.ServiceInfo)
+	err := json.Unmarshal([]byte(encoded.String()), info)
+	if err != nil {
+		return nil, err
+	}
+	if info.Id == "" {
+		return nil, errors.BadInput
+	}
+	return info, nil
+}
+
+// NewMDNSClient joins the mDNS multicast group and starts browsing for services
+func NewMDNSClient(config *MDNSConfig) (*MDNSClient, error) {
+	if config == nil {
+		config = new(MDNSConfig)
+	}
+
+	m := &MDNSClient{
+		handlers:    new(sync.Map),
+		serviceType: config.ServiceType,
+		ttl:         config.TTL,
+		interval:    config.BrowseInterval,
+		local:       map[string]*ome.ServiceInfo{},
+		remote:      map[string]*mdnsEntry{},
+		stop:        make(chan bool),
+	}
+
+	domain := config.Domain
+	if domain == "" {
+		domain = mdnsDefaultDomain
+	}
+	if !strings.HasSuffix(domain, ".") {
+		domain += "."
+	}
+
+	if m.serviceType == "" {
+		m.serviceType = mdnsDefaultServiceType
+	}
+	m.serviceType = strings.TrimSuffix(m.serviceType, ".") + "." + domain
+
+	if m.ttl == 0 {
+		m.ttl = mdnsDefaultTTL
+	}
+
+	if m.interval == 0 {
+		m.interval = mdnsDefaultBrowseInterval
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = uuid.New().String()
+	}
+	m.hostname = strings.Split(hostname, ".")[0] + "." + domain
+
+	m.conn, err = net.ListenMulticastUDP("udp4", config.Interface, mdnsGroupAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	// The group connection does not loop its packets back to the host, packets are sent
+	// from a distinct socket so that peers running on the same host see each other
+	m.sender, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		_ = m.conn.Close()
+		return nil, err
+	}
+	if config.Interface != nil {
+		if err := ipv4.NewPacketConn(m.sender).SetMulticastInterface(config.Interface); err != nil {
+			_ = m.conn.Close()
+			_ = m.sender.Close()
+			return nil, err
+		}
+	}
+
+	m.wg.Add(3)
+	go m.receive(m.conn)
+	go m.receive(m.sender)
+	go m.maintain()
+
+	log.Info("[discovery] mDNS registry started", log.Field("service-type", m.serviceType))
+	return m, nil
+}
@@ -0,0 +1,254 @@
+package discover
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/omecodes/libome"
+)
+
+func testMDNSClient() *MDNSClient {
+	return &MDNSClient{
+		handlers:    new(sync.Map),
+		serviceType: mdnsDefaultServiceType + "." + mdnsDefaultDomain,
+		hostname:    "host." + mdnsDefaultDomain,
+		ttl:         mdnsDefaultTTL,
+		local:       map[string]*ome.ServiceInfo{},
+		remote:      map[string]*mdnsEntry{},
+		stop:        make(chan bool),
+	}
+}
+
+func TestMDNSRecords(t *testing.T) {
+	m := testMDNSClient()
+	info := &ome.ServiceInfo{Id: "api", Nodes: []*ome.Node{
+		{Id: "a", Address: "10.0.0.1:80"},
+		{Id: "b.1", Address: "10.0.0.2:81"},
+		{Id: "c", Address: "db.example.com:82"},
+	}}
+
+	answers, additional, err := m.records(info, 120)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answers) != 1 || answers[0].Type != dnsTypePTR {
+		t.Fatalf("got answers %v", answers)
+	}
+
+	var records []string
+	for _, rr := range additional {
+		if rr.Type != dnsTypeTXT {
+			records = append(records, rr.Name+" "+dnsRRString(t, rr))
+		}
+	}
+	expected := []string{
+		"api._ome-discover._tcp.local. SRV 80 a.host.local.",
+		"a.host.local. A 10.0.0.1",
+		"api._ome-discover._tcp.local. SRV 81 b-1.host.local.",
+		"b-1.host.local. A 10.0.0.2",
+		"api._ome-discover._tcp.local. SRV 82 db.example.com.",
+	}
+	if strings.Join(records, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got records\n%s\nexpected\n%s", strings.Join(records, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestMDNSAnnouncements(t *testing.T) {
+	var nodes []*ome.Node
+	for i := 0; i < 300; i++ {
+		nodes = append(nodes, &ome.Node{Id: fmt.Sprintf("node-%d", i), Address: fmt.Sprintf("10.0.%d.%d:80", i/256, i%256)})
+	}
+
+	tests := []struct {
+		name     string
+		info     *ome.ServiceInfo
+		packets  int
+		withInfo bool
+	}{
+		{
+			name:     "small info",
+			info:     testService("api", "10.0.0.1:80"),
+			packets:  1,
+			withInfo: true,
+		},
+		{
+			name:    "many nodes",
+			info:    &ome.ServiceInfo{Id: "api", Nodes: nodes},
+			packets: 2,
+		},
+		{
+			name:    "large meta",
+			info:    &ome.ServiceInfo{Id: "api", Meta: map[string]string{"blob": strings.Repeat("x", mdnsMaxPacketSize)}},
+			packets: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := testMDNSClient()
+			msgs, err := m.announcements(test.info, 120)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(msgs) < test.packets {
+				t.Errorf("got %d packets, expected at least %d", len(msgs), test.packets)
+			}
+
+			srvs := 0
+			for _, msg := range msgs {
+				if size := len(msg.pack()); size > mdnsMaxPacketSize {
+					t.Errorf("packet of %d bytes", size)
+				}
+				if len(msg.Answers) != 1 || msg.Answers[0].Type != dnsTypePTR {
+					t.Error("packet without the PTR answer")
+				}
+				for _, rr := range msg.Additional {
+					if rr.Type == dnsTypeSRV {
+						srvs++
+					}
+				}
+			}
+			if srvs != len(test.info.Nodes) {
+				t.Errorf("announced %d SRV records for %d nodes", srvs, len(test.info.Nodes))
+			}
+
+			txt := msgs[0].Additional[0]
+			info, err := mdnsDecodeTXT(txt.Data)
+			if !test.withInfo {
+				if err == nil {
+					t.Error("the TXT record carries the service info")
+				}
+				if !strings.Contains(string(txt.Data), "id=api") {
+					t.Error("the TXT record does not carry the service id")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Id != test.info.Id || len(info.Nodes) != len(test.info.Nodes) {
+				t.Errorf("decoded %v", info)
+			}
+		})
+	}
+}
+
+func TestMDNSResponse(t *testing.T) {
+	announcer := testMDNSClient()
+	browser := testMDNSClient()
+	info := testService("api", "10.0.0.1:80")
+	info.Meta = map[string]string{"blob": strings.Repeat("x", 3*mdnsInfoChunkSize)}
+
+	msgs, err := announcer.announcements(info, 120)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range msgs {
+		received, err := unpackDNSMsg(msg.pack())
+		if err != nil {
+			t.Fatal(err)
+		}
+		browser.handleResponse(received)
+	}
+	discovered, err := browser.GetService("api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if discovered.Meta["blob"] != info.Meta["blob"] || discovered.Nodes[0].Address != "10.0.0.1:80" {
+		t.Errorf("discovered %v", discovered)
+	}
+
+	goodbye, err := announcer.announcements(info, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	browser.handleResponse(goodbye[0])
+	if hasService(browser, "api") {
+		t.Error("the service is still registered after its goodbye announcement")
+	}
+}
+
+func TestNewClientWithoutConfig(t *testing.T) {
+	registry, err := NewClient(nil)
+	if err != nil {
+		t.Skipf("multicast is not available: %s", err)
+	}
+	if _, ok := registry.(*MDNSClient); !ok {
+		t.Errorf("created a %T instead of an mDNS registry client", registry)
+	}
+	if err := registry.Stop(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMDNSClientReturnsCopies(t *testing.T) {
+	m := testMDNSClient()
+	sender, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	m.sender = sender
+
+	events := make(chan *ome.RegistryEvent, 10)
+	m.RegisterEventHandler(ome.EventHandlerFunc(func(e *ome.RegistryEvent) {
+		events <- e
+	}))
+
+	info := testService("api", "10.0.0.1:80")
+	info.Nodes = append(info.Nodes, &ome.Node{Id: "other", Address: "10.0.0.2:80"})
+	if err := m.RegisterService(info); err != nil {
+		t.Skipf("multicast is not available: %s", err)
+	}
+
+	registered := <-events
+
+	// the caller info is not the stored one
+	info.Nodes[0].Address = "10.0.0.9:80"
+	got, err := m.GetService("api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Nodes[0].Address != "10.0.0.1:80" {
+		t.Error("the registered info was changed by its caller")
+	}
+
+	// returned infos are copies
+	got.Nodes = nil
+	queried, err := m.Query(&Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queried) != 1 || len(queried[0].Nodes) != 2 {
+		t.Fatalf("got %v", queried)
+	}
+	queried[0].Nodes[1].Address = "10.0.0.9:80"
+	if node, err := m.GetNode("api", "other"); err != nil || node.Address != "10.0.0.2:80" {
+		t.Errorf("the stored info was changed through a query result: %v %v", node, err)
+	}
+
+	// removing nodes replaces the stored info instead of modifying infos handed out before
+	before, err := m.GetService("api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.DeregisterService("api", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if len(before.Nodes) != 2 || len(registered.Info.Nodes) != 2 {
+		t.Error("deregistering a node changed infos handed out before")
+	}
+	after, err := m.GetService("api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after.Nodes) != 1 || after.Nodes[0].Id != "node" {
+		t.Errorf("got nodes %v after the deregistration", after.Nodes)
+	}
+	if e := <-events; e.Type != ome.RegistryEventType_DeRegisterNode || len(e.Info.Nodes) != 1 {
+		t.Errorf("got event %v", e)
+	}
+}
@@ -0,0 +1,338 @@
+package discover
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/omecodes/common/utils/log"
+)
+
+// Metric names reported by the server and the client
+const (
+	MetricServerConnectedPeers     = "discover_server_connected_peers"
+	MetricServerPeerConnections    = "discover_server_peer_connections_total"
+	MetricServerPeerDisconnections = "discover_server_peer_disconnections_total"
+	MetricServerServices           = "discover_server_services"
+	MetricServerMessages           = "discover_server_messages_total"
+	MetricServerEvents             = "discover_server_events_total"
+	MetricServerDecodeFailures     = "discover_server_decode_failures_total"
+	MetricServerStoreDuration      = "discover_server_store_duration_seconds"
+	MetricServerBroadcastDuration  = "discover_server_broadcast_duration_seconds"
+	MetricServerInitialSync        = "discover_server_initial_sync_duration_seconds"
+	MetricServerResyncs            = "discover_server_resyncs_total"
+	MetricServerRejections         = "discover_server_rejections_total"
+	MetricServerAdmissionFailures  = "discover_server_admission_failures_total"
+	MetricServerWebhookDeliveries  = "discover_server_webhook_deliveries_total"
+
+	MetricClientConnected      = "discover_client_connected"
+	MetricClientReconnects     = "discover_client_reconnects_total"
+	MetricClientMessages       = "discover_client_messages_total"
+	MetricClientDecodeFailures = "discover_client_decode_failures_total"
+	MetricClientResyncs        = "discover_client_resyncs_total"
+	MetricClientRejections     = "discover_client_rejections_total"
+
+	// MetricsPath is the path the Prometheus exposition is served at
+	MetricsPath = "/metrics"
+
+	metricsRefreshInterval = time.Second * 15
+)
+
+var metricsHelp = map[string]string{
+	MetricServerConnectedPeers:     "Number of peers connected to the server.",
+	MetricServerPeerConnections:    "Number of peer connections accepted.",
+	MetricServerPeerDisconnections: "Number of peer disconnections.",
+	MetricServerServices:           "Number of registered services per type.",
+	MetricServerMessages:           "Number of messages received from peers per message type. Unsupported types are counted together.",
+	MetricServerEvents:             "Number of registry events notified to handlers per type.",
+	MetricServerDecodeFailures:     "Number of messages or store entries that could not be decoded.",
+	MetricServerStoreDuration:      "Duration of registry store operations.",
+	MetricServerBroadcastDuration:  "Duration of message broadcasts to all connected peers.",
+	MetricServerInitialSync:        "Duration of the registry content transfer to newly connected peers.",
+	MetricServerResyncs:            "Number of peer patches that did not apply and were replaced by the full service info.",
+	MetricServerRejections:         "Number of peer mutations rejected by rate limits, quotas, validation and admission hooks per reason.",
+	MetricServerAdmissionFailures:  "Number of admission hook failures and timeouts per hook and failure policy.",
+	MetricServerWebhookDeliveries:  "Number of webhook delivery attempts per endpoint and result: delivered, retried or dead_lettered.",
+	MetricClientConnected:          "Whether the client is connected to the server.",
+	MetricClientReconnects:         "Number of client reconnections to the server.",
+	MetricClientMessages:           "Number of messages received from the server per registry event type.",
+	MetricClientDecodeFailures:     "Number of server messages that could not be decoded.",
+	MetricClientResyncs:            "Number of server patches that did not apply and were replaced by the full service info.",
+	MetricClientRejections:         "Number of client mutations rejected by the server rate limits, quotas, validation and admission hooks.",
+}
+
+// Metrics is the interface metrics backends implement
+type Metrics interface {
+	// Add adds delta to the counter name
+	Add(name string, delta float64, labels map[string]string)
+	// Set sets the gauge name to value
+	Set(name string, value float64, labels map[string]string)
+	// Observe records value in the histogram name
+	Observe(name string, value float64, labels map[string]string)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) Add(string, float64, map[string]string)     {}
+func (noopMetrics) Set(string, float64, map[string]string)     {}
+func (noopMetrics) Observe(string, float64, map[string]string) {}
+
+func observeDuration(m Metrics, name string, start time.Time, labels map[string]string) {
+	m.Observe(name, time.Since(start).Seconds(), labels)
+}
+
+type metricKind int
+
+const (
+	metricCounter metricKind = iota
+	metricGauge
+	metricHistogram
+)
+
+func (k metricKind) String() string {
+	switch k {
+	case metricCounter:
+		return "counter"
+	case metricGauge:
+		return "gauge"
+	default:
+		return "histogram"
+	}
+}
+
+type metricSeries struct {
+	labels  map[string]string
+	value   float64
+	buckets []uint64
+	count   uint64
+}
+
+type metricFamily struct {
+	kind   metricKind
+	series map[string]*metricSeries
+}
+
+// PrometheusMetrics is an in-memory Metrics implementation that serves the Prometheus text exposition format
+type PrometheusMetrics struct {
+	mutex    sync.Mutex
+	buckets  []float64
+	families map[string]*metricFamily
+}
+
+// NewPrometheusMetrics creates a Prometheus metrics registry. Histograms use buckets, or default latency buckets if empty
+func NewPrometheusMetrics(buckets ...float64) *PrometheusMetrics {
+	if len(buckets) == 0 {
+		buckets = []float64{.0005, .001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	}
+	sort.Float64s(buckets)
+	return &PrometheusMetrics{
+		buckets:  buckets,
+		families: map[string]*metricFamily{},
+	}
+}
+
+func (p *PrometheusMetrics) Add(name string, delta float64, labels map[string]string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if series := p.get(name, metricCounter, labels); series != nil {
+		series.value += delta
+	}
+}
+
+func (p *PrometheusMetrics) Set(name string, value float64, labels map[string]string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if series := p.get(name, metricGauge, labels); series != nil {
+		series.value = value
+	}
+}
+
+func (p *PrometheusMetrics) Observe(name string, value float64, labels map[string]string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	series := p.get(name, metricHistogram, labels)
+	if series == nil {
+		return
+	}
+	if series.buckets == nil {
+		series.buckets = make([]uint64, len(p.buckets))
+	}
+	for i, upperBound := range p.buckets {
+		if value <= upperBound {
+			series.buckets[i]++
+		}
+	}
+	series.count++
+	series.value += value
+}
+
+// get returns the series of the metric name with labels, created if needed. It returns nil if name is already used
+// by a metric of another kind
+func (p *PrometheusMetrics) get(name string, kind metricKind, labels map[string]string) *metricSeries {
+	family, found := p.families[name]
+	if !found {
+		family = &metricFamily{kind: kind, series: map[string]*metricSeries{}}
+		p.families[name] = family
+	}
+	if family.kind != kind {
+		log.Error("metrics • dropped value of metric reused with another kind", log.Field("name", name),
+			log.Field("kind", family.kind.String()), log.Field("reused_as", kind.String()))
+		return nil
+	}
+
+	key := formatLabels(labels)
+	series, found := family.series[key]
+	if !found {
+		// callers may reuse their labels map once the value is recorded
+		copied := make(map[string]string, len(labels))
+		for k, v := range labels {
+			copied[k] = v
+		}
+		series = &metricSeries{labels: copied}
+		family.series[key] = series
+	}
+	return series
+}
+
+// ServeHTTP writes all metrics in the Prometheus text exposition format
+func (p *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var names []string
+	for name := range p.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		family := p.families[name]
+		if help, found := metricsHelp[name]; found {
+			fmt.Fprintf(&b, "# HELP %s %s\n", name, help)
+		}
+		fmt.Fprintf(&b, "# TYPE %s %s\n", name, family.kind)
+
+		var keys []string
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			series := family.series[key]
+			if family.kind != metricHistogram {
+				fmt.Fprintf(&b, "%s%s %s\n", name, key, formatMetricValue(series.value))
+				continue
+			}
+
+			for i, upperBound := range p.buckets {
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", name, formatLabels(series.labels, "le", formatMetricValue(upperBound)), series.buckets[i])
+			}
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", name, formatLabels(series.labels, "le", "+Inf"), series.count)
+			fmt.Fprintf(&b, "%s_sum%s %s\n", name, key, formatMetricValue(series.value))
+			fmt.Fprintf(&b, "%s_count%s %d\n", name, key, series.count)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if _, err := w.Write([]byte(b.String())); err != nil {
+		log.Error("metrics • could not write exposition", log.Err(err))
+	}
+}
+
+// formatLabels returns the Prometheus representation of labels to which the extra key/value pairs are appended
+func formatLabels(labels map[string]string, extra ...string) string {
+	var keys []string
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+quoteLabelValue(labels[key]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+quoteLabelValue(extra[i+1]))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// labelValueEscaper escapes label values as the exposition format expects: only backslashes, double quotes and line
+// feeds are escaped
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabelValue(value string) string {
+	return `"` + labelValueEscaper.Replace(value) + `"`
+}
+
+func formatMetricValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// refreshServiceMetrics periodically reports the number of services per type
+func (s *Server) refreshServiceMetrics() {
+	reported := map[uint32]bool{}
+	ticker := time.NewTicker(metricsRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		services, err := s.listServices()
+		if err != nil {
+			log.Error("registry server • could not list services for metrics", log.Err(err))
+		} else {
+			counts := map[uint32]int{}
+			for t := range reported {
+				counts[t] = 0
+			}
+			for _, info := range services {
+				counts[info.Type]++
+			}
+			for t, count := range counts {
+				reported[t] = true
+				s.metrics.Set(MetricServerServices, float64(count), map[string]string{"type": strconv.FormatUint(uint64(t), 10)})
+			}
+		}
+
+		select {
+		case <-s.stopMetrics:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) serveMetrics(address string, handler http.Handler) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, handler)
+	s.metricsServer = &http.Server{Handler: mux}
+
+	go func() {
+		if err := s.metricsServer.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Error("registry server • metrics server stopped", log.Err(err))
+		}
+	}()
+
+	log.Info("[discovery] starting metrics endpoint", log.Field("at", l.Addr()), log.Field("path", MetricsPath))
+	return nil
+}
@@ -0,0 +1,97 @@
+package discover
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// exposition returns the Prometheus text exposition of m
+func exposition(t *testing.T, m *PrometheusMetrics) string {
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, MetricsPath, nil))
+	if contentType := rec.Header().Get("Content-Type"); contentType != "text/plain; version=0.0.4" {
+		t.Errorf("got content type %q", contentType)
+	}
+	return rec.Body.String()
+}
+
+func TestPrometheusExposition(t *testing.T) {
+	m := NewPrometheusMetrics(0.1, 1)
+	m.Add(MetricServerMessages, 1, map[string]string{"type": "Register"})
+	m.Add(MetricServerMessages, 2, map[string]string{"type": "Register"})
+	m.Add(MetricServerMessages, 1, map[string]string{"type": "DeRegister"})
+	m.Set(MetricServerConnectedPeers, 3, nil)
+	m.Set(MetricServerConnectedPeers, 2, nil)
+	m.Observe(MetricServerStoreDuration, 0.05, map[string]string{"op": "save"})
+	m.Observe(MetricServerStoreDuration, 0.5, map[string]string{"op": "save"})
+	m.Observe(MetricServerStoreDuration, 5, map[string]string{"op": "save"})
+
+	want := `# HELP discover_server_connected_peers Number of peers connected to the server.
+# TYPE discover_server_connected_peers gauge
+discover_server_connected_peers 2
+# HELP discover_server_messages_total Number of messages received from peers per message type. Unsupported types are counted together.
+# TYPE discover_server_messages_total counter
+discover_server_messages_total{type="DeRegister"} 1
+discover_server_messages_total{type="Register"} 3
+# HELP discover_server_store_duration_seconds Duration of registry store operations.
+# TYPE discover_server_store_duration_seconds histogram
+discover_server_store_duration_seconds_bucket{op="save",le="0.1"} 1
+discover_server_store_duration_seconds_bucket{op="save",le="1"} 2
+discover_server_store_duration_seconds_bucket{op="save",le="+Inf"} 3
+discover_server_store_duration_seconds_sum{op="save"} 5.55
+discover_server_store_duration_seconds_count{op="save"} 3
+`
+	if got := exposition(t, m); got != want {
+		t.Errorf("got exposition\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestPrometheusLabelEscaping(t *testing.T) {
+	m := NewPrometheusMetrics()
+	m.Add("test_total", 1, map[string]string{"b": "line\nbreak", "a": `say "hi" \ bye`, "c": "é\t"})
+
+	want := `test_total{a="say \"hi\" \\ bye",b="line\nbreak",c="é	"} 1`
+	if got := exposition(t, m); !strings.Contains(got, want+"\n") {
+		t.Errorf("got exposition\n%s\nwant the line\n%s", got, want)
+	}
+}
+
+func TestPrometheusMetricsCopyLabels(t *testing.T) {
+	m := NewPrometheusMetrics()
+	labels := map[string]string{"type": "Register"}
+	m.Add("test_total", 1, labels)
+
+	// the series keeps the labels it was recorded with
+	labels["type"] = "Update"
+	m.Add("test_total", 1, labels)
+
+	got := exposition(t, m)
+	for _, line := range []string{`test_total{type="Register"} 1`, `test_total{type="Update"} 1`} {
+		if !strings.Contains(got, line+"\n") {
+			t.Errorf("got exposition\n%s\nwant the line\n%s", got, line)
+		}
+	}
+}
+
+func TestPrometheusMetricsKindMismatch(t *testing.T) {
+	m := NewPrometheusMetrics(1)
+	m.Add("test", 1, nil)
+	m.Set("test", 5, nil)
+	m.Observe("test", 0.5, nil)
+	m.Observe("test_seconds", 0.5, nil)
+	m.Add("test_seconds", 1, nil)
+
+	want := `# TYPE test counter
+test 1
+# TYPE test_seconds histogram
+test_seconds_bucket{le="1"} 1
+test_seconds_bucket{le="+Inf"} 1
+test_seconds_sum 0.5
+test_seconds_count 1
+`
+	if got := exposition(t, m); got != want {
+		t.Errorf("got exposition\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,369 @@
+package discover
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/omecodes/common/errors"
+	"github.com/omecodes/common/utils/log"
+	"github.com/omecodes/libome"
+)
+
+const defaultMirrorRetryInterval = time.Second * 5
+
+// Sink is an external system the registry is mirrored to
+type Sink interface {
+	// Put creates or replaces the info of a service
+	Put(info *ome.ServiceInfo) error
+	// Delete deletes the service id. Deleting a missing service is not an error
+	Delete(id string) error
+	// List returns the ids of the services the sink holds
+	List() ([]string, error)
+}
+
+// MirroredRegistry is a registry whose services can be mirrored, such as Server, MsgClient and MDNSClient
+type MirroredRegistry interface {
+	GetService(id string) (*ome.ServiceInfo, error)
+	Query(q *Query) ([]*ome.ServiceInfo, error)
+	RegisterEventHandler(h ome.EventHandler) string
+	DeregisterEventHandler(id string)
+}
+
+// MirrorConfig tells which services are mirrored and how often the sink is reconciled with the registry
+type MirrorConfig struct {
+	// Query selects the mirrored services. All if nil
+	Query *Query
+	// ResyncInterval is the period of the full reconciliations of the sink. The sink is only reconciled when the
+	// mirror starts if zero
+	ResyncInterval time.Duration
+	// RetryInterval is the delay before the failed sink operations are tried again. Defaults to 5 seconds
+	RetryInterval time.Duration
+}
+
+// Mirror keeps a sink in sync with a registry. Registry events only tell which services changed: their current
+// info is read from the registry when the sink is updated, which makes the mirror insensitive to event ordering
+type Mirror struct {
+	registry  MirroredRegistry
+	sink      Sink
+	config    MirrorConfig
+	handlerID string
+
+	mutex   sync.Mutex
+	pending map[string]bool
+	changed chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// StartMirror reconciles sink with registry, then updates sink as the registry services change until Stop is called
+func StartMirror(registry MirroredRegistry, sink Sink, config MirrorConfig) (*Mirror, error) {
+	if config.RetryInterval <= 0 {
+		config.RetryInterval = defaultMirrorRetryInterval
+	}
+
+	m := &Mirror{
+		registry: registry,
+		sink:     sink,
+		config:   config,
+		pending:  map[string]bool{},
+		changed:  make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	// events received during the reconciliation are applied afterwards
+	m.handlerID = registry.RegisterEventHandler(ome.EventHandlerFunc(m.handle))
+	if err := m.resync(); err != nil {
+		registry.DeregisterEventHandler(m.handlerID)
+		return nil, err
+	}
+
+	go m.run()
+	return m, nil
+}
+
+// handle schedules the update of the service of e
+func (m *Mirror) handle(e *ome.RegistryEvent) {
+	m.mutex.Lock()
+	m.pending[e.ServiceId] = true
+	m.mutex.Unlock()
+
+	select {
+	case m.changed <- struct{}{}:
+	default:
+	}
+}
+
+// resync puts the selected registry services in the sink and deletes the other services it holds
+func (m *Mirror) resync() error {
+	query := m.config.Query
+	if query == nil {
+		query = &Query{}
+	}
+	infos, err := m.registry.Query(query)
+	if err != nil {
+		return err
+	}
+	ids, err := m.sink.List()
+	if err != nil {
+		return err
+	}
+
+	mirrored := map[string]bool{}
+	for _, info := range infos {
+		mirrored[info.Id] = true
+		if err := m.sink.Put(info); err != nil {
+			return err
+		}
+	}
+	for _, id := range ids {
+		if !mirrored[id] {
+			if err := m.sink.Delete(id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// update mirrors the current state of the service id
+func (m *Mirror) update(id string) error {
+	info, err := m.registry.GetService(id)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	if info == nil || (m.config.Query != nil && !m.config.Query.Match(info)) {
+		return m.sink.Delete(id)
+	}
+	return m.sink.Put(info)
+}
+
+func (m *Mirror) run() {
+	defer close(m.done)
+
+	var resync <-chan time.Time
+	if m.config.ResyncInterval > 0 {
+		ticker := time.NewTicker(m.config.ResyncInterval)
+		defer ticker.Stop()
+		resync = ticker.C
+	}
+
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-m.stop:
+			return
+
+		case <-resync:
+			if err := m.resync(); err != nil {
+				log.Error("registry mirror • resync failed", log.Err(err))
+			}
+			continue
+
+		case <-retry:
+			retry = nil
+		case <-m.changed:
+		}
+
+		m.mutex.Lock()
+		pending := m.pending
+		m.pending = map[string]bool{}
+		m.mutex.Unlock()
+
+		var failed []string
+		for id := range pending {
+			if err := m.update(id); err != nil {
+				log.Error("registry mirror • failed to update sink", log.Err(err), log.Field("service", id))
+				failed = append(failed, id)
+			}
+		}
+		if len(failed) > 0 {
+			m.mutex.Lock()
+			for _, id := range failed {
+				m.pending[id] = true
+			}
+			m.mutex.Unlock()
+			if retry == nil {
+				retry = time.After(m.config.RetryInterval)
+			}
+		}
+	}
+}
+
+// Stop stops updating the sink
+func (m *Mirror) Stop() error {
+	m.registry.DeregisterEventHandler(m.handlerID)
+	close(m.stop)
+	<-m.done
+	return nil
+}
+
+// FileSink mirrors services to a directory, as one JSON file per service named after its URL path escaped id.
+// Files are replaced atomically, so that readers never see a partial service info
+type FileSink struct {
+	dir string
+}
+
+// NewFileSink creates a sink that writes the services files to dir, which is created if needed
+func NewFileSink(dir string) (*FileSink, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileSink{dir: dir}, nil
+}
+
+func (f *FileSink) filename(id string) string {
+	return filepath.Join(f.dir, url.PathEscape(id)+".json")
+}
+
+func (f *FileSink) Put(info *ome.ServiceInfo) error {
+	encoded, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	filename := f.filename(info.Id)
+	file, err := ioutil.TempFile(f.dir, filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(encoded)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0644)
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), filename)
+}
+
+func (f *FileSink) Delete(id string) error {
+	err := os.Remove(f.filename(id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (f *FileSink) List() ([]string, error) {
+	files, err := ioutil.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		id, err := url.PathUnescape(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// KeyValueStore is the interface of the key/value stores services can be mirrored to, such as etcd or the Consul KV
+type KeyValueStore interface {
+	// Put creates or replaces the value of key
+	Put(key string, value []byte) error
+	// Delete deletes key. Deleting a missing key is not an error
+	Delete(key string) error
+	// Keys returns the keys that start with prefix
+	Keys(prefix string) ([]string, error)
+}
+
+// KeyValueSink mirrors services to a key/value store, as JSON values under the Prefix + service id keys
+type KeyValueSink struct {
+	Store  KeyValueStore
+	Prefix string
+}
+
+func (k *KeyValueSink) Put(info *ome.ServiceInfo) error {
+	encoded, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return k.Store.Put(k.Prefix+info.Id, encoded)
+}
+
+func (k *KeyValueSink) Delete(id string) error {
+	return k.Store.Delete(k.Prefix + id)
+}
+
+func (k *KeyValueSink) List() ([]string, error) {
+	keys, err := k.Store.Keys(k.Prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(keys))
+	for i, key := range keys {
+		ids[i] = strings.TrimPrefix(key, k.Prefix)
+	}
+	return ids, nil
+}
+
+// MemoryKeyValueStore is an in-memory KeyValueStore, a stand-in for external stores in development and tests
+type MemoryKeyValueStore struct {
+	mutex  sync.RWMutex
+	values map[string][]byte
+}
+
+func NewMemoryKeyValueStore() *MemoryKeyValueStore {
+	return &MemoryKeyValueStore{values: map[string][]byte{}}
+}
+
+func (s *MemoryKeyValueStore) Put(key string, value []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.values[key] = append([]byte(nil), value...)
+	return nil
+}
+
+// Get returns the value of key. It returns errors.NotFound if there is none
+func (s *MemoryKeyValueStore) Get(key string) ([]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	value, found := s.values[key]
+	if !found {
+		return nil, errors.NotFound
+	}
+	return append([]byte(nil), value...), nil
+}
+
+func (s *MemoryKeyValueStore) Delete(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.values, key)
+	return nil
+}
+
+func (s *MemoryKeyValueStore) Keys(prefix string) ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var keys []string
+	for key := range s.values {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
@@ -0,0 +1,340 @@
+package discover
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/omecodes/common/errors"
+	"github.com/omecodes/libome"
+)
+
+// flakySink is a sink whose first failures puts fail
+type flakySink struct {
+	Sink
+	mutex    sync.Mutex
+	failures int
+	puts     int
+}
+
+func (f *flakySink) Put(info *ome.ServiceInfo) error {
+	f.mutex.Lock()
+	f.puts++
+	failed := f.puts <= f.failures
+	f.mutex.Unlock()
+
+	if failed {
+		return fmt.Errorf("%w: sink is down", errors.Unavailable)
+	}
+	return f.Sink.Put(info)
+}
+
+// mirroredService returns the service id held by store, or nil if there is none
+func mirroredService(t *testing.T, store *MemoryKeyValueStore, id string) *ome.ServiceInfo {
+	value, err := store.Get("services/" + id)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		t.Fatal(err)
+	}
+
+	info := new(ome.ServiceInfo)
+	if err := json.Unmarshal(value, info); err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func mirroredKeys(t *testing.T, store *MemoryKeyValueStore) []string {
+	keys, err := store.Keys("services/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestMirrorInitialResync(t *testing.T) {
+	s := startTestServer(t, &ServerConfig{})
+	defer s.Stop()
+
+	web := testService("web", "10.0.0.1:80")
+	web.Label = "web"
+	db := testService("db", "10.0.0.2:5432")
+	db.Label = "db"
+	for _, info := range []*ome.ServiceInfo{web, db} {
+		if err := s.RegisterService(info); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := NewMemoryKeyValueStore()
+	for _, key := range []string{"services/stale", "services/db", "other/web"} {
+		if err := store.Put(key, []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, err := StartMirror(s, &KeyValueSink{Store: store, Prefix: "services/"}, MirrorConfig{Query: &Query{Label: "w*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	// the sink holds the selected services only, and keys outside of the prefix are left as they are
+	if keys := mirroredKeys(t, store); !reflect.DeepEqual(keys, []string{"services/web"}) {
+		t.Errorf("got keys %v after the initial resync", keys)
+	}
+	if info := mirroredService(t, store, "web"); info == nil || info.Label != "web" || len(info.Nodes) != 1 {
+		t.Errorf("got mirrored service %v", info)
+	}
+	if _, err := store.Get("other/web"); err != nil {
+		t.Errorf("key outside of the prefix removed: %s", err)
+	}
+}
+
+func TestMirrorInitialResyncFailure(t *testing.T) {
+	s := startTestServer(t, &ServerConfig{})
+	defer s.Stop()
+	if err := s.RegisterService(testService("a", "10.0.0.1:80")); err != nil {
+		t.Fatal(err)
+	}
+
+	sink := &flakySink{Sink: &KeyValueSink{Store: NewMemoryKeyValueStore()}, failures: 1}
+	if _, err := StartMirror(s, sink, MirrorConfig{}); err == nil {
+		t.Error("expected the failed put to fail the mirror start")
+	}
+}
+
+func TestMirrorUpdates(t *testing.T) {
+	s := startTestServer(t, &ServerConfig{})
+	defer s.Stop()
+
+	store := NewMemoryKeyValueStore()
+	m, err := StartMirror(s, &KeyValueSink{Store: store, Prefix: "services/"}, MirrorConfig{Query: &Query{Label: "web"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	web := testService("web", "10.0.0.1:80")
+	web.Label = "web"
+	if err := s.RegisterService(web); err != nil {
+		t.Fatal(err)
+	}
+	other := testService("other", "10.0.0.2:80")
+	if err := s.RegisterService(other); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "registration", func() bool { return mirroredService(t, store, "web") != nil })
+
+	updated := testService("web", "10.0.0.3:80")
+	updated.Label = "web"
+	if err := s.RegisterService(updated); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "update", func() bool {
+		info := mirroredService(t, store, "web")
+		return info != nil && info.Nodes[0].Address == "10.0.0.3:80"
+	})
+
+	// a service that is no longer selected is deleted from the sink
+	updated = testService("web", "10.0.0.3:80")
+	updated.Label = "api"
+	if err := s.RegisterService(updated); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "unselected service removal", func() bool { return mirroredService(t, store, "web") == nil })
+
+	web.Label = "web"
+	if err := s.RegisterService(web); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "selected service", func() bool { return mirroredService(t, store, "web") != nil })
+	if err := s.DeregisterService("web"); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "deregistration", func() bool { return mirroredService(t, store, "web") == nil })
+
+	if keys := mirroredKeys(t, store); len(keys) > 0 {
+		t.Errorf("got keys %v", keys)
+	}
+}
+
+func TestMirrorRetriesFailedOperations(t *testing.T) {
+	s := startTestServer(t, &ServerConfig{})
+	defer s.Stop()
+
+	store := NewMemoryKeyValueStore()
+	sink := &flakySink{Sink: &KeyValueSink{Store: store, Prefix: "services/"}}
+	m, err := StartMirror(s, sink, MirrorConfig{RetryInterval: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	sink.mutex.Lock()
+	sink.failures = 3
+	sink.mutex.Unlock()
+
+	if err := s.RegisterService(testService("a", "10.0.0.1:80")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "retried put", func() bool { return mirroredService(t, store, "a") != nil })
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if sink.puts != 4 {
+		t.Errorf("got %d puts, want 4", sink.puts)
+	}
+}
+
+func TestMirrorPeriodicResync(t *testing.T) {
+	s := startTestServer(t, &ServerConfig{})
+	defer s.Stop()
+	if err := s.RegisterService(testService("a", "10.0.0.1:80")); err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewMemoryKeyValueStore()
+	m, err := StartMirror(s, &KeyValueSink{Store: store, Prefix: "services/"}, MirrorConfig{ResyncInterval: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	// changes made to the sink behind the mirror are reverted
+	if err := store.Put("services/stale", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("services/a"); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "resync", func() bool {
+		keys := mirroredKeys(t, store)
+		return reflect.DeepEqual(keys, []string{"services/a"})
+	})
+}
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discover-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sink, err := NewFileSink(filepath.Join(dir, "services"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []string{"a", "b/c", "d e"}
+	for _, id := range ids {
+		if err := sink.Put(testService(id, "10.0.0.1:80")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a replaced file holds the latest info and no temporary file is left behind
+	if err := sink.Put(testService("a", "10.0.0.2:80")); err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := ioutil.ReadFile(filepath.Join(dir, "services", "a.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := new(ome.ServiceInfo)
+	if err := json.Unmarshal(encoded, info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Id != "a" || info.Nodes[0].Address != "10.0.0.2:80" {
+		t.Errorf("got %v", info)
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(dir, "services"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			t.Errorf("temporary file %s left behind", file.Name())
+		}
+		if file.Mode().Perm() != 0644 {
+			t.Errorf("%s has mode %s", file.Name(), file.Mode())
+		}
+	}
+
+	// files and directories that are not services are not listed
+	if err := ioutil.WriteFile(filepath.Join(dir, "services", "notes.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "services", "dir.json"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	listed, err := sink.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(listed)
+	if !reflect.DeepEqual(listed, ids) {
+		t.Errorf("listed %v, want %v", listed, ids)
+	}
+
+	for _, id := range []string{"b/c", "missing"} {
+		if err := sink.Delete(id); err != nil {
+			t.Errorf("failed to delete %s: %s", id, err)
+		}
+	}
+	listed, err = sink.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(listed)
+	if !reflect.DeepEqual(listed, []string{"a", "d e"}) {
+		t.Errorf("listed %v after deletion", listed)
+	}
+}
+
+func TestFileSinkMirror(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discover-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := startTestServer(t, &ServerConfig{})
+	defer s.Stop()
+	if err := s.RegisterService(testService("a", "10.0.0.1:80")); err != nil {
+		t.Fatal(err)
+	}
+
+	sink, err := NewFileSink(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := StartMirror(s, sink, MirrorConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	if err := s.RegisterService(testService("b", "10.0.0.2:80")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeregisterService("a"); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "mirrored files", func() bool {
+		ids, err := sink.List()
+		return err == nil && reflect.DeepEqual(ids, []string{"b"})
+	})
+}
@@ -0,0 +1,344 @@
+package discover
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/omecodes/common/errors"
+	"github.com/omecodes/common/utils/log"
+	"github.com/omecodes/libome"
+	"github.com/omecodes/zebou"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// msgPatch carries the changes made to the nodes and meta of a service. It holds a JSON encoded servicePatch
+	msgPatch = "Patch"
+	// msgResync asks the other end for the full info of the service whose patch could not be applied
+	msgResync = "Resync"
+)
+
+// Operations of a service patch
+const (
+	patchAddNode    = "add_node"
+	patchUpdateNode = "update_node"
+	patchRemoveNode = "remove_node"
+	patchSetMeta    = "set_meta"
+	patchUnsetMeta  = "unset_meta"
+)
+
+// patchOp is a change of one node or meta key
+type patchOp struct {
+	Op     string    `json:"op"`
+	Node   *ome.Node `json:"node,omitempty"`
+	NodeID string    `json:"node_id,omitempty"`
+	Key    string    `json:"key,omitempty"`
+	Value  string    `json:"value,omitempty"`
+}
+
+// servicePatch is the list of changes that turns a service info into a new one. Checksum is the checksum of the new
+// info, a peer whose copy gives another checksum once patched has diverged and asks for the full info
+type servicePatch struct {
+	Ops      []*patchOp `json:"ops"`
+	Checksum string     `json:"checksum"`
+}
+
+// serviceChecksum returns a checksum of info that does not depend on the order of its nodes
+func serviceChecksum(info *ome.ServiceInfo) (string, error) {
+	sorted := proto.Clone(info).(*ome.ServiceInfo)
+	sort.Slice(sorted.Nodes, func(i, j int) bool {
+		return sorted.Nodes[i].Id < sorted.Nodes[j].Id
+	})
+
+	encoded, err := proto.MarshalOptions{Deterministic: true}.Marshal(sorted)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:16]), nil
+}
+
+// diffService returns the patch that turns before into after. It returns nil if the services differ by more than
+// their nodes and meta, or do not differ at all
+func diffService(before *ome.ServiceInfo, after *ome.ServiceInfo) (*servicePatch, error) {
+	if before == nil || before.Id != after.Id || before.Type != after.Type || before.Label != after.Label {
+		return nil, nil
+	}
+
+	patch := new(servicePatch)
+	for _, node := range before.Nodes {
+		if findNode(after.Nodes, node.Id) == nil {
+			patch.Ops = append(patch.Ops, &patchOp{Op: patchRemoveNode, NodeID: node.Id})
+		}
+	}
+	for _, node := range after.Nodes {
+		previous := findNode(before.Nodes, node.Id)
+		if previous == nil {
+			patch.Ops = append(patch.Ops, &patchOp{Op: patchAddNode, Node: node})
+		} else if !proto.Equal(previous, node) {
+			patch.Ops = append(patch.Ops, &patchOp{Op: patchUpdateNode, Node: node})
+		}
+	}
+
+	var keys []string
+	for key := range before.Meta {
+		keys = append(keys, key)
+	}
+	for key := range after.Meta {
+		if _, found := before.Meta[key]; !found {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value, found := after.Meta[key]
+		if !found {
+			patch.Ops = append(patch.Ops, &patchOp{Op: patchUnsetMeta, Key: key})
+		} else if previous, exists := before.Meta[key]; !exists || previous != value {
+			patch.Ops = append(patch.Ops, &patchOp{Op: patchSetMeta, Key: key, Value: value})
+		}
+	}
+
+	if len(patch.Ops) == 0 {
+		return nil, nil
+	}
+
+	checksum, err := serviceChecksum(after)
+	if err != nil {
+		return nil, err
+	}
+	patch.Checksum = checksum
+	return patch, nil
+}
+
+// applyPatch returns a copy of info with the changes of patch. It fails if the changes do not apply to info or if the
+// result does not match the patch checksum
+func applyPatch(info *ome.ServiceInfo, patch *servicePatch) (*ome.ServiceInfo, error) {
+	if info == nil {
+		return nil, fmt.Errorf("%w: patched service is unknown", errors.NotFound)
+	}
+
+	checksum, err := serviceChecksum(info)
+	if err != nil {
+		return nil, err
+	}
+	if checksum == patch.Checksum {
+		// info already holds the changes, as does the copy of the peer that made them
+		return info, nil
+	}
+
+	patched := proto.Clone(info).(*ome.ServiceInfo)
+	for _, op := range patch.Ops {
+		switch op.Op {
+		case patchAddNode:
+			if op.Node == nil || findNode(patched.Nodes, op.Node.Id) != nil {
+				return nil, fmt.Errorf("%w: cannot add node", errors.BadInput)
+			}
+			patched.Nodes = append(patched.Nodes, op.Node)
+
+		case patchUpdateNode:
+			if op.Node == nil {
+				return nil, fmt.Errorf("%w: missing updated node", errors.BadInput)
+			}
+			i := nodeIndex(patched.Nodes, op.Node.Id)
+			if i < 0 {
+				return nil, fmt.Errorf("%w: updated node %q is unknown", errors.BadInput, op.Node.Id)
+			}
+			patched.Nodes[i] = op.Node
+
+		case patchRemoveNode:
+			i := nodeIndex(patched.Nodes, op.NodeID)
+			if i < 0 {
+				return nil, fmt.Errorf("%w: removed node %q is unknown", errors.BadInput, op.NodeID)
+			}
+			patched.Nodes = append(patched.Nodes[:i], patched.Nodes[i+1:]...)
+
+		case patchSetMeta:
+			if patched.Meta == nil {
+				patched.Meta = map[string]string{}
+			}
+			patched.Meta[op.Key] = op.Value
+
+		case patchUnsetMeta:
+			delete(patched.Meta, op.Key)
+
+		default:
+			return nil, fmt.Errorf("%w: unknown patch operation %q", errors.NotSupported, op.Op)
+		}
+	}
+
+	checksum, err = serviceChecksum(patched)
+	if err != nil {
+		return nil, err
+	}
+	if checksum != patch.Checksum {
+		return nil, fmt.Errorf("%w: patched service checksum mismatch", errors.BadInput)
+	}
+	return patched, nil
+}
+
+func findNode(nodes []*ome.Node, id string) *ome.Node {
+	if i := nodeIndex(nodes, id); i >= 0 {
+		return nodes[i]
+	}
+	return nil
+}
+
+func nodeIndex(nodes []*ome.Node, id string) int {
+	for i, node := range nodes {
+		if node.Id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// patchMessage returns the patch message that turns before into after, or nil if the change cannot be sent as a patch
+func patchMessage(before *ome.ServiceInfo, after *ome.ServiceInfo) (*zebou.ZeMsg, error) {
+	patch, err := diffService(before, after)
+	if err != nil || patch == nil {
+		return nil, err
+	}
+
+	encoded, err := json.Marshal(patch)
+	if err != nil {
+		return nil, err
+	}
+	return &zebou.ZeMsg{Type: msgPatch, Id: after.Id, Encoded: encoded}, nil
+}
+
+// applyPatchMessage returns a copy of info with the changes of the patch msg holds
+func applyPatchMessage(info *ome.ServiceInfo, msg *zebou.ZeMsg) (*ome.ServiceInfo, error) {
+	patch := new(servicePatch)
+	if err := json.Unmarshal(msg.Encoded, patch); err != nil {
+		return nil, err
+	}
+	return applyPatch(info, patch)
+}
+
+// broadcastUpdate sends the change of a service from before to after to the peers, as a patch to those that
+// support it. msg is the full update sent to the others
+func (s *Server) broadcastUpdate(ctx context.Context, msg *zebou.ZeMsg, before *ome.ServiceInfo, after *ome.ServiceInfo) {
+	patch, err := patchMessage(before, after)
+	if err != nil {
+		log.Error("registry server • failed to create patch", log.Err(err), log.Field("service", after.Id))
+	}
+	s.broadcastChange(ctx, msg, patch)
+}
+
+// handlePatch applies the patch sent by the peer of ctx to the service it registered
+func (s *Server) handlePatch(ctx context.Context, msg *zebou.ZeMsg) {
+	peer := zebou.Peer(ctx)
+	defer s.lockMutations(peer.ID)()
+
+	before := s.storedService(peer.ID, msg.Id)
+	info, err := applyPatchMessage(before, msg)
+	if err != nil {
+		log.Info("registry server • could not apply patch, requesting full info", log.Err(err), log.Field("service", msg.Id), log.Field("peer", peer.ID))
+		s.metrics.Add(MetricServerResyncs, 1, nil)
+		if err := s.reply(ctx, &zebou.ZeMsg{Type: msgResync, Id: msg.Id}); err != nil {
+			log.Error("registry server • could not send message", log.Err(err))
+		}
+		return
+	}
+
+	admitted, ok := s.admit(ctx, msg, ome.RegistryEventType_Update.String(), info)
+	if !ok {
+		return
+	}
+
+	patch := msg
+	if !proto.Equal(admitted, info) {
+		// the patch of the peer does not lead to the admitted service
+		info = admitted
+		if patch, err = patchMessage(before, info); err != nil {
+			log.Error("registry server • failed to create patch", log.Err(err), log.Field("service", info.Id))
+		}
+	}
+
+	encoded, err := json.Marshal(info)
+	if err != nil {
+		log.Error("registry server • failed to encode service info", log.Err(err))
+		return
+	}
+
+	if reason, err := s.checkQuotas(peer.ID, info, len(encoded)); err != nil {
+		s.rejectMutation(ctx, msg, errorQuotaExceeded, reason, err)
+		return
+	}
+
+	done := s.storeOperation(ctx, "upsert")
+	err = s.store.Upsert(&StoreEntry{Peer: peer.ID, Service: info.Id, Value: string(encoded)})
+	done(err)
+	if err != nil {
+		log.Error("registry server • failed to store service info", log.Err(err))
+		return
+	}
+
+	log.Info("registry server • patched service", log.Field("id", info.Id))
+	go s.broadcastChange(ctx, &zebou.ZeMsg{
+		Type:    ome.RegistryEventType_Update.String(),
+		Id:      info.Id,
+		Encoded: encoded,
+	}, patch)
+
+	s.audit(peer, AuditUpdate, info.Id, before, info)
+	s.notifyEvent(peer.ID, &ome.RegistryEvent{
+		Type:      ome.RegistryEventType_Update,
+		ServiceId: info.Id,
+		Info:      info,
+	})
+}
+
+// handleResync sends the full info of the service the peer of ctx failed to patch
+func (s *Server) handleResync(ctx context.Context, msg *zebou.ZeMsg) {
+	resync := &zebou.ZeMsg{Type: ome.RegistryEventType_DeRegister.String(), Id: msg.Id}
+	if info := s.index.get(msg.Id); info != nil {
+		encoded, err := json.Marshal(info)
+		if err != nil {
+			log.Error("registry server • failed to encode service info", log.Err(err))
+			return
+		}
+		resync = &zebou.ZeMsg{Type: ome.RegistryEventType_Update.String(), Id: msg.Id, Encoded: encoded}
+	}
+
+	if err := s.reply(ctx, resync); err != nil {
+		log.Error("registry server • could not send message", log.Err(err))
+	}
+}
+
+// handlePatch applies a patch sent by the server, and asks for the full info if it does not apply to the local copy
+func (m *MsgClient) handlePatch(ctx context.Context, msg *zebou.ZeMsg) {
+	info, err := applyPatchMessage(m.store.lookup("", msg.Id), msg)
+	if err != nil {
+		log.Info("registry • could not apply patch, requesting full info", log.Err(err), log.Field("id", msg.Id))
+		m.getMetrics().Add(MetricClientResyncs, 1, nil)
+		if err := m.getMessenger().SendMsg(&zebou.ZeMsg{Type: msgResync, Id: msg.Id}); err != nil {
+			log.Error("could not send message to server", log.Err(err))
+		}
+		return
+	}
+
+	log.Info("registry • patch service event", log.Field("id", info.Id))
+	m.store.put("", info.Id, info)
+	m.notifyEvent(ctx, &ome.RegistryEvent{
+		Type:      ome.RegistryEventType_Update,
+		ServiceId: info.Id,
+		Info:      info,
+	})
+}
+
+// handleResync sends the full info of a service registered by the client the server failed to patch
+func (m *MsgClient) handleResync(msg *zebou.ZeMsg) {
+	info := m.registered.lookup("", msg.Id)
+	if info == nil {
+		return
+	}
+	if err := m.getMessenger().Send(ome.RegistryEventType_Update.String(), info.Id, info); err != nil {
+		log.Error("could not send message to server", log.Err(err))
+	}
+}
@@ -0,0 +1,284 @@
+package discover
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/omecodes/common/errors"
+	"github.com/omecodes/libome"
+	"google.golang.org/protobuf/proto"
+)
+
+func patchTestService(meta map[string]string, nodes ...string) *ome.ServiceInfo {
+	info := &ome.ServiceInfo{Id: "a", Type: 1, Label: "a", Meta: meta}
+	for _, node := range nodes {
+		parts := strings.SplitN(node, "=", 2)
+		info.Nodes = append(info.Nodes, &ome.Node{Id: parts[0], Address: parts[1], Protocol: ome.Protocol_Http})
+	}
+	return info
+}
+
+func TestDiffApplyRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		before *ome.ServiceInfo
+		after  *ome.ServiceInfo
+		ops    []string
+	}{
+		{
+			name:   "add node",
+			before: patchTestService(nil, "n1=10.0.0.1:80"),
+			after:  patchTestService(nil, "n1=10.0.0.1:80", "n2=10.0.0.2:80"),
+			ops:    []string{patchAddNode},
+		},
+		{
+			name:   "update node",
+			before: patchTestService(nil, "n1=10.0.0.1:80", "n2=10.0.0.2:80"),
+			after:  patchTestService(nil, "n1=10.0.0.1:80", "n2=10.0.0.3:80"),
+			ops:    []string{patchUpdateNode},
+		},
+		{
+			name:   "remove node",
+			before: patchTestService(nil, "n1=10.0.0.1:80", "n2=10.0.0.2:80"),
+			after:  patchTestService(nil, "n2=10.0.0.2:80"),
+			ops:    []string{patchRemoveNode},
+		},
+		{
+			name:   "meta",
+			before: patchTestService(map[string]string{"a": "1", "b": "2"}, "n1=10.0.0.1:80"),
+			after:  patchTestService(map[string]string{"b": "3", "c": "4"}, "n1=10.0.0.1:80"),
+			ops:    []string{patchUnsetMeta, patchSetMeta, patchSetMeta},
+		},
+		{
+			name:   "reordered nodes",
+			before: patchTestService(nil, "n1=10.0.0.1:80", "n2=10.0.0.2:80"),
+			after:  patchTestService(map[string]string{"a": "1"}, "n3=10.0.0.3:80", "n2=10.0.0.2:80", "n1=10.0.0.4:80"),
+			ops:    []string{patchAddNode, patchUpdateNode, patchSetMeta},
+		},
+		{
+			name:   "unchanged",
+			before: patchTestService(map[string]string{"a": "1"}, "n1=10.0.0.1:80"),
+			after:  patchTestService(map[string]string{"a": "1"}, "n1=10.0.0.1:80"),
+		},
+		{
+			name:   "label changed",
+			before: patchTestService(nil, "n1=10.0.0.1:80"),
+			after:  &ome.ServiceInfo{Id: "a", Type: 1, Label: "b"},
+		},
+		{
+			name:  "no previous info",
+			after: patchTestService(nil, "n1=10.0.0.1:80"),
+		},
+	}
+
+	for _, test := range tests {
+		patch, err := diffService(test.before, test.after)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if len(test.ops) == 0 {
+			if patch != nil {
+				t.Errorf("%s: expected no patch, got %d operations", test.name, len(patch.Ops))
+			}
+			continue
+		}
+		if patch == nil {
+			t.Errorf("%s: expected a patch", test.name)
+			continue
+		}
+
+		var ops []string
+		for _, op := range patch.Ops {
+			ops = append(ops, op.Op)
+		}
+		if strings.Join(ops, ",") != strings.Join(test.ops, ",") {
+			t.Errorf("%s: got operations %v, want %v", test.name, ops, test.ops)
+		}
+
+		message, err := patchMessage(test.before, test.after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		patched, err := applyPatchMessage(test.before, message)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		for _, node := range test.after.Nodes {
+			if !proto.Equal(findNode(patched.Nodes, node.Id), node) {
+				t.Errorf("%s: node %s not patched", test.name, node.Id)
+			}
+		}
+		if len(patched.Nodes) != len(test.after.Nodes) || len(patched.Meta) != len(test.after.Meta) {
+			t.Errorf("%s: got %v, want %v", test.name, patched, test.after)
+		}
+		for key, value := range test.after.Meta {
+			if patched.Meta[key] != value {
+				t.Errorf("%s: got meta %s=%q, want %q", test.name, key, patched.Meta[key], value)
+			}
+		}
+	}
+}
+
+func TestApplyPatchFailures(t *testing.T) {
+	info := patchTestService(map[string]string{"a": "1"}, "n1=10.0.0.1:80")
+
+	tests := []struct {
+		name  string
+		info  *ome.ServiceInfo
+		patch *servicePatch
+		err   error
+	}{
+		{
+			name:  "unknown service",
+			patch: &servicePatch{Ops: []*patchOp{{Op: patchSetMeta, Key: "a", Value: "2"}}},
+			err:   errors.NotFound,
+		},
+		{
+			name: "add known node",
+			info: info,
+			patch: &servicePatch{Ops: []*patchOp{{Op: patchAddNode, Node: &ome.Node{Id: "n1", Address: "10.0.0.2:80"}}},
+				Checksum: mustChecksum(t, patchTestService(map[string]string{"a": "1"}, "n1=10.0.0.1:80", "n1=10.0.0.2:80"))},
+			err: errors.BadInput,
+		},
+		{
+			name: "update unknown node",
+			info: info,
+			patch: &servicePatch{Ops: []*patchOp{{Op: patchUpdateNode, Node: &ome.Node{Id: "n2", Address: "10.0.0.2:80"}}},
+				Checksum: mustChecksum(t, patchTestService(map[string]string{"a": "1"}, "n1=10.0.0.1:80", "n2=10.0.0.2:80"))},
+			err: errors.BadInput,
+		},
+		{
+			name: "remove unknown node",
+			info: info,
+			patch: &servicePatch{Ops: []*patchOp{{Op: patchRemoveNode, NodeID: "n2"}},
+				Checksum: mustChecksum(t, patchTestService(map[string]string{"a": "1"}))},
+			err: errors.BadInput,
+		},
+		{
+			name:  "unknown operation",
+			info:  info,
+			patch: &servicePatch{Ops: []*patchOp{{Op: "rename"}}},
+			err:   errors.NotSupported,
+		},
+		{
+			name: "checksum mismatch",
+			info: info,
+			patch: &servicePatch{Ops: []*patchOp{{Op: patchSetMeta, Key: "a", Value: "2"}},
+				Checksum: mustChecksum(t, patchTestService(map[string]string{"a": "3"}, "n1=10.0.0.1:80"))},
+			err: errors.BadInput,
+		},
+	}
+
+	for _, test := range tests {
+		patched, err := applyPatch(test.info, test.patch)
+		if err == nil || !strings.HasPrefix(err.Error(), test.err.Error()) {
+			t.Errorf("%s: expected a %q error, got %v", test.name, test.err, err)
+		}
+		if patched != nil {
+			t.Errorf("%s: got a patched service", test.name)
+		}
+	}
+
+	if info.Meta["a"] != "1" || len(info.Nodes) != 1 || info.Nodes[0].Address != "10.0.0.1:80" {
+		t.Errorf("failed patches changed the service: %v", info)
+	}
+}
+
+func TestApplyPatchAlreadyApplied(t *testing.T) {
+	before := patchTestService(nil, "n1=10.0.0.1:80")
+	after := patchTestService(nil, "n1=10.0.0.1:80", "n2=10.0.0.2:80")
+
+	patch, err := diffService(before, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the ops would fail on after, which already holds n2
+	patched, err := applyPatch(after, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if patched != after {
+		t.Error("expected the already patched service as is")
+	}
+}
+
+func TestServerResyncsDivergedPeer(t *testing.T) {
+	metrics := NewPrometheusMetrics()
+	s := startTestServer(t, &ServerConfig{Metrics: metrics})
+	defer s.Stop()
+
+	owner := connectTestClient(t, s, nil)
+	defer owner.Stop()
+	if err := owner.RegisterService(patchTestService(nil, "n1=10.0.0.1:80")); err != nil {
+		t.Fatal(err)
+	}
+	waitHandled(t, s, metrics, "Register", 1)
+
+	// the owner believes it registered a node the server does not know, so that its patch does not apply
+	owner.registered.put("", "a", patchTestService(nil, "n1=10.0.0.1:80", "ghost=10.0.0.9:80"))
+	updated := patchTestService(map[string]string{"version": "2"}, "n1=10.0.0.1:80", "n2=10.0.0.2:80")
+	if err := owner.RegisterService(updated); err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, "resync", func() bool {
+		info, err := s.GetService("a")
+		return err == nil && proto.Equal(info, updated)
+	})
+	if resyncs := metricValue(metrics, MetricServerResyncs, nil); resyncs != 1 {
+		t.Errorf("got %v server resyncs, want 1", resyncs)
+	}
+}
+
+func TestClientResyncsDivergedCopy(t *testing.T) {
+	s := startTestServer(t, &ServerConfig{})
+	defer s.Stop()
+
+	owner := connectTestClient(t, s, nil)
+	defer owner.Stop()
+	if err := owner.RegisterService(patchTestService(nil, "n1=10.0.0.1:80")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "registration", func() bool { return hasService(s, "a") })
+
+	watcher := connectTestClient(t, s, nil)
+	defer watcher.Stop()
+	metrics := NewPrometheusMetrics()
+	watcher.SetMetrics(metrics)
+	if !watcher.ServerSupports(CapabilityPatch) {
+		t.Fatal("patches are not negotiated")
+	}
+
+	// the copy of the watcher loses the node, so that the patch of the next update does not apply
+	watcher.store.put("", "a", patchTestService(nil))
+	updated := patchTestService(nil, "n1=10.0.0.1:80", "n2=10.0.0.2:80")
+	if err := owner.RegisterService(updated); err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, "resync", func() bool {
+		info, err := watcher.GetService("a")
+		return err == nil && len(info.Nodes) == 2
+	})
+	info, err := watcher.GetService("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mustChecksum(t, info) != mustChecksum(t, updated) {
+		t.Errorf("got %v, want %v", info, updated)
+	}
+	if resyncs := metricValue(metrics, MetricClientResyncs, nil); resyncs != 1 {
+		t.Errorf("got %v client resyncs, want 1", resyncs)
+	}
+}
+
+func mustChecksum(t *testing.T, info *ome.ServiceInfo) string {
+	checksum, err := serviceChecksum(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return checksum
+}
@@ -0,0 +1,83 @@
+package discover
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/omecodes/common/utils/log"
+	"github.com/omecodes/zebou"
+)
+
+// Message types exchanged between the server and the clients in addition to the registry event types
+const (
+	// msgSynced is sent by the server to a new peer once the registry content has been transferred to it
+	msgSynced = "Synced"
+	// msgListPeers requests the list of connected peers. Its id is echoed back in the msgPeers response
+	msgListPeers = "ListPeers"
+	// msgPeers holds the JSON encoded list of connected peers
+	msgPeers = "Peers"
+)
+
+// PeerInfo describes a peer connected to the server
+type PeerInfo struct {
+	ID           string    `json:"id"`
+	Address      string    `json:"address"`
+	Identity     string    `json:"identity,omitempty"`
+	ConnectedAt  time.Time `json:"connected_at"`
+	Services     int       `json:"services"`
+	Version      int       `json:"version,omitempty"`
+	Codec        string    `json:"codec,omitempty"`
+	Compression  string    `json:"compression,omitempty"`
+	Capabilities []string  `json:"capabilities,omitempty"`
+}
+
+// Peers returns the peers connected to the server, sorted by connection time
+func (s *Server) Peers() []*PeerInfo {
+	var peers []*PeerInfo
+	s.peers.Range(func(key, value interface{}) bool {
+		session := value.(*peerSession)
+		session.mutex.Lock()
+		peer := *session.info
+		session.mutex.Unlock()
+
+		peer.Services = len(s.index.forPeer(peer.ID))
+		peers = append(peers, &peer)
+		return true
+	})
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].ConnectedAt.Before(peers[j].ConnectedAt)
+	})
+	return peers
+}
+
+// sessionCount returns the number of peers that have a session. The session of a peer is deleted once it quit and its
+// services are removed
+func (s *Server) sessionCount() int {
+	count := 0
+	s.peers.Range(func(key, value interface{}) bool {
+		count++
+		return true
+	})
+	return count
+}
+
+// sendPeers answers a msgListPeers request from the peer of ctx
+func (s *Server) sendPeers(ctx context.Context, requestID string) {
+	encoded, err := json.Marshal(s.Peers())
+	if err != nil {
+		log.Error("registry server • failed to encode peers", log.Err(err))
+		return
+	}
+
+	err = s.reply(ctx, &zebou.ZeMsg{
+		Type:    msgPeers,
+		Id:      requestID,
+		Encoded: encoded,
+	})
+	if err != nil {
+		log.Error("registry server • could not send peers", log.Err(err))
+	}
+}
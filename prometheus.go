@@ -0,0 +1,170 @@
+package discover
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/omecodes/common/utils/log"
+	"github.com/omecodes/libome"
+)
+
+const (
+	// PrometheusSDPath is the path the Prometheus HTTP service discovery endpoint is served at
+	PrometheusSDPath = "/prometheus/sd"
+
+	prometheusLabelPrefix = "__meta_discover_"
+)
+
+var prometheusInvalidLabelChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+// PrometheusTargetGroup is an entry of the Prometheus HTTP service discovery response
+type PrometheusTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// PrometheusSDFilter restricts the nodes listed by the Prometheus service discovery endpoint
+type PrometheusSDFilter struct {
+	// Protocol keeps only nodes that implement it if not unsupported
+	Protocol ome.Protocol
+	// MetaKey keeps only nodes whose service or node meta contains it if not empty
+	MetaKey string
+}
+
+func (f *PrometheusSDFilter) match(info *ome.ServiceInfo, node *ome.Node) bool {
+	if f.Protocol != ome.Protocol_Unsupported && node.Protocol != f.Protocol {
+		return false
+	}
+
+	if f.MetaKey != "" {
+		_, inService := info.Meta[f.MetaKey]
+		_, inNode := node.Meta[f.MetaKey]
+		return inService || inNode
+	}
+	return true
+}
+
+// PrometheusTargets converts services into Prometheus target groups, one per node that matches filter
+func PrometheusTargets(services []*ome.ServiceInfo, filter *PrometheusSDFilter) []*PrometheusTargetGroup {
+	groups := []*PrometheusTargetGroup{}
+	for _, info := range services {
+		for _, node := range info.Nodes {
+			if filter != nil && !filter.match(info, node) {
+				continue
+			}
+
+			labels := map[string]string{
+				prometheusLabelPrefix + "service_id":    info.Id,
+				prometheusLabelPrefix + "service_type":  strconv.FormatUint(uint64(info.Type), 10),
+				prometheusLabelPrefix + "service_label": info.Label,
+				prometheusLabelPrefix + "node_id":       node.Id,
+				prometheusLabelPrefix + "node_protocol": strings.ToLower(node.Protocol.String()),
+			}
+			for key, value := range info.Meta {
+				if key == ome.MetaServiceCertificate {
+					continue
+				}
+				labels[prometheusLabelPrefix+"meta_"+prometheusLabelName(key)] = value
+			}
+			for key, value := range node.Meta {
+				labels[prometheusLabelPrefix+"node_meta_"+prometheusLabelName(key)] = value
+			}
+
+			groups = append(groups, &PrometheusTargetGroup{
+				Targets: []string{node.Address},
+				Labels:  labels,
+			})
+		}
+	}
+	return groups
+}
+
+// parseProtocol returns the protocol whose name matches name case insensitively
+func parseProtocol(name string) (ome.Protocol, bool) {
+	for protocolName, value := range ome.Protocol_value {
+		if strings.EqualFold(protocolName, name) {
+			return ome.Protocol(value), true
+		}
+	}
+	return ome.Protocol_Unsupported, false
+}
+
+func prometheusLabelName(key string) string {
+	return prometheusInvalidLabelChars.ReplaceAllString(key, "_")
+}
+
+// PrometheusSDHandler returns an HTTP handler compatible with Prometheus http_sd_configs. Nodes can be
+// filtered with the "protocol" (e.g. grpc) and "meta" (a meta key that must be set) query parameters,
+// and services with the "query" parameter that holds a query string (see Query)
+func (s *Server) PrometheusSDHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		filter := &PrometheusSDFilter{
+			MetaKey: r.URL.Query().Get("meta"),
+		}
+		if protocol := r.URL.Query().Get("protocol"); protocol != "" {
+			value, found := parseProtocol(protocol)
+			if !found {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			filter.Protocol = value
+		}
+
+		var services []*ome.ServiceInfo
+		switch {
+		case r.URL.Query().Get("query") != "":
+			q, err := ParseQuery(r.URL.Query().Get("query"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			services = s.index.query(q)
+		case filter.Protocol != ome.Protocol_Unsupported:
+			services = s.index.withProtocol(filter.Protocol)
+		case filter.MetaKey != "":
+			services = s.index.withMetaKey(filter.MetaKey)
+		default:
+			services = s.index.all()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(PrometheusTargets(services, filter))
+		if err != nil {
+			log.Error("registry server • could not write prometheus targets", log.Err(err))
+		}
+	})
+}
+
+// listServices returns all the services in registration order
+func (s *Server) listServices() ([]*ome.ServiceInfo, error) {
+	return s.index.all(), nil
+}
+
+func (s *Server) servePrometheusSD(address string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(PrometheusSDPath, s.PrometheusSDHandler())
+	s.prometheusSD = &http.Server{Handler: mux}
+
+	go func() {
+		if err := s.prometheusSD.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Error("registry server • prometheus service discovery server stopped", log.Err(err))
+		}
+	}()
+
+	log.Info("[discovery] starting prometheus service discovery endpoint", log.Field("at", l.Addr()), log.Field("path", PrometheusSDPath))
+	return nil
+}
@@ -0,0 +1,164 @@
+package discover
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/omecodes/libome"
+)
+
+// prometheusTestServices returns a gRPC service with two nodes, one of them labelled, and an HTTP service
+func prometheusTestServices() []*ome.ServiceInfo {
+	return []*ome.ServiceInfo{
+		{
+			Id:    "billing",
+			Type:  2,
+			Label: "billing-api",
+			Meta:  map[string]string{"region": "eu-west", "team.name": "payments"},
+			Nodes: []*ome.Node{
+				{Id: "n1", Address: "10.0.0.1:9000", Protocol: ome.Protocol_Grpc, Meta: map[string]string{"metrics-path": "/m"}},
+				{Id: "n2", Address: "10.0.0.2:9000", Protocol: ome.Protocol_Grpc},
+			},
+		},
+		{
+			Id:    "web",
+			Type:  1,
+			Label: "web",
+			Nodes: []*ome.Node{{Id: "w1", Address: "10.0.0.3:80", Protocol: ome.Protocol_Http}},
+		},
+	}
+}
+
+// targetsOf returns the sorted targets of groups
+func targetsOf(groups []*PrometheusTargetGroup) []string {
+	var targets []string
+	for _, group := range groups {
+		targets = append(targets, group.Targets...)
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+func TestPrometheusTargets(t *testing.T) {
+	services := prometheusTestServices()
+	services[0].Meta[ome.MetaServiceCertificate] = "certificate"
+	groups := PrometheusTargets(services, nil)
+	if len(groups) != 3 {
+		t.Fatalf("got %d groups, want one per node", len(groups))
+	}
+
+	// the service certificate is not exposed as a label
+	want := map[string]string{
+		"__meta_discover_service_id":             "billing",
+		"__meta_discover_service_type":           "2",
+		"__meta_discover_service_label":          "billing-api",
+		"__meta_discover_node_id":                "n1",
+		"__meta_discover_node_protocol":          "grpc",
+		"__meta_discover_meta_region":            "eu-west",
+		"__meta_discover_meta_team_name":         "payments",
+		"__meta_discover_node_meta_metrics_path": "/m",
+	}
+	if !reflect.DeepEqual(groups[0].Targets, []string{"10.0.0.1:9000"}) || !reflect.DeepEqual(groups[0].Labels, want) {
+		t.Errorf("got group %v %v, want %v", groups[0].Targets, groups[0].Labels, want)
+	}
+
+	// the node meta only labels the node it belongs to
+	if _, found := groups[1].Labels["__meta_discover_node_meta_metrics_path"]; found || groups[1].Labels["__meta_discover_node_id"] != "n2" {
+		t.Errorf("got labels %v for the second node", groups[1].Labels)
+	}
+	if groups[2].Labels["__meta_discover_node_protocol"] != "http" || groups[2].Labels["__meta_discover_service_id"] != "web" {
+		t.Errorf("got labels %v for the web node", groups[2].Labels)
+	}
+
+	if groups := PrometheusTargets(nil, nil); groups == nil || len(groups) > 0 {
+		t.Errorf("expected an empty list of groups, got %v", groups)
+	}
+}
+
+func TestPrometheusTargetsFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  *PrometheusSDFilter
+		targets []string
+	}{
+		{name: "protocol", filter: &PrometheusSDFilter{Protocol: ome.Protocol_Http}, targets: []string{"10.0.0.3:80"}},
+		{name: "service meta", filter: &PrometheusSDFilter{MetaKey: "region"}, targets: []string{"10.0.0.1:9000", "10.0.0.2:9000"}},
+		{name: "node meta", filter: &PrometheusSDFilter{MetaKey: "metrics-path"}, targets: []string{"10.0.0.1:9000"}},
+		{name: "protocol and meta", filter: &PrometheusSDFilter{Protocol: ome.Protocol_Http, MetaKey: "region"}},
+		{name: "none", filter: &PrometheusSDFilter{}, targets: []string{"10.0.0.1:9000", "10.0.0.2:9000", "10.0.0.3:80"}},
+	}
+
+	for _, test := range tests {
+		if targets := targetsOf(PrometheusTargets(prometheusTestServices(), test.filter)); !reflect.DeepEqual(targets, test.targets) {
+			t.Errorf("%s: got targets %v, want %v", test.name, targets, test.targets)
+		}
+	}
+}
+
+func TestPrometheusSDHandler(t *testing.T) {
+	s := startTestServer(t, &ServerConfig{})
+	defer s.Stop()
+	for _, info := range prometheusTestServices() {
+		if err := s.RegisterService(info); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	endpoint := httptest.NewServer(s.PrometheusSDHandler())
+	defer endpoint.Close()
+
+	tests := []struct {
+		params  url.Values
+		status  int
+		targets []string
+	}{
+		{params: url.Values{}, status: http.StatusOK, targets: []string{"10.0.0.1:9000", "10.0.0.2:9000", "10.0.0.3:80"}},
+		{params: url.Values{"protocol": {"GRPC"}}, status: http.StatusOK, targets: []string{"10.0.0.1:9000", "10.0.0.2:9000"}},
+		{params: url.Values{"meta": {"metrics-path"}}, status: http.StatusOK, targets: []string{"10.0.0.1:9000"}},
+		{params: url.Values{"query": {"label=web"}}, status: http.StatusOK, targets: []string{"10.0.0.3:80"}},
+		{params: url.Values{"query": {"meta.region=eu-west"}, "meta": {"metrics-path"}}, status: http.StatusOK, targets: []string{"10.0.0.1:9000"}},
+		{params: url.Values{"query": {"type=3"}}, status: http.StatusOK},
+		{params: url.Values{"protocol": {"ftp"}}, status: http.StatusBadRequest},
+		{params: url.Values{"query": {"color=red"}}, status: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		rsp, err := http.Get(endpoint.URL + "?" + test.params.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var groups []*PrometheusTargetGroup
+		if rsp.StatusCode == http.StatusOK {
+			if contentType := rsp.Header.Get("Content-Type"); contentType != "application/json" {
+				t.Errorf("%s: got content type %q", test.params.Encode(), contentType)
+			}
+			if err := json.NewDecoder(rsp.Body).Decode(&groups); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_ = rsp.Body.Close()
+
+		if rsp.StatusCode != test.status {
+			t.Errorf("%s: got status %d, want %d", test.params.Encode(), rsp.StatusCode, test.status)
+			continue
+		}
+		if targets := targetsOf(groups); !reflect.DeepEqual(targets, test.targets) {
+			t.Errorf("%s: got targets %v, want %v", test.params.Encode(), targets, test.targets)
+		}
+	}
+
+	rsp, err := http.Post(endpoint.URL, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = rsp.Body.Close()
+	if rsp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("got status %d for a POST", rsp.StatusCode)
+	}
+}
@@ -0,0 +1,606 @@
+package discover
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/omecodes/common/errors"
+	"github.com/omecodes/libome"
+)
+
+// Operator is the comparison a query requirement applies
+type Operator string
+
+const (
+	OpEquals       Operator = "="
+	OpNotEquals    Operator = "!="
+	OpIn           Operator = "in"
+	OpNotIn        Operator = "notin"
+	OpExists       Operator = "exists"
+	OpNotExists    Operator = "!exists"
+	OpGreater      Operator = ">"
+	OpGreaterEqual Operator = ">="
+	OpLess         Operator = "<"
+	OpLessEqual    Operator = "<="
+)
+
+// HealthUnknown is the health status of nodes whose meta does not hold one
+const HealthUnknown = "unknown"
+
+// MetaRequirement is a condition on a service meta value. Values holds one value for OpEquals and OpNotEquals,
+// the value set for OpIn and OpNotIn and nothing for OpExists and OpNotExists
+type MetaRequirement struct {
+	Key      string
+	Operator Operator
+	Values   []string
+}
+
+func (r *MetaRequirement) match(meta map[string]string) bool {
+	value, found := meta[r.Key]
+	switch r.Operator {
+	case OpExists:
+		return found
+	case OpNotExists:
+		return !found
+	case OpEquals:
+		return found && len(r.Values) > 0 && value == r.Values[0]
+	case OpNotEquals:
+		return !found || len(r.Values) == 0 || value != r.Values[0]
+	case OpIn:
+		return found && containsString(r.Values, value)
+	case OpNotIn:
+		return !found || !containsString(r.Values, value)
+	default:
+		return false
+	}
+}
+
+// CountRequirement is a condition on a count, e.g. the number of nodes of a service
+type CountRequirement struct {
+	Operator Operator
+	Count    int
+}
+
+func (r *CountRequirement) match(count int) bool {
+	switch r.Operator {
+	case OpEquals:
+		return count == r.Count
+	case OpNotEquals:
+		return count != r.Count
+	case OpGreater:
+		return count > r.Count
+	case OpGreaterEqual:
+		return count >= r.Count
+	case OpLess:
+		return count < r.Count
+	case OpLessEqual:
+		return count <= r.Count
+	default:
+		return false
+	}
+}
+
+// Query selects services. A service is selected if it meets all the set conditions, the zero Query selects all services.
+//
+// Protocols and Health are node conditions: a service is selected if one of its nodes meets both.
+//
+// The string syntax is a comma separated list of terms:
+//
+//	type=2, type in (1,2)
+//	label=billing-*                   glob pattern, see path.Match
+//	meta.region=eu, meta.region!=eu, meta.region in (eu,us), meta.region notin (eu,us)
+//	meta.region, !meta.region         the meta key is set, is not set
+//	protocol=grpc, protocol in (grpc,http)
+//	nodes>=2                          also nodes=, nodes!=, nodes>, nodes<, nodes<=
+//	health=healthy, health in (healthy,degraded)
+//
+// Values that contain commas, parentheses, quotes or surrounding spaces are written as double-quoted Go string
+// literals, e.g. meta.zone="eu (west)"
+type Query struct {
+	// Types keeps the services whose type is one of Types
+	Types []uint32
+	// Label keeps the services whose label matches the glob pattern Label
+	Label string
+	// Meta keeps the services whose meta meets all the requirements
+	Meta []MetaRequirement
+	// Nodes keeps the services whose node count meets all the requirements
+	Nodes []CountRequirement
+	// Protocols keeps the services that have a node that implements one of Protocols
+	Protocols []ome.Protocol
+	// Health keeps the services that have a node whose health status (see MetaNodeHealth) is one of Health.
+	// HealthUnknown matches the nodes that have no status
+	Health []string
+}
+
+// Match reports whether info is selected by q
+func (q *Query) Match(info *ome.ServiceInfo) bool {
+	if len(q.Types) > 0 && !containsType(q.Types, info.Type) {
+		return false
+	}
+
+	if q.Label != "" {
+		if matched, _ := path.Match(q.Label, info.Label); !matched {
+			return false
+		}
+	}
+
+	for i := range q.Meta {
+		if !q.Meta[i].match(info.Meta) {
+			return false
+		}
+	}
+
+	for i := range q.Nodes {
+		if !q.Nodes[i].match(len(info.Nodes)) {
+			return false
+		}
+	}
+
+	if len(q.Protocols) == 0 && len(q.Health) == 0 {
+		return true
+	}
+
+	for _, node := range info.Nodes {
+		if q.matchNode(node) {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *Query) matchNode(node *ome.Node) bool {
+	if len(q.Protocols) > 0 {
+		found := false
+		for _, protocol := range q.Protocols {
+			if node.Protocol == protocol {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(q.Health) > 0 {
+		status := strings.ToLower(node.Meta[MetaNodeHealth])
+		if status == "" {
+			status = HealthUnknown
+		}
+
+		found := false
+		for _, health := range q.Health {
+			if strings.EqualFold(health, status) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Filter returns the services of services that q selects
+func (q *Query) Filter(services []*ome.ServiceInfo) []*ome.ServiceInfo {
+	var result []*ome.ServiceInfo
+	for _, info := range services {
+		if q.Match(info) {
+			result = append(result, info)
+		}
+	}
+	return result
+}
+
+// String returns the string syntax of q, which ParseQuery parses back into q
+func (q *Query) String() string {
+	var terms []string
+
+	if len(q.Types) == 1 {
+		terms = append(terms, "type="+strconv.FormatUint(uint64(q.Types[0]), 10))
+	} else if len(q.Types) > 1 {
+		var values []string
+		for _, t := range q.Types {
+			values = append(values, strconv.FormatUint(uint64(t), 10))
+		}
+		terms = append(terms, "type in ("+strings.Join(values, ",")+")")
+	}
+
+	if q.Label != "" {
+		terms = append(terms, "label="+quoteQueryValue(q.Label))
+	}
+
+	for _, r := range q.Meta {
+		key := "meta." + r.Key
+		switch r.Operator {
+		case OpExists:
+			terms = append(terms, key)
+		case OpNotExists:
+			terms = append(terms, "!"+key)
+		case OpIn, OpNotIn:
+			terms = append(terms, key+" "+string(r.Operator)+" ("+joinQueryValues(r.Values)+")")
+		default:
+			value := ""
+			if len(r.Values) > 0 {
+				value = r.Values[0]
+			}
+			terms = append(terms, key+string(r.Operator)+quoteQueryValue(value))
+		}
+	}
+
+	for _, r := range q.Nodes {
+		terms = append(terms, "nodes"+string(r.Operator)+strconv.Itoa(r.Count))
+	}
+
+	if len(q.Protocols) == 1 {
+		terms = append(terms, "protocol="+strings.ToLower(q.Protocols[0].String()))
+	} else if len(q.Protocols) > 1 {
+		var values []string
+		for _, protocol := range q.Protocols {
+			values = append(values, strings.ToLower(protocol.String()))
+		}
+		terms = append(terms, "protocol in ("+strings.Join(values, ",")+")")
+	}
+
+	if len(q.Health) == 1 {
+		terms = append(terms, "health="+quoteQueryValue(q.Health[0]))
+	} else if len(q.Health) > 1 {
+		terms = append(terms, "health in ("+joinQueryValues(q.Health)+")")
+	}
+
+	return strings.Join(terms, ",")
+}
+
+// quoteQueryValue returns value as a Go string literal if the query syntax cannot hold it as is
+func quoteQueryValue(value string) string {
+	if value == "" || value != strings.TrimSpace(value) || strings.ContainsAny(value, `,()"`) {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+func joinQueryValues(values []string) string {
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		quoted[i] = quoteQueryValue(value)
+	}
+	return strings.Join(quoted, ",")
+}
+
+// ParseQuery parses the string syntax of a query. Errors wrap errors.BadInput
+func ParseQuery(s string) (*Query, error) {
+	q := new(Query)
+
+	terms, err := splitQueryTerms(s)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, term := range terms {
+		if err := q.parseTerm(term); err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+func (q *Query) parseTerm(term string) error {
+	field, operator, values, err := parseQueryTerm(term)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(field, "meta.") {
+		key := strings.TrimPrefix(field, "meta.")
+		if key == "" {
+			return querySyntaxError(term, "empty meta key")
+		}
+
+		switch operator {
+		case OpExists, OpNotExists, OpIn, OpNotIn, OpEquals, OpNotEquals:
+		default:
+			return querySyntaxError(term, "unsupported meta operator")
+		}
+		q.Meta = append(q.Meta, MetaRequirement{Key: key, Operator: operator, Values: values})
+		return nil
+	}
+
+	switch field {
+	case "type":
+		if operator != OpEquals && operator != OpIn {
+			return querySyntaxError(term, "type supports = and in")
+		}
+		for _, value := range values {
+			t, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return querySyntaxError(term, "invalid type")
+			}
+			q.Types = append(q.Types, uint32(t))
+		}
+
+	case "label":
+		if operator != OpEquals {
+			return querySyntaxError(term, "label supports =")
+		}
+		if _, err := path.Match(values[0], ""); err != nil {
+			return querySyntaxError(term, "invalid label pattern")
+		}
+		q.Label = values[0]
+
+	case "protocol":
+		if operator != OpEquals && operator != OpIn {
+			return querySyntaxError(term, "protocol supports = and in")
+		}
+		for _, value := range values {
+			protocol, found := parseProtocol(value)
+			if !found {
+				return querySyntaxError(term, "unknown protocol")
+			}
+			q.Protocols = append(q.Protocols, protocol)
+		}
+
+	case "health":
+		if operator != OpEquals && operator != OpIn {
+			return querySyntaxError(term, "health supports = and in")
+		}
+		q.Health = append(q.Health, values...)
+
+	case "nodes":
+		switch operator {
+		case OpEquals, OpNotEquals, OpGreater, OpGreaterEqual, OpLess, OpLessEqual:
+		default:
+			return querySyntaxError(term, "unsupported nodes operator")
+		}
+		count, err := strconv.Atoi(values[0])
+		if err != nil {
+			return querySyntaxError(term, "invalid node count")
+		}
+		q.Nodes = append(q.Nodes, CountRequirement{Operator: operator, Count: count})
+
+	default:
+		return querySyntaxError(term, "unknown field")
+	}
+	return nil
+}
+
+// parseQueryTerm splits a term into its field, operator and values
+func parseQueryTerm(term string) (string, Operator, []string, error) {
+	if strings.HasPrefix(term, "!") {
+		field := strings.TrimSpace(term[1:])
+		if !isQueryField(field) {
+			return "", "", nil, querySyntaxError(term, "invalid field")
+		}
+		return field, OpNotExists, nil, nil
+	}
+
+	fields := strings.Fields(term)
+	if len(fields) >= 2 && isQueryField(fields[0]) && (fields[1] == string(OpIn) || fields[1] == string(OpNotIn)) {
+		rest := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(term[len(fields[0]):]), fields[1]))
+		if !strings.HasPrefix(rest, "(") || !strings.HasSuffix(rest, ")") {
+			return "", "", nil, querySyntaxError(term, "set values must be enclosed in parentheses")
+		}
+
+		items, err := splitQuoted(rest[1:len(rest)-1], ',', false)
+		if err != nil {
+			return "", "", nil, querySyntaxError(term, err.Error())
+		}
+
+		var values []string
+		for _, item := range items {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			value, err := unquoteQueryValue(item)
+			if err != nil {
+				return "", "", nil, querySyntaxError(term, err.Error())
+			}
+			values = append(values, value)
+		}
+		if len(values) == 0 {
+			return "", "", nil, querySyntaxError(term, "empty value set")
+		}
+		return fields[0], Operator(fields[1]), values, nil
+	}
+
+	if i := strings.IndexAny(term, "=!<>"); i >= 0 {
+		field := strings.TrimSpace(term[:i])
+		rest := term[i:]
+
+		var operator Operator
+		for _, op := range []Operator{OpNotEquals, OpGreaterEqual, OpLessEqual, OpEquals, OpGreater, OpLess} {
+			if strings.HasPrefix(rest, string(op)) {
+				operator = op
+				break
+			}
+		}
+		if operator == "" || !isQueryField(field) {
+			return "", "", nil, querySyntaxError(term, "invalid term")
+		}
+
+		value := strings.TrimSpace(rest[len(operator):])
+		if value == "" {
+			return "", "", nil, querySyntaxError(term, "missing value")
+		}
+		value, err := unquoteQueryValue(value)
+		if err != nil {
+			return "", "", nil, querySyntaxError(term, err.Error())
+		}
+		return field, operator, []string{value}, nil
+	}
+
+	field := strings.TrimSpace(term)
+	if !isQueryField(field) {
+		return "", "", nil, querySyntaxError(term, "invalid field")
+	}
+	return field, OpExists, nil, nil
+}
+
+func isQueryField(field string) bool {
+	return field != "" && !strings.ContainsAny(field, " \t()=!<>,\"")
+}
+
+// unquoteQueryValue returns the value of a quoted value, or value itself if it is not quoted
+func unquoteQueryValue(value string) (string, error) {
+	if !strings.HasPrefix(value, `"`) {
+		return value, nil
+	}
+	unquoted, err := strconv.Unquote(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid quoted value %s", value)
+	}
+	return unquoted, nil
+}
+
+// splitQueryTerms splits s on the commas that are neither enclosed in parentheses nor quoted
+func splitQueryTerms(s string) ([]string, error) {
+	parts, err := splitQuoted(s, ',', true)
+	if err != nil {
+		return nil, querySyntaxError(s, err.Error())
+	}
+
+	var terms []string
+	for _, term := range parts {
+		if term = strings.TrimSpace(term); term != "" {
+			terms = append(terms, term)
+		}
+	}
+	return terms, nil
+}
+
+// splitQuoted splits s on the separators that are not quoted, nor enclosed in parentheses if parentheses is true
+func splitQuoted(s string, separator byte, parentheses bool) ([]string, error) {
+	var (
+		parts []string
+		depth int
+		start int
+	)
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"':
+			for i++; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(s) {
+				return nil, errors.New("unterminated quoted value")
+			}
+		case c == '(' && parentheses:
+			depth++
+			if depth > 1 {
+				return nil, errors.New("nested parentheses")
+			}
+		case c == ')' && parentheses:
+			depth--
+			if depth < 0 {
+				return nil, errors.New("unbalanced parentheses")
+			}
+		case c == separator && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+
+	if depth != 0 {
+		return nil, errors.New("unbalanced parentheses")
+	}
+	return append(parts, s[start:]), nil
+}
+
+func querySyntaxError(term string, reason string) error {
+	return fmt.Errorf("%w: query term %q: %s", errors.BadInput, term, reason)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsType(types []uint32, t uint32) bool {
+	for _, v := range types {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
+// query returns the infos q selects in registration order. The candidates are taken from the smallest
+// index set that q restricts the selection to, then matched against q
+func (x *serviceIndex) query(q *Query) []*ome.ServiceInfo {
+	x.RLock()
+	defer x.RUnlock()
+
+	candidates := x.entries
+	narrow := func(set indexSet) {
+		if len(set) < len(candidates) {
+			candidates = set
+		}
+	}
+
+	if len(q.Types) > 0 {
+		var sets []indexSet
+		for _, t := range q.Types {
+			sets = append(sets, x.byType[t])
+		}
+		narrow(unionOf(sets))
+	}
+
+	if len(q.Protocols) > 0 {
+		var sets []indexSet
+		for _, protocol := range q.Protocols {
+			sets = append(sets, x.byProtocol[protocol])
+		}
+		narrow(unionOf(sets))
+	}
+
+	if q.Label != "" && !strings.ContainsAny(q.Label, `*?[\`) {
+		narrow(x.byLabel[q.Label])
+	}
+
+	for _, r := range q.Meta {
+		switch r.Operator {
+		case OpEquals, OpExists, OpIn:
+			narrow(x.byMetaKey[r.Key])
+		}
+	}
+
+	var entries []*indexEntry
+	for _, entry := range candidates {
+		if q.Match(entry.info) {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seq < entries[j].seq
+	})
+
+	result := make([]*ome.ServiceInfo, len(entries))
+	for i, entry := range entries {
+		result[i] = entry.info
+	}
+	return result
+}
+
+func unionOf(sets []indexSet) indexSet {
+	if len(sets) == 1 {
+		return sets[0]
+	}
+
+	union := indexSet{}
+	for _, set := range sets {
+		for key, entry := range set {
+			union[key] = entry
+		}
+	}
+	return union
+}
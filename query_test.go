@@ -0,0 +1,159 @@
+package discover
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/omecodes/libome"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected *Query
+		err      string
+	}{
+		{query: "", expected: &Query{}},
+		{query: "type=2", expected: &Query{Types: []uint32{2}}},
+		{query: "type in (1, 2)", expected: &Query{Types: []uint32{1, 2}}},
+		{query: "label=billing-*", expected: &Query{Label: "billing-*"}},
+		{
+			query: "meta.region=eu, meta.zone!=a, meta.tier in (gold,silver), meta.os notin (win)",
+			expected: &Query{Meta: []MetaRequirement{
+				{Key: "region", Operator: OpEquals, Values: []string{"eu"}},
+				{Key: "zone", Operator: OpNotEquals, Values: []string{"a"}},
+				{Key: "tier", Operator: OpIn, Values: []string{"gold", "silver"}},
+				{Key: "os", Operator: OpNotIn, Values: []string{"win"}},
+			}},
+		},
+		{
+			query: "meta.region, !meta.zone",
+			expected: &Query{Meta: []MetaRequirement{
+				{Key: "region", Operator: OpExists},
+				{Key: "zone", Operator: OpNotExists},
+			}},
+		},
+		{query: "nodes>=2,nodes<5", expected: &Query{Nodes: []CountRequirement{{OpGreaterEqual, 2}, {OpLess, 5}}}},
+		{query: "protocol in (grpc,http)", expected: &Query{Protocols: []ome.Protocol{ome.Protocol_Grpc, ome.Protocol_Http}}},
+		{query: "health=healthy", expected: &Query{Health: []string{"healthy"}}},
+		{
+			query: `meta.zone="eu (west), a", meta.tier in ("a,b", ")", "")`,
+			expected: &Query{Meta: []MetaRequirement{
+				{Key: "zone", Operator: OpEquals, Values: []string{"eu (west), a"}},
+				{Key: "tier", Operator: OpIn, Values: []string{"a,b", ")", ""}},
+			}},
+		},
+		{query: `meta.note="in (x)"`, expected: &Query{Meta: []MetaRequirement{{Key: "note", Operator: OpEquals, Values: []string{"in (x)"}}}}},
+		{query: "color=red", err: "unknown field"},
+		{query: "type>1", err: "type supports"},
+		{query: "type=x", err: "invalid type"},
+		{query: "protocol=ftp", err: "unknown protocol"},
+		{query: "meta.=a", err: "empty meta key"},
+		{query: "meta.a>1", err: "unsupported meta operator"},
+		{query: "meta.a in x", err: "parentheses"},
+		{query: "meta.a in ()", err: "empty value set"},
+		{query: "meta.a in ((b))", err: "nested parentheses"},
+		{query: "meta.a in (b", err: "unbalanced parentheses"},
+		{query: `meta.a="b`, err: "unterminated quoted value"},
+		{query: `meta.a="b"c`, err: "invalid quoted value"},
+		{query: "meta.a=", err: "missing value"},
+		{query: "label=[", err: "invalid label pattern"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			q, err := ParseQuery(test.query)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(q, test.expected) {
+				t.Errorf("parsed %#v, expected %#v", q, test.expected)
+			}
+		})
+	}
+}
+
+func TestQueryStringRoundTrip(t *testing.T) {
+	queries := []*Query{
+		{},
+		{Types: []uint32{2}},
+		{Types: []uint32{1, 2}, Label: "billing-*"},
+		{Label: "a,b (c)"},
+		{Meta: []MetaRequirement{
+			{Key: "region", Operator: OpEquals, Values: []string{"eu, west"}},
+			{Key: "zone", Operator: OpNotEquals, Values: []string{" padded "}},
+			{Key: "tier", Operator: OpIn, Values: []string{"a,b", "(c)", `"d"`}},
+			{Key: "os", Operator: OpNotIn, Values: []string{"win"}},
+			{Key: "gpu", Operator: OpExists},
+			{Key: "legacy", Operator: OpNotExists},
+		}},
+		{Nodes: []CountRequirement{{OpGreater, 1}, {OpLessEqual, 4}}},
+		{Protocols: []ome.Protocol{ome.Protocol_Grpc}, Health: []string{"healthy", "degraded (slow)"}},
+	}
+
+	for _, q := range queries {
+		parsed, err := ParseQuery(q.String())
+		if err != nil {
+			t.Errorf("could not parse %q: %s", q.String(), err)
+			continue
+		}
+		if !reflect.DeepEqual(parsed, q) {
+			t.Errorf("%q parsed into %#v, expected %#v", q.String(), parsed, q)
+		}
+	}
+}
+
+func TestQueryMatch(t *testing.T) {
+	info := &ome.ServiceInfo{
+		Id:    "billing",
+		Type:  2,
+		Label: "billing-eu",
+		Meta:  map[string]string{"region": "eu (west)", "tier": "gold"},
+		Nodes: []*ome.Node{
+			{Id: "a", Protocol: ome.Protocol_Grpc, Meta: map[string]string{MetaNodeHealth: "healthy"}},
+			{Id: "b", Protocol: ome.Protocol_Http},
+		},
+	}
+
+	tests := []struct {
+		query   string
+		matches bool
+	}{
+		{"", true},
+		{"type=2", true},
+		{"type in (1,3)", false},
+		{"label=billing-*", true},
+		{"label=billing", false},
+		{`meta.region="eu (west)"`, true},
+		{"meta.region!=eu", true},
+		{`meta.region in ("eu (west)", us)`, true},
+		{"meta.tier notin (gold)", false},
+		{"meta.tier", true},
+		{"!meta.tier", false},
+		{"meta.missing!=x", true},
+		{"nodes=2", true},
+		{"nodes>2", false},
+		{"protocol=http", true},
+		{"protocol=grpc, health=healthy", true},
+		{"protocol=http, health=healthy", false},
+		{"health=unknown", true},
+		{"health=degraded", false},
+	}
+
+	for _, test := range tests {
+		q, err := ParseQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matches := q.Match(info); matches != test.matches {
+			t.Errorf("%q matches: %t, expected %t", test.query, matches, test.matches)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package discover
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/omecodes/common/errors"
+	"github.com/omecodes/common/utils/log"
+	"github.com/omecodes/libome"
+	"github.com/omecodes/zebou"
+)
+
+// Codes of the protocol errors reported to peers whose mutations are rejected
+const (
+	errorRateLimited   = "rate_limited"
+	errorQuotaExceeded = "quota_exceeded"
+)
+
+// Reasons of the rejections counted by MetricServerRejections
+const (
+	rejectionRateLimit         = "rate_limit"
+	rejectionIdentityRateLimit = "identity_rate_limit"
+	rejectionServices          = "services"
+	rejectionNodes             = "nodes"
+	rejectionSize              = "size"
+)
+
+// limits are the rate limits and quotas applied to the mutations of peers
+type limits struct {
+	rate          float64
+	burst         int
+	identityRate  float64
+	identityBurst int
+	maxServices   int
+	maxNodes      int
+	maxSize       int
+}
+
+func limitsFrom(configs *ServerConfig) limits {
+	return limits{
+		rate:          configs.RateLimit,
+		burst:         configs.RateBurst,
+		identityRate:  configs.IdentityRateLimit,
+		identityBurst: configs.IdentityRateBurst,
+		maxServices:   configs.MaxServicesPerPeer,
+		maxNodes:      configs.MaxNodesPerPeer,
+		maxSize:       configs.MaxServiceInfoSize,
+	}
+}
+
+// tokenBucket allows rate events per second on average, and burst events at once
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = int(rate)
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// allow takes a token if one is available
+func (b *tokenBucket) allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// isMutation reports whether messages of type msgType change the registry
+func isMutation(msgType string) bool {
+	switch msgType {
+	case ome.RegistryEventType_Register.String(), ome.RegistryEventType_Update.String(), msgPatch,
+		ome.RegistryEventType_DeRegister.String(), ome.RegistryEventType_DeRegisterNode.String(), msgAdminDeRegister:
+		return true
+	}
+	return false
+}
+
+// allowMutation consumes the rate limits of the peer of session and of its identity. It returns the reason of the
+// rejection if one of them is exhausted
+func (s *Server) allowMutation(session *peerSession) (string, bool) {
+	if session.limiter != nil && !session.limiter.allow() {
+		return rejectionRateLimit, false
+	}
+
+	identity := session.info.Identity
+	if s.limits.identityRate <= 0 || identity == "" {
+		return "", true
+	}
+
+	o, _ := s.identityLimiters.LoadOrStore(identity, newTokenBucket(s.limits.identityRate, s.limits.identityBurst))
+	if !o.(*tokenBucket).allow() {
+		return rejectionIdentityRateLimit, false
+	}
+	return "", true
+}
+
+// checkQuotas returns an error if peer registering info, whose JSON encoding is size bytes long, exceeds one of
+// the configured quotas. The reason of the rejection is returned with it
+func (s *Server) checkQuotas(peer string, info *ome.ServiceInfo, size int) (string, error) {
+	if max := s.limits.maxSize; max > 0 && size > max {
+		return rejectionSize, fmt.Errorf("%w: service info of %d bytes exceeds the %d bytes limit", errors.Forbidden, size, max)
+	}
+
+	maxServices, maxNodes := s.limits.maxServices, s.limits.maxNodes
+	if maxServices <= 0 && maxNodes <= 0 {
+		return "", nil
+	}
+
+	services := 1
+	nodes := len(info.Nodes)
+	for _, registered := range s.index.forPeer(peer) {
+		if registered.Id == info.Id {
+			continue
+		}
+		services++
+		nodes += len(registered.Nodes)
+	}
+
+	if maxServices > 0 && services > maxServices {
+		return rejectionServices, fmt.Errorf("%w: peer cannot register more than %d services", errors.Forbidden, maxServices)
+	}
+	if maxNodes > 0 && nodes > maxNodes {
+		return rejectionNodes, fmt.Errorf("%w: peer cannot register more than %d nodes", errors.Forbidden, maxNodes)
+	}
+	return "", nil
+}
+
+// lockMutations serializes the registrations of peer, so that its quotas are checked against the services it
+// registered before. It returns the unlock function
+func (s *Server) lockMutations(peer string) func() {
+	session := s.session(peer)
+	if session == nil {
+		return func() {}
+	}
+	session.mutations.Lock()
+	return session.mutations.Unlock
+}
+
+// rejectMutation reports to the peer of ctx that its mutation msg was rejected
+func (s *Server) rejectMutation(ctx context.Context, msg *zebou.ZeMsg, code string, reason string, err error) {
+	peer := zebou.Peer(ctx)
+	s.metrics.Add(MetricServerRejections, 1, map[string]string{"reason": reason})
+	log.Info("registry server • rejected mutation", log.Err(err), log.Field("peer", peer.ID), log.Field("service", msg.Id), log.Field("reason", reason))
+
+	s.replyError(ctx, &protocolError{
+		Code:    code,
+		Type:    messageType(msg),
+		Service: msg.Id,
+		Message: err.Error(),
+	})
+}
@@ -0,0 +1,269 @@
+package discover
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omecodes/libome"
+	"github.com/omecodes/zebou"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(10, 3)
+	for i := 0; i < 3; i++ {
+		if !b.allow() {
+			t.Fatalf("burst token %d was not allowed", i+1)
+		}
+	}
+	if b.allow() {
+		t.Fatal("allowed more than the burst")
+	}
+
+	// 250ms at 10 tokens per second refill 2.5 tokens
+	b.mutex.Lock()
+	b.last = b.last.Add(-250 * time.Millisecond)
+	b.mutex.Unlock()
+	for i := 0; i < 2; i++ {
+		if !b.allow() {
+			t.Fatalf("refilled token %d was not allowed", i+1)
+		}
+	}
+	if b.allow() {
+		t.Fatal("allowed more than the refilled tokens")
+	}
+
+	// refills do not exceed the burst
+	b.mutex.Lock()
+	b.last = b.last.Add(-time.Minute)
+	b.mutex.Unlock()
+	allowed := 0
+	for b.allow() {
+		allowed++
+	}
+	if allowed != 3 {
+		t.Errorf("allowed %d tokens after a long pause instead of 3", allowed)
+	}
+
+	for _, test := range []struct {
+		rate  float64
+		burst int
+		want  float64
+	}{
+		{rate: 5, burst: 0, want: 5},
+		{rate: 0.5, burst: 0, want: 1},
+		{rate: 5, burst: 2, want: 2},
+	} {
+		if b := newTokenBucket(test.rate, test.burst); b.burst != test.want || b.tokens != test.want {
+			t.Errorf("bucket of rate %v and burst %d has a burst of %v", test.rate, test.burst, b.burst)
+		}
+	}
+}
+
+func TestCheckQuotas(t *testing.T) {
+	registered := []*ome.ServiceInfo{
+		{Id: "a", Nodes: []*ome.Node{{Id: "1"}, {Id: "2"}}},
+		{Id: "b", Nodes: []*ome.Node{{Id: "1"}}},
+	}
+	nodes := func(count int) []*ome.Node {
+		var result []*ome.Node
+		for i := 0; i < count; i++ {
+			result = append(result, &ome.Node{Id: string(rune('a' + i))})
+		}
+		return result
+	}
+
+	tests := []struct {
+		name   string
+		limits limits
+		info   *ome.ServiceInfo
+		size   int
+		reason string
+	}{
+		{
+			name: "unlimited",
+			info: &ome.ServiceInfo{Id: "c", Nodes: nodes(10)},
+			size: 1 << 20,
+		},
+		{
+			name:   "service within quota",
+			limits: limits{maxServices: 3},
+			info:   &ome.ServiceInfo{Id: "c"},
+		},
+		{
+			name:   "service over quota",
+			limits: limits{maxServices: 2},
+			info:   &ome.ServiceInfo{Id: "c"},
+			reason: rejectionServices,
+		},
+		{
+			name:   "update of a registered service",
+			limits: limits{maxServices: 2},
+			info:   &ome.ServiceInfo{Id: "a"},
+		},
+		{
+			name:   "nodes within quota",
+			limits: limits{maxNodes: 5},
+			info:   &ome.ServiceInfo{Id: "c", Nodes: nodes(2)},
+		},
+		{
+			name:   "nodes over quota",
+			limits: limits{maxNodes: 5},
+			info:   &ome.ServiceInfo{Id: "c", Nodes: nodes(3)},
+			reason: rejectionNodes,
+		},
+		{
+			name:   "update replaces the nodes of the registered service",
+			limits: limits{maxNodes: 5},
+			info:   &ome.ServiceInfo{Id: "a", Nodes: nodes(4)},
+		},
+		{
+			name:   "size within quota",
+			limits: limits{maxSize: 100},
+			info:   &ome.ServiceInfo{Id: "c"},
+			size:   100,
+		},
+		{
+			name:   "size over quota",
+			limits: limits{maxSize: 100, maxServices: 1},
+			info:   &ome.ServiceInfo{Id: "c"},
+			size:   101,
+			reason: rejectionSize,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &Server{index: newServiceIndex(), limits: test.limits}
+			for _, info := range registered {
+				s.index.put("peer", info.Id, info)
+				s.index.put("other", info.Id+"-other", info)
+			}
+
+			reason, err := s.checkQuotas("peer", test.info, test.size)
+			if reason != test.reason {
+				t.Errorf("got rejection reason %q, expected %q", reason, test.reason)
+			}
+			if (err != nil) != (test.reason != "") {
+				t.Errorf("got error %v", err)
+			}
+		})
+	}
+}
+
+func TestMutationRejections(t *testing.T) {
+	tests := []struct {
+		name    string
+		configs *ServerConfig
+		code    string
+		reason  string
+	}{
+		{
+			name:    "rate limit",
+			configs: &ServerConfig{RateLimit: 0.001, RateBurst: 1},
+			code:    errorRateLimited,
+			reason:  rejectionRateLimit,
+		},
+		{
+			name:    "services quota",
+			configs: &ServerConfig{MaxServicesPerPeer: 1},
+			code:    errorQuotaExceeded,
+			reason:  rejectionServices,
+		},
+		{
+			name:    "size quota",
+			configs: &ServerConfig{MaxServiceInfoSize: 200},
+			code:    errorQuotaExceeded,
+			reason:  rejectionSize,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metrics := NewPrometheusMetrics()
+			test.configs.Metrics = metrics
+			s := startTestServer(t, test.configs)
+			defer s.Stop()
+
+			client := connectTestClient(t, s, nil)
+			defer client.Stop()
+			clientMetrics := NewPrometheusMetrics()
+			client.SetMetrics(clientMetrics)
+
+			if err := client.RegisterService(testService("a", "10.0.0.1:80")); err != nil {
+				t.Fatal(err)
+			}
+			waitHandled(t, s, metrics, "Register", 1)
+			large := testService("b", "10.0.0.1:80")
+			large.Meta = map[string]string{"blob": strings.Repeat("x", 200)}
+			if err := client.RegisterService(large); err != nil {
+				t.Fatal(err)
+			}
+			waitHandled(t, s, metrics, "Register", 2)
+
+			if !hasService(s, "a") || hasService(s, "b") {
+				t.Errorf("registered a: %t, b: %t", hasService(s, "a"), hasService(s, "b"))
+			}
+			if rejections := metricValue(metrics, MetricServerRejections, map[string]string{"reason": test.reason}); rejections != 1 {
+				t.Errorf("server counted %v %s rejections instead of 1", rejections, test.reason)
+			}
+			eventually(t, "rejection reply", func() bool {
+				return metricValue(clientMetrics, MetricClientRejections, map[string]string{"code": test.code}) == 1
+			})
+		})
+	}
+}
+
+func TestRejectionReply(t *testing.T) {
+	metrics := NewPrometheusMetrics()
+	s := startTestServer(t, &ServerConfig{Metrics: metrics, MaxServicesPerPeer: 1})
+	defer s.Stop()
+
+	peer := zebou.NewClient(s.listener.Addr().String(), nil)
+	// the peer is disconnected when s stops: zebou clients cannot be stopped while connected without a data race
+	peer.Connect()
+
+	errs := make(chan *protocolError, 1)
+	go func() {
+		for {
+			msg, err := peer.GetMessage()
+			if err != nil {
+				return
+			}
+			if messageType(msg) != msgError {
+				continue
+			}
+			e := new(protocolError)
+			if err := json.Unmarshal(msg.Encoded, e); err == nil {
+				errs <- e
+			}
+		}
+	}()
+
+	for i, id := range []string{"a", "b"} {
+		encoded, err := json.Marshal(testService(id, "10.0.0.1:80"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := peer.SendMsg(&zebou.ZeMsg{Type: ome.RegistryEventType_Register.String(), Id: id, Encoded: encoded}); err != nil {
+			t.Fatal(err)
+		}
+		waitHandled(t, s, metrics, "Register", float64(i+1))
+	}
+
+	select {
+	case e := <-errs:
+		if e.Code != errorQuotaExceeded || e.Type != ome.RegistryEventType_Register.String() || e.Service != "b" {
+			t.Errorf("got rejection %+v", e)
+		}
+		if !strings.Contains(e.Message, "more than 1 services") {
+			t.Errorf("got rejection message %q", e.Message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the rejection was not reported to the peer")
+	}
+	if !hasService(s, "a") || hasService(s, "b") {
+		t.Errorf("registered a: %t, b: %t", hasService(s, "a"), hasService(s, "b"))
+	}
+}
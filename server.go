@@ -2,21 +2,26 @@ package discover
 
 import (
 	"context"
-	"database/sql"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net"
-	"path/filepath"
+	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
-	"github.com/omecodes/bome"
 	"github.com/omecodes/common/errors"
 	"github.com/omecodes/common/utils/log"
 	"github.com/omecodes/libome"
 	net2 "github.com/omecodes/libome/net"
 	"github.com/omecodes/zebou"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/proto"
 )
 
 type ServerConfig struct {
@@ -26,6 +31,112 @@ type ServerConfig struct {
 	CertFilename         string
 	KeyFilename          string
 	ClientCACertFilename string
+	// TLSReloadInterval is the period at which the certificate, key and client CA files are checked for changes.
+	// Defaults to 1 minute. Files are only reloaded by ReloadTLS if negative
+	TLSReloadInterval time.Duration
+
+	// StoreBackend selects the built-in registry storage. Defaults to StoreSQLite if StoreDir is set, StoreMemory otherwise
+	StoreBackend StoreBackend
+	// StoreDSN is the data source name of the MySQL registry storage
+	StoreDSN string
+	// Store is a custom registry storage. It overrides StoreBackend and is closed when the server stops
+	Store Store
+
+	// Codecs are the codecs peers may negotiate to encode service infos, in addition to JSON. Defaults to protobuf
+	Codecs []string
+	// Compressions are the compressions peers may negotiate for the frames sent to them. Defaults to gzip
+	Compressions []string
+	// DisableCompression sends frames uncompressed whatever the peers offer
+	DisableCompression bool
+
+	// Validators check the services registered by peers and by the server, after the built-in rules of ValidateService
+	Validators []Validator
+
+	// AdmissionHooks enrich and police the registrations of peers before they are stored
+	AdmissionHooks []AdmissionHook
+
+	// RateLimit is the number of registry mutations per second a peer may send. Unlimited if zero
+	RateLimit float64
+	// RateBurst is the number of mutations a peer may send at once. It must allow the registrations clients send again
+	// when they reconnect. Defaults to RateLimit
+	RateBurst int
+	// IdentityRateLimit is the number of registry mutations per second the peers authenticated with a same client
+	// certificate may send together. Unlimited if zero
+	IdentityRateLimit float64
+	// IdentityRateBurst is the number of mutations the peers of a same identity may send at once. Defaults to IdentityRateLimit
+	IdentityRateBurst int
+	// MaxServicesPerPeer is the number of services a peer may register. Unlimited if zero
+	MaxServicesPerPeer int
+	// MaxNodesPerPeer is the number of nodes the services registered by a peer may have in total. Unlimited if zero
+	MaxNodesPerPeer int
+	// MaxServiceInfoSize is the size in bytes of the JSON encoded info of a registered service. Unlimited if zero
+	MaxServiceInfoSize int
+
+	// DNSBindAddress is the UDP/TCP address of the embedded DNS server. DNS is disabled if empty
+	DNSBindAddress string
+	// DNSZone is the zone the DNS server is authoritative for. Defaults to "discover."
+	DNSZone string
+
+	// PrometheusSDBindAddress is the address of the Prometheus HTTP service discovery endpoint. Disabled if empty
+	PrometheusSDBindAddress string
+
+	// XDSBindAddress is the address of the Envoy REST xDS (CDS/EDS) endpoints. Disabled if empty
+	XDSBindAddress string
+	// XDSClusterName is the name of the Envoy cluster pointing at XDSBindAddress. Defaults to "discover"
+	XDSClusterName string
+
+	// TracerProvider provides the tracer used to trace message handling. Defaults to the global provider
+	TracerProvider trace.TracerProvider
+	// Propagator propagates the trace context to and from the peers that support tracing. Defaults to the W3C trace
+	// context propagator
+	Propagator propagation.TextMapPropagator
+
+	// AuditLogFilename is the JSON lines file registry mutations are audited to. Ignored if AuditSink is set
+	AuditLogFilename string
+	// AuditLogMaxSize is the size in bytes from which the audit log is rotated. Never rotated if zero
+	AuditLogMaxSize int64
+	// AuditLogMaxBackups is the number of rotated audit logs that are kept. Defaults to 5
+	AuditLogMaxBackups int
+	// AuditSink receives the audit records. Mutations are not audited if neither AuditSink nor AuditLogFilename is set
+	AuditSink AuditSink
+
+	// SnapshotFilename is the file a registry snapshot is periodically written to. Disabled if empty
+	SnapshotFilename string
+	// SnapshotInterval is the period of registry snapshots. Defaults to 5 minutes
+	SnapshotInterval time.Duration
+	// RestoreGracePeriod is how long the services restored for peers that are not connected are kept, which gives
+	// their clients time to reconnect and register them again. Defaults to 1 minute
+	RestoreGracePeriod time.Duration
+
+	// AdminIdentities are the client certificate identities allowed to deregister the services of other peers.
+	// Nobody is allowed if empty
+	AdminIdentities []string
+
+	// StaticServicesDir is a directory of JSON or YAML files defining services that are registered under
+	// StaticServicesPeer. Files are reloaded when they change. Disabled if empty
+	StaticServicesDir string
+	// StaticServicesInterval is the period at which StaticServicesDir is checked for changes. Defaults to 5 seconds
+	StaticServicesInterval time.Duration
+
+	// Sources are the external registries services are imported from
+	Sources []SourceConfig
+
+	// Webhooks are the HTTP endpoints the registry events are delivered to
+	Webhooks []WebhookConfig
+	// WebhookDeadLetterFilename is the JSON lines file the events that could not be delivered to a webhook are
+	// appended to. They are only logged if empty
+	WebhookDeadLetterFilename string
+
+	// Sinks are the external systems the registry services are mirrored to
+	Sinks []Sink
+	// SinksResyncInterval is the period of the full reconciliations of the sinks with the registry. Sinks are only
+	// reconciled at startup if zero
+	SinksResyncInterval time.Duration
+
+	// MetricsBindAddress is the address of the Prometheus metrics exposition endpoint. Disabled if empty
+	MetricsBindAddress string
+	// Metrics is the metrics backend. Defaults to an in-memory Prometheus registry if MetricsBindAddress is set
+	Metrics Metrics
 }
 
 type Server struct {
@@ -33,145 +144,293 @@ type Server struct {
 	handlers map[string]ome.EventHandler
 	listener net.Listener
 	hub      *zebou.Hub
-	store    *bome.DoubleMap
+	store    Store
+	index    *serviceIndex
 	name     string
+	dns      *dnsServer
+
+	prometheusSD *http.Server
+	xds          *xdsServer
+	webhooks     *webhookDispatcher
+	mirrors      []*Mirror
+
+	identities         *identityListener
+	certificates       *CertificateReloader
+	peers              sync.Map
+	auditSink          AuditSink
+	stopSnapshots      chan struct{}
+	stopRestore        chan struct{}
+	stopStatic         chan struct{}
+	stopSources        chan struct{}
+	staticFingerprint  string
+	snapshotFilename   string
+	restoreGracePeriod time.Duration
+	tracer             trace.Tracer
+	propagator         propagation.TextMapPropagator
+	metrics            Metrics
+	metricsServer      *http.Server
+	stopMetrics        chan struct{}
+	connectedPeers     int64
+	handling           sync.RWMutex
+	draining           int32
+	drainRedirect      atomic.Value
+	codecs             []string
+	compressions       []string
+	limits             limits
+	validators         []Validator
+	admissionHooks     []AdmissionHook
+	adminIdentities    []string
+	identityLimiters   sync.Map
+	stopOnce           sync.Once
+	stopErr            error
 }
 
 func (s *Server) getFromClient(id string) ([]*ome.ServiceInfo, error) {
-	c, err := s.store.GetForFirst(id)
-	if err != nil {
-		log.Error("registry server • failed to get registered nodes", log.Field("conn_id", id))
-		return nil, err
-	}
-
-	defer func() {
-		if err := c.Close(); err != nil {
-			log.Error("registry server • failed to close cursor", log.Err(err))
-		}
-	}()
-
-	var result []*ome.ServiceInfo
-	for c.HasNext() {
-		o, err := c.Next()
-		if err != nil {
-			return nil, err
-		}
+	return s.index.forPeer(id), nil
+}
 
-		entry := o.(*bome.MapEntry)
+// storeEntries returns all the registry store entries
+func (s *Server) storeEntries(ctx context.Context) ([]*StoreEntry, error) {
+	var entries []*StoreEntry
+	done := s.storeOperation(ctx, "get_all")
+	err := s.store.Range(func(entry *StoreEntry) bool {
+		entries = append(entries, entry)
+		return true
+	})
+	done(err)
+	return entries, err
+}
 
-		var info ome.ServiceInfo
-		err = json.Unmarshal([]byte(entry.Value), &info)
-		if err != nil {
-			return nil, err
-		}
-		result = append(result, &info)
+func (s *Server) NewClient(ctx context.Context, peer *zebou.PeerInfo) {
+	s.metrics.Add(MetricServerPeerConnections, 1, nil)
+	s.metrics.Set(MetricServerConnectedPeers, float64(atomic.AddInt64(&s.connectedPeers, 1)), nil)
+
+	session := newPeerSession(ctx, &PeerInfo{
+		ID:          peer.ID,
+		Address:     peer.Address,
+		Identity:    s.peerIdentity(peer),
+		ConnectedAt: time.Now(),
+	})
+	if s.limits.rate > 0 {
+		session.limiter = newTokenBucket(s.limits.rate, s.limits.burst)
 	}
-	return result, nil
+	s.peers.Store(peer.ID, session)
+	log.Info("registry server • new client connected", log.Field("conn_id", peer.ID), log.Field("addr", peer.Address))
+
+	// the hub reads the peer messages once NewClient returns: the hello is waited for in the background
+	go s.syncPeer(session)
 }
 
-func (s *Server) NewClient(ctx context.Context, peer *zebou.PeerInfo) {
-	if peer != nil {
-		log.Info("registry server • new client connected", log.Field("conn_id", peer.ID), log.Field("addr", peer.Address))
-	} else {
-		log.Info("registry server • new client connected")
+// syncPeer sends the registry content to a new peer, encoded with the codec negotiated in its hello.
+// Messages broadcast in the meantime are sent afterwards
+func (s *Server) syncPeer(session *peerSession) {
+	defer observeDuration(s.metrics, MetricServerInitialSync, time.Now(), nil)
+	session.waitGreeted(helloTimeout)
+	if session.isRejected() {
+		return
 	}
 
-	c, err := s.store.GetAll()
+	entries, err := s.storeEntries(session.ctx)
 	if err != nil {
 		log.Error("registry server • could not load services list from store", log.Err(err))
 		return
 	}
 
-	defer func() {
-		if err := c.Close(); err != nil {
-			log.Error("registry server • failed to close cursor", log.Err(err))
-		}
-	}()
-
-	count := 0
-	for c.HasNext() {
-		count++
-
+	// the content is sent at once, in batches for the peers that support them
+	msgs := make([]*zebou.ZeMsg, 0, len(entries)+1)
+	for _, entry := range entries {
 		var info ome.ServiceInfo
-		o, err := c.Next()
-		if err != nil {
-			log.Error("registry server • failed to parse service info", log.Err(err))
-			return
-		}
-
-		entry := o.(*bome.DoubleMapEntry)
 		err = json.Unmarshal([]byte(entry.Value), &info)
 		if err != nil {
+			s.metrics.Add(MetricServerDecodeFailures, 1, map[string]string{"source": "store"})
 			log.Error("registry server • could not load service info from store", log.Err(err))
 		}
 
-		err = zebou.Send(ctx, &zebou.ZeMsg{
+		msgs = append(msgs, &zebou.ZeMsg{
 			Type:    ome.RegistryEventType_Register.String(),
 			Id:      info.Id,
 			Encoded: []byte(entry.Value),
 		})
-		if err != nil {
-			log.Error("registry server • could not send message", log.Err(err))
-			return
-		}
-		log.Info("registry server • sent register event to new connected client", log.Field("type", info.Type), log.Field("id", info.Id))
 	}
+	msgs = append(msgs, &zebou.ZeMsg{Type: msgSynced})
 
-	if count == 0 {
+	if err := session.send(msgs...); err != nil {
+		log.Error("registry server • could not send message", log.Err(err))
+		return
+	}
+
+	if len(entries) == 0 {
 		log.Info("registry server • no info sent to client")
 	} else {
-		log.Info("registry server • sent all service info to client", log.Field("count", count))
+		log.Info("registry server • sent all service info to client", log.Field("count", len(entries)))
+	}
+
+	if err := session.markSynced(); err != nil {
+		log.Error("registry server • could not send message", log.Err(err))
 	}
 }
 
+// reply sends msg to the peer of ctx
+func (s *Server) reply(ctx context.Context, msg *zebou.ZeMsg) error {
+	if session := s.session(zebou.Peer(ctx).ID); session != nil {
+		return session.send(msg)
+	}
+	return zebou.Send(ctx, msg)
+}
+
 func (s *Server) ClientQuit(ctx context.Context, peer *zebou.PeerInfo) {
 	log.Info("registry server • client disconnected", log.Field("conn_id", peer.ID), log.Field("addr", peer.Address))
+	s.metrics.Add(MetricServerPeerDisconnections, 1, nil)
+	s.metrics.Set(MetricServerConnectedPeers, float64(atomic.AddInt64(&s.connectedPeers, -1)), nil)
+	defer s.peers.Delete(peer.ID)
+	if session := s.session(peer.ID); session != nil {
+		session.close()
+	}
+
 	services, err := s.getFromClient(peer.ID)
 	if err != nil {
 		log.Error("registry server • could not get client registered services", log.Err(err))
 		return
 	}
 
-	err = s.store.DeleteAllMatchingFirstKey(peer.ID)
+	done := s.storeOperation(ctx, "delete_peer")
+	err = s.store.DeleteForPeer(peer.ID)
+	done(err)
 	if err != nil {
 		log.Error("registry server • could not delete client registered services", log.Err(err))
 		return
 	}
 
 	for _, info := range services {
+		if s.isDraining() {
+			// the owner registers the service again on the server it migrates to
+			s.audit(peer, AuditClientQuit, info.Id, info, nil)
+			continue
+		}
+
 		encoded, err := json.Marshal(info)
 		if err != nil {
 			log.Error("registry server • failed to encode service info", log.Err(err))
 			return
 		}
 
-		s.hub.Broadcast(ctx, &zebou.ZeMsg{
+		s.announceRemoval(ctx, peer.ID, &zebou.ZeMsg{
 			Type:    ome.RegistryEventType_DeRegister.String(),
 			Id:      info.Id,
 			Encoded: encoded,
-		})
+		}, info)
+		s.audit(peer, AuditClientQuit, info.Id, info, nil)
 	}
 }
 
+// handledMessageTypes are the types of the messages handled by OnMessage
+var handledMessageTypes = map[string]bool{
+	ome.RegistryEventType_Register.String():       true,
+	ome.RegistryEventType_Update.String():         true,
+	ome.RegistryEventType_DeRegister.String():     true,
+	ome.RegistryEventType_DeRegisterNode.String(): true,
+	msgAdminDeRegister:                            true,
+	msgListPeers:                                  true,
+	msgHello:                                      true,
+	msgPatch:                                      true,
+	msgResync:                                     true,
+	msgDrain:                                      true,
+}
+
+// messageMetricType returns the type label of the metrics of messages of type msgType. Types that are not handled are
+// counted as "unsupported", peers would otherwise create as many metric series as they send types
+func messageMetricType(msgType string) string {
+	if handledMessageTypes[msgType] {
+		return msgType
+	}
+	return "unsupported"
+}
+
 func (s *Server) OnMessage(ctx context.Context, msg *zebou.ZeMsg) {
 	peer := zebou.Peer(ctx)
-	go s.hub.Broadcast(ctx, msg)
+	msgType := messageType(msg)
+
+	ctx, span := s.tracer.Start(extractTrace(ctx, s.propagator, msg), "discover.server.OnMessage",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("discover.message.type", msgType),
+			attribute.String("discover.service.id", msg.Id),
+			attribute.String("discover.peer.id", peer.ID),
+		),
+	)
+	defer span.End()
+
+	s.metrics.Add(MetricServerMessages, 1, map[string]string{"type": messageMetricType(msgType)})
+
+	msg, err := decodeMessage(msg)
+	if err != nil {
+		s.metrics.Add(MetricServerDecodeFailures, 1, map[string]string{"source": "message"})
+		log.Error("registry server • failed to decode message", log.Err(err), log.Field("type", msgType))
+		return
+	}
+
+	s.handling.RLock()
+	defer s.handling.RUnlock()
+
+	session := s.session(peer.ID)
+	if session != nil && session.isRejected() {
+		log.Info("registry server • dropped message of incompatible peer", log.Field("peer", peer.ID), log.Field("type", msgType))
+		return
+	}
+
+	if session != nil && isMutation(msgType) {
+		if reason, allowed := s.allowMutation(session); !allowed {
+			s.rejectMutation(ctx, msg, errorRateLimited, reason, fmt.Errorf("%w: registry mutation rate limit exceeded", errors.Forbidden))
+			return
+		}
+	}
+
+	if s.isDraining() && (msgType == ome.RegistryEventType_Register.String() || msgType == ome.RegistryEventType_Update.String() || msgType == msgPatch) {
+		s.rejectWhileDraining(ctx, msg)
+		return
+	}
 
-	switch msg.Type {
+	switch msgType {
 	case ome.RegistryEventType_Update.String(), ome.RegistryEventType_Register.String():
 		info := new(ome.ServiceInfo)
 		err := json.Unmarshal(msg.Encoded, &info)
 		if err != nil {
+			s.metrics.Add(MetricServerDecodeFailures, 1, map[string]string{"source": "message"})
 			log.Error("registry server • failed to decode service info", log.Err(err))
 			return
 		}
 
-		entry := &bome.DoubleMapEntry{
-			FirstKey:  peer.ID,
-			SecondKey: info.Id,
-			Value:     string(msg.Encoded),
+		admitted, ok := s.admit(ctx, msg, msgType, info)
+		if !ok {
+			return
+		}
+		if !proto.Equal(admitted, info) {
+			encoded, err := json.Marshal(admitted)
+			if err != nil {
+				log.Error("registry server • failed to encode service info", log.Err(err))
+				return
+			}
+			info = admitted
+			msg = &zebou.ZeMsg{Type: msg.Type, Id: info.Id, Encoded: encoded}
+		}
+
+		defer s.lockMutations(peer.ID)()
+		if reason, err := s.checkQuotas(peer.ID, info, len(msg.Encoded)); err != nil {
+			s.rejectMutation(ctx, msg, errorQuotaExceeded, reason, err)
+			return
+		}
+
+		before := s.storedService(peer.ID, info.Id)
+		go s.broadcastUpdate(ctx, msg, before, info)
+
+		entry := &StoreEntry{
+			Peer:    peer.ID,
+			Service: info.Id,
+			Value:   string(msg.Encoded),
 		}
+		done := s.storeOperation(ctx, "upsert")
 		err = s.store.Upsert(entry)
+		done(err)
 		if err != nil {
 			log.Error("registry server • failed to store service info", log.Err(err))
 			return
@@ -183,109 +442,181 @@ func (s *Server) OnMessage(ctx context.Context, msg *zebou.ZeMsg) {
 			ServiceId: info.Id,
 			Info:      info,
 		}
-		if msg.Type == ome.RegistryEventType_Register.String() {
+		if msgType == ome.RegistryEventType_Register.String() {
 			event.Type = ome.RegistryEventType_Register
+			s.audit(peer, AuditRegister, info.Id, before, info)
 		} else {
 			event.Type = ome.RegistryEventType_Update
+			s.audit(peer, AuditUpdate, info.Id, before, info)
 		}
-		s.notifyEvent(event)
+		s.notifyEvent(peer.ID, event)
 
 	case ome.RegistryEventType_DeRegister.String():
+		before := s.index.lookup(peer.ID, msg.Id)
+		if before == nil {
+			log.Info("registry server • ignored deregistration of a service the peer did not register", log.Field("peer", peer.ID), log.Field("service", msg.Id))
+			return
+		}
+
+		done := s.storeOperation(ctx, "delete")
 		err := s.store.Delete(peer.ID, msg.Id)
+		done(err)
 		if err != nil {
 			log.Error("registry server • could not delete service info", log.Err(err), log.Field("service", msg.Id))
 			return
 		}
+		s.audit(peer, AuditDeregister, msg.Id, before, nil)
 
-		log.Info("registry server • "+msg.Type, log.Field("service", msg.Id))
-		s.notifyEvent(&ome.RegistryEvent{
-			Type:      ome.RegistryEventType_DeRegister,
-			ServiceId: msg.Id,
-		})
+		log.Info("registry server • "+msgType, log.Field("service", msg.Id))
+		s.announceRemoval(ctx, peer.ID, msg, before)
 
 	case ome.RegistryEventType_DeRegisterNode.String():
-
-		value, err := s.store.Get(peer.ID, msg.Id)
-		if err != nil {
-			log.Error("registry server • failed to read service info", log.Err(err), log.Field("service", msg.Id))
+		if s.index.lookup(peer.ID, msg.Id) == nil {
+			log.Info("registry server • ignored deregistration of a service the peer did not register", log.Field("peer", peer.ID), log.Field("service", msg.Id))
 			return
 		}
+		s.deregisterNodes(ctx, peer, peer.ID, msg.Id, strings.Split(string(msg.Encoded), "|"))
+		s.announceNodesRemoval(ctx, msg)
 
-		var info ome.ServiceInfo
-		err = json.Unmarshal([]byte(value), &info)
-		if err != nil {
-			log.Error("registry server • failed to decode service info", log.Err(err))
-			return
-		}
+	case msgAdminDeRegister:
+		s.handleAdminDeRegister(ctx, msg)
 
-		nodeId := string(msg.Encoded)
-		var newNodes []*ome.Node
-		for _, node := range info.Nodes {
-			if node.Id != nodeId {
-				newNodes = append(newNodes, node)
-			}
-		}
-		info.Nodes = newNodes
+	case msgListPeers:
+		s.sendPeers(ctx, msg.Id)
 
-		newEncoded, err := json.Marshal(&info)
-		if err != nil {
-			log.Error("registry server • failed to encode service info", log.Err(err))
-			return
-		}
+	case msgHello:
+		s.handleHello(ctx, msg)
 
-		entry := &bome.DoubleMapEntry{
-			FirstKey:  peer.ID,
-			SecondKey: msg.Id,
-			Value:     string(newEncoded),
-		}
-		err = s.store.Upsert(entry)
-		if err != nil {
-			log.Error("registry server • failed to update service info", log.Err(err), log.Field("service", msg.Id))
-			return
-		}
+	case msgPatch:
+		s.handlePatch(ctx, msg)
 
-		log.Info(msg.Type, log.Field("nodes", string(msg.Encoded)))
+	case msgResync:
+		s.handleResync(ctx, msg)
 
-		s.notifyEvent(&ome.RegistryEvent{
-			Type:      ome.RegistryEventType_Update,
-			ServiceId: info.Id,
-			Info:      &info,
-		})
+	case msgDrain:
+		s.handlePeerMigrated(peer)
 
 	default:
-		log.Info("registry server • received unsupported msg type", log.Field("type", msg.Type))
+		log.Info("registry server • received unsupported msg type", log.Field("type", msgType))
+		s.replyError(ctx, &protocolError{
+			Code:    errorUnsupportedMessage,
+			Type:    msgType,
+			Message: fmt.Sprintf("message type %q is not supported by protocol version %d", msgType, ProtocolVersion),
+		})
 	}
 }
 
-func (s *Server) RegisterService(info *ome.ServiceInfo) error {
-	encoded, err := json.Marshal(info)
-	if err != nil {
-		log.Error("registry server • failed to json encode info")
-		return err
+// announceRemoval tells the peers and the event handlers that removed, the registration of owner of the service of
+// the deregistration msg, was deleted. Peers only get msg if no other owner registers the service: they get the
+// remaining registration otherwise, so that they do not drop a service that is still registered
+func (s *Server) announceRemoval(ctx context.Context, owner string, msg *zebou.ZeMsg, removed *ome.ServiceInfo) {
+	remainingOwner, remaining := s.index.earliest(msg.Id)
+	if remaining == nil {
+		s.broadcast(ctx, msg)
+		s.notifyEvent(owner, &ome.RegistryEvent{
+			Type:      ome.RegistryEventType_DeRegister,
+			ServiceId: msg.Id,
+			Info:      removed,
+		})
+		return
 	}
+	s.announceRemaining(ctx, remainingOwner, remaining)
+}
+
+// announceNodesRemoval tells the peers that the nodes of the node deregistration msg were removed. Peers only get
+// msg if a single owner registers the service: they get its remaining registration otherwise
+func (s *Server) announceNodesRemoval(ctx context.Context, msg *zebou.ZeMsg) {
+	if len(s.index.peersOf(msg.Id)) <= 1 {
+		s.broadcast(ctx, msg)
+		return
+	}
+	if owner, remaining := s.index.earliest(msg.Id); remaining != nil {
+		s.announceRemaining(ctx, owner, remaining)
+	}
+}
 
-	err = s.store.Upsert(&bome.DoubleMapEntry{
-		FirstKey:  s.name,
-		SecondKey: info.Id,
-		Value:     string(encoded),
+// announceRemaining sends the registration of owner of a service that remains once another one was removed
+func (s *Server) announceRemaining(ctx context.Context, owner string, remaining *ome.ServiceInfo) {
+	encoded, err := json.Marshal(remaining)
+	if err != nil {
+		log.Error("registry server • failed to encode service info", log.Err(err))
+		return
+	}
+	s.broadcast(ctx, &zebou.ZeMsg{
+		Type:    ome.RegistryEventType_Update.String(),
+		Id:      remaining.Id,
+		Encoded: encoded,
+	})
+	s.notifyEvent(owner, &ome.RegistryEvent{
+		Type:      ome.RegistryEventType_Update,
+		ServiceId: remaining.Id,
+		Info:      remaining,
 	})
+}
+
+// deregisterNodes removes the nodes nodeIDs from the service id registered by owner, on behalf of peer
+func (s *Server) deregisterNodes(ctx context.Context, peer *zebou.PeerInfo, owner string, id string, nodeIDs []string) {
+	done := s.storeOperation(ctx, "get")
+	value, err := s.store.Get(owner, id)
+	done(err)
 	if err != nil {
-		return err
+		log.Error("registry server • failed to read service info", log.Err(err), log.Field("service", id))
+		return
 	}
 
-	msg := &zebou.ZeMsg{
-		Type:    ome.RegistryEventType_Register.String(),
-		Id:      info.Id,
-		Encoded: encoded,
+	var info ome.ServiceInfo
+	err = json.Unmarshal([]byte(value), &info)
+	if err != nil {
+		s.metrics.Add(MetricServerDecodeFailures, 1, map[string]string{"source": "store"})
+		log.Error("registry server • failed to decode service info", log.Err(err))
+		return
+	}
+
+	var before *ome.ServiceInfo
+	if s.auditEnabled() {
+		before = new(ome.ServiceInfo)
+		_ = json.Unmarshal([]byte(value), before)
+	}
+
+	var newNodes []*ome.Node
+	for _, node := range info.Nodes {
+		if !containsString(nodeIDs, node.Id) {
+			newNodes = append(newNodes, node)
+		}
+	}
+	info.Nodes = newNodes
+
+	newEncoded, err := json.Marshal(&info)
+	if err != nil {
+		log.Error("registry server • failed to encode service info", log.Err(err))
+		return
 	}
 
-	s.hub.Broadcast(context.Background(), msg)
-	s.notifyEvent(&ome.RegistryEvent{
-		Type:      ome.RegistryEventType_Register,
+	entry := &StoreEntry{
+		Peer:    owner,
+		Service: id,
+		Value:   string(newEncoded),
+	}
+	done = s.storeOperation(ctx, "upsert")
+	err = s.store.Upsert(entry)
+	done(err)
+	if err != nil {
+		log.Error("registry server • failed to update service info", log.Err(err), log.Field("service", id))
+		return
+	}
+
+	log.Info(ome.RegistryEventType_DeRegisterNode.String(), log.Field("nodes", nodeIDs))
+	s.audit(peer, AuditDeregisterNode, info.Id, before, &info, nodeIDs...)
+
+	s.notifyEvent(owner, &ome.RegistryEvent{
+		Type:      ome.RegistryEventType_Update,
 		ServiceId: info.Id,
-		Info:      info,
+		Info:      &info,
 	})
-	return nil
+}
+
+func (s *Server) RegisterService(info *ome.ServiceInfo) error {
+	return s.putOwnedService(s.name, info, ome.RegistryEventType_Register)
 }
 
 func (s *Server) DeregisterService(id string, nodes ...string) error {
@@ -305,6 +636,12 @@ func (s *Server) DeregisterService(id string, nodes ...string) error {
 			return err
 		}
 
+		var before *ome.ServiceInfo
+		if s.auditEnabled() {
+			before = new(ome.ServiceInfo)
+			_ = json.Unmarshal([]byte(encoded), before)
+		}
+
 		var newNodes []*ome.Node
 		for _, node := range info.Nodes {
 			deleted := true
@@ -327,10 +664,10 @@ func (s *Server) DeregisterService(id string, nodes ...string) error {
 			return err
 		}
 
-		err = s.store.Upsert(&bome.DoubleMapEntry{
-			FirstKey:  s.name,
-			SecondKey: id,
-			Value:     string(newEncodedBytes),
+		err = s.store.Upsert(&StoreEntry{
+			Peer:    s.name,
+			Service: id,
+			Value:   string(newEncodedBytes),
 		})
 		if err != nil {
 			return err
@@ -338,67 +675,38 @@ func (s *Server) DeregisterService(id string, nodes ...string) error {
 
 		msg.Encoded = []byte(strings.Join(nodes, "|"))
 		msg.Type = ome.RegistryEventType_DeRegisterNode.String()
-		s.hub.Broadcast(context.Background(), msg)
+		s.broadcast(context.Background(), msg)
+		s.audit(nil, AuditDeregisterNode, id, before, &info, nodes...)
 		ev := &ome.RegistryEvent{
 			Type:      ome.RegistryEventType_DeRegisterNode,
 			ServiceId: fmt.Sprintf("%s:%s", id, encoded),
 		}
-		s.notifyEvent(ev)
+		s.notifyEvent(s.name, ev)
 
 	} else {
-		err := s.store.Delete(s.name, id)
-		if err != nil {
-			return err
-		}
-
-		msg.Type = ome.RegistryEventType_DeRegister.String()
-		msg.Id = id
-
-		s.hub.Broadcast(context.Background(), msg)
-		ev := &ome.RegistryEvent{
-			Type:      ome.RegistryEventType_DeRegister,
-			ServiceId: id,
-		}
-		s.notifyEvent(ev)
+		return s.deleteOwnedService(s.name, id)
 	}
 	return nil
 }
 
+// GetService returns a copy of the earliest registered info with id
 func (s *Server) GetService(id string) (*ome.ServiceInfo, error) {
-	var info ome.ServiceInfo
-	c, err := s.store.GetForSecond(id)
-	if err != nil {
-		return nil, err
-	}
-
-	defer func() {
-		if err := c.Close(); err != nil {
-			log.Error("registry server • failed to close cursor", log.Err(err))
-		}
-	}()
-	if !c.HasNext() {
+	info := s.index.get(id)
+	if info == nil {
 		return nil, errors.NotFound
 	}
-
-	o, err := c.Next()
-	if err != nil {
-		return nil, err
-	}
-
-	entry := o.(*bome.MapEntry)
-	err = json.Unmarshal([]byte(entry.Value), &info)
-	return &info, err
+	return proto.Clone(info).(*ome.ServiceInfo), nil
 }
 
 func (s *Server) GetNode(id string, nodeName string) (*ome.Node, error) {
-	info, err := s.GetService(id)
-	if err != nil {
-		return nil, err
+	info := s.index.get(id)
+	if info == nil {
+		return nil, errors.NotFound
 	}
 
 	for _, node := range info.Nodes {
 		if node.Id == nodeName {
-			return node, nil
+			return proto.Clone(node).(*ome.Node), nil
 		}
 	}
 
@@ -406,9 +714,9 @@ func (s *Server) GetNode(id string, nodeName string) (*ome.Node, error) {
 }
 
 func (s *Server) Certificate(id string) ([]byte, error) {
-	info, err := s.GetService(id)
-	if err != nil {
-		return nil, err
+	info := s.index.get(id)
+	if info == nil {
+		return nil, errors.NotFound
 	}
 
 	strCert, found := info.Meta["certificate"]
@@ -419,9 +727,9 @@ func (s *Server) Certificate(id string) ([]byte, error) {
 }
 
 func (s *Server) ConnectionInfo(id string, protocol ome.Protocol) (*ome.ConnectionInfo, error) {
-	info, err := s.GetService(id)
-	if err != nil {
-		return nil, err
+	info := s.index.get(id)
+	if info == nil {
+		return nil, errors.NotFound
 	}
 
 	for _, n := range info.Nodes {
@@ -455,126 +763,317 @@ func (s *Server) DeregisterEventHandler(hid string) {
 }
 
 func (s *Server) GetOfType(t uint32) ([]*ome.ServiceInfo, error) {
-	var infoList []*ome.ServiceInfo
-	c, err := s.store.GetAll()
-	if err != nil {
-		return nil, err
+	return cloneServices(s.index.ofType(t)), nil
+}
+
+// Query returns copies of the services q selects, in registration order
+func (s *Server) Query(q *Query) ([]*ome.ServiceInfo, error) {
+	return cloneServices(s.index.query(q)), nil
+}
+
+func (s *Server) FirstOfType(t uint32) (*ome.ServiceInfo, error) {
+	info := s.index.firstOfType(t)
+	if info == nil {
+		return nil, errors.NotFound
 	}
+	return proto.Clone(info).(*ome.ServiceInfo), nil
+}
 
-	defer func() {
-		if err := c.Close(); err != nil {
-			log.Error("registry server • failed to close cursor", log.Err(err))
-		}
-	}()
+// cloneServices returns copies of infos, so that the infos the index shares are not exposed to callers
+func cloneServices(infos []*ome.ServiceInfo) []*ome.ServiceInfo {
+	if infos == nil {
+		return nil
+	}
+	clones := make([]*ome.ServiceInfo, len(infos))
+	for i, info := range infos {
+		clones[i] = proto.Clone(info).(*ome.ServiceInfo)
+	}
+	return clones
+}
 
-	for c.HasNext() {
-		o, err := c.Next()
-		if err != nil {
-			return infoList, err
+// Stop stops the server. Only the first call stops it, the next ones return the same error
+func (s *Server) Stop() error {
+	s.stopOnce.Do(func() {
+		s.stopErr = s.stop()
+	})
+	return s.stopErr
+}
+
+func (s *Server) stop() error {
+	if s.certificates != nil {
+		s.certificates.Stop()
+	}
+	if s.dns != nil {
+		if err := s.dns.Stop(); err != nil {
+			log.Error("registry server • failed to stop DNS server", log.Err(err))
+		}
+	}
+	if s.stopMetrics != nil {
+		close(s.stopMetrics)
+	}
+	close(s.stopRestore)
+	if s.stopStatic != nil {
+		close(s.stopStatic)
+	}
+	if s.stopSources != nil {
+		close(s.stopSources)
+	}
+	if s.stopSnapshots != nil {
+		close(s.stopSnapshots)
+		if err := s.snapshotToFile(s.snapshotFilename); err != nil {
+			log.Error("registry server • failed to write final snapshot", log.Err(err))
+		}
+	}
+	if s.metricsServer != nil {
+		if err := s.metricsServer.Close(); err != nil {
+			log.Error("registry server • failed to stop metrics server", log.Err(err))
+		}
+	}
+	if s.xds != nil {
+		if err := s.xds.Stop(); err != nil {
+			log.Error("registry server • failed to stop xDS server", log.Err(err))
+		}
+	}
+	if s.prometheusSD != nil {
+		if err := s.prometheusSD.Close(); err != nil {
+			log.Error("registry server • failed to stop prometheus service discovery server", log.Err(err))
+		}
+	}
+	// the hub stops the sessions of the connected peers without waiting for them: the peers are disconnected first
+	// so that their sessions are over when it is stopped
+	s.identities.closeConns()
+	s.waitPeersQuit(peersQuitTimeout)
+	_ = s.hub.Stop()
+	for _, mirror := range s.mirrors {
+		_ = mirror.Stop()
+	}
+	if s.webhooks != nil {
+		if err := s.webhooks.Stop(); err != nil {
+			log.Error("registry server • failed to stop webhooks", log.Err(err))
+		}
+	}
+	if s.auditSink != nil {
+		if err := s.auditSink.Close(); err != nil {
+			log.Error("registry server • failed to close audit sink", log.Err(err))
 		}
+	}
+	if err := s.store.Close(); err != nil {
+		log.Error("registry server • failed to close store", log.Err(err))
+	}
+	// the hub closes the listener when it is serving
+	if err := s.listener.Close(); err != nil && !isClosedConnError(err) {
+		return err
+	}
+	return nil
+}
 
-		entry := o.(*bome.DoubleMapEntry)
+// peersQuitTimeout is how long Stop waits for the disconnected peers to quit
+const peersQuitTimeout = 5 * time.Second
 
-		var info ome.ServiceInfo
-		err = json.Unmarshal([]byte(entry.Value), &info)
-		if err != nil {
-			return infoList, err
-		}
+// waitPeersQuit waits until the peers have quit, or timeout
+func (s *Server) waitPeersQuit(timeout time.Duration) {
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+	deadline := time.After(timeout)
 
-		if info.Type == t {
-			infoList = append(infoList, &info)
+	for s.sessionCount() > 0 {
+		select {
+		case <-deadline:
+			log.Info("registry server • peers still connected at stop", log.Field("count", s.sessionCount()))
+			return
+		case <-ticker.C:
 		}
 	}
-	return infoList, nil
 }
 
-func (s *Server) FirstOfType(t uint32) (*ome.ServiceInfo, error) {
-	c, err := s.store.GetAll()
-	if err != nil {
-		return nil, err
+// broadcast sends msg to all connected peers. The sent message carries the trace context of the broadcast span
+func (s *Server) broadcast(ctx context.Context, msg *zebou.ZeMsg) {
+	s.broadcastChange(ctx, msg, nil)
+}
+
+// broadcastChange sends patch to the peers that support patches and msg to the others. msg is sent to all the peers
+// if patch is nil
+func (s *Server) broadcastChange(ctx context.Context, msg *zebou.ZeMsg, patch *zebou.ZeMsg) {
+	ctx, span := s.tracer.Start(ctx, "discover.server.broadcast", trace.WithSpanKind(trace.SpanKindProducer))
+	defer span.End()
+	defer observeDuration(s.metrics, MetricServerBroadcastDuration, time.Now(), nil)
+
+	// trace headers are only sent to the peers that support tracing
+	plain, traced := injectTrace(ctx, nil, msg), injectTrace(ctx, s.propagator, msg)
+	var plainPatch, tracedPatch *zebou.ZeMsg
+	if patch != nil {
+		plainPatch, tracedPatch = injectTrace(ctx, nil, patch), injectTrace(ctx, s.propagator, patch)
 	}
-	defer func() {
-		if err := c.Close(); err != nil {
-			log.Error("failed to close cursor", log.Err(err))
-		}
-	}()
 
-	for c.HasNext() {
-		o, err := c.Next()
-		if err != nil {
-			return nil, err
+	encoded := map[string]*zebou.ZeMsg{}
+	s.peers.Range(func(key, value interface{}) bool {
+		session := value.(*peerSession)
+		codec := session.currentCodec()
+		tracing := session.supports(CapabilityTracing)
+
+		// patches hold no service info, they are the same whatever the codec
+		if patch != nil && session.supports(CapabilityPatch) {
+			out := plainPatch
+			if tracing {
+				out = tracedPatch
+			}
+			if err := session.deliver(out); err != nil {
+				log.Error("registry server • broadcast failed to send message to peer", log.Err(err), log.Field("peer", key))
+			}
+			return true
 		}
 
-		entry := o.(*bome.DoubleMapEntry)
-
-		var info ome.ServiceInfo
-		err = json.Unmarshal([]byte(entry.Value), &info)
-		if err != nil {
-			return nil, err
+		// the message is encoded once per codec and tracing support
+		in, variant := plain, codec.Name()
+		if tracing {
+			in, variant = traced, variant+"+tracing"
+		}
+		out, found := encoded[variant]
+		if !found {
+			var err error
+			out, err = encodeMessage(in, codec)
+			if err != nil {
+				log.Error("registry server • failed to encode message", log.Err(err), log.Field("codec", codec.Name()))
+				out = in
+			}
+			encoded[variant] = out
 		}
 
-		if info.Type == t {
-			return &info, nil
+		if err := session.deliver(out); err != nil {
+			log.Error("registry server • broadcast failed to send message to peer", log.Err(err), log.Field("peer", key))
 		}
-	}
-	return nil, errors.NotFound
+		return true
+	})
 }
 
-func (s *Server) Stop() error {
-	_ = s.hub.Stop()
-	return s.listener.Close()
+// storeOperation starts measuring a store operation. The returned function must be called with the operation result
+func (s *Server) storeOperation(ctx context.Context, operation string) func(error) {
+	_, span := s.tracer.Start(ctx, "discover.server.store", trace.WithAttributes(attribute.String("discover.store.operation", operation)))
+	start := time.Now()
+	return func(err error) {
+		observeDuration(s.metrics, MetricServerStoreDuration, start, map[string]string{"operation": operation})
+		endSpan(span, err)
+	}
 }
 
-func (s *Server) notifyEvent(e *ome.RegistryEvent) {
+// notifyEvent passes e, about the registration of owner, to the event handlers
+func (s *Server) notifyEvent(owner string, e *ome.RegistryEvent) {
+	s.metrics.Add(MetricServerEvents, 1, map[string]string{"type": e.Type.String()})
+
 	s.Lock()
 	defer s.Unlock()
 
 	for _, h := range s.handlers {
-		go h.Handle(e)
+		if _, ok := h.(inlineHandler); ok {
+			handleEvent(h, owner, e)
+			continue
+		}
+		go handleEvent(h, owner, e)
 	}
 }
 
+func handleEvent(h ome.EventHandler, owner string, e *ome.RegistryEvent) {
+	if owned, ok := h.(ownedEventHandler); ok {
+		owned.handleOwned(owner, e)
+		return
+	}
+	h.Handle(e)
+}
+
+// inlineHandler is implemented by the event handlers that must get the events in order. They are called with the
+// server locked, and must return quickly
+type inlineHandler interface {
+	inline()
+}
+
+// ownedEventHandler is implemented by the event handlers that track the registrations of each owner. They get the
+// events with the owner of the registration they are about, instead of Handle calls
+type ownedEventHandler interface {
+	handleOwned(owner string, e *ome.RegistryEvent)
+}
+
 func Serve(configs *ServerConfig) (*Server, error) {
 	s := new(Server)
-	var opts []net2.ListenOption
-
-	if configs.CertFilename != "" {
-		if configs.ClientCACertFilename != "" {
-			opts = append(opts, net2.WithTLSParams(configs.CertFilename, configs.KeyFilename, configs.ClientCACertFilename))
+	s.tracer = tracerFrom(configs.TracerProvider)
+	s.propagator = configs.Propagator
+	if s.propagator == nil {
+		s.propagator = defaultPropagator
+	}
+	s.metrics = configs.Metrics
+	if s.metrics == nil {
+		if configs.MetricsBindAddress != "" {
+			s.metrics = NewPrometheusMetrics()
 		} else {
-			opts = append(opts, net2.WithTLSParams(configs.CertFilename, configs.KeyFilename))
+			s.metrics = noopMetrics{}
 		}
 	}
 
 	s.name = configs.Name
-	var err error
-	s.listener, err = net2.Listen(configs.BindAddress, opts...)
-	if err != nil {
-		return nil, err
+	s.adminIdentities = configs.AdminIdentities
+
+	s.restoreGracePeriod = configs.RestoreGracePeriod
+	if s.restoreGracePeriod <= 0 {
+		s.restoreGracePeriod = defaultRestoreGracePeriod
 	}
+	s.stopRestore = make(chan struct{})
 
-	log.Info("[discovery] starting gRPC server", log.Field("at", s.listener.Addr()))
+	s.codecs = append([]string{CodecJSON}, configs.Codecs...)
+	if len(configs.Codecs) == 0 {
+		s.codecs = defaultCodecs
+	}
+	s.compressions = configs.Compressions
+	if len(configs.Compressions) == 0 {
+		s.compressions = defaultCompressions
+	}
+	if configs.DisableCompression {
+		s.compressions = nil
+	}
+	s.limits = limitsFrom(configs)
+	s.validators = configs.Validators
+	s.admissionHooks = configs.AdmissionHooks
+
+	var err error
+	if configs.CertFilename != "" {
+		s.certificates, err = NewCertificateReloader(configs.CertFilename, configs.KeyFilename, configs.ClientCACertFilename)
+		if err != nil {
+			return nil, err
+		}
+
+		address := configs.BindAddress
+		if address == "" {
+			address = ":"
+		}
+		s.listener, err = tls.Listen("tcp", address, s.certificates.ServerConfig())
+		if err != nil {
+			return nil, err
+		}
 
-	var filename string
-	if configs.StoreDir == "" {
-		filename = ":memory:"
+		interval := configs.TLSReloadInterval
+		if interval == 0 {
+			interval = defaultTLSReloadInterval
+		}
+		if interval > 0 {
+			go s.certificates.Watch(interval)
+		}
 	} else {
-		filename = filepath.Join(configs.StoreDir, "registry.db")
-	}
-	db, err := sql.Open("sqlite3", filename)
-	if err != nil {
-		log.Error("could not open registry database", log.Err(err))
-		return nil, err
+		s.listener, err = net2.Listen(configs.BindAddress)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	s.store, err = bome.Build().
-		SetConn(db).
-		SetDialect(bome.SQLite3).
-		SetTableName("registry").
-		DoubleMap()
+	s.identities = &identityListener{Listener: s.listener}
+	s.listener = s.identities
+
+	log.Info("[discovery] starting gRPC server", log.Field("at", s.listener.Addr()))
+
+	store, err := openStore(configs)
 	if err != nil {
+		log.Error("could not open registry store", log.Err(err))
 		return nil, err
 	}
+	s.index = newServiceIndex()
+	s.store = &indexedStore{Store: store, index: s.index}
 
 	err = s.store.Clear()
 	if err != nil {
@@ -582,6 +1081,15 @@ func Serve(configs *ServerConfig) (*Server, error) {
 		return nil, err
 	}
 
+	s.auditSink = configs.AuditSink
+	if s.auditSink == nil && configs.AuditLogFilename != "" {
+		s.auditSink, err = OpenAuditFile(configs.AuditLogFilename, configs.AuditLogMaxSize, configs.AuditLogMaxBackups)
+		if err != nil {
+			log.Error("could not open audit log", log.Err(err))
+			return nil, err
+		}
+	}
+
 	s.hub, err = zebou.Serve(s.listener, s)
 	if err != nil {
 		return nil, err
@@ -589,5 +1097,99 @@ func Serve(configs *ServerConfig) (*Server, error) {
 
 	s.handlers = map[string]ome.EventHandler{}
 
+	if configs.DNSBindAddress != "" {
+		s.dns, err = serveDNS(configs.DNSBindAddress, configs.DNSZone, s)
+		if err != nil {
+			_ = s.Stop()
+			return nil, err
+		}
+	}
+
+	if configs.PrometheusSDBindAddress != "" {
+		err = s.servePrometheusSD(configs.PrometheusSDBindAddress)
+		if err != nil {
+			_ = s.Stop()
+			return nil, err
+		}
+	}
+
+	if _, noop := s.metrics.(noopMetrics); !noop {
+		s.stopMetrics = make(chan struct{})
+		go s.refreshServiceMetrics()
+	}
+
+	if configs.MetricsBindAddress != "" {
+		handler, ok := s.metrics.(http.Handler)
+		if !ok {
+			_ = s.Stop()
+			return nil, errors.NotSupported
+		}
+
+		err = s.serveMetrics(configs.MetricsBindAddress, handler)
+		if err != nil {
+			_ = s.Stop()
+			return nil, err
+		}
+	}
+
+	if configs.SnapshotFilename != "" {
+		interval := configs.SnapshotInterval
+		if interval <= 0 {
+			interval = defaultSnapshotInterval
+		}
+		s.snapshotFilename = configs.SnapshotFilename
+		s.stopSnapshots = make(chan struct{})
+		go s.snapshotPeriodically(configs.SnapshotFilename, interval)
+	}
+
+	if len(configs.Webhooks) > 0 {
+		s.webhooks, err = startWebhooks(s, configs.Webhooks, configs.WebhookDeadLetterFilename)
+		if err != nil {
+			_ = s.Stop()
+			return nil, err
+		}
+	}
+
+	for _, sink := range configs.Sinks {
+		mirror, err := StartMirror(s, sink, MirrorConfig{ResyncInterval: configs.SinksResyncInterval})
+		if err != nil {
+			log.Error("could not mirror registry to sink", log.Err(err))
+			_ = s.Stop()
+			return nil, err
+		}
+		s.mirrors = append(s.mirrors, mirror)
+	}
+
+	if configs.StaticServicesDir != "" {
+		err = s.loadStaticServices(configs.StaticServicesDir)
+		if err != nil {
+			log.Error("could not load static services", log.Err(err))
+			_ = s.Stop()
+			return nil, err
+		}
+
+		interval := configs.StaticServicesInterval
+		if interval <= 0 {
+			interval = defaultStaticServicesInterval
+		}
+		s.stopStatic = make(chan struct{})
+		go s.watchStaticServices(configs.StaticServicesDir, interval)
+	}
+
+	if len(configs.Sources) > 0 {
+		if err = s.startSources(configs.Sources); err != nil {
+			_ = s.Stop()
+			return nil, err
+		}
+	}
+
+	if configs.XDSBindAddress != "" {
+		s.xds, err = serveXDS(s, configs.XDSBindAddress, configs.XDSClusterName)
+		if err != nil {
+			_ = s.Stop()
+			return nil, err
+		}
+	}
+
 	return s, nil
 }
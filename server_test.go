@@ -0,0 +1,273 @@
+package discover
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/omecodes/libome"
+)
+
+// startTestServer serves configs on a free local port
+func startTestServer(t *testing.T, configs *ServerConfig) *Server {
+	if configs.Name == "" {
+		configs.Name = "test"
+	}
+	configs.BindAddress = "127.0.0.1:0"
+
+	s, err := Serve(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// connectTestClient connects a client to s and waits for the registry content
+func connectTestClient(t *testing.T, s *Server, tlsConfig *tls.Config) *MsgClient {
+	c := NewZebouClient(s.listener.Addr().String(), tlsConfig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.WaitSynced(ctx); err != nil {
+		_ = c.Stop()
+		t.Fatal(err)
+	}
+	return c
+}
+
+// eventually fails t if cond does not hold within 5 seconds
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testService returns a service with one node listening at address
+func testService(id string, address string) *ome.ServiceInfo {
+	return &ome.ServiceInfo{Id: id, Nodes: []*ome.Node{{Id: "node", Address: address}}}
+}
+
+// metricValue returns the value of the series of the metric name with labels
+func metricValue(m *PrometheusMetrics, name string, labels map[string]string) float64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	family, found := m.families[name]
+	if !found {
+		return 0
+	}
+	if series, found := family.series[formatLabels(labels)]; found {
+		return series.value
+	}
+	return 0
+}
+
+func hasService(r ome.Registry, id string) bool {
+	_, err := r.GetService(id)
+	return err == nil
+}
+
+// waitHandled waits until s received count messages of type msgType and handled all the messages it received
+func waitHandled(t *testing.T, s *Server, metrics *PrometheusMetrics, msgType string, count float64) {
+	eventually(t, msgType+" messages", func() bool {
+		return metricValue(metrics, MetricServerMessages, map[string]string{"type": msgType}) >= count
+	})
+	s.handling.Lock()
+	s.handling.Unlock()
+}
+
+func TestDeregistrationIsLimitedToOwnServices(t *testing.T) {
+	metrics := NewPrometheusMetrics()
+	s := startTestServer(t, &ServerConfig{Metrics: metrics})
+	defer s.Stop()
+
+	owner := connectTestClient(t, s, nil)
+	defer owner.Stop()
+	other := connectTestClient(t, s, nil)
+	defer other.Stop()
+
+	if err := owner.RegisterService(testService("owned", "owner:1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := owner.RegisterService(testService("shared", "owner:2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterService(testService("server", "server:1")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "owner registrations", func() bool {
+		return hasService(s, "owned") && hasService(s, "shared") && hasService(other, "server")
+	})
+
+	if err := other.RegisterService(testService("shared", "other:2")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "other registration", func() bool {
+		return len(s.index.peersOf("shared")) == 2
+	})
+
+	for _, id := range []string{"owned", "server", "shared"} {
+		if err := other.DeregisterService(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := other.AdminDeregisterService("owned"); err != nil {
+		t.Fatal(err)
+	}
+	waitHandled(t, s, metrics, ome.RegistryEventType_DeRegister.String(), 3)
+	waitHandled(t, s, metrics, msgAdminDeRegister, 1)
+	eventually(t, "own deregistration", func() bool {
+		return len(s.index.peersOf("shared")) == 1
+	})
+
+	for _, id := range []string{"owned", "server", "shared"} {
+		if !hasService(s, id) {
+			t.Errorf("server lost %s", id)
+		}
+		if !hasService(owner, id) {
+			t.Errorf("clients were told %s was deregistered", id)
+		}
+	}
+	eventually(t, "remaining registration", func() bool {
+		shared, err := other.GetService("shared")
+		return err == nil && shared.Nodes[0].Address == "owner:2"
+	})
+}
+
+// testCertificate creates a certificate for cn signed by ca, or a self-signed CA certificate if ca is nil
+func testCertificate(t *testing.T, cn string, ca *x509.Certificate, caKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey, tls.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		ca, caKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func writePEM(t *testing.T, filename string, blockType string, bytes []byte) {
+	if err := ioutil.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: bytes}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdminDeregistration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discover-admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	metrics := NewPrometheusMetrics()
+	ca, caKey, _ := testCertificate(t, "ca", nil, nil)
+	serverCert, serverKey, _ := testCertificate(t, "server", ca, caKey)
+	writePEM(t, filepath.Join(dir, "ca.crt"), "CERTIFICATE", ca.Raw)
+	writePEM(t, filepath.Join(dir, "server.crt"), "CERTIFICATE", serverCert.Raw)
+	writePEM(t, filepath.Join(dir, "server.key"), "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(serverKey))
+
+	s := startTestServer(t, &ServerConfig{
+		CertFilename:         filepath.Join(dir, "server.crt"),
+		KeyFilename:          filepath.Join(dir, "server.key"),
+		ClientCACertFilename: filepath.Join(dir, "ca.crt"),
+		AdminIdentities:      []string{"ops"},
+		Metrics:              metrics,
+	})
+	defer s.Stop()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	connect := func(cn string) *MsgClient {
+		_, _, cert := testCertificate(t, cn, ca, caKey)
+		return connectTestClient(t, s, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{cert}})
+	}
+	app, user, ops := connect("app"), connect("user"), connect("ops")
+	defer app.Stop()
+	defer user.Stop()
+	defer ops.Stop()
+
+	if err := app.RegisterService(testService("app", "app:1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterService(testService("server", "server:1")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "registrations", func() bool {
+		return hasService(user, "app") && hasService(ops, "server")
+	})
+
+	if err := user.AdminDeregisterService("app"); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "rejection of the non admin", func() bool {
+		return metricValue(metrics, MetricServerRejections, map[string]string{"reason": rejectionAdmin}) == 1
+	})
+	if !hasService(s, "app") {
+		t.Fatal("a peer that is not an admin deregistered a service")
+	}
+
+	if err := ops.AdminDeregisterService("server"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ops.AdminDeregisterService("app"); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "admin deregistration", func() bool {
+		return !hasService(s, "app") && !hasService(user, "app")
+	})
+	if !hasService(s, "server") {
+		t.Error("admin deregistered a service of the server configuration")
+	}
+}
+
+func TestMessageMetricType(t *testing.T) {
+	for msgType, expected := range map[string]string{
+		"Register":          "Register",
+		msgAdminDeRegister:  msgAdminDeRegister,
+		"Register?x=1":      "unsupported",
+		"random-type-12345": "unsupported",
+		"":                  "unsupported",
+	} {
+		if label := messageMetricType(msgType); label != expected {
+			t.Errorf("type %q is counted as %q instead of %q", msgType, label, expected)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package discover
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/omecodes/common/errors"
+	"github.com/omecodes/common/utils/log"
+	"github.com/omecodes/libome"
+	"github.com/omecodes/zebou"
+)
+
+// SnapshotVersion is the version of the snapshot format written by Server.Snapshot
+const SnapshotVersion = 1
+
+const defaultSnapshotInterval = time.Minute * 5
+
+const defaultRestoreGracePeriod = time.Minute
+
+// snapshot is the serialized registry content. Checksum is the hex encoded SHA-256 of the JSON encoding of Entries
+type snapshot struct {
+	Version   int           `json:"version"`
+	Server    string        `json:"server"`
+	CreatedAt time.Time     `json:"created_at"`
+	Checksum  string        `json:"checksum"`
+	Entries   []*StoreEntry `json:"entries"`
+}
+
+func snapshotChecksum(entries []*StoreEntry) (string, error) {
+	encoded, err := json.Marshal(entries)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Snapshot writes the whole registry content to w
+func (s *Server) Snapshot(w io.Writer) error {
+	entries, err := s.storeEntries(context.Background())
+	if err != nil {
+		return err
+	}
+
+	snap := &snapshot{
+		Version:   SnapshotVersion,
+		Server:    s.name,
+		CreatedAt: time.Now(),
+		Entries:   entries,
+	}
+
+	snap.Checksum, err = snapshotChecksum(entries)
+	if err != nil {
+		return err
+	}
+
+	return json.NewEncoder(w).Encode(snap)
+}
+
+// Restore replaces the registry content with the snapshot read from r. Connected clients are sent the services that
+// were added, updated or removed by the restore. The services of the connected peers and of the server configuration
+// are left as they are. Restored services of peers that are not connected are removed after the restore grace period,
+// unless they were changed in the meantime
+func (s *Server) Restore(r io.Reader) error {
+	snap := new(snapshot)
+	if err := json.NewDecoder(r).Decode(snap); err != nil {
+		return err
+	}
+
+	if snap.Version != SnapshotVersion {
+		log.Error("registry server • unsupported snapshot version", log.Field("version", snap.Version))
+		return errors.NotSupported
+	}
+
+	checksum, err := snapshotChecksum(snap.Entries)
+	if err != nil {
+		return err
+	}
+	if checksum != snap.Checksum {
+		log.Error("registry server • snapshot checksum mismatch", log.Field("expected", snap.Checksum), log.Field("computed", checksum))
+		return errors.BadInput
+	}
+
+	restored := map[[2]string]*ome.ServiceInfo{}
+	for _, entry := range snap.Entries {
+		info := new(ome.ServiceInfo)
+		if err := json.Unmarshal([]byte(entry.Value), info); err != nil {
+			return err
+		}
+		restored[[2]string{entry.Peer, entry.Service}] = info
+	}
+
+	// no message is handled and no owned services are reconciled during the restore
+	s.handling.Lock()
+	defer s.handling.Unlock()
+
+	ctx := context.Background()
+	current, err := s.storeEntries(ctx)
+	if err != nil {
+		return err
+	}
+
+	previous := map[[2]string]string{}
+	for _, entry := range current {
+		previous[[2]string{entry.Peer, entry.Service}] = entry.Value
+	}
+
+	orphans := map[[2]string]string{}
+	for _, entry := range snap.Entries {
+		if s.keepsOnRestore(entry.Peer) {
+			continue
+		}
+
+		key := [2]string{entry.Peer, entry.Service}
+		orphans[key] = entry.Value
+		value, found := previous[key]
+		if found && value == entry.Value {
+			continue
+		}
+
+		done := s.storeOperation(ctx, "upsert")
+		err = s.store.Upsert(entry)
+		done(err)
+		if err != nil {
+			return err
+		}
+
+		eventType := ome.RegistryEventType_Register
+		var before *ome.ServiceInfo
+		if found {
+			eventType = ome.RegistryEventType_Update
+			before = new(ome.ServiceInfo)
+			_ = json.Unmarshal([]byte(value), before)
+		}
+
+		info := restored[key]
+		s.broadcast(ctx, &zebou.ZeMsg{
+			Type:    eventType.String(),
+			Id:      entry.Service,
+			Encoded: []byte(entry.Value),
+		})
+		s.audit(nil, AuditRestore, entry.Service, before, info)
+		s.notifyEvent(entry.Peer, &ome.RegistryEvent{
+			Type:      eventType,
+			ServiceId: entry.Service,
+			Info:      info,
+		})
+	}
+
+	// services are removed once the restored ones are stored, so that peers are only told a service is gone when no
+	// owner registers it anymore
+	for _, entry := range current {
+		key := [2]string{entry.Peer, entry.Service}
+		if _, found := restored[key]; found || s.keepsOnRestore(entry.Peer) {
+			continue
+		}
+
+		before := new(ome.ServiceInfo)
+		if err := json.Unmarshal([]byte(entry.Value), before); err != nil {
+			return err
+		}
+
+		done := s.storeOperation(ctx, "delete")
+		err = s.store.Delete(entry.Peer, entry.Service)
+		done(err)
+		if err != nil {
+			return err
+		}
+
+		s.audit(nil, AuditRestore, entry.Service, before, nil)
+		s.announceRemoval(ctx, entry.Peer, &zebou.ZeMsg{
+			Type: ome.RegistryEventType_DeRegister.String(),
+			Id:   entry.Service,
+		}, before)
+	}
+
+	if len(orphans) > 0 {
+		go s.expireRestored(orphans)
+	}
+
+	log.Info("registry server • restored snapshot", log.Field("entries", len(snap.Entries)), log.Field("created_at", snap.CreatedAt))
+	return nil
+}
+
+// keepsOnRestore reports whether the services of owner are left as they are by restores: the ones of the connected
+// peers and of the server configuration
+func (s *Server) keepsOnRestore(owner string) bool {
+	return s.isManagedOwner(owner) || s.session(owner) != nil
+}
+
+// expireRestored removes the restored entries of peers, that hold their restored value, once the restore grace
+// period elapsed. Peers get new ids when they reconnect, the restored services are kept meanwhile so that clients
+// do not see them disappear before they are registered again
+func (s *Server) expireRestored(entries map[[2]string]string) {
+	select {
+	case <-s.stopRestore:
+		return
+	case <-time.After(s.restoreGracePeriod):
+	}
+
+	s.handling.RLock()
+	defer s.handling.RUnlock()
+
+	ctx := context.Background()
+	for key, value := range entries {
+		owner, id := key[0], key[1]
+		if s.session(owner) != nil {
+			continue
+		}
+
+		done := s.storeOperation(ctx, "get")
+		current, err := s.store.Get(owner, id)
+		done(err)
+		if err != nil || current != value {
+			continue
+		}
+
+		before := new(ome.ServiceInfo)
+		if err := json.Unmarshal([]byte(value), before); err != nil {
+			continue
+		}
+
+		done = s.storeOperation(ctx, "delete")
+		err = s.store.Delete(owner, id)
+		done(err)
+		if err != nil {
+			log.Error("registry server • could not delete restored service", log.Err(err), log.Field("service", id))
+			continue
+		}
+
+		log.Info("registry server • expired restored service", log.Field("peer", owner), log.Field("service", id))
+		s.audit(nil, AuditDeregister, id, before, nil)
+		s.announceRemoval(ctx, owner, &zebou.ZeMsg{
+			Type: ome.RegistryEventType_DeRegister.String(),
+			Id:   id,
+		}, before)
+	}
+}
+
+// snapshotToFile writes a snapshot to a temporary file that is then renamed to filename,
+// so that filename always holds a complete snapshot
+func (s *Server) snapshotToFile(filename string) error {
+	file, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+
+	err = s.Snapshot(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), filename)
+}
+
+// snapshotPeriodically writes a snapshot to filename every interval until Stop is called
+func (s *Server) snapshotPeriodically(filename string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopSnapshots:
+			return
+		case <-ticker.C:
+			if err := s.snapshotToFile(filename); err != nil {
+				log.Error("registry server • periodic snapshot failed", log.Err(err), log.Field("file", filename))
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package discover
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	first := startTestServer(t, &ServerConfig{Name: "first"})
+	defer first.Stop()
+
+	client := connectTestClient(t, first, nil)
+	defer client.Stop()
+	for _, info := range []string{"app", "shared"} {
+		if err := client.RegisterService(testService(info, "first:1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := first.RegisterService(testService("server", "first:2")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "registrations", func() bool {
+		return hasService(first, "app") && hasService(first, "shared")
+	})
+
+	var snapshot bytes.Buffer
+	if err := first.Snapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	second := startTestServer(t, &ServerConfig{Name: "second", RestoreGracePeriod: 200 * time.Millisecond})
+	defer second.Stop()
+
+	live := connectTestClient(t, second, nil)
+	defer live.Stop()
+	for _, info := range []string{"live", "shared"} {
+		if err := live.RegisterService(testService(info, "second:1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := second.RegisterService(testService("own", "second:2")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "live registrations", func() bool {
+		return hasService(second, "live") && len(second.index.peersOf("shared")) == 1
+	})
+
+	if err := second.Restore(bytes.NewReader(snapshot.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"app", "server", "live", "own"} {
+		if !hasService(second, id) {
+			t.Errorf("%s is not registered after the restore", id)
+		}
+	}
+	if owners := second.index.peersOf("shared"); len(owners) != 2 {
+		t.Errorf("shared has %d owners after the restore", len(owners))
+	}
+	eventually(t, "restored services on the clients", func() bool {
+		return hasService(live, "app") && hasService(live, "server")
+	})
+
+	eventually(t, "expiration of the restored services", func() bool {
+		return !hasService(second, "app") && !hasService(second, "server") && !hasService(live, "app")
+	})
+	for _, id := range []string{"live", "own", "shared"} {
+		if !hasService(second, id) {
+			t.Errorf("%s expired with the restored services", id)
+		}
+	}
+	eventually(t, "remaining shared registration", func() bool {
+		shared, err := live.GetService("shared")
+		return err == nil && shared.Nodes[0].Address == "second:1"
+	})
+}
+
+func TestRestoreRejectsCorruptedSnapshot(t *testing.T) {
+	s := startTestServer(t, &ServerConfig{})
+	defer s.Stop()
+
+	if err := s.RegisterService(testService("server", "server:1")); err != nil {
+		t.Fatal(err)
+	}
+	var snapshot bytes.Buffer
+	if err := s.Snapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	corrupted := strings.Replace(snapshot.String(), "server:1", "server:2", 1)
+	if err := s.Restore(strings.NewReader(corrupted)); err == nil {
+		t.Error("restored a snapshot whose checksum does not match")
+	}
+}
+
+func TestServerStopsOnce(t *testing.T) {
+	s := startTestServer(t, &ServerConfig{RestoreGracePeriod: time.Hour})
+	if err := s.Shutdown(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	// a deferred Stop after Shutdown must not close the stop channels again
+	if err := s.Stop(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,330 @@
+package discover
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/omecodes/common/errors"
+	"github.com/omecodes/common/utils/log"
+	"github.com/omecodes/libome"
+	"github.com/omecodes/zebou"
+	"gopkg.in/yaml.v2"
+)
+
+// StaticServicesPeer is the owner of the services loaded from the static services directory
+const StaticServicesPeer = "static"
+
+const defaultStaticServicesInterval = time.Second * 5
+
+// ReadServicesFile reads a service or a list of services from a JSON or YAML file. Node protocols and security modes
+// can be given by name, e.g. "protocol: grpc"
+func ReadServicesFile(filename string) ([]*ome.ServiceInfo, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var document interface{}
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", errors.BadInput, filename, err)
+	}
+
+	var items []interface{}
+	if list, ok := document.([]interface{}); ok {
+		items = list
+	} else if document != nil {
+		items = []interface{}{document}
+	}
+
+	var services []*ome.ServiceInfo
+	for i, item := range items {
+		info, err := decodeServiceDocument(normalizeYAML(item))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: service %d: %v", errors.BadInput, filename, i, err)
+		}
+		if info.Id == "" {
+			return nil, fmt.Errorf("%w: %s: service %d has no id", errors.BadInput, filename, i)
+		}
+		services = append(services, info)
+	}
+	return services, nil
+}
+
+// normalizeYAML converts the maps decoded by the YAML parser into maps that can be encoded to JSON
+func normalizeYAML(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		result := map[string]interface{}{}
+		for key, item := range v {
+			result[fmt.Sprint(key)] = normalizeYAML(item)
+		}
+		return result
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeYAML(item)
+		}
+		return v
+	default:
+		return value
+	}
+}
+
+func decodeServiceDocument(document interface{}) (*ome.ServiceInfo, error) {
+	fields, ok := document.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("not an object")
+	}
+
+	if nodes, ok := fields["nodes"].([]interface{}); ok {
+		for _, item := range nodes {
+			node, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			if name, ok := node["protocol"].(string); ok {
+				value, found := enumValue(ome.Protocol_value, name)
+				if !found {
+					return nil, fmt.Errorf("unknown protocol %q", name)
+				}
+				node["protocol"] = value
+			}
+
+			if name, ok := node["security"].(string); ok {
+				value, found := enumValue(ome.Security_value, name)
+				if !found {
+					return nil, fmt.Errorf("unknown security %q", name)
+				}
+				node["security"] = value
+			}
+		}
+	}
+
+	encoded, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	info := new(ome.ServiceInfo)
+	return info, json.Unmarshal(encoded, info)
+}
+
+func enumValue(values map[string]int32, name string) (int32, bool) {
+	for key, value := range values {
+		if strings.EqualFold(key, name) {
+			return value, true
+		}
+	}
+	return 0, false
+}
+
+// staticServiceFiles returns the JSON and YAML files of dir with their modification time and size,
+// which changes whenever a file is added, removed or modified
+func staticServiceFiles(dir string) ([]string, string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var (
+		files       []string
+		fingerprint strings.Builder
+	)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".json", ".yaml", ".yml":
+			files = append(files, filepath.Join(dir, entry.Name()))
+			fmt.Fprintf(&fingerprint, "%s:%d:%d;", entry.Name(), entry.ModTime().UnixNano(), entry.Size())
+		}
+	}
+	sort.Strings(files)
+	return files, fingerprint.String(), nil
+}
+
+// readStaticServices reads the services defined in the files of dir, in file name order. A service id can only be defined once
+func readStaticServices(dir string) ([]*ome.ServiceInfo, string, error) {
+	files, fingerprint, err := staticServiceFiles(dir)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var services []*ome.ServiceInfo
+	definedIn := map[string]string{}
+	for _, filename := range files {
+		infos, err := ReadServicesFile(filename)
+		if err != nil {
+			return nil, "", err
+		}
+
+		for _, info := range infos {
+			if previous, found := definedIn[info.Id]; found {
+				return nil, "", fmt.Errorf("%w: service %s is defined in %s and %s", errors.BadInput, info.Id, previous, filename)
+			}
+			definedIn[info.Id] = filename
+			services = append(services, info)
+		}
+	}
+	return services, fingerprint, nil
+}
+
+// loadStaticServices registers the services defined in dir under StaticServicesPeer, updates those whose definition
+// changed and deregisters those that are no longer defined
+func (s *Server) loadStaticServices(dir string) error {
+	services, fingerprint, err := readStaticServices(dir)
+	if err != nil {
+		return err
+	}
+	s.staticFingerprint = fingerprint
+
+	if err := s.reconcileOwnedServices(StaticServicesPeer, services); err != nil {
+		return err
+	}
+
+	log.Info("registry server • loaded static services", log.Field("dir", dir), log.Field("count", len(services)))
+	return nil
+}
+
+// watchStaticServices reloads the static services every interval if the files of dir changed, until Stop is called.
+// Services are left as they are while the directory content is invalid
+func (s *Server) watchStaticServices(dir string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopStatic:
+			return
+		case <-ticker.C:
+			_, fingerprint, err := staticServiceFiles(dir)
+			if err != nil {
+				log.Error("registry server • could not read static services directory", log.Err(err), log.Field("dir", dir))
+				continue
+			}
+			if fingerprint == s.staticFingerprint {
+				continue
+			}
+			// an invalid content is reported once, not at every tick
+			s.staticFingerprint = fingerprint
+
+			if err := s.loadStaticServices(dir); err != nil {
+				log.Error("registry server • could not reload static services", log.Err(err), log.Field("dir", dir))
+			}
+		}
+	}
+}
+
+// reconcileOwnedServices registers services under owner, updates those that changed and deregisters the services
+// of owner that are not in services
+func (s *Server) reconcileOwnedServices(owner string, services []*ome.ServiceInfo) error {
+	s.handling.RLock()
+	defer s.handling.RUnlock()
+
+	defined := map[string]bool{}
+	for _, info := range services {
+		defined[info.Id] = true
+	}
+
+	for _, current := range s.index.forPeer(owner) {
+		if defined[current.Id] {
+			continue
+		}
+		if err := s.deleteOwnedService(owner, current.Id); err != nil {
+			return err
+		}
+	}
+
+	for _, info := range services {
+		var err error
+		current := s.index.lookup(owner, info.Id)
+		if current == nil {
+			err = s.putOwnedService(owner, info, ome.RegistryEventType_Register)
+		} else if !sameServiceInfo(current, info) {
+			err = s.putOwnedService(owner, info, ome.RegistryEventType_Update)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putOwnedService stores info as registered by owner and sends eventType to the clients
+func (s *Server) putOwnedService(owner string, info *ome.ServiceInfo, eventType ome.RegistryEventType) error {
+	if err := validateService(info, s.validators); err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(info)
+	if err != nil {
+		log.Error("registry server • failed to json encode info")
+		return err
+	}
+
+	before := s.storedService(owner, info.Id)
+
+	ctx := context.Background()
+	done := s.storeOperation(ctx, "upsert")
+	err = s.store.Upsert(&StoreEntry{
+		Peer:    owner,
+		Service: info.Id,
+		Value:   string(encoded),
+	})
+	done(err)
+	if err != nil {
+		return err
+	}
+
+	s.broadcastUpdate(ctx, &zebou.ZeMsg{
+		Type:    eventType.String(),
+		Id:      info.Id,
+		Encoded: encoded,
+	}, before, info)
+
+	action := AuditRegister
+	if eventType == ome.RegistryEventType_Update {
+		action = AuditUpdate
+	}
+	s.audit(nil, action, info.Id, before, info)
+	s.notifyEvent(owner, &ome.RegistryEvent{
+		Type:      eventType,
+		ServiceId: info.Id,
+		Info:      info,
+	})
+	return nil
+}
+
+// deleteOwnedService deletes the service id registered by owner and tells the clients it was removed
+func (s *Server) deleteOwnedService(owner string, id string) error {
+	before := s.storedService(owner, id)
+
+	ctx := context.Background()
+	done := s.storeOperation(ctx, "delete")
+	err := s.store.Delete(owner, id)
+	done(err)
+	if err != nil {
+		return err
+	}
+
+	s.audit(nil, AuditDeregister, id, before, nil)
+	s.announceRemoval(ctx, owner, &zebou.ZeMsg{
+		Type: ome.RegistryEventType_DeRegister.String(),
+		Id:   id,
+	}, before)
+	return nil
+}
+
+func sameServiceInfo(a, b *ome.ServiceInfo) bool {
+	encodedA, errA := json.Marshal(a)
+	encodedB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(encodedA) == string(encodedB)
+}
@@ -0,0 +1,239 @@
+package discover
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/omecodes/libome"
+)
+
+func TestReadServicesFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discover-static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name     string
+		filename string
+		content  string
+		ids      []string
+		protocol ome.Protocol
+		security ome.Security
+		err      string
+	}{
+		{
+			name:     "json service",
+			filename: "api.json",
+			content:  `{"id": "api", "nodes": [{"id": "a", "address": "10.0.0.1:80", "protocol": 2}]}`,
+			ids:      []string{"api"},
+			protocol: ome.Protocol_Http,
+		},
+		{
+			name:     "yaml list",
+			filename: "list.yaml",
+			content:  "- id: api\n- id: db\n",
+			ids:      []string{"api", "db"},
+		},
+		{
+			name:     "yaml enum names",
+			filename: "enums.yml",
+			content:  "id: api\nnodes:\n  - id: a\n    address: 10.0.0.1:80\n    protocol: grpc\n    security: MUTUALTLS\n",
+			ids:      []string{"api"},
+			protocol: ome.Protocol_Grpc,
+			security: ome.Security_MutualTls,
+		},
+		{
+			name:     "empty file",
+			filename: "empty.yaml",
+		},
+		{
+			name:     "unknown protocol",
+			filename: "protocol.yaml",
+			content:  "id: api\nnodes:\n  - id: a\n    protocol: ftp\n",
+			err:      `unknown protocol "ftp"`,
+		},
+		{
+			name:     "unknown security",
+			filename: "security.yaml",
+			content:  "id: api\nnodes:\n  - id: a\n    security: none\n",
+			err:      `unknown security "none"`,
+		},
+		{
+			name:     "missing id",
+			filename: "anonymous.yaml",
+			content:  "label: api\n",
+			err:      "has no id",
+		},
+		{
+			name:     "not an object",
+			filename: "scalar.yaml",
+			content:  "api\n",
+			err:      "not an object",
+		},
+		{
+			name:     "invalid yaml",
+			filename: "invalid.yaml",
+			content:  "id: [api\n",
+			err:      "bad input",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filename := filepath.Join(dir, test.filename)
+			if err := ioutil.WriteFile(filename, []byte(test.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			services, err := ReadServicesFile(filename)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var ids []string
+			for _, info := range services {
+				ids = append(ids, info.Id)
+			}
+			if strings.Join(ids, ",") != strings.Join(test.ids, ",") {
+				t.Fatalf("got services %v, expected %v", ids, test.ids)
+			}
+			if len(services) > 0 && len(services[0].Nodes) > 0 {
+				node := services[0].Nodes[0]
+				if node.Protocol != test.protocol || node.Security != test.security {
+					t.Errorf("got protocol %s and security %s", node.Protocol, node.Security)
+				}
+			}
+		})
+	}
+}
+
+// eventRecorder records the events of a server in notification order
+type eventRecorder struct {
+	mutex  sync.Mutex
+	events []string
+}
+
+func (r *eventRecorder) inline() {}
+
+func (r *eventRecorder) Handle(e *ome.RegistryEvent) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = append(r.events, e.Type.String()+" "+e.ServiceId)
+}
+
+func (r *eventRecorder) String() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return strings.Join(r.events, ", ")
+}
+
+func TestReconcileOwnedServices(t *testing.T) {
+	tests := []struct {
+		name     string
+		initial  []*ome.ServiceInfo
+		services []*ome.ServiceInfo
+		owned    []string
+		events   string
+		invalid  bool
+	}{
+		{
+			name:     "registers new services",
+			services: []*ome.ServiceInfo{testService("api", "10.0.0.1:80")},
+			owned:    []string{"api"},
+			events:   "Register api",
+		},
+		{
+			name:     "updates changed services",
+			initial:  []*ome.ServiceInfo{testService("api", "10.0.0.1:80")},
+			services: []*ome.ServiceInfo{testService("api", "10.0.0.2:80")},
+			owned:    []string{"api"},
+			events:   "Update api",
+		},
+		{
+			name:     "keeps unchanged services",
+			initial:  []*ome.ServiceInfo{testService("api", "10.0.0.1:80")},
+			services: []*ome.ServiceInfo{testService("api", "10.0.0.1:80")},
+			owned:    []string{"api"},
+		},
+		{
+			name:     "deregisters removed services",
+			initial:  []*ome.ServiceInfo{testService("api", "10.0.0.1:80"), testService("db", "10.0.0.3:5432")},
+			services: []*ome.ServiceInfo{testService("db", "10.0.0.3:5432")},
+			owned:    []string{"db"},
+			events:   "DeRegister api",
+		},
+		{
+			name:    "updates removed services a peer registers",
+			initial: []*ome.ServiceInfo{testService("shared", "10.0.0.1:80")},
+			events:  "Update shared",
+		},
+		{
+			name:     "rejects invalid services",
+			services: []*ome.ServiceInfo{{Id: "api", Nodes: []*ome.Node{{Id: "a"}}}},
+			invalid:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := startTestServer(t, &ServerConfig{})
+			defer s.Stop()
+
+			peer := connectTestClient(t, s, nil)
+			defer peer.Stop()
+			if err := peer.RegisterService(testService("shared", "10.0.0.9:80")); err != nil {
+				t.Fatal(err)
+			}
+			eventually(t, "peer registration", func() bool {
+				return hasService(s, "shared")
+			})
+
+			if err := s.reconcileOwnedServices(StaticServicesPeer, test.initial); err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := &eventRecorder{}
+			handlerID := s.RegisterEventHandler(recorder)
+			defer s.DeregisterEventHandler(handlerID)
+
+			err := s.reconcileOwnedServices(StaticServicesPeer, test.services)
+			if test.invalid {
+				if err == nil {
+					t.Error("reconciled an invalid service")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var owned []string
+			for _, info := range s.index.forPeer(StaticServicesPeer) {
+				owned = append(owned, info.Id)
+			}
+			sort.Strings(owned)
+			if strings.Join(owned, ",") != strings.Join(test.owned, ",") {
+				t.Errorf("owns %v, expected %v", owned, test.owned)
+			}
+			if events := recorder.String(); events != test.events {
+				t.Errorf("got events %q, expected %q", events, test.events)
+			}
+			if !hasService(s, "shared") {
+				t.Error("the service of the peer was deregistered")
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package discover
+
+import (
+	"path/filepath"
+	"sync"
+
+	"github.com/omecodes/common/errors"
+)
+
+// StoreBackend names a built-in registry storage
+type StoreBackend string
+
+const (
+	StoreMemory StoreBackend = "memory"
+	StoreSQLite StoreBackend = "sqlite"
+	StoreMySQL  StoreBackend = "mysql"
+)
+
+// StoreEntry is the encoded service info Value registered by the peer Peer under the service id Service
+type StoreEntry struct {
+	Peer    string `json:"peer"`
+	Service string `json:"service"`
+	Value   string `json:"value"`
+}
+
+// Store is the interface registry storage backends implement. Entries are identified by the (peer, service) pair
+type Store interface {
+	// Upsert creates entry or replaces the value of the entry that has the same peer and service
+	Upsert(entry *StoreEntry) error
+	// Get returns the value registered by peer for service. It returns errors.NotFound if there is none
+	Get(peer string, service string) (string, error)
+	// GetForPeer returns the entries registered by peer
+	GetForPeer(peer string) ([]*StoreEntry, error)
+	// GetForService returns the entries registered for service by any peer
+	GetForService(service string) ([]*StoreEntry, error)
+	// Delete deletes the entry registered by peer for service. Deleting a missing entry is not an error
+	Delete(peer string, service string) error
+	// DeleteForPeer deletes all the entries registered by peer
+	DeleteForPeer(peer string) error
+	// Range calls fn for every entry until fn returns false. fn must not call the store
+	Range(fn func(entry *StoreEntry) bool) error
+	// Clear deletes all the entries
+	Clear() error
+	// Close releases the store resources
+	Close() error
+}
+
+// openStore creates the registry store selected by configs
+func openStore(configs *ServerConfig) (Store, error) {
+	if configs.Store != nil {
+		return configs.Store, nil
+	}
+
+	backend := configs.StoreBackend
+	if backend == "" {
+		if configs.StoreDir != "" {
+			backend = StoreSQLite
+		} else {
+			backend = StoreMemory
+		}
+	}
+
+	switch backend {
+	case StoreMemory:
+		return NewMemoryStore(), nil
+
+	case StoreSQLite:
+		filename := ":memory:"
+		if configs.StoreDir != "" {
+			filename = filepath.Join(configs.StoreDir, "registry.db")
+		}
+		return NewSQLiteStore(filename)
+
+	case StoreMySQL:
+		return NewMySQLStore(configs.StoreDSN)
+
+	default:
+		return nil, errors.NotSupported
+	}
+}
+
+type memoryStore struct {
+	sync.RWMutex
+	entries map[string]map[string]string
+}
+
+// NewMemoryStore creates a store that keeps entries in memory
+func NewMemoryStore() Store {
+	return &memoryStore{entries: map[string]map[string]string{}}
+}
+
+func (m *memoryStore) Upsert(entry *StoreEntry) error {
+	m.Lock()
+	defer m.Unlock()
+
+	services, found := m.entries[entry.Peer]
+	if !found {
+		services = map[string]string{}
+		m.entries[entry.Peer] = services
+	}
+	services[entry.Service] = entry.Value
+	return nil
+}
+
+func (m *memoryStore) Get(peer string, service string) (string, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	value, found := m.entries[peer][service]
+	if !found {
+		return "", errors.NotFound
+	}
+	return value, nil
+}
+
+func (m *memoryStore) GetForPeer(peer string) ([]*StoreEntry, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	var entries []*StoreEntry
+	for service, value := range m.entries[peer] {
+		entries = append(entries, &StoreEntry{Peer: peer, Service: service, Value: value})
+	}
+	return entries, nil
+}
+
+func (m *memoryStore) GetForService(service string) ([]*StoreEntry, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	var entries []*StoreEntry
+	for peer, services := range m.entries {
+		if value, found := services[service]; found {
+			entries = append(entries, &StoreEntry{Peer: peer, Service: service, Value: value})
+		}
+	}
+	return entries, nil
+}
+
+func (m *memoryStore) Delete(peer string, service string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	services, found := m.entries[peer]
+	if !found {
+		return nil
+	}
+
+	delete(services, service)
+	if len(services) == 0 {
+		delete(m.entries, peer)
+	}
+	return nil
+}
+
+func (m *memoryStore) DeleteForPeer(peer string) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.entries, peer)
+	return nil
+}
+
+func (m *memoryStore) Range(fn func(entry *StoreEntry) bool) error {
+	m.RLock()
+	defer m.RUnlock()
+
+	for peer, services := range m.entries {
+		for service, value := range services {
+			if !fn(&StoreEntry{Peer: peer, Service: service, Value: value}) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) Clear() error {
+	m.Lock()
+	defer m.Unlock()
+	m.entries = map[string]map[string]string{}
+	return nil
+}
+
+func (m *memoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,154 @@
+package discover
+
+import (
+	"database/sql"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/omecodes/bome"
+	"github.com/omecodes/common/errors"
+	"github.com/omecodes/common/utils/log"
+)
+
+const storeTableName = "registry"
+
+// sqlStore is a Store backed by a bome double map: peer ids are the first keys and service ids the second keys
+type sqlStore struct {
+	entries *bome.DoubleMap
+}
+
+// NewSQLiteStore creates a store in the SQLite database at filename. An in-memory database is used if filename is ":memory:"
+func NewSQLiteStore(filename string) (Store, error) {
+	db, err := sql.Open(bome.SQLite3, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if filename == ":memory:" {
+		// every connection opens its own in-memory database
+		db.SetMaxOpenConns(1)
+	}
+	return newSQLStore(db, bome.SQLite3)
+}
+
+// NewMySQLStore creates a store in the MySQL database dsn points to, e.g. "user:password@tcp(localhost:3306)/discover"
+func NewMySQLStore(dsn string) (Store, error) {
+	db, err := sql.Open(bome.MySQL, dsn)
+	if err != nil {
+		return nil, err
+	}
+	return newSQLStore(db, bome.MySQL)
+}
+
+func newSQLStore(db *sql.DB, dialect string) (Store, error) {
+	entries, err := bome.Build().
+		SetConn(db).
+		SetDialect(dialect).
+		SetTableName(storeTableName).
+		DoubleMap()
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &sqlStore{entries: entries}, nil
+}
+
+func (s *sqlStore) Upsert(entry *StoreEntry) error {
+	return s.entries.Upsert(&bome.DoubleMapEntry{
+		FirstKey:  entry.Peer,
+		SecondKey: entry.Service,
+		Value:     entry.Value,
+	})
+}
+
+func (s *sqlStore) Get(peer string, service string) (string, error) {
+	value, err := s.entries.Get(peer, service)
+	if bome.IsNotFound(err) {
+		return "", errors.NotFound
+	}
+	return value, err
+}
+
+func (s *sqlStore) GetForPeer(peer string) ([]*StoreEntry, error) {
+	c, err := s.entries.GetForFirst(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	return readStoreEntries(c, func(o interface{}) *StoreEntry {
+		entry := o.(*bome.MapEntry)
+		return &StoreEntry{Peer: peer, Service: entry.Key, Value: entry.Value}
+	})
+}
+
+func (s *sqlStore) GetForService(service string) ([]*StoreEntry, error) {
+	c, err := s.entries.GetForSecond(service)
+	if err != nil {
+		return nil, err
+	}
+
+	return readStoreEntries(c, func(o interface{}) *StoreEntry {
+		entry := o.(*bome.MapEntry)
+		return &StoreEntry{Peer: entry.Key, Service: service, Value: entry.Value}
+	})
+}
+
+func (s *sqlStore) Delete(peer string, service string) error {
+	return s.entries.Delete(peer, service)
+}
+
+func (s *sqlStore) DeleteForPeer(peer string) error {
+	return s.entries.DeleteAllMatchingFirstKey(peer)
+}
+
+func (s *sqlStore) Range(fn func(entry *StoreEntry) bool) error {
+	c, err := s.entries.GetAll()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := c.Close(); err != nil {
+			log.Error("registry store • failed to close cursor", log.Err(err))
+		}
+	}()
+
+	for c.HasNext() {
+		o, err := c.Next()
+		if err != nil {
+			return err
+		}
+
+		entry := o.(*bome.DoubleMapEntry)
+		if !fn(&StoreEntry{Peer: entry.FirstKey, Service: entry.SecondKey, Value: entry.Value}) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) Clear() error {
+	return s.entries.Clear()
+}
+
+func (s *sqlStore) Close() error {
+	return s.entries.Close()
+}
+
+func readStoreEntries(c bome.Cursor, convert func(o interface{}) *StoreEntry) ([]*StoreEntry, error) {
+	defer func() {
+		if err := c.Close(); err != nil {
+			log.Error("registry store • failed to close cursor", log.Err(err))
+		}
+	}()
+
+	var entries []*StoreEntry
+	for c.HasNext() {
+		o, err := c.Next()
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, convert(o))
+	}
+	return entries, nil
+}
@@ -0,0 +1,55 @@
+package discover_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/omecodes/discover"
+	"github.com/omecodes/discover/storetest"
+)
+
+func TestMemoryStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) discover.Store {
+		return discover.NewMemoryStore()
+	})
+}
+
+func TestSQLiteStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) discover.Store {
+		store, err := discover.NewSQLiteStore(filepath.Join(t.TempDir(), "registry.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+}
+
+func TestSQLiteMemoryStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) discover.Store {
+		store, err := discover.NewSQLiteStore(":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+}
+
+// TestMySQLStore runs against the database DISCOVER_TEST_MYSQL_DSN points to
+func TestMySQLStore(t *testing.T) {
+	dsn := os.Getenv("DISCOVER_TEST_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("DISCOVER_TEST_MYSQL_DSN is not set")
+	}
+
+	storetest.Run(t, func(t *testing.T) discover.Store {
+		store, err := discover.NewMySQLStore(dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Clear(); err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+}
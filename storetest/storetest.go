@@ -0,0 +1,253 @@
+// Package storetest provides the conformance suite registry storage backends must pass
+package storetest
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/omecodes/common/errors"
+	"github.com/omecodes/discover"
+)
+
+// Run runs the conformance suite against the stores created by newStore. Every test gets its own empty store
+// that is closed when the test ends
+func Run(t *testing.T, newStore func(t *testing.T) discover.Store) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, store discover.Store)
+	}{
+		{"UpsertAndGet", testUpsertAndGet},
+		{"GetMissing", testGetMissing},
+		{"UpsertReplaces", testUpsertReplaces},
+		{"GetForPeer", testGetForPeer},
+		{"GetForService", testGetForService},
+		{"Delete", testDelete},
+		{"DeleteMissing", testDeleteMissing},
+		{"DeleteForPeer", testDeleteForPeer},
+		{"Range", testRange},
+		{"RangeStops", testRangeStops},
+		{"Clear", testClear},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			store := newStore(t)
+			defer func() {
+				if err := store.Close(); err != nil {
+					t.Errorf("close: %v", err)
+				}
+			}()
+			test.fn(t, store)
+		})
+	}
+}
+
+func upsert(t *testing.T, store discover.Store, entries ...*discover.StoreEntry) {
+	t.Helper()
+	for _, entry := range entries {
+		if err := store.Upsert(entry); err != nil {
+			t.Fatalf("upsert %s/%s: %v", entry.Peer, entry.Service, err)
+		}
+	}
+}
+
+func keys(entries []*discover.StoreEntry) []string {
+	var result []string
+	for _, entry := range entries {
+		result = append(result, entry.Peer+"/"+entry.Service+"="+entry.Value)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func expectEntries(t *testing.T, got []*discover.StoreEntry, want ...*discover.StoreEntry) {
+	t.Helper()
+	gotKeys, wantKeys := keys(got), keys(want)
+	if len(gotKeys) != len(wantKeys) {
+		t.Fatalf("got entries %v, want %v", gotKeys, wantKeys)
+	}
+	for i := range gotKeys {
+		if gotKeys[i] != wantKeys[i] {
+			t.Fatalf("got entries %v, want %v", gotKeys, wantKeys)
+		}
+	}
+}
+
+func all(t *testing.T, store discover.Store) []*discover.StoreEntry {
+	t.Helper()
+	var entries []*discover.StoreEntry
+	err := store.Range(func(entry *discover.StoreEntry) bool {
+		entries = append(entries, entry)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("range: %v", err)
+	}
+	return entries
+}
+
+func testUpsertAndGet(t *testing.T, store discover.Store) {
+	upsert(t, store, &discover.StoreEntry{Peer: "p1", Service: "s1", Value: `{"id":"s1"}`})
+
+	value, err := store.Get("p1", "s1")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if value != `{"id":"s1"}` {
+		t.Fatalf("got value %q", value)
+	}
+}
+
+func testGetMissing(t *testing.T, store discover.Store) {
+	upsert(t, store, &discover.StoreEntry{Peer: "p1", Service: "s1", Value: "v"})
+
+	for _, key := range [][2]string{{"p1", "s2"}, {"p2", "s1"}} {
+		if _, err := store.Get(key[0], key[1]); err == nil || !errors.IsNotFound(err) {
+			t.Fatalf("get %s/%s: got error %v, want not found", key[0], key[1], err)
+		}
+	}
+}
+
+func testUpsertReplaces(t *testing.T, store discover.Store) {
+	upsert(t, store,
+		&discover.StoreEntry{Peer: "p1", Service: "s1", Value: "v1"},
+		&discover.StoreEntry{Peer: "p1", Service: "s1", Value: "v2"},
+	)
+
+	value, err := store.Get("p1", "s1")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if value != "v2" {
+		t.Fatalf("got value %q, want v2", value)
+	}
+	expectEntries(t, all(t, store), &discover.StoreEntry{Peer: "p1", Service: "s1", Value: "v2"})
+}
+
+func testGetForPeer(t *testing.T, store discover.Store) {
+	upsert(t, store,
+		&discover.StoreEntry{Peer: "p1", Service: "s1", Value: "a"},
+		&discover.StoreEntry{Peer: "p1", Service: "s2", Value: "b"},
+		&discover.StoreEntry{Peer: "p2", Service: "s1", Value: "c"},
+	)
+
+	entries, err := store.GetForPeer("p1")
+	if err != nil {
+		t.Fatalf("get for peer: %v", err)
+	}
+	expectEntries(t, entries,
+		&discover.StoreEntry{Peer: "p1", Service: "s1", Value: "a"},
+		&discover.StoreEntry{Peer: "p1", Service: "s2", Value: "b"},
+	)
+
+	entries, err = store.GetForPeer("p3")
+	if err != nil {
+		t.Fatalf("get for unknown peer: %v", err)
+	}
+	expectEntries(t, entries)
+}
+
+func testGetForService(t *testing.T, store discover.Store) {
+	upsert(t, store,
+		&discover.StoreEntry{Peer: "p1", Service: "s1", Value: "a"},
+		&discover.StoreEntry{Peer: "p1", Service: "s2", Value: "b"},
+		&discover.StoreEntry{Peer: "p2", Service: "s1", Value: "c"},
+	)
+
+	entries, err := store.GetForService("s1")
+	if err != nil {
+		t.Fatalf("get for service: %v", err)
+	}
+	expectEntries(t, entries,
+		&discover.StoreEntry{Peer: "p1", Service: "s1", Value: "a"},
+		&discover.StoreEntry{Peer: "p2", Service: "s1", Value: "c"},
+	)
+
+	entries, err = store.GetForService("s3")
+	if err != nil {
+		t.Fatalf("get for unknown service: %v", err)
+	}
+	expectEntries(t, entries)
+}
+
+func testDelete(t *testing.T, store discover.Store) {
+	upsert(t, store,
+		&discover.StoreEntry{Peer: "p1", Service: "s1", Value: "a"},
+		&discover.StoreEntry{Peer: "p1", Service: "s2", Value: "b"},
+	)
+
+	if err := store.Delete("p1", "s1"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := store.Get("p1", "s1"); err == nil || !errors.IsNotFound(err) {
+		t.Fatalf("get deleted: got error %v, want not found", err)
+	}
+	expectEntries(t, all(t, store), &discover.StoreEntry{Peer: "p1", Service: "s2", Value: "b"})
+}
+
+func testDeleteMissing(t *testing.T, store discover.Store) {
+	if err := store.Delete("p1", "s1"); err != nil {
+		t.Fatalf("delete missing: %v", err)
+	}
+	if err := store.DeleteForPeer("p1"); err != nil {
+		t.Fatalf("delete for missing peer: %v", err)
+	}
+}
+
+func testDeleteForPeer(t *testing.T, store discover.Store) {
+	upsert(t, store,
+		&discover.StoreEntry{Peer: "p1", Service: "s1", Value: "a"},
+		&discover.StoreEntry{Peer: "p1", Service: "s2", Value: "b"},
+		&discover.StoreEntry{Peer: "p2", Service: "s1", Value: "c"},
+	)
+
+	if err := store.DeleteForPeer("p1"); err != nil {
+		t.Fatalf("delete for peer: %v", err)
+	}
+	expectEntries(t, all(t, store), &discover.StoreEntry{Peer: "p2", Service: "s1", Value: "c"})
+}
+
+func testRange(t *testing.T, store discover.Store) {
+	expectEntries(t, all(t, store))
+
+	entries := []*discover.StoreEntry{
+		{Peer: "p1", Service: "s1", Value: "a"},
+		{Peer: "p1", Service: "s2", Value: "b"},
+		{Peer: "p2", Service: "s1", Value: "c"},
+	}
+	upsert(t, store, entries...)
+	expectEntries(t, all(t, store), entries...)
+}
+
+func testRangeStops(t *testing.T, store discover.Store) {
+	upsert(t, store,
+		&discover.StoreEntry{Peer: "p1", Service: "s1", Value: "a"},
+		&discover.StoreEntry{Peer: "p1", Service: "s2", Value: "b"},
+		&discover.StoreEntry{Peer: "p2", Service: "s1", Value: "c"},
+	)
+
+	count := 0
+	err := store.Range(func(entry *discover.StoreEntry) bool {
+		count++
+		return false
+	})
+	if err != nil {
+		t.Fatalf("range: %v", err)
+	}
+	if count != 1 {
+		t.Fatalf("range called fn %d times after it returned false", count)
+	}
+}
+
+func testClear(t *testing.T, store discover.Store) {
+	upsert(t, store,
+		&discover.StoreEntry{Peer: "p1", Service: "s1", Value: "a"},
+		&discover.StoreEntry{Peer: "p2", Service: "s2", Value: "b"},
+	)
+
+	if err := store.Clear(); err != nil {
+		t.Fatalf("clear: %v", err)
+	}
+	expectEntries(t, all(t, store))
+}
@@ -0,0 +1,225 @@
+package discover
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/omecodes/common/errors"
+	"github.com/omecodes/common/utils/log"
+	"github.com/omecodes/libome/crypt"
+)
+
+const defaultTLSReloadInterval = time.Minute
+
+// CertificateReloader holds a certificate, its key and a CA bundle loaded from files, and reloads them when asked to
+// or when the files change. The TLS configurations it creates use the latest loaded files for every new handshake,
+// connections that are already established are not affected
+type CertificateReloader struct {
+	certFilename string
+	keyFilename  string
+	caFilename   string
+
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+	caPool      *x509.CertPool
+	fingerprint string
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewCertificateReloader loads the certificate and key files, and the CA bundle file if caFilename is not empty.
+// The certificate is optional for clients that only verify the server with the CA bundle
+func NewCertificateReloader(certFilename, keyFilename, caFilename string) (*CertificateReloader, error) {
+	r := &CertificateReloader{
+		certFilename: certFilename,
+		keyFilename:  keyFilename,
+		caFilename:   caFilename,
+		stop:         make(chan struct{}),
+	}
+	return r, r.Reload()
+}
+
+// Reload loads the files again. The previously loaded files remain in use if one of them cannot be loaded
+func (r *CertificateReloader) Reload() error {
+	fingerprint := r.filesFingerprint()
+
+	var certificate *tls.Certificate
+	if r.certFilename != "" {
+		cert, err := crypt.LoadCertificate(r.certFilename)
+		if err != nil {
+			return err
+		}
+
+		key, err := crypt.LoadPrivateKey(nil, r.keyFilename)
+		if err != nil {
+			return err
+		}
+
+		certificate = &tls.Certificate{
+			Certificate: [][]byte{cert.Raw},
+			PrivateKey:  key,
+			Leaf:        cert,
+		}
+	}
+
+	var caPool *x509.CertPool
+	if r.caFilename != "" {
+		content, err := ioutil.ReadFile(r.caFilename)
+		if err != nil {
+			return err
+		}
+
+		caPool = x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(content) {
+			return fmt.Errorf("%w: no certificate found in %s", errors.BadInput, r.caFilename)
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.certificate = certificate
+	r.caPool = caPool
+	r.fingerprint = fingerprint
+	return nil
+}
+
+// filesFingerprint returns a string that changes when one of the files is modified or replaced
+func (r *CertificateReloader) filesFingerprint() string {
+	fingerprint := ""
+	for _, filename := range []string{r.certFilename, r.keyFilename, r.caFilename} {
+		if filename == "" {
+			continue
+		}
+
+		info, err := os.Stat(filename)
+		if err != nil {
+			fingerprint += filename + ":missing;"
+			continue
+		}
+		fingerprint += fmt.Sprintf("%s:%d:%d;", filename, info.ModTime().UnixNano(), info.Size())
+	}
+	return fingerprint
+}
+
+// Watch reloads the files every interval if they changed, until Stop is called
+func (r *CertificateReloader) Watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			r.mutex.RLock()
+			changed := r.filesFingerprint() != r.fingerprint
+			r.mutex.RUnlock()
+			if !changed {
+				continue
+			}
+
+			// files are often replaced one after the other: a failed reload is retried at the next tick
+			if err := r.Reload(); err != nil {
+				log.Error("registry • could not reload certificates", log.Err(err), log.Field("cert", r.certFilename))
+				continue
+			}
+			log.Info("registry • reloaded certificates", log.Field("cert", r.certFilename), log.Field("ca", r.caFilename))
+		}
+	}
+}
+
+// Stop stops watching the files
+func (r *CertificateReloader) Stop() {
+	r.stopOnce.Do(func() {
+		close(r.stop)
+	})
+}
+
+func (r *CertificateReloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.certificate, r.caPool
+}
+
+// ServerConfig returns a server TLS configuration presenting the loaded certificate. Client certificates are verified
+// with the loaded CA bundle if there is one
+func (r *CertificateReloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			certificate, caPool := r.current()
+			if certificate == nil {
+				return nil, errors.NotFound
+			}
+
+			config := &tls.Config{Certificates: []tls.Certificate{*certificate}}
+			if caPool != nil {
+				config.ClientCAs = caPool
+				config.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+			return config, nil
+		},
+	}
+}
+
+// ClientConfig returns a client TLS configuration presenting the loaded certificate, if any, to the server. The server
+// certificate is verified for serverName with the loaded CA bundle, or with the system roots if there is none
+func (r *CertificateReloader) ClientConfig(serverName string) *tls.Config {
+	return &tls.Config{
+		ServerName: serverName,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			certificate, _ := r.current()
+			if certificate == nil {
+				return new(tls.Certificate), nil
+			}
+			return certificate, nil
+		},
+		// RootCAs cannot be replaced once the configuration is in use: the verification is done with the current pool
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			_, caPool := r.current()
+			return verifyCertificateChain(rawCerts, serverName, caPool)
+		},
+	}
+}
+
+func verifyCertificateChain(rawCerts [][]byte, serverName string, roots *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("%w: no server certificate", errors.Forbidden)
+	}
+
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+// ReloadTLS reloads the server certificate, key and client CA files. New connections use the reloaded files,
+// established sessions are kept
+func (s *Server) ReloadTLS() error {
+	if s.certificates == nil {
+		return errors.NotSupported
+	}
+	return s.certificates.Reload()
+}
@@ -0,0 +1,202 @@
+package discover
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeKeyPair writes cert and key to name.crt and name.key in dir
+func writeKeyPair(t *testing.T, dir string, name string, cert *x509.Certificate, key *rsa.PrivateKey) {
+	writePEM(t, filepath.Join(dir, name+".crt"), "CERTIFICATE", cert.Raw)
+	writePEM(t, filepath.Join(dir, name+".key"), "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))
+}
+
+// handshakeCommonName returns the common name of the certificate presented by the TLS server at address
+func handshakeCommonName(t *testing.T, address string, config *tls.Config) string {
+	conn, err := tls.Dial("tcp", address, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestServerCertificateRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discover-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey, _ := testCertificate(t, "ca", nil, nil)
+	cert, key, _ := testCertificate(t, "server-1", ca, caKey)
+	writePEM(t, filepath.Join(dir, "ca.crt"), "CERTIFICATE", ca.Raw)
+	writeKeyPair(t, dir, "server", cert, key)
+
+	metrics := NewPrometheusMetrics()
+	s := startTestServer(t, &ServerConfig{
+		CertFilename:      filepath.Join(dir, "server.crt"),
+		KeyFilename:       filepath.Join(dir, "server.key"),
+		TLSReloadInterval: 10 * time.Millisecond,
+		Metrics:           metrics,
+	})
+	defer s.Stop()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	tlsConfig := &tls.Config{RootCAs: roots}
+	address := s.listener.Addr().String()
+
+	c := connectTestClient(t, s, tlsConfig)
+	defer c.Stop()
+	if cn := handshakeCommonName(t, address, tlsConfig); cn != "server-1" {
+		t.Fatalf("got certificate %q, want server-1", cn)
+	}
+
+	cert, key, _ = testCertificate(t, "server-2", ca, caKey)
+	writeKeyPair(t, dir, "server", cert, key)
+	eventually(t, "rotated certificate", func() bool {
+		return handshakeCommonName(t, address, tlsConfig) == "server-2"
+	})
+
+	// the session established with the previous certificate is still in use
+	if err := c.RegisterService(testService("a", "10.0.0.1:80")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "registration", func() bool { return hasService(s, "a") })
+	if connections := metricValue(metrics, MetricServerPeerConnections, nil); connections != 1 {
+		t.Errorf("got %v connections, want 1", connections)
+	}
+
+	other := connectTestClient(t, s, tlsConfig)
+	defer other.Stop()
+	eventually(t, "registry content", func() bool { return hasService(other, "a") })
+
+	// a failed reload keeps the loaded certificate
+	if err := ioutil.WriteFile(filepath.Join(dir, "server.key"), []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ReloadTLS(); err == nil {
+		t.Error("expected the invalid key to fail the reload")
+	}
+	if cn := handshakeCommonName(t, address, tlsConfig); cn != "server-2" {
+		t.Errorf("got certificate %q after a failed reload, want server-2", cn)
+	}
+}
+
+func TestClientCertificateRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discover-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey, _ := testCertificate(t, "ca", nil, nil)
+	writePEM(t, filepath.Join(dir, "ca.crt"), "CERTIFICATE", ca.Raw)
+	serverCert, serverKey, _ := testCertificate(t, "server", ca, caKey)
+	writeKeyPair(t, dir, "server", serverCert, serverKey)
+	cert, key, _ := testCertificate(t, "client-1", ca, caKey)
+	writeKeyPair(t, dir, "client", cert, key)
+
+	server, err := NewCertificateReloader(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewCertificateReloader(filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key"), filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", server.ServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// the server answers each connection with the common name of the client certificate
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn *tls.Conn) {
+				defer conn.Close()
+				if err := conn.Handshake(); err != nil {
+					return
+				}
+				for {
+					buf := make([]byte, 1)
+					if _, err := conn.Read(buf); err != nil {
+						return
+					}
+					cn := "none"
+					if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+						cn = certs[0].Subject.CommonName
+					}
+					if _, err := conn.Write([]byte(cn + "\n")); err != nil {
+						return
+					}
+				}
+			}(conn.(*tls.Conn))
+		}
+	}()
+
+	presented := func(conn net.Conn) string {
+		if _, err := conn.Write([]byte{0}); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 64)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n-1])
+	}
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	address := net.JoinHostPort("127.0.0.1", port)
+	established, err := tls.Dial("tcp", address, client.ClientConfig("127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer established.Close()
+	if cn := presented(established); cn != "client-1" {
+		t.Fatalf("got client certificate %q, want client-1", cn)
+	}
+
+	cert, key, _ = testCertificate(t, "client-2", ca, caKey)
+	writeKeyPair(t, dir, "client", cert, key)
+	go client.Watch(10 * time.Millisecond)
+	defer client.Stop()
+
+	eventually(t, "rotated client certificate", func() bool {
+		conn, err := tls.Dial("tcp", address, client.ClientConfig("127.0.0.1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return presented(conn) == "client-2"
+	})
+	if cn := presented(established); cn != "client-1" {
+		t.Errorf("established connection got client certificate %q, want client-1", cn)
+	}
+
+	// the server certificate is verified with the loaded CA bundle
+	other, _, _ := testCertificate(t, "other-ca", nil, nil)
+	writePEM(t, filepath.Join(dir, "ca.crt"), "CERTIFICATE", other.Raw)
+	if err := client.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := tls.Dial("tcp", address, client.ClientConfig("127.0.0.1")); err == nil {
+		conn.Close()
+		t.Error("expected the server certificate to fail the verification with another CA")
+	}
+}
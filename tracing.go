@@ -0,0 +1,98 @@
+package discover
+
+import (
+	"context"
+	"net/url"
+	"strings"
+
+	"github.com/omecodes/zebou"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/omecodes/discover"
+
+// msgCarrier carries propagation headers inside a zebou message. As ZeMsg has no header field, headers are
+// appended to the message type as a URL query, e.g. "Register?traceparent=00-...". Trace headers are only sent to
+// peers that negotiated CapabilityTracing, use messageType to read the type of messages that may carry headers
+type msgCarrier struct {
+	msg *zebou.ZeMsg
+}
+
+func (c msgCarrier) Get(key string) string {
+	return messageHeaders(c.msg).Get(key)
+}
+
+func (c msgCarrier) Set(key string, value string) {
+	headers := messageHeaders(c.msg)
+	headers.Set(key, value)
+	c.msg.Type = messageType(c.msg) + "?" + headers.Encode()
+}
+
+func (c msgCarrier) Keys() []string {
+	var keys []string
+	for key := range messageHeaders(c.msg) {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// messageType returns the type of msg without the propagation headers
+func messageType(msg *zebou.ZeMsg) string {
+	if i := strings.Index(msg.Type, "?"); i >= 0 {
+		return msg.Type[:i]
+	}
+	return msg.Type
+}
+
+func messageHeaders(msg *zebou.ZeMsg) url.Values {
+	i := strings.Index(msg.Type, "?")
+	if i < 0 {
+		return url.Values{}
+	}
+
+	headers, err := url.ParseQuery(msg.Type[i+1:])
+	if err != nil {
+		return url.Values{}
+	}
+	return headers
+}
+
+// defaultPropagator propagates the trace context to the peers when none is configured
+var defaultPropagator propagation.TextMapPropagator = propagation.TraceContext{}
+
+// injectTrace returns a copy of msg that carries the trace context of ctx in place of the one msg may carry. The copy
+// carries no trace context if propagator is nil
+func injectTrace(ctx context.Context, propagator propagation.TextMapPropagator, msg *zebou.ZeMsg) *zebou.ZeMsg {
+	out := &zebou.ZeMsg{
+		Type:    messageType(msg),
+		Id:      msg.Id,
+		Encoded: msg.Encoded,
+	}
+	if propagator != nil {
+		propagator.Inject(ctx, msgCarrier{msg: out})
+	}
+	return out
+}
+
+// extractTrace returns a copy of ctx that holds the trace context carried by msg
+func extractTrace(ctx context.Context, propagator propagation.TextMapPropagator, msg *zebou.ZeMsg) context.Context {
+	return propagator.Extract(ctx, msgCarrier{msg: msg})
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func tracerFrom(provider trace.TracerProvider) trace.Tracer {
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	return provider.Tracer(tracerName)
+}
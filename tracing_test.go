@@ -0,0 +1,37 @@
+package discover
+
+import (
+	"context"
+	"testing"
+
+	"github.com/omecodes/zebou"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestInjectTrace(t *testing.T) {
+	spanContext := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{2},
+		TraceFlags: trace.FlagsSampled,
+	})
+	ctx := trace.ContextWithSpanContext(context.Background(), spanContext)
+	msg := &zebou.ZeMsg{Type: "Register?traceparent=previous", Id: "service"}
+
+	plain := injectTrace(ctx, nil, msg)
+	if plain.Type != "Register" {
+		t.Errorf("message without propagator has type %q", plain.Type)
+	}
+
+	traced := injectTrace(ctx, defaultPropagator, msg)
+	if messageType(traced) != "Register" || messageHeaders(traced).Get("traceparent") == "previous" {
+		t.Fatalf("traced message has type %q", traced.Type)
+	}
+
+	extracted := trace.SpanContextFromContext(extractTrace(context.Background(), defaultPropagator, traced))
+	if extracted.TraceID() != spanContext.TraceID() || extracted.SpanID() != spanContext.SpanID() {
+		t.Errorf("extracted span context %v, expected %v", extracted, spanContext)
+	}
+	if msg.Type != "Register?traceparent=previous" {
+		t.Error("injection changed the original message")
+	}
+}
@@ -0,0 +1,105 @@
+package discover
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/omecodes/common/errors"
+	"github.com/omecodes/libome"
+)
+
+// errorInvalidService is the code of the protocol error reported to peers whose registration is not valid
+const errorInvalidService = "invalid_service"
+
+// rejectionInvalid is the reason counted by MetricServerRejections for invalid registrations
+const rejectionInvalid = "invalid"
+
+// Validator checks the info of a service before it is registered
+type Validator interface {
+	Validate(info *ome.ServiceInfo) error
+}
+
+// ValidatorFunc is a function that implements Validator
+type ValidatorFunc func(info *ome.ServiceInfo) error
+
+func (f ValidatorFunc) Validate(info *ome.ServiceInfo) error {
+	return f(info)
+}
+
+// ValidateService applies the built-in rules to info: the service and its nodes have ids, node ids are unique,
+// node addresses are host:port pairs, protocols and security modes are known, and the certificate in meta, if any,
+// is a PEM encoded X.509 certificate
+func ValidateService(info *ome.ServiceInfo) error {
+	if info == nil {
+		return fmt.Errorf("%w: missing service info", errors.BadInput)
+	}
+	if info.Id == "" {
+		return fmt.Errorf("%w: service has no id", errors.BadInput)
+	}
+
+	ids := map[string]bool{}
+	for _, node := range info.Nodes {
+		if node == nil || node.Id == "" {
+			return fmt.Errorf("%w: service %q has a node without id", errors.BadInput, info.Id)
+		}
+		if ids[node.Id] {
+			return fmt.Errorf("%w: service %q has several nodes %q", errors.BadInput, info.Id, node.Id)
+		}
+		ids[node.Id] = true
+
+		if err := validateAddress(node.Address); err != nil {
+			return fmt.Errorf("%w: node %q of service %q: %s", errors.BadInput, node.Id, info.Id, err)
+		}
+		if _, known := ome.Protocol_name[int32(node.Protocol)]; !known {
+			return fmt.Errorf("%w: node %q of service %q has unknown protocol %d", errors.BadInput, node.Id, info.Id, node.Protocol)
+		}
+		if _, known := ome.Security_name[int32(node.Security)]; !known {
+			return fmt.Errorf("%w: node %q of service %q has unknown security %d", errors.BadInput, node.Id, info.Id, node.Security)
+		}
+	}
+
+	if encoded, found := info.Meta[ome.MetaServiceCertificate]; found {
+		block, _ := pem.Decode([]byte(encoded))
+		if block == nil || block.Type != "CERTIFICATE" {
+			return fmt.Errorf("%w: certificate of service %q is not PEM encoded", errors.BadInput, info.Id)
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return fmt.Errorf("%w: certificate of service %q: %s", errors.BadInput, info.Id, err)
+		}
+	}
+	return nil
+}
+
+func validateAddress(address string) error {
+	if address == "" {
+		return fmt.Errorf("no address")
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("address %q has no host", address)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return fmt.Errorf("address %q has an invalid port", address)
+	}
+	return nil
+}
+
+// validateService applies the built-in rules then validators to info
+func validateService(info *ome.ServiceInfo, validators []Validator) error {
+	if err := ValidateService(info); err != nil {
+		return err
+	}
+	for _, v := range validators {
+		if err := v.Validate(info); err != nil {
+			return fmt.Errorf("%w: %s", errors.BadInput, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package discover
+
+import (
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/omecodes/common/errors"
+	"github.com/omecodes/libome"
+)
+
+func TestValidateService(t *testing.T) {
+	cert, _, _ := testCertificate(t, "api", nil, nil)
+	certificate := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+
+	node := func(id string, address string) *ome.Node {
+		return &ome.Node{Id: id, Address: address, Protocol: ome.Protocol_Grpc}
+	}
+
+	tests := []struct {
+		name string
+		info *ome.ServiceInfo
+		err  string
+	}{
+		{
+			name: "valid service",
+			info: &ome.ServiceInfo{Id: "api", Nodes: []*ome.Node{node("a", "10.0.0.1:80"), node("b", "[::1]:443"), node("c", "api.local:8080")}},
+		},
+		{
+			name: "service without nodes",
+			info: &ome.ServiceInfo{Id: "api"},
+		},
+		{
+			name: "valid certificate",
+			info: &ome.ServiceInfo{Id: "api", Meta: map[string]string{ome.MetaServiceCertificate: certificate}},
+		},
+		{
+			name: "missing info",
+			err:  "missing service info",
+		},
+		{
+			name: "missing id",
+			info: &ome.ServiceInfo{Nodes: []*ome.Node{node("a", "10.0.0.1:80")}},
+			err:  "service has no id",
+		},
+		{
+			name: "nil node",
+			info: &ome.ServiceInfo{Id: "api", Nodes: []*ome.Node{nil}},
+			err:  "node without id",
+		},
+		{
+			name: "node without id",
+			info: &ome.ServiceInfo{Id: "api", Nodes: []*ome.Node{node("", "10.0.0.1:80")}},
+			err:  "node without id",
+		},
+		{
+			name: "duplicate nodes",
+			info: &ome.ServiceInfo{Id: "api", Nodes: []*ome.Node{node("a", "10.0.0.1:80"), node("a", "10.0.0.2:80")}},
+			err:  `several nodes "a"`,
+		},
+		{
+			name: "missing address",
+			info: &ome.ServiceInfo{Id: "api", Nodes: []*ome.Node{node("a", "")}},
+			err:  "no address",
+		},
+		{
+			name: "address without port",
+			info: &ome.ServiceInfo{Id: "api", Nodes: []*ome.Node{node("a", "10.0.0.1")}},
+			err:  "missing port",
+		},
+		{
+			name: "address without host",
+			info: &ome.ServiceInfo{Id: "api", Nodes: []*ome.Node{node("a", ":80")}},
+			err:  "has no host",
+		},
+		{
+			name: "zero port",
+			info: &ome.ServiceInfo{Id: "api", Nodes: []*ome.Node{node("a", "10.0.0.1:0")}},
+			err:  "invalid port",
+		},
+		{
+			name: "port out of range",
+			info: &ome.ServiceInfo{Id: "api", Nodes: []*ome.Node{node("a", "10.0.0.1:65536")}},
+			err:  "invalid port",
+		},
+		{
+			name: "named port",
+			info: &ome.ServiceInfo{Id: "api", Nodes: []*ome.Node{node("a", "10.0.0.1:http")}},
+			err:  "invalid port",
+		},
+		{
+			name: "unknown protocol",
+			info: &ome.ServiceInfo{Id: "api", Nodes: []*ome.Node{{Id: "a", Address: "10.0.0.1:80", Protocol: 99}}},
+			err:  "unknown protocol 99",
+		},
+		{
+			name: "unknown security",
+			info: &ome.ServiceInfo{Id: "api", Nodes: []*ome.Node{{Id: "a", Address: "10.0.0.1:80", Security: 99}}},
+			err:  "unknown security 99",
+		},
+		{
+			name: "certificate not PEM encoded",
+			info: &ome.ServiceInfo{Id: "api", Meta: map[string]string{ome.MetaServiceCertificate: "certificate"}},
+			err:  "is not PEM encoded",
+		},
+		{
+			name: "PEM block of another type",
+			info: &ome.ServiceInfo{Id: "api", Meta: map[string]string{
+				ome.MetaServiceCertificate: string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: cert.Raw})),
+			}},
+			err: "is not PEM encoded",
+		},
+		{
+			name: "invalid certificate",
+			info: &ome.ServiceInfo{Id: "api", Meta: map[string]string{
+				ome.MetaServiceCertificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("not a certificate")})),
+			}},
+			err: `certificate of service "api"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ValidateService(test.info)
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("got error %v, expected %q", err, test.err)
+			}
+			if !strings.HasPrefix(err.Error(), errors.BadInput.Error()) {
+				t.Errorf("error %v does not wrap BadInput", err)
+			}
+		})
+	}
+}
+
+func TestValidateServiceWithValidators(t *testing.T) {
+	var validated []string
+	validators := []Validator{
+		ValidatorFunc(func(info *ome.ServiceInfo) error {
+			validated = append(validated, "label")
+			if info.Label == "" {
+				return fmt.Errorf("service %q has no label", info.Id)
+			}
+			return nil
+		}),
+		ValidatorFunc(func(info *ome.ServiceInfo) error {
+			validated = append(validated, "type")
+			return nil
+		}),
+	}
+
+	if err := validateService(&ome.ServiceInfo{}, validators); err == nil || len(validated) != 0 {
+		t.Errorf("validators ran on a service the built-in rules reject: %v", validated)
+	}
+
+	err := validateService(&ome.ServiceInfo{Id: "api"}, validators)
+	if err == nil || !strings.HasPrefix(err.Error(), errors.BadInput.Error()) || !strings.Contains(err.Error(), "has no label") {
+		t.Errorf("got error %v", err)
+	}
+	if strings.Join(validated, ",") != "label" {
+		t.Errorf("validators %v ran", validated)
+	}
+
+	validated = nil
+	if err := validateService(&ome.ServiceInfo{Id: "api", Label: "api"}, validators); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(validated, ",") != "label,type" {
+		t.Errorf("validators %v ran", validated)
+	}
+}
@@ -0,0 +1,407 @@
+package discover
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/omecodes/common/errors"
+	"github.com/omecodes/common/utils/log"
+	"github.com/omecodes/libome"
+)
+
+// Headers of the webhook deliveries
+const (
+	WebhookHeaderEvent     = "X-Discover-Event"
+	WebhookHeaderDelivery  = "X-Discover-Delivery"
+	WebhookHeaderSignature = "X-Discover-Signature"
+)
+
+const (
+	webhookDefaultMaxAttempts    = 5
+	webhookDefaultInitialBackoff = time.Second
+	webhookDefaultMaxBackoff     = time.Minute
+	webhookDefaultTimeout        = time.Second * 10
+	webhookDefaultQueueSize      = 1000
+)
+
+// WebhookConfig is an HTTP endpoint the registry events are POSTed to, as JSON encoded WebhookEvent. Each endpoint
+// gets its events in order: an event is only sent once the previous one was delivered or dead-lettered
+type WebhookConfig struct {
+	URL string
+	// Secret is the key of the HMAC-SHA256 signature of the request body, sent hex encoded in the
+	// X-Discover-Signature header as "sha256=<signature>". Requests are not signed if empty
+	Secret string
+	// EventTypes are the types of the events sent to the endpoint. All if empty
+	EventTypes []ome.RegistryEventType
+	// Query selects the services whose events are sent to the endpoint. All if nil
+	Query *Query
+	// MaxAttempts is the number of delivery attempts of an event before it is dead-lettered. Defaults to 5
+	MaxAttempts int
+	// InitialBackoff is the delay before the second attempt, doubled at each attempt up to MaxBackoff.
+	// Defaults to 1 second and 1 minute
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Timeout is the timeout of a delivery attempt. Defaults to 10 seconds
+	Timeout time.Duration
+	// QueueSize is the number of events waiting for delivery above which events are dead-lettered. Defaults to 1000
+	QueueSize int
+	// Client defaults to http.DefaultClient
+	Client *http.Client
+}
+
+// WebhookEvent is the body of webhook deliveries
+type WebhookEvent struct {
+	ID        string           `json:"id"`
+	Time      time.Time        `json:"time"`
+	Server    string           `json:"server"`
+	Type      string           `json:"type"`
+	ServiceID string           `json:"service_id"`
+	Service   *ome.ServiceInfo `json:"service,omitempty"`
+}
+
+// webhookDeadLetter is a dead letter file record
+type webhookDeadLetter struct {
+	Time     time.Time     `json:"time"`
+	URL      string        `json:"url"`
+	Attempts int           `json:"attempts"`
+	Error    string        `json:"error"`
+	Event    *WebhookEvent `json:"event"`
+}
+
+// webhookDispatcher delivers the registry events to the configured endpoints
+type webhookDispatcher struct {
+	// pending is the number of events queued or being delivered
+	pending int64
+
+	registry  *Server
+	handlerID string
+	endpoints []*webhookEndpoint
+
+	// services are the last known infos of the registered services by id and owner, that filter their deregistrations
+	services map[string]map[string]*ome.ServiceInfo
+
+	deadLetterMutex sync.Mutex
+	deadLetter      io.WriteCloser
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+type webhookEndpoint struct {
+	config WebhookConfig
+	queue  chan *WebhookEvent
+}
+
+// startWebhooks starts delivering the events of registry to endpoints. Events that cannot be delivered are appended
+// to the deadLetterFilename JSON lines file, or logged if it is empty
+func startWebhooks(registry *Server, endpoints []WebhookConfig, deadLetterFilename string) (*webhookDispatcher, error) {
+	d := &webhookDispatcher{
+		registry: registry,
+		services: map[string]map[string]*ome.ServiceInfo{},
+		stop:     make(chan struct{}),
+	}
+
+	if deadLetterFilename != "" {
+		file, err := os.OpenFile(deadLetterFilename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		d.deadLetter = file
+	}
+
+	for _, config := range endpoints {
+		if config.URL == "" {
+			return nil, fmt.Errorf("%w: webhook without URL", errors.BadInput)
+		}
+		if config.MaxAttempts <= 0 {
+			config.MaxAttempts = webhookDefaultMaxAttempts
+		}
+		if config.InitialBackoff <= 0 {
+			config.InitialBackoff = webhookDefaultInitialBackoff
+		}
+		if config.MaxBackoff <= 0 {
+			config.MaxBackoff = webhookDefaultMaxBackoff
+		}
+		if config.Timeout <= 0 {
+			config.Timeout = webhookDefaultTimeout
+		}
+		if config.QueueSize <= 0 {
+			config.QueueSize = webhookDefaultQueueSize
+		}
+		if config.Client == nil {
+			config.Client = http.DefaultClient
+		}
+
+		endpoint := &webhookEndpoint{config: config, queue: make(chan *WebhookEvent, config.QueueSize)}
+		d.endpoints = append(d.endpoints, endpoint)
+		d.wg.Add(1)
+		go d.run(endpoint)
+	}
+
+	registry.index.each(d.track)
+	d.handlerID = registry.RegisterEventHandler(d)
+	return d, nil
+}
+
+// inline marks the dispatcher as a handler called in notification order, which keeps the endpoints events in order
+func (d *webhookDispatcher) inline() {}
+
+// Handle queues e for the endpoints whose filters it passes. The server calls handleOwned instead
+func (d *webhookDispatcher) Handle(e *ome.RegistryEvent) {
+	d.handleOwned("", e)
+}
+
+// handleOwned queues e, about the registration of owner, for the endpoints whose filters it passes. It never blocks:
+// events are dead-lettered in the background if a queue is full
+func (d *webhookDispatcher) handleOwned(owner string, e *ome.RegistryEvent) {
+	info := e.Info
+	if info == nil {
+		info = d.known(owner, e.ServiceId)
+	}
+	if e.Type == ome.RegistryEventType_DeRegister {
+		delete(d.services[e.ServiceId], owner)
+	} else if e.Info != nil {
+		d.track(owner, e.Info)
+	}
+	d.forget(e.ServiceId)
+
+	event := &WebhookEvent{
+		ID:        uuid.New().String(),
+		Time:      time.Now(),
+		Server:    d.registry.name,
+		Type:      e.Type.String(),
+		ServiceID: e.ServiceId,
+		Service:   info,
+	}
+
+	for _, endpoint := range d.endpoints {
+		if !endpoint.accepts(e.Type, info) {
+			continue
+		}
+
+		atomic.AddInt64(&d.pending, 1)
+		select {
+		case endpoint.queue <- event:
+		default:
+			atomic.AddInt64(&d.pending, -1)
+			d.wg.Add(1)
+			go func(endpoint *webhookEndpoint) {
+				defer d.wg.Done()
+				d.deadLetterEvent(endpoint, event, 0, fmt.Errorf("%w: delivery queue is full", errors.Unavailable))
+			}(endpoint)
+		}
+	}
+}
+
+func (d *webhookDispatcher) track(owner string, info *ome.ServiceInfo) {
+	owners, found := d.services[info.Id]
+	if !found {
+		owners = map[string]*ome.ServiceInfo{}
+		d.services[info.Id] = owners
+	}
+	owners[owner] = info
+}
+
+// known returns the last known info of the registration of id by owner, or of any registration of id if owner's
+// is not known
+func (d *webhookDispatcher) known(owner string, id string) *ome.ServiceInfo {
+	owners := d.services[id]
+	if info, found := owners[owner]; found {
+		return info
+	}
+	for _, info := range owners {
+		return info
+	}
+	return nil
+}
+
+// forget drops the infos of id whose owner no longer registers it, as the removal of a registration is announced with
+// the remaining one while other owners register the service
+func (d *webhookDispatcher) forget(id string) {
+	for owner := range d.services[id] {
+		if d.registry.index.lookup(owner, id) == nil {
+			delete(d.services[id], owner)
+		}
+	}
+	if len(d.services[id]) == 0 {
+		delete(d.services, id)
+	}
+}
+
+func (w *webhookEndpoint) accepts(t ome.RegistryEventType, info *ome.ServiceInfo) bool {
+	if len(w.config.EventTypes) > 0 {
+		found := false
+		for _, accepted := range w.config.EventTypes {
+			if accepted == t {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return w.config.Query == nil || (info != nil && w.config.Query.Match(info))
+}
+
+// run delivers the events of endpoint one after the other until the dispatcher stops
+func (d *webhookDispatcher) run(endpoint *webhookEndpoint) {
+	defer d.wg.Done()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case event := <-endpoint.queue:
+			d.deliver(endpoint, event)
+			atomic.AddInt64(&d.pending, -1)
+		}
+	}
+}
+
+// deliver sends event to endpoint, retrying with an exponential backoff. The event is dead-lettered if all the
+// attempts fail or if the dispatcher stops in the meantime
+func (d *webhookDispatcher) deliver(endpoint *webhookEndpoint, event *WebhookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Error("registry webhooks • failed to encode event", log.Err(err))
+		return
+	}
+
+	backoff := endpoint.config.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := endpoint.post(event, body)
+		if err == nil {
+			d.registry.metrics.Add(MetricServerWebhookDeliveries, 1, map[string]string{"url": endpoint.config.URL, "result": "delivered"})
+			return
+		}
+
+		log.Error("registry webhooks • delivery failed", log.Err(err), log.Field("url", endpoint.config.URL), log.Field("attempt", attempt))
+		if !retry || attempt >= endpoint.config.MaxAttempts {
+			d.deadLetterEvent(endpoint, event, attempt, err)
+			return
+		}
+		d.registry.metrics.Add(MetricServerWebhookDeliveries, 1, map[string]string{"url": endpoint.config.URL, "result": "retried"})
+
+		select {
+		case <-d.stop:
+			d.deadLetterEvent(endpoint, event, attempt, err)
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > endpoint.config.MaxBackoff {
+			backoff = endpoint.config.MaxBackoff
+		}
+	}
+}
+
+// post sends body to the endpoint. It tells whether the delivery is worth retrying if it fails
+func (w *webhookEndpoint) post(event *WebhookEvent, body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), w.config.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookHeaderEvent, event.Type)
+	req.Header.Set(WebhookHeaderDelivery, event.ID)
+	if w.config.Secret != "" {
+		req.Header.Set(WebhookHeaderSignature, "sha256="+WebhookSignature(w.config.Secret, body))
+	}
+
+	rsp, err := w.config.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_, _ = io.Copy(ioutil.Discard, rsp.Body)
+	_ = rsp.Body.Close()
+
+	if rsp.StatusCode >= 200 && rsp.StatusCode < 300 {
+		return false, nil
+	}
+	// client errors other than throttling will not succeed on retry
+	retry := rsp.StatusCode >= 500 || rsp.StatusCode == http.StatusTooManyRequests || rsp.StatusCode == http.StatusRequestTimeout
+	return retry, fmt.Errorf("%w: endpoint responded %s", errors.Unavailable, rsp.Status)
+}
+
+// WebhookSignature returns the hex encoded HMAC-SHA256 of body with secret, as sent in the X-Discover-Signature header
+func WebhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (d *webhookDispatcher) deadLetterEvent(endpoint *webhookEndpoint, event *WebhookEvent, attempts int, err error) {
+	d.registry.metrics.Add(MetricServerWebhookDeliveries, 1, map[string]string{"url": endpoint.config.URL, "result": "dead_lettered"})
+	if d.deadLetter == nil {
+		log.Error("registry webhooks • event dropped", log.Err(err), log.Field("url", endpoint.config.URL), log.Field("event", event.ID))
+		return
+	}
+
+	encoded, encodeErr := json.Marshal(&webhookDeadLetter{
+		Time:     time.Now(),
+		URL:      endpoint.config.URL,
+		Attempts: attempts,
+		Error:    err.Error(),
+		Event:    event,
+	})
+	if encodeErr != nil {
+		log.Error("registry webhooks • failed to encode dead letter", log.Err(encodeErr))
+		return
+	}
+
+	d.deadLetterMutex.Lock()
+	defer d.deadLetterMutex.Unlock()
+	if _, err := d.deadLetter.Write(append(encoded, '\n')); err != nil {
+		log.Error("registry webhooks • failed to write dead letter", log.Err(err))
+	}
+}
+
+// flush waits until the queued events are delivered or dead-lettered, or ctx is done
+func (d *webhookDispatcher) flush(ctx context.Context) error {
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+
+	for atomic.LoadInt64(&d.pending) > 0 {
+		select {
+		case <-ctx.Done():
+			log.Error("registry webhooks • events not delivered before drain deadline", log.Err(ctx.Err()), log.Field("count", atomic.LoadInt64(&d.pending)))
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// Stop stops the deliveries. The events waiting for delivery are dead-lettered
+func (d *webhookDispatcher) Stop() error {
+	d.registry.DeregisterEventHandler(d.handlerID)
+	close(d.stop)
+	d.wg.Wait()
+
+	for _, endpoint := range d.endpoints {
+		for len(endpoint.queue) > 0 {
+			d.deadLetterEvent(endpoint, <-endpoint.queue, 0, fmt.Errorf("%w: server stopped", errors.Unavailable))
+		}
+	}
+
+	if d.deadLetter != nil {
+		return d.deadLetter.Close()
+	}
+	return nil
+}
@@ -0,0 +1,406 @@
+package discover
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/omecodes/libome"
+)
+
+// webhookEndpointRecorder is a webhook endpoint that records the deliveries it gets and responds with the status
+// returned by status for each attempt
+type webhookEndpointRecorder struct {
+	mutex    sync.Mutex
+	times    []time.Time
+	headers  []http.Header
+	bodies   [][]byte
+	status   func(attempt int) int
+	received chan struct{}
+}
+
+func newWebhookEndpointRecorder(status func(attempt int) int) (*webhookEndpointRecorder, *httptest.Server) {
+	r := &webhookEndpointRecorder{status: status, received: make(chan struct{}, 100)}
+	return r, httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+
+		r.mutex.Lock()
+		r.times = append(r.times, time.Now())
+		r.headers = append(r.headers, req.Header)
+		r.bodies = append(r.bodies, body)
+		attempt := len(r.bodies)
+		r.mutex.Unlock()
+
+		if r.status != nil {
+			w.WriteHeader(r.status(attempt))
+		}
+		r.received <- struct{}{}
+	}))
+}
+
+func (r *webhookEndpointRecorder) count() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.bodies)
+}
+
+func (r *webhookEndpointRecorder) events(t *testing.T) []*WebhookEvent {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var events []*WebhookEvent
+	for _, body := range r.bodies {
+		event := new(WebhookEvent)
+		if err := json.Unmarshal(body, event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func readDeadLetters(t *testing.T, filename string) []*webhookDeadLetter {
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var letters []*webhookDeadLetter
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		letter := new(webhookDeadLetter)
+		if err := json.Unmarshal(scanner.Bytes(), letter); err != nil {
+			t.Fatal(err)
+		}
+		letters = append(letters, letter)
+	}
+	return letters
+}
+
+func TestWebhookSignature(t *testing.T) {
+	recorder, endpoint := newWebhookEndpointRecorder(nil)
+	defer endpoint.Close()
+
+	s := startTestServer(t, &ServerConfig{Webhooks: []WebhookConfig{
+		{URL: endpoint.URL, Secret: "secret"},
+		{URL: endpoint.URL},
+	}})
+	defer s.Stop()
+	if err := s.RegisterService(testService("api", "10.0.0.1:80")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "deliveries", func() bool {
+		return recorder.count() == 2
+	})
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	signed := 0
+	for i, header := range recorder.headers {
+		if header.Get(WebhookHeaderEvent) != "Register" || header.Get(WebhookHeaderDelivery) == "" {
+			t.Errorf("delivery has headers %v", header)
+		}
+		signature := header.Get(WebhookHeaderSignature)
+		if signature == "" {
+			continue
+		}
+		signed++
+
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(recorder.bodies[i])
+		if expected := "sha256=" + hex.EncodeToString(mac.Sum(nil)); signature != expected {
+			t.Errorf("got signature %s, expected %s", signature, expected)
+		}
+	}
+	if signed != 1 {
+		t.Errorf("%d deliveries are signed instead of 1", signed)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	recorder, endpoint := newWebhookEndpointRecorder(func(attempt int) int {
+		if attempt < 4 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	})
+	defer endpoint.Close()
+
+	metrics := NewPrometheusMetrics()
+	s := startTestServer(t, &ServerConfig{Metrics: metrics, Webhooks: []WebhookConfig{{
+		URL:            endpoint.URL,
+		InitialBackoff: 50 * time.Millisecond,
+		MaxBackoff:     80 * time.Millisecond,
+	}}})
+	defer s.Stop()
+	if err := s.RegisterService(testService("api", "10.0.0.1:80")); err != nil {
+		t.Fatal(err)
+	}
+
+	labels := map[string]string{"url": endpoint.URL, "result": "delivered"}
+	eventually(t, "delivery", func() bool {
+		return metricValue(metrics, MetricServerWebhookDeliveries, labels) == 1
+	})
+	labels["result"] = "retried"
+	if retried := metricValue(metrics, MetricServerWebhookDeliveries, labels); retried != 3 {
+		t.Errorf("retried %v times instead of 3", retried)
+	}
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	for i, minimum := range []time.Duration{50, 80, 80} {
+		if delay := recorder.times[i+1].Sub(recorder.times[i]); delay < minimum*time.Millisecond {
+			t.Errorf("attempt %d came %s after the previous one, expected at least %dms", i+2, delay, minimum)
+		}
+	}
+	for _, body := range recorder.bodies[1:] {
+		if string(body) != string(recorder.bodies[0]) {
+			t.Error("retries do not send the same event")
+		}
+	}
+}
+
+func TestWebhookOrder(t *testing.T) {
+	recorder, endpoint := newWebhookEndpointRecorder(func(attempt int) int {
+		// the first delivery is retried so that the next events wait in the queue
+		if attempt == 1 {
+			return http.StatusInternalServerError
+		}
+		return http.StatusOK
+	})
+	defer endpoint.Close()
+
+	s := startTestServer(t, &ServerConfig{Webhooks: []WebhookConfig{{
+		URL:            endpoint.URL,
+		InitialBackoff: 50 * time.Millisecond,
+		EventTypes:     []ome.RegistryEventType{ome.RegistryEventType_Register},
+	}}})
+	defer s.Stop()
+
+	var expected []string
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		if err := s.RegisterService(testService(id, "10.0.0.1:80")); err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, id)
+	}
+	if err := s.DeregisterService("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, "deliveries", func() bool {
+		return recorder.count() == 6
+	})
+	var ids []string
+	for _, event := range recorder.events(t)[1:] {
+		ids = append(ids, event.ServiceID)
+	}
+	if strings.Join(ids, ",") != strings.Join(expected, ",") {
+		t.Errorf("delivered %v, expected %v", ids, expected)
+	}
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discover-webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "dead-letters.jsonl")
+
+	_, failing := newWebhookEndpointRecorder(func(int) int {
+		return http.StatusInternalServerError
+	})
+	defer failing.Close()
+	_, rejecting := newWebhookEndpointRecorder(func(int) int {
+		return http.StatusBadRequest
+	})
+	defer rejecting.Close()
+
+	s := startTestServer(t, &ServerConfig{WebhookDeadLetterFilename: filename, Webhooks: []WebhookConfig{
+		{URL: failing.URL, MaxAttempts: 2, InitialBackoff: time.Millisecond},
+		{URL: rejecting.URL, MaxAttempts: 5},
+	}})
+	defer s.Stop()
+	if err := s.RegisterService(testService("api", "10.0.0.1:80")); err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, "dead letters", func() bool {
+		return len(readDeadLetters(t, filename)) == 2
+	})
+	for _, letter := range readDeadLetters(t, filename) {
+		expected := 2
+		if letter.URL == rejecting.URL {
+			expected = 1
+		}
+		if letter.Attempts != expected || letter.Event.ServiceID != "api" || letter.Error == "" {
+			t.Errorf("%s dead letter has %d attempts for %s", letter.URL, letter.Attempts, letter.Event.ServiceID)
+		}
+	}
+}
+
+func TestWebhookFullQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discover-webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "dead-letters.jsonl")
+
+	received := make(chan struct{}, 10)
+	release := make(chan struct{})
+	blocking := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-release
+	}))
+	defer blocking.Close()
+
+	s := startTestServer(t, &ServerConfig{WebhookDeadLetterFilename: filename, Webhooks: []WebhookConfig{
+		{URL: blocking.URL, QueueSize: 1},
+	}})
+	defer s.Stop()
+	defer close(release)
+
+	if err := s.RegisterService(testService("a", "10.0.0.1:80")); err != nil {
+		t.Fatal(err)
+	}
+	<-received
+
+	// a is being delivered and b waits in the queue
+	for _, id := range []string{"b", "c", "d"} {
+		if err := s.RegisterService(testService(id, "10.0.0.1:80")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eventually(t, "dead letters", func() bool {
+		return len(readDeadLetters(t, filename)) == 2
+	})
+	for _, letter := range readDeadLetters(t, filename) {
+		if letter.Attempts != 0 || (letter.Event.ServiceID != "c" && letter.Event.ServiceID != "d") {
+			t.Errorf("dead-lettered %s after %d attempts", letter.Event.ServiceID, letter.Attempts)
+		}
+	}
+}
+
+func TestWebhookTracksOwners(t *testing.T) {
+	recorder, endpoint := newWebhookEndpointRecorder(nil)
+	defer endpoint.Close()
+
+	metrics := NewPrometheusMetrics()
+	s := startTestServer(t, &ServerConfig{Metrics: metrics, Webhooks: []WebhookConfig{{
+		URL:        endpoint.URL,
+		Query:      &Query{Label: "eu"},
+		EventTypes: []ome.RegistryEventType{ome.RegistryEventType_DeRegister},
+	}}})
+	defer s.Stop()
+
+	own := testService("api", "10.0.0.1:80")
+	own.Label = "eu"
+	if err := s.RegisterService(own); err != nil {
+		t.Fatal(err)
+	}
+
+	client := connectTestClient(t, s, nil)
+	defer client.Stop()
+	if err := client.RegisterService(testService("api", "10.0.0.2:80")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "client registration", func() bool {
+		return len(s.index.peersOf("api")) == 2
+	})
+
+	s.Lock()
+	owners := len(s.webhooks.services["api"])
+	s.Unlock()
+	if owners != 2 {
+		t.Fatalf("dispatcher knows %d registrations of api instead of 2", owners)
+	}
+
+	if err := client.DeregisterService("api"); err != nil {
+		t.Fatal(err)
+	}
+	waitHandled(t, s, metrics, "DeRegister", 1)
+	s.Lock()
+	remaining := s.webhooks.services["api"]
+	s.Unlock()
+	if len(remaining) != 1 || remaining[s.name] == nil {
+		t.Fatalf("dispatcher knows the registrations %v of api", remaining)
+	}
+
+	if err := s.DeregisterService("api"); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "deregistration delivery", func() bool {
+		return recorder.count() == 1
+	})
+	if event := recorder.events(t)[0]; event.Service == nil || event.Service.Label != "eu" {
+		t.Errorf("delivered deregistration of %v", event.Service)
+	}
+}
+
+func TestDrainFlushesWebhooks(t *testing.T) {
+	recorder, endpoint := newWebhookEndpointRecorder(func(attempt int) int {
+		if attempt < 3 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	})
+	defer endpoint.Close()
+
+	s := startTestServer(t, &ServerConfig{Webhooks: []WebhookConfig{{
+		URL:            endpoint.URL,
+		InitialBackoff: 50 * time.Millisecond,
+		EventTypes:     []ome.RegistryEventType{ome.RegistryEventType_Register},
+	}}})
+	defer s.Stop()
+	for _, id := range []string{"a", "b", "c"} {
+		if err := s.RegisterService(testService(id, "10.0.0.1:80")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Drain(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+	// the events are delivered by the time Drain returns, the first one after two retries
+	if count := recorder.count(); count != 5 {
+		t.Errorf("got %d deliveries after drain, want 5", count)
+	}
+}
+
+func TestDrainWebhooksDeadline(t *testing.T) {
+	release := make(chan struct{})
+	blocking := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer blocking.Close()
+
+	s := startTestServer(t, &ServerConfig{Webhooks: []WebhookConfig{{URL: blocking.URL}}})
+	defer s.Stop()
+	defer close(release)
+	if err := s.RegisterService(testService("a", "10.0.0.1:80")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Drain(ctx, ""); err != context.DeadlineExceeded {
+		t.Errorf("expected the drain deadline error, got %v", err)
+	}
+}
@@ -0,0 +1,338 @@
+package discover
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/omecodes/common/utils/log"
+	"github.com/omecodes/libome"
+)
+
+const (
+	// MetaNodeHealth is the node meta key holding the node health status: "healthy", "unhealthy", "draining" or "degraded"
+	MetaNodeHealth = "health"
+
+	xdsClusterTypeURL  = "type.googleapis.com/envoy.config.cluster.v3.Cluster"
+	xdsEndpointTypeURL = "type.googleapis.com/envoy.config.endpoint.v3.ClusterLoadAssignment"
+	xdsHTTPOptionsURL  = "type.googleapis.com/envoy.extensions.upstreams.http.v3.HttpProtocolOptions"
+
+	xdsClustersPath  = "/v3/discovery:clusters"
+	xdsEndpointsPath = "/v3/discovery:endpoints"
+
+	xdsDefaultClusterName = "discover"
+	xdsDefaultPollTimeout = time.Second * 25
+)
+
+type xdsDiscoveryRequest struct {
+	VersionInfo   string   `json:"version_info"`
+	ResourceNames []string `json:"resource_names"`
+	TypeURL       string   `json:"type_url"`
+}
+
+type xdsDiscoveryResponse struct {
+	VersionInfo string        `json:"version_info"`
+	Resources   []interface{} `json:"resources"`
+	TypeURL     string        `json:"type_url"`
+}
+
+// xdsServer is an Envoy REST-JSON xDS v3 control plane serving CDS and EDS from the registry. It implements
+// state-of-the-world polling, not the incremental protocol: every response holds all the requested resources.
+// Requests carrying the current version are held until the registry changes, so that Envoy gets updates as they
+// happen, or until the poll timeout expires, in which case the current resources are sent again
+type xdsServer struct {
+	registry    *Server
+	clusterName string
+	pollTimeout time.Duration
+	handlerID   string
+	http        *http.Server
+
+	mutex   sync.Mutex
+	epoch   int64
+	counter uint64
+	changed chan struct{}
+}
+
+func (x *xdsServer) Handle(event *ome.RegistryEvent) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	x.counter++
+	close(x.changed)
+	x.changed = make(chan struct{})
+}
+
+func (x *xdsServer) current() (string, chan struct{}) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	return fmt.Sprintf("%d-%d", x.epoch, x.counter), x.changed
+}
+
+func (x *xdsServer) handler(typeURL string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req xdsDiscoveryRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		version, changed := x.current()
+		if req.VersionInfo == version {
+			select {
+			case <-changed:
+				version, _ = x.current()
+			case <-r.Context().Done():
+				return
+			case <-time.After(x.pollTimeout):
+			}
+		}
+
+		services, err := x.registry.listServices()
+		if err != nil {
+			log.Error("registry xds • could not list services", log.Err(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		services = xdsMergeServices(services)
+
+		response := &xdsDiscoveryResponse{
+			VersionInfo: version,
+			TypeURL:     typeURL,
+			Resources:   []interface{}{},
+		}
+		if typeURL == xdsClusterTypeURL {
+			response.Resources = x.clusters(services, req.ResourceNames)
+		} else {
+			response.Resources = x.loadAssignments(services, req.ResourceNames)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(response)
+		if err != nil {
+			log.Error("registry xds • could not write discovery response", log.Err(err))
+		}
+	})
+}
+
+// clusters returns a cluster for every (service, protocol) pair whose name is in names, or all if names is empty
+func (x *xdsServer) clusters(services []*ome.ServiceInfo, names []string) []interface{} {
+	resources := []interface{}{}
+	for _, info := range services {
+		for _, protocol := range xdsServiceProtocols(info) {
+			name := xdsClusterName(info.Id, protocol)
+			if !xdsRequested(names, name) {
+				continue
+			}
+
+			cluster := map[string]interface{}{
+				"@type":           xdsClusterTypeURL,
+				"name":            name,
+				"type":            "EDS",
+				"connect_timeout": "5s",
+				"eds_cluster_config": map[string]interface{}{
+					"service_name": name,
+					"eds_config": map[string]interface{}{
+						"resource_api_version": "V3",
+						"api_config_source": map[string]interface{}{
+							"api_type":              "REST",
+							"transport_api_version": "V3",
+							"cluster_names":         []string{x.clusterName},
+							"refresh_delay":         "1s",
+							"request_timeout":       fmt.Sprintf("%ds", int(x.pollTimeout.Seconds())+5),
+						},
+					},
+				},
+			}
+
+			if protocol == ome.Protocol_Grpc {
+				cluster["typed_extension_protocol_options"] = map[string]interface{}{
+					"envoy.extensions.upstreams.http.v3.HttpProtocolOptions": map[string]interface{}{
+						"@type": xdsHTTPOptionsURL,
+						"explicit_http_config": map[string]interface{}{
+							"http2_protocol_options": map[string]interface{}{},
+						},
+					},
+				}
+			}
+			resources = append(resources, cluster)
+		}
+	}
+	return resources
+}
+
+// loadAssignments returns the endpoints of every cluster whose name is in names, or all if names is empty
+func (x *xdsServer) loadAssignments(services []*ome.ServiceInfo, names []string) []interface{} {
+	resources := []interface{}{}
+	for _, info := range services {
+		for _, protocol := range xdsServiceProtocols(info) {
+			name := xdsClusterName(info.Id, protocol)
+			if !xdsRequested(names, name) {
+				continue
+			}
+
+			lbEndpoints := []interface{}{}
+			for _, node := range info.Nodes {
+				if node.Protocol != protocol {
+					continue
+				}
+
+				host, port := dnsNodeHostPort(node)
+				if net.ParseIP(host) == nil {
+					log.Info("registry xds • skipped node with non IP address", log.Field("service", info.Id), log.Field("node", node.Id))
+					continue
+				}
+
+				lbEndpoints = append(lbEndpoints, map[string]interface{}{
+					"endpoint": map[string]interface{}{
+						"address": map[string]interface{}{
+							"socket_address": map[string]interface{}{
+								"address":    host,
+								"port_value": port,
+							},
+						},
+					},
+					"health_status": xdsHealthStatus(node),
+				})
+			}
+
+			resources = append(resources, map[string]interface{}{
+				"@type":        xdsEndpointTypeURL,
+				"cluster_name": name,
+				"endpoints": []interface{}{
+					map[string]interface{}{
+						"lb_endpoints": lbEndpoints,
+					},
+				},
+			})
+		}
+	}
+	return resources
+}
+
+func (x *xdsServer) Stop() error {
+	x.registry.DeregisterEventHandler(x.handlerID)
+	return x.http.Close()
+}
+
+// xdsMergeServices merges the registrations of the same service by several peers, whose nodes all are endpoints of
+// the service clusters. Nodes of different registrations with the same protocol and address are merged too
+func xdsMergeServices(services []*ome.ServiceInfo) []*ome.ServiceInfo {
+	var merged []*ome.ServiceInfo
+	byID := map[string]*ome.ServiceInfo{}
+	for _, info := range services {
+		service, found := byID[info.Id]
+		if !found {
+			service = &ome.ServiceInfo{Id: info.Id}
+			byID[info.Id] = service
+			merged = append(merged, service)
+		}
+
+		for _, node := range info.Nodes {
+			duplicate := false
+			for _, other := range service.Nodes {
+				if other.Protocol == node.Protocol && other.Address == node.Address {
+					duplicate = true
+					break
+				}
+			}
+			if !duplicate {
+				service.Nodes = append(service.Nodes, node)
+			}
+		}
+	}
+	return merged
+}
+
+func xdsClusterName(serviceID string, protocol ome.Protocol) string {
+	return serviceID + "_" + strings.ToLower(protocol.String())
+}
+
+// xdsServiceProtocols returns the sorted list of the protocols implemented by info nodes
+func xdsServiceProtocols(info *ome.ServiceInfo) []ome.Protocol {
+	var protocols []ome.Protocol
+	seen := map[ome.Protocol]bool{}
+	for _, node := range info.Nodes {
+		if node.Protocol == ome.Protocol_Unsupported || seen[node.Protocol] {
+			continue
+		}
+		seen[node.Protocol] = true
+		protocols = append(protocols, node.Protocol)
+	}
+	sort.Slice(protocols, func(i, j int) bool {
+		return protocols[i] < protocols[j]
+	})
+	return protocols
+}
+
+func xdsRequested(names []string, name string) bool {
+	if len(names) == 0 {
+		return true
+	}
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func xdsHealthStatus(node *ome.Node) string {
+	switch strings.ToLower(node.Meta[MetaNodeHealth]) {
+	case "healthy":
+		return "HEALTHY"
+	case "unhealthy":
+		return "UNHEALTHY"
+	case "draining":
+		return "DRAINING"
+	case "degraded":
+		return "DEGRADED"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// serveXDS starts the xDS REST endpoints. clusterName is the name of the cluster Envoy uses to reach them
+func serveXDS(s *Server, address string, clusterName string) (*xdsServer, error) {
+	if clusterName == "" {
+		clusterName = xdsDefaultClusterName
+	}
+
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	x := &xdsServer{
+		registry:    s,
+		clusterName: clusterName,
+		pollTimeout: xdsDefaultPollTimeout,
+		epoch:       time.Now().Unix(),
+		changed:     make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(xdsClustersPath, x.handler(xdsClusterTypeURL))
+	mux.Handle(xdsEndpointsPath, x.handler(xdsEndpointTypeURL))
+	x.http = &http.Server{Handler: mux}
+	x.handlerID = s.RegisterEventHandler(x)
+
+	go func() {
+		if err := x.http.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Error("registry xds • server stopped", log.Err(err))
+		}
+	}()
+
+	log.Info("[discovery] starting xDS server", log.Field("at", l.Addr()), log.Field("cluster", clusterName))
+	return x, nil
+}
@@ -0,0 +1,72 @@
+package discover
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omecodes/libome"
+)
+
+func TestXDSMergeServices(t *testing.T) {
+	services := []*ome.ServiceInfo{
+		{Id: "api", Nodes: []*ome.Node{{Id: "a", Address: "10.0.0.1:80", Protocol: ome.Protocol_Http}}},
+		{Id: "db", Nodes: []*ome.Node{{Id: "a", Address: "10.0.0.3:5432", Protocol: ome.Protocol_Grpc}}},
+		{Id: "api", Nodes: []*ome.Node{
+			{Id: "a", Address: "10.0.0.2:80", Protocol: ome.Protocol_Http},
+			{Id: "b", Address: "10.0.0.1:80", Protocol: ome.Protocol_Http},
+		}},
+	}
+
+	merged := xdsMergeServices(services)
+	if len(merged) != 2 || merged[0].Id != "api" || merged[1].Id != "db" {
+		t.Fatalf("merged %v", merged)
+	}
+	if len(merged[0].Nodes) != 2 {
+		t.Errorf("api has %d nodes instead of 2", len(merged[0].Nodes))
+	}
+
+	x := &xdsServer{clusterName: xdsDefaultClusterName, pollTimeout: time.Second}
+	if clusters := x.clusters(merged, nil); len(clusters) != 2 {
+		t.Errorf("got %d clusters instead of 2", len(clusters))
+	}
+	assignments := x.loadAssignments(merged, []string{"api_http"})
+	if len(assignments) != 1 {
+		t.Fatalf("got %d load assignments instead of 1", len(assignments))
+	}
+	endpoints := assignments[0].(map[string]interface{})["endpoints"].([]interface{})
+	if lb := endpoints[0].(map[string]interface{})["lb_endpoints"].([]interface{}); len(lb) != 2 {
+		t.Errorf("api_http has %d endpoints instead of 2", len(lb))
+	}
+}
+
+func TestXDSPollTimeout(t *testing.T) {
+	s := startTestServer(t, &ServerConfig{})
+	defer s.Stop()
+	if err := s.RegisterService(&ome.ServiceInfo{Id: "api", Nodes: []*ome.Node{
+		{Id: "a", Address: "10.0.0.1:80", Protocol: ome.Protocol_Http},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	x := &xdsServer{registry: s, clusterName: xdsDefaultClusterName, pollTimeout: 50 * time.Millisecond, epoch: 1, changed: make(chan struct{})}
+	version, _ := x.current()
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, xdsClustersPath, strings.NewReader(`{"version_info": "`+version+`"}`))
+	x.handler(xdsClusterTypeURL).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("poll timeout responded %d", rec.Code)
+	}
+	var rsp xdsDiscoveryResponse
+	if err := json.NewDecoder(rec.Body).Decode(&rsp); err != nil {
+		t.Fatal(err)
+	}
+	if rsp.VersionInfo != version || len(rsp.Resources) != 1 {
+		t.Errorf("got version %s with %d resources", rsp.VersionInfo, len(rsp.Resources))
+	}
+}